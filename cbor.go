@@ -0,0 +1,282 @@
+package inventoryd
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// CBORのMajor Type
+// RFC7049 2.1 Major Types参照
+const (
+	cborMajorTypeUnsignedInteger byte = 0
+	cborMajorTypeNegativeInteger byte = 1
+	cborMajorTypeByteString      byte = 2
+	cborMajorTypeTextString      byte = 3
+	cborMajorTypeArray           byte = 4
+	cborMajorTypeMap             byte = 5
+	cborMajorTypeTag             byte = 6
+	cborMajorTypeSimple          byte = 7
+)
+
+// CBORのSimple Value / 浮動小数点数のAdditional Information
+// RFC7049 2.3 Floating-Point Numbers and Values with No Content参照
+const (
+	cborSimpleFalse byte = 20
+	cborSimpleTrue  byte = 21
+	cborSimpleNull  byte = 22
+	cborFloat16     byte = 25
+	cborFloat32     byte = 26
+	cborFloat64     byte = 27
+)
+
+// cborMaxDepth : 解析する配列 / マップの入れ子の最大数
+const cborMaxDepth = 16
+
+// appendCborHead : Major Typeと値(長さ)を追加する
+func appendCborHead(buf []byte, majorType byte, value uint64) []byte {
+	head := majorType << 5
+	switch {
+	case value < 24:
+		return append(buf, head|(byte)(value))
+	case value <= math.MaxUint8:
+		return append(buf, head|24, (byte)(value))
+	case value <= math.MaxUint16:
+		buf = append(buf, head|25, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], (uint16)(value))
+		return buf
+	case value <= math.MaxUint32:
+		buf = append(buf, head|26, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], (uint32)(value))
+		return buf
+	}
+	buf = append(buf, head|27, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(buf[len(buf)-8:], value)
+	return buf
+}
+
+// appendCborInt : 整数を追加する
+func appendCborInt(buf []byte, value int64) []byte {
+	if value < 0 {
+		return appendCborHead(buf, cborMajorTypeNegativeInteger, (uint64)(-1-value))
+	}
+	return appendCborHead(buf, cborMajorTypeUnsignedInteger, (uint64)(value))
+}
+
+// appendCborFloat : 浮動小数点数を追加する
+// 単精度で表せる値は単精度、それ以外は倍精度とする
+func appendCborFloat(buf []byte, value float64) []byte {
+	if (float64)((float32)(value)) == value {
+		buf = append(buf, cborMajorTypeSimple<<5|cborFloat32, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], math.Float32bits((float32)(value)))
+		return buf
+	}
+	buf = append(buf, cborMajorTypeSimple<<5|cborFloat64, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(buf[len(buf)-8:], math.Float64bits(value))
+	return buf
+}
+
+// appendCborText : 文字列を追加する
+func appendCborText(buf []byte, value string) []byte {
+	return append(appendCborHead(buf, cborMajorTypeTextString, (uint64)(len(value))), value...)
+}
+
+// appendCborBytes : バイト列を追加する
+func appendCborBytes(buf []byte, value []byte) []byte {
+	return append(appendCborHead(buf, cborMajorTypeByteString, (uint64)(len(value))), value...)
+}
+
+// appendCborBool : 真偽値を追加する
+func appendCborBool(buf []byte, value bool) []byte {
+	if value {
+		return append(buf, cborMajorTypeSimple<<5|cborSimpleTrue)
+	}
+	return append(buf, cborMajorTypeSimple<<5|cborSimpleFalse)
+}
+
+// cborDecoder : CBORのデコーダ
+// 整数はint64、浮動小数点数はfloat64、文字列はstring、バイト列は[]byte、真偽値はbool、nullはnil、
+// 配列は[]interface{}、マップはmap[interface{}]interface{}に変換する
+// 長さ不定(indefinite length)の配列 / マップ / 文字列には対応しない
+type cborDecoder struct {
+	raw    []byte
+	offset int
+}
+
+// decodeCbor : CBORのデータをひとつ解析する
+// 解析後に余分なデータがある場合は形式エラーとする
+func decodeCbor(raw []byte) (interface{}, error) {
+	decoder := &cborDecoder{raw: raw}
+	value, err := decoder.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.offset != len(raw) {
+		return nil, errors.New("CBORの後に余分なデータがあります")
+	}
+	return value, nil
+}
+
+// readBytes : 指定した長さのデータを読み出す
+func (decoder *cborDecoder) readBytes(length uint64) ([]byte, error) {
+	if length > (uint64)(len(decoder.raw)-decoder.offset) {
+		return nil, errors.New("CBORのデータが不足しています")
+	}
+	ret := decoder.raw[decoder.offset : decoder.offset+(int)(length)]
+	decoder.offset += (int)(length)
+	return ret, nil
+}
+
+// readHead : Major TypeとAdditional Information、および続く値(長さ)を読み出す
+// 浮動小数点数の場合、値はビット列をそのまま返す
+func (decoder *cborDecoder) readHead() (byte, byte, uint64, error) {
+	buf, err := decoder.readBytes(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	majorType := buf[0] >> 5
+	info := buf[0] & 0x1f
+	switch {
+	case info < 24:
+		return majorType, info, (uint64)(info), nil
+	case info == 24:
+		buf, err = decoder.readBytes(1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		return majorType, info, (uint64)(buf[0]), nil
+	case info == 25:
+		buf, err = decoder.readBytes(2)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		return majorType, info, (uint64)(binary.BigEndian.Uint16(buf)), nil
+	case info == 26:
+		buf, err = decoder.readBytes(4)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		return majorType, info, (uint64)(binary.BigEndian.Uint32(buf)), nil
+	case info == 27:
+		buf, err = decoder.readBytes(8)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		return majorType, info, binary.BigEndian.Uint64(buf), nil
+	}
+	return 0, 0, 0, errors.New("対応していないCBORの形式です")
+}
+
+// decode : データをひとつ解析する
+func (decoder *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, errors.New("CBORの入れ子が深すぎます")
+	}
+	majorType, info, value, err := decoder.readHead()
+	if err != nil {
+		return nil, err
+	}
+	switch majorType {
+	case cborMajorTypeUnsignedInteger:
+		if value > math.MaxInt64 {
+			return nil, errors.New("CBORの整数が範囲外です")
+		}
+		return (int64)(value), nil
+	case cborMajorTypeNegativeInteger:
+		if value > math.MaxInt64 {
+			return nil, errors.New("CBORの整数が範囲外です")
+		}
+		return -1 - (int64)(value), nil
+	case cborMajorTypeByteString:
+		buf, err := decoder.readBytes(value)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, buf...), nil
+	case cborMajorTypeTextString:
+		buf, err := decoder.readBytes(value)
+		if err != nil {
+			return nil, err
+		}
+		return string(buf), nil
+	case cborMajorTypeArray:
+		if value > (uint64)(len(decoder.raw)-decoder.offset) {
+			return nil, errors.New("CBORのデータが不足しています")
+		}
+		ret := make([]interface{}, 0, value)
+		for i := (uint64)(0); i < value; i++ {
+			item, err := decoder.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, item)
+		}
+		return ret, nil
+	case cborMajorTypeMap:
+		if value > (uint64)(len(decoder.raw)-decoder.offset) {
+			return nil, errors.New("CBORのデータが不足しています")
+		}
+		ret := make(map[interface{}]interface{})
+		for i := (uint64)(0); i < value; i++ {
+			key, err := decoder.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, errors.New("対応していないCBORのマップのキーです")
+			}
+			item, err := decoder.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			ret[key] = item
+		}
+		return ret, nil
+	case cborMajorTypeTag:
+		// タグは無視して中身のみを使用する
+		return decoder.decode(depth + 1)
+	}
+
+	// cborMajorTypeSimple
+	switch info {
+	case cborSimpleFalse:
+		return false, nil
+	case cborSimpleTrue:
+		return true, nil
+	case cborSimpleNull:
+		return nil, nil
+	case cborFloat16:
+		return cborFloat16ToFloat64((uint16)(value)), nil
+	case cborFloat32:
+		return (float64)(math.Float32frombits((uint32)(value))), nil
+	case cborFloat64:
+		return math.Float64frombits(value), nil
+	}
+	return nil, errors.New("対応していないCBORの値です")
+}
+
+// cborFloat16ToFloat64 : 半精度浮動小数点数を変換する
+// RFC7049 Appendix D. Half-Precision参照
+func cborFloat16ToFloat64(half uint16) float64 {
+	exponent := (int)(half>>10) & 0x1f
+	mantissa := (float64)(half & 0x3ff)
+	var value float64
+	switch exponent {
+	case 0:
+		value = math.Ldexp(mantissa, -24)
+	case 0x1f:
+		if mantissa == 0 {
+			value = math.Inf(1)
+		} else {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mantissa+1024, exponent-25)
+	}
+	if half&0x8000 != 0 {
+		return -value
+	}
+	return value
+}
@@ -2,9 +2,13 @@ package inventoryd
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
 	"math/rand"
 	"net"
 	"sort"
+	"sync"
 	"time"
 )
 
@@ -12,9 +16,27 @@ import (
 type Coap struct {
 	Connection    net.Conn // 接続
 	NextMessageID uint16
-	ChInProcess   map[uint16]chan int
 	RecvHandler   func(*CoapMessage)
 	recvStopCh    chan bool
+	recvErrorCh   chan bool // 受信エラーで受信動作が停止したら閉じる
+	recvError     error
+	stream        bool // CoAP over TCP / TLS(coap_tcp.go参照)
+
+	// 再送と重複検出についてはcoap_transmission.go、レスポンスの対応付けについてはcoap_exchange.go参照
+	mutex            sync.Mutex
+	writeMutex       sync.Mutex
+	retransmissions  map[uint16]*coapRetransmission
+	receivedMessages map[uint16]*coapReceivedMessage
+	// 期限切れの記録を取り除くためのCON / NONごとの受信順の記録
+	receivedConfirmables    coapReceivedQueue
+	receivedNonConfirmables coapReceivedQueue
+	exchanges               map[uint16]*coapExchange // キーはメッセージID
+	exchangesByToken        map[string]*coapExchange // キーはトークン
+	deliveries              map[uint16]func(bool)    // ACKを待っているCONのNotify(キーはメッセージID)
+
+	// ブロック単位の転送についてはcoap_block.go参照
+	block1Transfers map[string]*coapBlockTransfer
+	block2Transfers map[string]*coapBlockTransfer
 }
 
 // CoapMessage : Coapのメッセージ
@@ -53,26 +75,51 @@ const (
 // Coap Response Code
 // RFC7252 12.1.2 Response Codes参照
 const (
-	CoapCodeEmpty      CoapCode = 0   // 0.00 Empty
-	CoapCodeCreated    CoapCode = 65  // 2.01 Created
-	CoapCodeDeleted    CoapCode = 66  // 2.02 Deleted
-	CoapCodeChanged    CoapCode = 68  // 2.04 Changed
-	CoapCodeContent    CoapCode = 69  // 2.05 Content
-	CoapCodeBadRequest CoapCode = 128 // 4.00 Bad Request
-	CoapCodeNotFound   CoapCode = 132 // 4.04 Not Found
-	CoapCodeNotAllowed CoapCode = 133 // 4.05 Method Not Allowed
+	CoapCodeEmpty                    CoapCode = 0   // 0.00 Empty
+	CoapCodeCreated                  CoapCode = 65  // 2.01 Created
+	CoapCodeDeleted                  CoapCode = 66  // 2.02 Deleted
+	CoapCodeChanged                  CoapCode = 68  // 2.04 Changed
+	CoapCodeContent                  CoapCode = 69  // 2.05 Content
+	CoapCodeBadRequest               CoapCode = 128 // 4.00 Bad Request
+	CoapCodeBadOption                CoapCode = 130 // 4.02 Bad Option
+	CoapCodeNotFound                 CoapCode = 132 // 4.04 Not Found
+	CoapCodeNotAllowed               CoapCode = 133 // 4.05 Method Not Allowed
+	CoapCodeNotAcceptable            CoapCode = 134 // 4.06 Not Acceptable
+	CoapCodeUnsupportedContentFormat CoapCode = 143 // 4.15 Unsupported Content-Format
+)
+
+// Coap Response Code(Block-wise transfer)
+// RFC7959 2.9 Response Codes参照
+const (
+	CoapCodeContinue                CoapCode = 95  // 2.31 Continue
+	CoapCodeRequestEntityIncomplete CoapCode = 136 // 4.08 Request Entity Incomplete
+	CoapCodeRequestEntityTooLarge   CoapCode = 141 // 4.13 Request Entity Too Large
 )
 
+// IsResponse : レスポンスコード(2.xx - 5.xx)か
+// RFC7252 12.1 CoAP Code Registries参照
+func (code CoapCode) IsResponse() bool {
+	return code>>5 >= 2 && code>>5 <= 5
+}
+
+// String : c.dd形式の文字列に変換する
+func (code CoapCode) String() string {
+	return fmt.Sprintf("%d.%02d", code>>5, code&0x1f)
+}
+
 // CoAP Content Format
-// RFC7252 12.3 CoAP Content-Formats Registry参照
+// RFC7252 12.3 CoAP Content-Formats Registry、RFC8428 12.3 CoAP Content-Format Registration参照
 const (
 	coapContentFormatLinkFormat = 40
+	coapContentFormatSenMLJSON  = 110
+	coapContentFormatSenMLCBOR  = 112
 	coapContentFormatLwm2mTLV   = 11542
 	coapContentFormatLwm2mJSON  = 11543
 )
 
 const (
 	coapDefaultTokenLength byte = 8
+	coapMaxTokenLength     byte = 8 // RFC7252 3. Message Format Token Length(TKL)参照
 )
 
 // CoapOption : Coapのオプション
@@ -90,6 +137,7 @@ const (
 	coapOptionNoURIPath       = 11
 	coapOptionNoContentFormat = 12
 	coapOptionNoURIQuery      = 15
+	coapOptionNoAccept        = 17
 )
 
 // CoAP Observe Option
@@ -102,10 +150,11 @@ const (
 // CoAP Optionの解析パラメータ
 // RFC7252 5.10参照
 const (
-	coapOptCodeByte = 13
-	coapOptCodeWord = 14
-	coapOptByteBase = 13
-	coapOptWordBase = 269
+	coapOptCodeByte     = 13
+	coapOptCodeWord     = 14
+	coapOptCodeReserved = 15
+	coapOptByteBase     = 13
+	coapOptWordBase     = 269
 )
 
 // Initialize : Coap構造体を初期化する
@@ -113,8 +162,15 @@ func (coap *Coap) Initialize(conn net.Conn, recvHandler func(*CoapMessage)) {
 	rand.Seed(time.Now().UnixNano())
 	coap.NextMessageID = (uint16)(rand.Intn(65536))
 	coap.Connection = conn
-	coap.ChInProcess = make(map[uint16]chan int)
 	coap.recvStopCh = make(chan bool)
+	coap.recvErrorCh = make(chan bool)
+	coap.retransmissions = make(map[uint16]*coapRetransmission)
+	coap.receivedMessages = make(map[uint16]*coapReceivedMessage)
+	coap.exchanges = make(map[uint16]*coapExchange)
+	coap.deliveries = make(map[uint16]func(bool))
+	coap.exchangesByToken = make(map[string]*coapExchange)
+	coap.block1Transfers = make(map[string]*coapBlockTransfer)
+	coap.block2Transfers = make(map[string]*coapBlockTransfer)
 	coap.RecvHandler = recvHandler
 	go coap.ReadCoapMessage(coap.recvStopCh)
 }
@@ -122,63 +178,138 @@ func (coap *Coap) Initialize(conn net.Conn, recvHandler func(*CoapMessage)) {
 // Close : Coap接続を閉じる
 // メッセージ受信に関わるgorutineを止める
 func (coap *Coap) Close() {
+	coap.stopAllRetransmissions()
 	coap.recvStopCh <- true
 	coap.Connection.Close()
 }
 
 // ReadCoapMessage : メッセージを受信する
+// 送信したリクエストへのレスポンスはSendRequestに返し、それ以外はRecvHandlerで処理する
 // stopChを受信すると受信動作を停止する
+// 受信エラー(DTLSのAlertを含む)が発生した場合は受信動作を止め、Errで取得できるようにする
 func (coap *Coap) ReadCoapMessage(stopCh chan bool) {
 	for {
-		buf := make([]byte, 1500)
-		readLenCh := make(chan int)
+		messageCh := make(chan *CoapMessage, 1)
+		var readErr error
 		go func() {
-			len, _ := coap.Connection.Read(buf)
-			readLenCh <- len
+			message, err := coap.readMessage()
+			readErr = err
+			messageCh <- message
 		}()
-		var readLen int
+		var message *CoapMessage
 		select {
 		case <-stopCh:
 			return
-		case readLen = <-readLenCh:
+		case message = <-messageCh:
+		}
+		if readErr == nil {
+			var isSignal bool
+			isSignal, readErr = coap.handleSignal(message)
+			if isSignal && readErr == nil {
+				continue
+			}
+		}
+		if readErr != nil {
+			coap.recvError = readErr
+			close(coap.recvErrorCh)
+			<-stopCh
+			return
 		}
-		raw := make([]byte, readLen)
-		copy(raw, buf[:readLen])
-		message := coap.ParseMessage(raw)
-		if message == nil {
+		if message == nil || coap.isDuplicate(message) {
+			continue
+		}
+		if coap.handleDelivery(message) || coap.handleResponse(message) || coap.handleBlockRequest(message) {
 			continue
 		}
 		coap.RecvHandler(message)
-		if message.Type == CoapTypeAcknowledgement {
-			ch := coap.ChInProcess[message.MessageID]
-			ch <- 1
-			delete(coap.ChInProcess, message.MessageID)
+	}
+}
+
+// readMessage : メッセージを1つ受信する
+// 形式が不正なメッセージの場合はnilを返す(CONの場合はResetを返す)
+func (coap *Coap) readMessage() (*CoapMessage, error) {
+	if coap.stream {
+		tokenLength, raw, err := coap.readTCPMessage()
+		if err != nil {
+			return nil, err
+		}
+		message, err := coap.ParseTCPMessage(tokenLength, raw)
+		if err != nil {
+			log.Print(err)
+			return nil, nil
 		}
+		return message, nil
 	}
+	buf := make([]byte, 1500)
+	readLen, err := coap.Connection.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	message, err := coap.ParseMessage(buf[:readLen])
+	if err != nil {
+		log.Print(err)
+		coap.rejectMessage(buf[:readLen])
+		return nil, nil
+	}
+	return message, nil
 }
 
-// SendRequest : リクエスト(CON)を送信する
-// ACKが返ってきたらチャネルに1を送る
-// メッセージIDを返す
-func (coap *Coap) SendRequest(code CoapCode, options []CoapOption, payload []byte, ch chan int) uint16 {
-	message := &CoapMessage{
-		Version:     1,
-		Type:        CoapTypeConfirmable,
-		Code:        code,
-		MessageID:   coap.NextMessageID,
-		Token:       make([]byte, coapDefaultTokenLength),
-		TokenLength: coapDefaultTokenLength,
-		Options:     options,
-		Payload:     payload}
+// rejectMessage : 形式が不正なCONメッセージにResetを返す
+// RFC7252 4.2 Messages Transmitted Reliably参照
+func (coap *Coap) rejectMessage(raw []byte) {
+	if len(raw) < 4 || raw[0]>>6 != 1 || (raw[0]>>4)&0x03 != CoapTypeConfirmable {
+		return
+	}
+	reset := &CoapMessage{
+		Version:   1,
+		Type:      CoapTypeReset,
+		Code:      CoapCodeEmpty,
+		MessageID: binary.BigEndian.Uint16(raw[2:4])}
+	coap.write(reset.ConvertToBytes())
+}
+
+// encode : 接続の種類に応じてMessageを[]byteに変換する
+func (coap *Coap) encode(message *CoapMessage) []byte {
+	if coap.stream {
+		return message.ConvertToTCPBytes()
+	}
+	return message.ConvertToBytes()
+}
+
+// Err : 受信動作が停止した原因のエラーを取得する
+// 受信中の場合はnilを返す
+func (coap *Coap) Err() error {
+	select {
+	case <-coap.recvErrorCh:
+		return coap.recvError
+	default:
+		return nil
+	}
+}
+
+// SendRequestについてはcoap_exchange.go参照
+
+// nextMessageID : 新しいメッセージIDを払い出す
+func (coap *Coap) nextMessageID() uint16 {
+	coap.mutex.Lock()
+	defer coap.mutex.Unlock()
+	ret := coap.NextMessageID
 	coap.NextMessageID = (coap.NextMessageID + 1) & 0xFFFF
-	rand.Read(message.Token)
-	coap.ChInProcess[message.MessageID] = ch
-	coap.Connection.Write(message.ConvertToBytes())
-	return message.MessageID
+	return ret
+}
+
+// generateToken : ランダムなトークンを生成する
+func (coap *Coap) generateToken(token []byte) {
+	coap.mutex.Lock()
+	defer coap.mutex.Unlock()
+	rand.Read(token)
 }
 
 // SendResponse : レスポンス(ACK)を送信する
+// 大きなPayloadはブロックに分割し、最初のブロックのみを返す(coap_block.go参照)
+// リクエストが再送された場合に備えて送信したレスポンスを記録する
 func (coap *Coap) SendResponse(request *CoapMessage, code CoapCode, options []CoapOption, payload []byte) {
+	code, options, payload = coap.blockOptions(request, code, options, payload)
 	message := &CoapMessage{
 		Version:     1,
 		Type:        CoapTypeAcknowledgement,
@@ -188,32 +319,55 @@ func (coap *Coap) SendResponse(request *CoapMessage, code CoapCode, options []Co
 		TokenLength: request.TokenLength,
 		Options:     options,
 		Payload:     payload}
-	coap.Connection.Write(message.ConvertToBytes())
+	raw := coap.encode(message)
+	coap.storeResponse(request.MessageID, raw)
+	coap.write(raw)
 }
 
-// SendRelatedMessage : 関連メッセージ(新規メッセージだがトークンが同じ)を送信する
+// SendRelatedMessage : 関連メッセージ(新規メッセージだがトークンがrequestと同じ)を送信する
 // Lwm2m Notifyメッセージで使用する
+// Payloadがブロックサイズを超える場合は最初のブロックのみ送信する(relatedBlockOptions参照)
 // メッセージIDを返す
-func (coap *Coap) SendRelatedMessage(code CoapCode, token []byte, options []CoapOption, payload []byte) uint16 {
+func (coap *Coap) SendRelatedMessage(request *CoapMessage, code CoapCode, options []CoapOption, payload []byte) uint16 {
+	options, payload = coap.relatedBlockOptions(request, code, options, payload)
 	message := &CoapMessage{
 		Version:     1,
 		Type:        CoapTypeNonConfirmable,
 		Code:        code,
-		MessageID:   coap.NextMessageID,
-		Token:       token,
-		TokenLength: (byte)(len(token)),
+		MessageID:   coap.nextMessageID(),
+		Token:       request.Token,
+		TokenLength: request.TokenLength,
 		Options:     options,
 		Payload:     payload}
-	coap.NextMessageID = (coap.NextMessageID + 1) & 0xFFFF
-	coap.Connection.Write(message.ConvertToBytes())
+	coap.write(coap.encode(message))
+	return message.MessageID
+}
+
+// SendConfirmableRelatedMessage : 関連メッセージをCONで送信する
+// Lwm2m Notifyメッセージで、届いたことを確認する必要がある場合に使用する
+// 届いたかどうかはdeliveredに通知する(ACK:true、Reset / タイムアウト:false)
+// メッセージIDを返す
+func (coap *Coap) SendConfirmableRelatedMessage(request *CoapMessage, code CoapCode, options []CoapOption, payload []byte, delivered func(bool)) uint16 {
+	options, payload = coap.relatedBlockOptions(request, code, options, payload)
+	message := &CoapMessage{
+		Version:     1,
+		Type:        CoapTypeConfirmable,
+		Code:        code,
+		MessageID:   coap.nextMessageID(),
+		Token:       request.Token,
+		TokenLength: request.TokenLength,
+		Options:     options,
+		Payload:     payload}
+	coap.sendConfirmable(message, delivered)
 	return message.MessageID
 }
 
 // ParseMessage : 受信生データを解析してCoapMessageを生成する
-// 生成できない場合はnilを返す
-func (coap *Coap) ParseMessage(raw []byte) *CoapMessage {
+// 形式が不正な場合はエラーを返す
+// RFC7252 3. Message Format参照
+func (coap *Coap) ParseMessage(raw []byte) (*CoapMessage, error) {
 	if len(raw) < 4 {
-		return nil
+		return nil, errors.New("CoAPメッセージのヘッダが不足しています")
 	}
 	ret := &CoapMessage{}
 	ret.Version = raw[0] >> 6
@@ -221,19 +375,42 @@ func (coap *Coap) ParseMessage(raw []byte) *CoapMessage {
 	ret.TokenLength = raw[0] & 0x0F
 	ret.Code = (CoapCode)(raw[1])
 	ret.MessageID = ((uint16)(raw[2]) << 8) + (uint16)(raw[3])
-	if len(raw) < 4+(int)(ret.TokenLength) {
-		return nil
+	if ret.Version != 1 {
+		return nil, errors.New("未対応のCoAPバージョンです")
 	}
-	ret.Token = raw[4 : 4+ret.TokenLength]
-	optionsLength := ret.ParseOptions(raw[(4 + ret.TokenLength):])
-	ret.Payload = raw[(4 + (int)(ret.TokenLength) + optionsLength):]
-	return ret
+	// Emptyメッセージはヘッダのみ
+	if ret.Code == CoapCodeEmpty && len(raw) != 4 {
+		return nil, errors.New("Emptyメッセージにヘッダ以外のデータがあります")
+	}
+	if err := ret.parseTokenAndBody(raw[4:]); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// parseTokenAndBody : トークン以降(トークン、オプション、ペイロード)を解析する
+// トークン長の9-15は予約済みのため形式エラーとする
+func (message *CoapMessage) parseTokenAndBody(raw []byte) error {
+	if message.TokenLength > coapMaxTokenLength {
+		return errors.New("トークン長が不正です")
+	}
+	if len(raw) < (int)(message.TokenLength) {
+		return errors.New("トークンが不足しています")
+	}
+	message.Token = raw[:message.TokenLength]
+	optionsLength, err := message.ParseOptions(raw[message.TokenLength:])
+	if err != nil {
+		return err
+	}
+	message.Payload = raw[((int)(message.TokenLength) + optionsLength):]
+	return nil
 }
 
 // ConvertToBytes : Messageを[]byteに変換する
+// トークン長はTokenの長さとする
 func (message *CoapMessage) ConvertToBytes() []byte {
 	ret := make([]byte, 4)
-	ret[0] = (message.Version << 6) + (message.Type << 4) + message.TokenLength
+	ret[0] = (message.Version << 6) + (message.Type << 4) + (byte)(len(message.Token))
 	ret[1] = (byte)(message.Code)
 	binary.BigEndian.PutUint16(ret[2:4], message.MessageID)
 	ret = append(ret, message.Token...)
@@ -245,26 +422,56 @@ func (message *CoapMessage) ConvertToBytes() []byte {
 	return ret
 }
 
-// IsObserve : Observeメッセージかを判定する
+// IsObserve : Observeの登録(Observe=0)のメッセージかを判定する
+// RFC7641 2. The Observe Option参照
 func (message *CoapMessage) IsObserve() bool {
-	for _, option := range message.Options {
-		if option.No == coapOptionNoObserve {
-			return true
-		}
+	option := message.findOption(coapOptionNoObserve)
+	return option != nil && parseCoapUintOptionValue(option.Value) == (uint32)(coapObserveRegister)
+}
+
+// IsObserveCancel : Observeの解除(Observe=1)のメッセージかを判定する
+// RFC7641 3.6 Cancellation参照
+func (message *CoapMessage) IsObserveCancel() bool {
+	option := message.findOption(coapOptionNoObserve)
+	return option != nil && parseCoapUintOptionValue(option.Value) == (uint32)(coapObserveDeregister)
+}
+
+// Accept : Acceptオプションで指定されたContent Formatを取得する
+// Acceptオプションが無い場合はfalseを返す
+// RFC7252 5.10.4 Accept参照
+func (message *CoapMessage) Accept() (uint32, bool) {
+	option := message.findOption(coapOptionNoAccept)
+	if option == nil {
+		return 0, false
+	}
+	return parseCoapUintOptionValue(option.Value), true
+}
+
+// ContentFormat : Content-Formatオプションで指定されたペイロードの形式を取得する
+// Content-Formatオプションが無い場合はfalseを返す
+// RFC7252 5.10.3 Content-Format参照
+func (message *CoapMessage) ContentFormat() (uint32, bool) {
+	option := message.findOption(coapOptionNoContentFormat)
+	if option == nil {
+		return 0, false
 	}
-	return false
+	return parseCoapUintOptionValue(option.Value), true
 }
 
 // ParseOptions : 生データのオプション部以降を解析しオプションをセットする
 // 戻り値：オプション部の長さ
-func (message *CoapMessage) ParseOptions(raw []byte) int {
+// ペイロードマーカー(0xFF)の後にペイロードが無い場合は形式エラーとする
+func (message *CoapMessage) ParseOptions(raw []byte) (int, error) {
 	length := 0
 	var base uint
 	// 全データを解析し終わるか(Payloadが無い場合)
 	// OxFFを確認する(Optionの終端を表すコード)までオプションを解析する
 	for len(raw) > length && raw[length] != 0xFF {
 		option := &CoapOption{}
-		optionLength := option.ParseOption(raw[length:], base)
+		optionLength, err := option.ParseOption(raw[length:], base)
+		if err != nil {
+			return 0, err
+		}
 		message.Options = append(message.Options, *option)
 		length += optionLength
 		base = option.No
@@ -273,46 +480,62 @@ func (message *CoapMessage) ParseOptions(raw []byte) int {
 	// オプション終端がある場合はその部分までオプション部とする
 	if len(raw) > length && raw[length] == 0xFF {
 		length++
+		if len(raw) == length {
+			return 0, errors.New("ペイロードマーカーの後にペイロードがありません")
+		}
 	}
-	return length
+	return length, nil
 }
 
 // ParseOption : 生データの各オプションをセットする
 // 戻り値:オプションの長さ
-func (option *CoapOption) ParseOption(raw []byte, base uint) int {
-	var delta uint
-	var length uint
-
-	deltaLength := 0
-	delta = (uint)(raw[0]) >> 4
-	if delta == coapOptCodeByte {
-		delta = (uint)(raw[1] + coapOptByteBase)
-		deltaLength = 1
-	} else if delta == coapOptCodeWord {
-		delta = (uint)(raw[1])>>8 + (uint)(raw[2]) + coapOptWordBase
-		deltaLength = 2
+// RFC7252 3.1 Option Format参照
+func (option *CoapOption) ParseOption(raw []byte, base uint) (int, error) {
+	if len(raw) < 1 {
+		return 0, errors.New("オプションが不足しています")
+	}
+	delta, index, err := parseCoapOptionExtended((uint)(raw[0]>>4), raw, 1)
+	if err != nil {
+		return 0, err
+	}
+	length, index, err := parseCoapOptionExtended((uint)(raw[0]&0x0F), raw, index)
+	if err != nil {
+		return 0, err
+	}
+	if uint(len(raw)) < (uint)(index)+length {
+		return 0, errors.New("オプションの値が不足しています")
 	}
 	option.No = base + delta
+	option.Value = raw[index:(index + (int)(length))]
+	return index + (int)(length), nil
+}
 
-	lengthLength := 0
-	length = (uint)(raw[0]) & 0x0F
-	if length == coapOptCodeByte {
-		length = (uint)(raw[1+deltaLength] + coapOptByteBase)
-		lengthLength = 1
-	} else if length == coapOptCodeWord {
-		length = (uint)(raw[1+deltaLength])>>8 + (uint)(raw[2+deltaLength]) + coapOptWordBase
-		lengthLength = 2
+// parseCoapOptionExtended : Option Delta / Option Lengthを拡張部を含めて解析する
+// 13の場合は1byte、14の場合は2byteの拡張部が続き、15は予約済み(ペイロードマーカー)
+// 戻り値は値と拡張部の次のインデックス
+func parseCoapOptionExtended(nibble uint, raw []byte, index int) (uint, int, error) {
+	switch nibble {
+	case coapOptCodeByte:
+		if len(raw) < index+1 {
+			return 0, 0, errors.New("オプションの拡張部が不足しています")
+		}
+		return (uint)(raw[index]) + coapOptByteBase, index + 1, nil
+	case coapOptCodeWord:
+		if len(raw) < index+2 {
+			return 0, 0, errors.New("オプションの拡張部が不足しています")
+		}
+		return ((uint)(raw[index])<<8 | (uint)(raw[index+1])) + coapOptWordBase, index + 2, nil
+	case coapOptCodeReserved:
+		return 0, 0, errors.New("オプションに予約済みの値が使用されています")
 	}
-
-	option.Value = raw[1+deltaLength+lengthLength : 1+deltaLength+lengthLength+(int)(length)]
-
-	return (1 + deltaLength + lengthLength + (int)(length))
+	return nibble, index, nil
 }
 
 // BuildOptions : Coapのオプション部を生成する
 func (message *CoapMessage) BuildOptions() []byte {
 	ret := make([]byte, 0)
-	sort.Slice(message.Options, func(i, j int) bool { return message.Options[i].No < message.Options[j].No })
+	// 同じ番号のオプション(Uri-Path等)は順番に意味があるため、安定ソートとする
+	sort.SliceStable(message.Options, func(i, j int) bool { return message.Options[i].No < message.Options[j].No })
 	var base uint
 	for i := range message.Options {
 		ret = append(ret, message.Options[i].BuildOption(base)...)
@@ -324,27 +547,21 @@ func (message *CoapMessage) BuildOptions() []byte {
 // BuildOption : Coapの各オプション部を生成する
 // RFC7252 3.1 Option Format参照
 func (option *CoapOption) BuildOption(base uint) []byte {
-	delta := option.No - base
-	length := len(option.Value)
-	ret := make([]byte, 1)
-	if delta < coapOptByteBase {
-		ret[0] += (byte)(delta << 4)
-	} else if delta < coapOptWordBase {
-		ret[0] += (byte)(coapOptCodeByte << 4)
-		ret = append(ret, (byte)(delta-coapOptByteBase))
-	} else {
-		ret[0] += (byte)(coapOptCodeWord << 4)
-		ret = append(ret, (byte)((delta-coapOptWordBase)>>8), (byte)((delta-coapOptWordBase)&0x00FF))
-	}
-	if length < coapOptByteBase {
-		ret[0] += (byte)(length)
-	} else if delta < coapOptWordBase {
-		ret[0] += (byte)(coapOptCodeByte)
-		ret = append(ret, (byte)(length-coapOptByteBase))
-	} else {
-		ret[0] += (byte)(coapOptCodeWord)
-		ret = append(ret, (byte)((length-coapOptWordBase)>>8), (byte)((length-coapOptWordBase)&0x00FF))
-	}
+	delta, deltaExtended := buildCoapOptionExtended(option.No - base)
+	length, lengthExtended := buildCoapOptionExtended((uint)(len(option.Value)))
+	ret := []byte{(byte)(delta<<4) + (byte)(length)}
+	ret = append(ret, deltaExtended...)
+	ret = append(ret, lengthExtended...)
 	ret = append(ret, option.Value...)
 	return ret
 }
+
+// buildCoapOptionExtended : Option Delta / Option Lengthの4bitの値と拡張部を生成する
+func buildCoapOptionExtended(value uint) (uint, []byte) {
+	if value < coapOptByteBase {
+		return value, []byte{}
+	} else if value < coapOptWordBase {
+		return coapOptCodeByte, []byte{(byte)(value - coapOptByteBase)}
+	}
+	return coapOptCodeWord, []byte{(byte)((value - coapOptWordBase) >> 8), (byte)((value - coapOptWordBase) & 0x00FF)}
+}
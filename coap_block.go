@@ -0,0 +1,273 @@
+package inventoryd
+
+import (
+	"strings"
+	"time"
+)
+
+// Block Option
+// RFC7959 2.1 The Block2 and Block1 Options / 4. The Size2 and Size1 Options参照
+const (
+	coapOptionNoBlock2 = 23
+	coapOptionNoBlock1 = 27
+	coapOptionNoSize2  = 28
+	coapOptionNoSize1  = 60
+)
+
+// ブロックサイズ
+// SZXは2^(SZX+4)バイトを表す(0:16byte - 6:1024byte)
+// DTLSのレコードに収まるよう、相手から指定が無い場合は512byteとする
+const (
+	coapDefaultBlockSZX byte = 5
+	coapMaxBlockSZX     byte = 6
+)
+
+// coapMaxBlock1PayloadSize : Block1で受信するリクエストのPayloadの上限
+// 超える場合は4.13 Request Entity Too Largeを返し、Size1 Optionで上限を通知する
+// RFC7959 2.9.3 4.13 Request Entity Too Large参照
+const coapMaxBlock1PayloadSize = 256 * 1024
+
+// coapBlock : Block1 / Block2 Optionの値
+// RFC7959 2.2 Structure of a Block Option参照
+type coapBlock struct {
+	Num  uint32
+	More bool
+	SZX  byte
+}
+
+// coapBlockTransfer : 転送中のブロック単位のメッセージ
+// Block2ではブロックに分割して返すレスポンス全体、Block1では受信済みのリクエストのPayloadを保持する
+type coapBlockTransfer struct {
+	code    CoapCode
+	options []CoapOption
+	payload []byte
+	expire  time.Time
+}
+
+// parseCoapBlock : Optionの値(0-3byteの符号なし整数)からブロックの情報を取得する
+// NUM(4-20bit) || M(1bit) || SZX(3bit)
+func parseCoapBlock(value []byte) coapBlock {
+	raw := parseCoapUintOptionValue(value)
+	block := coapBlock{Num: raw >> 4, More: raw&0x08 != 0, SZX: (byte)(raw & 0x07)}
+	if block.SZX > coapMaxBlockSZX {
+		// SZX=7は予約済みのため、最大のサイズとして扱う
+		block.SZX = coapMaxBlockSZX
+	}
+	return block
+}
+
+// Size : ブロックのバイト長
+func (block coapBlock) Size() int {
+	return 1 << (block.SZX + 4)
+}
+
+// Bytes : Optionの値に変換する
+func (block coapBlock) Bytes() []byte {
+	raw := block.Num<<4 + (uint32)(block.SZX)
+	if block.More {
+		raw += 0x08
+	}
+	return coapUintOptionValue(raw)
+}
+
+// coapUintOptionValue : 符号なし整数をOptionの値に変換する
+// 先頭の0のバイトは省略する(0の場合は長さ0)
+// RFC7252 3.2 Option Value Formats参照
+func coapUintOptionValue(value uint32) []byte {
+	ret := []byte{}
+	for value > 0 {
+		ret = append([]byte{(byte)(value & 0xff)}, ret...)
+		value >>= 8
+	}
+	return ret
+}
+
+// parseCoapUintOptionValue : Optionの値を符号なし整数に変換する
+func parseCoapUintOptionValue(value []byte) uint32 {
+	var ret uint32
+	for _, b := range value {
+		ret = ret<<8 + (uint32)(b)
+	}
+	return ret
+}
+
+// findOption : 指定した番号のオプションを取得する
+// 存在しない場合はnilを返す
+func (message *CoapMessage) findOption(no uint) *CoapOption {
+	for i := range message.Options {
+		if message.Options[i].No == no {
+			return &message.Options[i]
+		}
+	}
+	return nil
+}
+
+// blockTransferKey : ブロック転送を識別するキー
+// 同じリソースに対する同じメソッドのリクエストを同一の転送とみなす
+func (message *CoapMessage) blockTransferKey() string {
+	keys := []string{message.Code.String()}
+	for _, option := range message.Options {
+		if option.No == coapOptionNoURIPath || option.No == coapOptionNoURIQuery {
+			keys = append(keys, string(option.Value))
+		}
+	}
+	return strings.Join(keys, "/")
+}
+
+// handleBlockRequest : ブロック単位で送られてきたリクエストを処理する
+// Block2で2番目以降のブロックを要求された場合は、保持しているレスポンスから返す
+// Block1の場合は最後のブロックを受信するまでPayloadを連結し、2.31 Continueを返す
+// 最後のブロックを受信したら連結したPayloadのリクエストとしてハンドラに渡すため、falseを返す
+// 連結したPayloadが上限(coapMaxBlock1PayloadSize)を超える場合は4.13 Request Entity Too Largeを返す
+// 処理した場合はtrueを返す
+func (coap *Coap) handleBlockRequest(message *CoapMessage) bool {
+	if message.Type != CoapTypeConfirmable && message.Type != CoapTypeNonConfirmable {
+		return false
+	}
+	key := message.blockTransferKey()
+	if option := message.findOption(coapOptionNoBlock2); option != nil {
+		block := parseCoapBlock(option.Value)
+		if block.Num > 0 {
+			transfer := coap.findBlockTransfer(coap.block2Transfers, key)
+			if transfer != nil {
+				coap.SendResponse(message, transfer.code, transfer.options, transfer.payload)
+				return true
+			}
+			// 保持していない場合はハンドラの結果から該当するブロックを返す
+		}
+	}
+
+	option := message.findOption(coapOptionNoBlock1)
+	if option == nil {
+		return false
+	}
+	block := parseCoapBlock(option.Value)
+	size1 := message.findOption(coapOptionNoSize1)
+	if (int)(block.Num)*block.Size()+len(message.Payload) > coapMaxBlock1PayloadSize ||
+		(size1 != nil && parseCoapUintOptionValue(size1.Value) > coapMaxBlock1PayloadSize) {
+		coap.mutex.Lock()
+		delete(coap.block1Transfers, key)
+		coap.mutex.Unlock()
+		coap.SendResponse(message, CoapCodeRequestEntityTooLarge,
+			[]CoapOption{CoapOption{coapOptionNoSize1, coapUintOptionValue(coapMaxBlock1PayloadSize)}}, []byte{})
+		return true
+	}
+	coap.mutex.Lock()
+	coap.pruneBlockTransfers(coap.block1Transfers)
+	transfer, exist := coap.block1Transfers[key]
+	if block.Num == 0 || !exist {
+		transfer = &coapBlockTransfer{payload: []byte{}}
+		coap.block1Transfers[key] = transfer
+	}
+	transfer.expire = time.Now().Add(coapExchangeLifetime)
+	if (int)(block.Num)*block.Size() != len(transfer.payload) {
+		// 途中のブロックが欠けている場合は最初からやり直させる
+		delete(coap.block1Transfers, key)
+		coap.mutex.Unlock()
+		coap.SendResponse(message, CoapCodeRequestEntityIncomplete, []CoapOption{}, []byte{})
+		return true
+	}
+	transfer.payload = append(transfer.payload, message.Payload...)
+	if block.More {
+		coap.mutex.Unlock()
+		coap.SendResponse(message, CoapCodeContinue, []CoapOption{}, []byte{})
+		return true
+	}
+	delete(coap.block1Transfers, key)
+	coap.mutex.Unlock()
+	message.Payload = transfer.payload
+	return false
+}
+
+// findBlockTransfer : 転送中のメッセージを取得する
+// 期限切れのものは削除する
+func (coap *Coap) findBlockTransfer(transfers map[string]*coapBlockTransfer, key string) *coapBlockTransfer {
+	coap.mutex.Lock()
+	defer coap.mutex.Unlock()
+	coap.pruneBlockTransfers(transfers)
+	return transfers[key]
+}
+
+// pruneBlockTransfers : 期限切れの転送中のメッセージを削除する
+// coap.mutexをロックした状態で呼び出すこと
+func (coap *Coap) pruneBlockTransfers(transfers map[string]*coapBlockTransfer) {
+	now := time.Now()
+	for transferKey, transfer := range transfers {
+		if now.After(transfer.expire) {
+			delete(transfers, transferKey)
+		}
+	}
+}
+
+// blockOptions : レスポンスに付加するBlock Optionを生成し、送信するPayloadを切り出す
+// Block1のリクエストにはBlock1 Optionをそのまま返す
+// Payloadがブロックサイズを超える場合、またはBlock2で2番目以降のブロックを要求された場合は
+// 要求されたブロックを切り出してBlock2 Optionを付加する(最初のブロックにはSize2 Optionも付加する)
+// 2番目以降のブロックの要求に備えてレスポンス全体を保持する
+// 成功のレスポンスでPayloadの末尾を超えるブロックを要求された場合は4.02 Bad Optionとする
+// RFC7959 2.2 Structure of a Block Option / 2.4 Using the Block2 Option / 2.5 Using the Block1 Option参照
+func (coap *Coap) blockOptions(request *CoapMessage, code CoapCode, options []CoapOption, payload []byte) (CoapCode, []CoapOption, []byte) {
+	ret := append([]CoapOption{}, options...)
+	if option := request.findOption(coapOptionNoBlock1); option != nil {
+		ret = append(ret, CoapOption{coapOptionNoBlock1, option.Value})
+	}
+
+	block := coapBlock{SZX: coapDefaultBlockSZX}
+	if option := request.findOption(coapOptionNoBlock2); option != nil {
+		requested := parseCoapBlock(option.Value)
+		block.Num = requested.Num
+		if requested.SZX < block.SZX {
+			block.SZX = requested.SZX
+		}
+	}
+	if len(payload) <= block.Size() && block.Num == 0 {
+		return code, ret, payload
+	}
+
+	start := (int)(block.Num) * block.Size()
+	if start >= len(payload) {
+		if code>>5 != 2 {
+			// エラーのレスポンスはブロックに分割せずにそのまま返す
+			return code, ret, payload
+		}
+		return CoapCodeBadOption, ret, []byte{}
+	}
+	end := start + block.Size()
+	if end >= len(payload) {
+		end = len(payload)
+	} else {
+		block.More = true
+	}
+	if block.Num == 0 {
+		coap.mutex.Lock()
+		coap.block2Transfers[request.blockTransferKey()] = &coapBlockTransfer{
+			code:    code,
+			options: options,
+			payload: payload,
+			expire:  time.Now().Add(coapExchangeLifetime)}
+		coap.mutex.Unlock()
+		ret = append(ret, CoapOption{coapOptionNoSize2, coapUintOptionValue((uint32)(len(payload)))})
+	}
+	ret = append(ret, CoapOption{coapOptionNoBlock2, block.Bytes()})
+	return code, ret, payload[start:end]
+}
+
+// relatedBlockOptions : 関連メッセージ(Notify)に付加するBlock Optionを生成し、送信するPayloadを切り出す
+// Payloadがブロックサイズを超える場合は、常に最初のブロックにBlock2 / Size2 Optionを付加して送信する
+// 残りのブロックはrequestと同じリソースへのBlock2(Observe無し)のGETで要求されるため、レスポンスと同様に全体を保持する
+// requestでBlock2 Optionが指定されていた場合は、そのブロックサイズを上限とする
+// RFC7959 3.4 Block-Wise Transfer and Observe参照
+func (coap *Coap) relatedBlockOptions(request *CoapMessage, code CoapCode, options []CoapOption, payload []byte) ([]CoapOption, []byte) {
+	first := &CoapMessage{Code: request.Code, Options: []CoapOption{}}
+	for _, option := range request.Options {
+		switch option.No {
+		case coapOptionNoURIPath, coapOptionNoURIQuery:
+			first.Options = append(first.Options, option)
+		case coapOptionNoBlock2:
+			block := coapBlock{SZX: parseCoapBlock(option.Value).SZX}
+			first.Options = append(first.Options, CoapOption{coapOptionNoBlock2, block.Bytes()})
+		}
+	}
+	_, options, payload = coap.blockOptions(first, code, options, payload)
+	return options, payload
+}
@@ -0,0 +1,213 @@
+package inventoryd
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// coapTestBlock1Peer : Block1のリクエストを送り、レスポンスを受け取るテスト用の相手
+type coapTestBlock1Peer struct {
+	t         *testing.T
+	conn      net.Conn
+	messageID uint16
+}
+
+// send : Block1 Option(と指定があればSize1 Option)を付けたPUTを送り、レスポンスを返す
+func (peer *coapTestBlock1Peer) send(block coapBlock, size1 int, payload []byte) *CoapMessage {
+	peer.t.Helper()
+	peer.messageID++
+	options := []CoapOption{
+		CoapOption{coapOptionNoURIPath, []byte("3")},
+		CoapOption{coapOptionNoBlock1, block.Bytes()}}
+	if size1 > 0 {
+		options = append(options, CoapOption{coapOptionNoSize1, coapUintOptionValue((uint32)(size1))})
+	}
+	request := &CoapMessage{
+		Version:     1,
+		Type:        CoapTypeConfirmable,
+		Code:        CoapCodePut,
+		MessageID:   peer.messageID,
+		TokenLength: 1,
+		Token:       []byte{0x01},
+		Options:     options,
+		Payload:     payload}
+	if _, err := peer.conn.Write(request.ConvertToBytes()); err != nil {
+		peer.t.Fatal(err)
+	}
+	peer.conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	readLen, err := peer.conn.Read(buf)
+	if err != nil {
+		peer.t.Fatal(err)
+	}
+	response, err := (&Coap{}).ParseMessage(buf[:readLen])
+	if err != nil {
+		peer.t.Fatal(err)
+	}
+	return response
+}
+
+// newCoapTestBlock1Peer : net.Pipeで接続したCoapとテスト用の相手を生成する
+// 再構成が終わったリクエストはreceivedChに渡す
+func newCoapTestBlock1Peer(t *testing.T) (*Coap, *coapTestBlock1Peer, chan *CoapMessage) {
+	local, remote := net.Pipe()
+	receivedCh := make(chan *CoapMessage, 1)
+	coap := &Coap{}
+	coap.Initialize(local, func(message *CoapMessage) {
+		coap.SendResponse(message, CoapCodeChanged, []CoapOption{}, []byte{})
+		receivedCh <- message
+	})
+	t.Cleanup(func() {
+		remote.Close()
+		coap.Close()
+	})
+	return coap, &coapTestBlock1Peer{t: t, conn: remote}, receivedCh
+}
+
+// TestCoapBlock1TooLarge : 上限を超えるBlock1のリクエストに4.13とSize1 Optionを返すことを確認する
+// RFC7959 2.9.3 4.13 Request Entity Too Large参照
+func TestCoapBlock1TooLarge(t *testing.T) {
+	assertTooLarge := func(response *CoapMessage) {
+		t.Helper()
+		if response.Code != CoapCodeRequestEntityTooLarge {
+			t.Fatalf("レスポンスコードが4.13ではありません %s", response.Code)
+		}
+		size1 := response.findOption(coapOptionNoSize1)
+		if size1 == nil || parseCoapUintOptionValue(size1.Value) != coapMaxBlock1PayloadSize {
+			t.Fatal("Size1 Optionで上限が通知されていません")
+		}
+	}
+
+	// Size1 Optionで事前に通知された全体のサイズが上限を超える
+	coap, peer, _ := newCoapTestBlock1Peer(t)
+	block := coapBlock{Num: 0, More: true, SZX: coapMaxBlockSZX}
+	assertTooLarge(peer.send(block, coapMaxBlock1PayloadSize+1, make([]byte, block.Size())))
+
+	// Size1 Optionが無く、受信したPayloadが上限を超える
+	blockCount := coapMaxBlock1PayloadSize / block.Size()
+	for ; (int)(block.Num) < blockCount; block.Num++ {
+		response := peer.send(block, 0, make([]byte, block.Size()))
+		if response.Code != CoapCodeContinue {
+			t.Fatalf("%d番目のブロックのレスポンスコードが2.31ではありません %s", block.Num, response.Code)
+		}
+	}
+	assertTooLarge(peer.send(block, 0, []byte{0x00}))
+	coap.mutex.Lock()
+	defer coap.mutex.Unlock()
+	if len(coap.block1Transfers) != 0 {
+		t.Fatal("上限を超えたBlock1の転送が破棄されていません")
+	}
+}
+
+// TestCoapBlock1Reassembly : 上限以内のBlock1のリクエストが連結されてハンドラに渡ることを確認する
+func TestCoapBlock1Reassembly(t *testing.T) {
+	_, peer, receivedCh := newCoapTestBlock1Peer(t)
+	expected := []byte{}
+	block := coapBlock{Num: 0, More: true, SZX: 0}
+	for ; block.Num < 3; block.Num++ {
+		payload := bytes.Repeat([]byte{(byte)(block.Num)}, block.Size())
+		expected = append(expected, payload...)
+		if response := peer.send(block, 0, payload); response.Code != CoapCodeContinue {
+			t.Fatalf("レスポンスコードが2.31ではありません %s", response.Code)
+		}
+	}
+	block.More = false
+	expected = append(expected, 0xFF)
+	if response := peer.send(block, 0, []byte{0xFF}); response.Code != CoapCodeChanged {
+		t.Fatalf("レスポンスコードが2.04ではありません %s", response.Code)
+	}
+	if received := <-receivedCh; !bytes.Equal(received.Payload, expected) {
+		t.Fatalf("連結したPayloadが一致しません %x", received.Payload)
+	}
+}
+
+// TestCoapBlock1Prune : 期限切れのBlock1の転送が削除されることを確認する
+func TestCoapBlock1Prune(t *testing.T) {
+	coap, peer, _ := newCoapTestBlock1Peer(t)
+	coap.mutex.Lock()
+	coap.block1Transfers["expired"] = &coapBlockTransfer{payload: make([]byte, 1024), expire: time.Now().Add(-time.Second)}
+	coap.mutex.Unlock()
+
+	peer.send(coapBlock{Num: 0, More: true, SZX: 0}, 0, make([]byte, 16))
+	coap.mutex.Lock()
+	defer coap.mutex.Unlock()
+	if _, exist := coap.block1Transfers["expired"]; exist {
+		t.Fatal("期限切れのBlock1の転送が削除されていません")
+	}
+	if len(coap.block1Transfers) != 1 {
+		t.Fatalf("転送中のBlock1の数が不正です %d", len(coap.block1Transfers))
+	}
+}
+
+// TestCoapBlock2OutOfRange : Payloadの末尾を超えるBlock2を要求された場合に4.02 Bad Optionを返し、
+// エラーのレスポンスはそのまま返すことを確認する
+// RFC7959 2.2 Structure of a Block Option参照
+func TestCoapBlock2OutOfRange(t *testing.T) {
+	coap := &Coap{block2Transfers: map[string]*coapBlockTransfer{}}
+	payload := make([]byte, 1000)
+	request := func(num uint32) *CoapMessage {
+		return &CoapMessage{Code: CoapCodeGet, Options: []CoapOption{
+			CoapOption{coapOptionNoURIPath, []byte("3")},
+			CoapOption{coapOptionNoBlock2, coapBlock{Num: num, SZX: coapDefaultBlockSZX}.Bytes()}}}
+	}
+
+	code, options, body := coap.blockOptions(request(1), CoapCodeContent, []CoapOption{}, payload)
+	if code != CoapCodeContent || len(body) != 1000-512 {
+		t.Fatalf("最後のブロックが不正です code=%s len=%d", code, len(body))
+	}
+	if block := parseCoapBlock(options[len(options)-1].Value); block.Num != 1 || block.More {
+		t.Fatalf("最後のブロックのBlock2 Optionが不正です %+v", block)
+	}
+
+	for _, num := range []uint32{2, 100} {
+		code, options, body = coap.blockOptions(request(num), CoapCodeContent, []CoapOption{}, payload)
+		if code != CoapCodeBadOption || len(body) != 0 {
+			t.Fatalf("Num=%d の結果が不正です code=%s len=%d", num, code, len(body))
+		}
+		for _, option := range options {
+			if option.No == coapOptionNoBlock2 {
+				t.Fatalf("Num=%d の4.02にBlock2 Optionが付加されています", num)
+			}
+		}
+	}
+
+	code, _, body = coap.blockOptions(request(2), CoapCodeNotFound, []CoapOption{}, []byte{})
+	if code != CoapCodeNotFound || len(body) != 0 {
+		t.Fatalf("エラーのレスポンスが変更されました code=%s", code)
+	}
+}
+
+// TestCoapRelatedBlockOptions : ブロックサイズを超える関連メッセージ(Notify)は、Observeのリクエストで要求されたブロックに関わらず
+// 最初のブロックにSize2 Optionを付加し、リクエストのブロックサイズを上限とすること、
+// 残りのブロックを要求された際に返せるよう全体を保持することを確認する
+// RFC7959 3.4 Block-Wise Transfer and Observe参照
+func TestCoapRelatedBlockOptions(t *testing.T) {
+	coap := &Coap{block2Transfers: map[string]*coapBlockTransfer{}}
+	request := &CoapMessage{Code: CoapCodeGet, Options: []CoapOption{
+		CoapOption{coapOptionNoObserve, coapUintOptionValue((uint32)(coapObserveRegister))},
+		CoapOption{coapOptionNoURIPath, []byte("3")},
+		CoapOption{coapOptionNoBlock2, coapBlock{Num: 2, SZX: 4}.Bytes()}}}
+
+	options, body := coap.relatedBlockOptions(request, CoapCodeContent, []CoapOption{}, []byte{0x01})
+	if len(options) != 0 || len(body) != 1 {
+		t.Fatal("ブロックサイズ以下のPayloadが分割されました")
+	}
+
+	payload := make([]byte, 1000)
+	options, body = coap.relatedBlockOptions(request, CoapCodeContent, []CoapOption{}, payload)
+	if len(body) != 256 {
+		t.Fatalf("最初のブロックの長さが不正です %d", len(body))
+	}
+	message := &CoapMessage{Options: options}
+	if block := parseCoapBlock(message.findOption(coapOptionNoBlock2).Value); block.Num != 0 || !block.More || block.SZX != 4 {
+		t.Fatalf("Block2 Optionが不正です %+v", block)
+	}
+	if size2 := message.findOption(coapOptionNoSize2); size2 == nil || parseCoapUintOptionValue(size2.Value) != 1000 {
+		t.Fatal("Size2 Optionで全体の長さが通知されていません")
+	}
+	if transfer := coap.findBlockTransfer(coap.block2Transfers, request.blockTransferKey()); transfer == nil || len(transfer.payload) != 1000 {
+		t.Fatal("Notifyの全体が保持されていません")
+	}
+}
@@ -0,0 +1,145 @@
+package inventoryd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+)
+
+// CoapResult : リクエストに対するレスポンス
+type CoapResult struct {
+	Message *CoapMessage // レスポンスのメッセージ
+	Code    CoapCode     // レスポンスコード
+}
+
+// coapExchange : レスポンスを待っているリクエスト
+// レスポンスはACKに含まれる(Piggybacked Response)か、
+// 空のACKの後にトークンが同じ別のメッセージで届く(Separate Response)
+// RFC7252 5.2 Responses参照
+type coapExchange struct {
+	messageID uint16
+	token     []byte
+	resultCh  chan *CoapResult
+}
+
+// SendRequest : リクエスト(CON)を送信し、レスポンスを待つ
+// ACKが返ってくるまで再送する
+// ctxが終了した場合、Resetを受信した場合、MAX_RETRANSMIT回再送してもACKが無い場合、受信動作が停止した場合はエラーを返す
+func (coap *Coap) SendRequest(ctx context.Context, code CoapCode, options []CoapOption, payload []byte) (*CoapResult, error) {
+	message := &CoapMessage{
+		Version:     1,
+		Type:        CoapTypeConfirmable,
+		Code:        code,
+		MessageID:   coap.nextMessageID(),
+		Token:       make([]byte, coapDefaultTokenLength),
+		TokenLength: coapDefaultTokenLength,
+		Options:     options,
+		Payload:     payload}
+	coap.generateToken(message.Token)
+	exchange := &coapExchange{
+		messageID: message.MessageID,
+		token:     message.Token,
+		resultCh:  make(chan *CoapResult, 1)}
+	coap.addExchange(exchange)
+	defer coap.removeExchange(exchange)
+
+	raw := coap.encode(message)
+	// MAX_RETRANSMIT回再送してもACKが無ければ、ctxの終了を待たずにエラーとする
+	failedCh := make(chan bool, 1)
+	if !coap.stream {
+		coap.startRetransmission(message.MessageID, raw, func() { failedCh <- true })
+	}
+	coap.write(raw)
+	select {
+	case <-ctx.Done():
+		coap.stopRetransmission(message.MessageID)
+		return nil, ctx.Err()
+	case <-failedCh:
+		return nil, errors.New("リクエストを再送しましたがACKを受信できませんでした")
+	case <-coap.recvErrorCh:
+		coap.stopRetransmission(message.MessageID)
+		return nil, coap.recvError
+	case result := <-exchange.resultCh:
+		if result.Message.Type == CoapTypeReset {
+			return nil, errors.New("リクエストがResetされました")
+		}
+		return result, nil
+	}
+}
+
+// addExchange : レスポンスを待つリクエストを登録する
+func (coap *Coap) addExchange(exchange *coapExchange) {
+	coap.mutex.Lock()
+	defer coap.mutex.Unlock()
+	coap.exchanges[exchange.messageID] = exchange
+	coap.exchangesByToken[string(exchange.token)] = exchange
+}
+
+// removeExchange : レスポンスを待つリクエストの登録を削除する
+func (coap *Coap) removeExchange(exchange *coapExchange) {
+	coap.mutex.Lock()
+	defer coap.mutex.Unlock()
+	delete(coap.exchanges, exchange.messageID)
+	delete(coap.exchangesByToken, string(exchange.token))
+}
+
+// findExchange : 受信したメッセージに対応するリクエストを検索する
+// ACK / ResetはメッセージIDで、Separate Response(およびCoAP over TCPのレスポンス)はトークンで対応付ける
+// PiggybackedなレスポンスはメッセージIDとトークンの両方が一致しなければならない
+func (coap *Coap) findExchange(message *CoapMessage) *coapExchange {
+	coap.mutex.Lock()
+	defer coap.mutex.Unlock()
+	switch message.Type {
+	case CoapTypeAcknowledgement, CoapTypeReset:
+		exchange, exist := coap.exchanges[message.MessageID]
+		if !exist {
+			return nil
+		}
+		if message.Code != CoapCodeEmpty && !bytes.Equal(exchange.token, message.Token) {
+			return nil
+		}
+		return exchange
+	default:
+		if !message.Code.IsResponse() {
+			return nil
+		}
+		return coap.exchangesByToken[string(message.Token)]
+	}
+}
+
+// handleResponse : 受信したメッセージがリクエストへのレスポンスであれば処理する
+// 処理した場合はtrueを返す
+// Separate ResponseがCONの場合は空のACKを返す(RFC7252 5.2.2 Separate参照)
+func (coap *Coap) handleResponse(message *CoapMessage) bool {
+	exchange := coap.findExchange(message)
+	if exchange == nil {
+		return false
+	}
+	coap.stopRetransmission(exchange.messageID)
+	if message.Type == CoapTypeAcknowledgement && message.Code == CoapCodeEmpty {
+		// Separate Responseを待つ
+		return true
+	}
+	if message.Type == CoapTypeConfirmable && !coap.stream {
+		coap.sendEmptyAck(message)
+	}
+	select {
+	case exchange.resultCh <- &CoapResult{Message: message, Code: message.Code}:
+	default:
+		// 既にレスポンスを受信している
+	}
+	return true
+}
+
+// sendEmptyAck : 空のACKを送信する
+// リクエストが再送された場合に備えて送信したACKを記録する
+func (coap *Coap) sendEmptyAck(message *CoapMessage) {
+	ack := &CoapMessage{
+		Version:   1,
+		Type:      CoapTypeAcknowledgement,
+		Code:      CoapCodeEmpty,
+		MessageID: message.MessageID}
+	raw := ack.ConvertToBytes()
+	coap.storeResponse(message.MessageID, raw)
+	coap.write(raw)
+}
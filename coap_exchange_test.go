@@ -0,0 +1,180 @@
+package inventoryd
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// coapTestExchange : SendRequestを別のgoroutineで実行し、結果を受け取る
+type coapTestExchange struct {
+	resultCh chan *CoapResult
+	errCh    chan error
+}
+
+// startCoapTestExchange : GETのリクエストを送信し、相手が受信したリクエストを返す
+func startCoapTestExchange(ctx context.Context, coap *Coap, peer *coapTestPeer) (*coapTestExchange, *CoapMessage) {
+	exchange := &coapTestExchange{resultCh: make(chan *CoapResult, 1), errCh: make(chan error, 1)}
+	go func() {
+		result, err := coap.SendRequest(ctx, CoapCodeGet, []CoapOption{}, []byte{})
+		exchange.resultCh <- result
+		exchange.errCh <- err
+	}()
+	return exchange, peer.read()
+}
+
+// wait : SendRequestの結果を返す
+func (exchange *coapTestExchange) wait(t *testing.T) (*CoapResult, error) {
+	t.Helper()
+	select {
+	case result := <-exchange.resultCh:
+		return result, <-exchange.errCh
+	case <-time.After(time.Second):
+		t.Fatal("SendRequestが戻りません")
+		return nil, nil
+	}
+}
+
+// expectPending : SendRequestがまだレスポンスを待っていることを確認する
+func (exchange *coapTestExchange) expectPending(t *testing.T) {
+	t.Helper()
+	select {
+	case result := <-exchange.resultCh:
+		t.Fatalf("対応しないメッセージでSendRequestが戻りました %v", result)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// coapTestResponse : リクエストに対するレスポンスを生成する
+func coapTestResponse(request *CoapMessage, messageType byte, messageID uint16, code CoapCode, payload string) *CoapMessage {
+	return &CoapMessage{
+		Version:     1,
+		Type:        messageType,
+		Code:        code,
+		MessageID:   messageID,
+		TokenLength: request.TokenLength,
+		Token:       request.Token,
+		Options:     []CoapOption{},
+		Payload:     []byte(payload)}
+}
+
+// TestCoapExchangePiggybacked : ACKに含まれるレスポンスをメッセージIDとトークンで対応付けることを確認する
+// RFC7252 5.2.1 Piggybacked参照
+func TestCoapExchangePiggybacked(t *testing.T) {
+	coap, peer := newCoapTestPeer(t, func(*CoapMessage) {})
+	exchange, request := startCoapTestExchange(context.Background(), coap, peer)
+	if request.Type != CoapTypeConfirmable || request.TokenLength != coapDefaultTokenLength {
+		t.Fatalf("リクエストが不正です type=%d token=%x", request.Type, request.Token)
+	}
+	peer.write(coapTestResponse(request, CoapTypeAcknowledgement, request.MessageID, CoapCodeContent, "piggybacked"))
+	result, err := exchange.wait(t)
+	if err != nil || result.Code != CoapCodeContent || string(result.Message.Payload) != "piggybacked" {
+		t.Fatalf("レスポンスが不正です err=%v", err)
+	}
+	coap.mutex.Lock()
+	remaining := len(coap.exchanges) + len(coap.exchangesByToken) + len(coap.retransmissions)
+	coap.mutex.Unlock()
+	if remaining != 0 {
+		t.Fatal("レスポンスを受信したリクエストの記録が残っています")
+	}
+}
+
+// TestCoapExchangeSeparate : 空のACKの後にトークンが同じ別のメッセージで届くレスポンスを受け取り、
+// CONのレスポンスには空のACKを返すことを確認する
+// RFC7252 5.2.2 Separate参照
+func TestCoapExchangeSeparate(t *testing.T) {
+	for _, messageType := range []byte{CoapTypeConfirmable, CoapTypeNonConfirmable} {
+		coap, peer := newCoapTestPeer(t, func(*CoapMessage) {})
+		exchange, request := startCoapTestExchange(context.Background(), coap, peer)
+		peer.write(&CoapMessage{Version: 1, Type: CoapTypeAcknowledgement, Code: CoapCodeEmpty, MessageID: request.MessageID, Options: []CoapOption{}})
+		exchange.expectPending(t)
+
+		separateID := request.MessageID + 100
+		peer.write(coapTestResponse(request, messageType, separateID, CoapCodeContent, "separate"))
+		if messageType == CoapTypeConfirmable {
+			ack := peer.read()
+			if ack.Type != CoapTypeAcknowledgement || ack.Code != CoapCodeEmpty || ack.MessageID != separateID {
+				t.Fatalf("CONのレスポンスへのACKが不正です type=%d code=%d id=%d", ack.Type, ack.Code, ack.MessageID)
+			}
+		}
+		result, err := exchange.wait(t)
+		if err != nil || string(result.Message.Payload) != "separate" {
+			t.Fatalf("type=%d のSeparate Responseが不正です err=%v", messageType, err)
+		}
+		// 空のACKを受信した時点で再送は止まっている
+		peer.expectSilence(50 * time.Millisecond)
+	}
+}
+
+// TestCoapExchangeUnmatched : メッセージIDまたはトークンが一致しないACK / レスポンスは
+// 待っているリクエストに対応付けず、RecvHandlerに渡すことを確認する
+func TestCoapExchangeUnmatched(t *testing.T) {
+	receivedCh := make(chan *CoapMessage, 4)
+	coap, peer := newCoapTestPeer(t, func(message *CoapMessage) { receivedCh <- message })
+	exchange, request := startCoapTestExchange(context.Background(), coap, peer)
+
+	otherToken := *request
+	otherToken.Token = []byte{request.Token[0] ^ 0xff}
+	otherToken.TokenLength = 1
+	cases := []struct {
+		name    string
+		message *CoapMessage
+	}{
+		{"メッセージIDが異なるACK", coapTestResponse(request, CoapTypeAcknowledgement, request.MessageID+1, CoapCodeContent, "")},
+		{"メッセージIDが異なる空のACK", &CoapMessage{Version: 1, Type: CoapTypeAcknowledgement, Code: CoapCodeEmpty, MessageID: request.MessageID + 2, Options: []CoapOption{}}},
+		{"トークンが異なるPiggybacked Response", coapTestResponse(&otherToken, CoapTypeAcknowledgement, request.MessageID, CoapCodeContent, "")},
+		{"トークンが異なるSeparate Response", coapTestResponse(&otherToken, CoapTypeNonConfirmable, request.MessageID+3, CoapCodeContent, "")},
+		{"メッセージIDが異なるReset", &CoapMessage{Version: 1, Type: CoapTypeReset, Code: CoapCodeEmpty, MessageID: request.MessageID + 4, Options: []CoapOption{}}},
+	}
+	for _, c := range cases {
+		peer.write(c.message)
+		select {
+		case message := <-receivedCh:
+			if message.MessageID != c.message.MessageID {
+				t.Fatalf("%s と異なるメッセージがRecvHandlerに渡されました", c.name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s がRecvHandlerに渡されません", c.name)
+		}
+		exchange.expectPending(t)
+	}
+
+	peer.write(coapTestResponse(request, CoapTypeAcknowledgement, request.MessageID, CoapCodeContent, "matched"))
+	if result, err := exchange.wait(t); err != nil || string(result.Message.Payload) != "matched" {
+		t.Fatalf("対応するレスポンスを受け取れません err=%v", err)
+	}
+
+	// レスポンスを受け取った後に届いた同じレスポンスは、もう待っているリクエストが無いためRecvHandlerに渡す
+	peer.write(coapTestResponse(request, CoapTypeAcknowledgement, request.MessageID, CoapCodeContent, "late"))
+	select {
+	case message := <-receivedCh:
+		if string(message.Payload) != "late" {
+			t.Fatal("遅れて届いたレスポンスが不正です")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("遅れて届いたレスポンスがRecvHandlerに渡されません")
+	}
+}
+
+// TestCoapExchangeReset : Resetを受信したリクエストと、ctxが終了したリクエストがエラーになることを確認する
+func TestCoapExchangeReset(t *testing.T) {
+	coap, peer := newCoapTestPeer(t, func(*CoapMessage) {})
+	exchange, request := startCoapTestExchange(context.Background(), coap, peer)
+	peer.write(&CoapMessage{Version: 1, Type: CoapTypeReset, Code: CoapCodeEmpty, MessageID: request.MessageID, Options: []CoapOption{}})
+	if _, err := exchange.wait(t); err == nil {
+		t.Fatal("Resetされたリクエストがエラーになりません")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	exchange, _ = startCoapTestExchange(ctx, coap, peer)
+	cancel()
+	if _, err := exchange.wait(t); err != context.Canceled {
+		t.Fatalf("ctxが終了したリクエストのエラーが不正です %v", err)
+	}
+	coap.mutex.Lock()
+	remaining := len(coap.exchanges) + len(coap.exchangesByToken) + len(coap.retransmissions)
+	coap.mutex.Unlock()
+	if remaining != 0 {
+		t.Fatal("終了したリクエストの記録が残っています")
+	}
+}
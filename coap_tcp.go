@@ -0,0 +1,189 @@
+package inventoryd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// CoAP over TCP / TLS
+// TCPではメッセージの信頼性はTCPが保証するため、Type / Message IDは無く、
+// レスポンスはトークンのみで対応付ける(ACK、再送、重複検出は行わない)
+// RFC8323 3. CoAP over TCP参照
+//
+//	 0                   1                   2                   3
+//	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|  Len  |  TKL  | Extended Length (if any, as chosen by Len) ...
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|      Code     | Token (if any, TKL bytes) ...
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|   Options (if any) ...
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|1 1 1 1 1 1 1 1|    Payload (if any) ...
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+// Lenはオプション以降の長さで、13 / 14 / 15の場合はExtended Lengthが1 / 2 / 4byte続く
+const (
+	coapTCPLengthByte  = 13
+	coapTCPLengthWord  = 14
+	coapTCPLengthDWord = 15
+	coapTCPByteBase    = 13
+	coapTCPWordBase    = 269
+	coapTCPDWordBase   = 65805
+)
+
+// Signaling Code
+// RFC8323 5. Signaling参照
+const (
+	CoapCodeCSM     CoapCode = 225 // 7.01 Capabilities and Settings Message
+	CoapCodePing    CoapCode = 226 // 7.02 Ping
+	CoapCodePong    CoapCode = 227 // 7.03 Pong
+	CoapCodeRelease CoapCode = 228 // 7.04 Release
+	CoapCodeAbort   CoapCode = 229 // 7.05 Abort
+)
+
+// CSM Option
+// RFC8323 5.3 Capabilities and Settings Messages (CSMs)参照
+const (
+	coapOptionNoMaxMessageSize    = 2
+	coapOptionNoBlockWiseTransfer = 4
+)
+
+// coapTCPMaxMessageSize : 受信するメッセージの最大長
+// CSMで相手に通知し、これを超えるメッセージを受信した場合は接続を閉じる
+const coapTCPMaxMessageSize uint32 = 16384
+
+// InitializeTCP : CoAP over TCP / TLSとしてCoap構造体を初期化する
+// 接続後に最初にCSMを送信する
+func (coap *Coap) InitializeTCP(conn net.Conn, recvHandler func(*CoapMessage)) {
+	coap.stream = true
+	coap.Initialize(conn, recvHandler)
+	coap.sendSignal(CoapCodeCSM, []byte{}, []CoapOption{
+		CoapOption{coapOptionNoMaxMessageSize, coapUintOptionValue(coapTCPMaxMessageSize)},
+		CoapOption{coapOptionNoBlockWiseTransfer, []byte{}}})
+}
+
+// readTCPMessage : メッセージを1つ読み出す
+// 戻り値はLen / TKL / Extended Lengthを除いた、Code以降のデータ
+func (coap *Coap) readTCPMessage() (byte, []byte, error) {
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(coap.Connection, header); err != nil {
+		return 0, nil, err
+	}
+	length := (uint32)(header[0] >> 4)
+	tokenLength := header[0] & 0x0F
+	var extendedLength int
+	var base uint32
+	switch length {
+	case coapTCPLengthByte:
+		extendedLength, base = 1, coapTCPByteBase
+	case coapTCPLengthWord:
+		extendedLength, base = 2, coapTCPWordBase
+	case coapTCPLengthDWord:
+		extendedLength, base = 4, coapTCPDWordBase
+	}
+	if extendedLength > 0 {
+		extended := make([]byte, 4)
+		if _, err := io.ReadFull(coap.Connection, extended[(4-extendedLength):]); err != nil {
+			return 0, nil, err
+		}
+		extendedValue := binary.BigEndian.Uint32(extended)
+		if extendedValue > coapTCPMaxMessageSize {
+			return 0, nil, errors.New("CoAPメッセージが最大長を超えています")
+		}
+		length = extendedValue + base
+	}
+	if length > coapTCPMaxMessageSize {
+		return 0, nil, errors.New("CoAPメッセージが最大長を超えています")
+	}
+	raw := make([]byte, 1+(int)(tokenLength)+(int)(length))
+	if _, err := io.ReadFull(coap.Connection, raw); err != nil {
+		return 0, nil, err
+	}
+	return tokenLength, raw, nil
+}
+
+// ParseTCPMessage : readTCPMessageで読み出したデータを解析してCoapMessageを生成する
+// Typeは全てCONとして扱う
+// 形式が不正な場合はエラーを返す
+func (coap *Coap) ParseTCPMessage(tokenLength byte, raw []byte) (*CoapMessage, error) {
+	if len(raw) < 1 {
+		return nil, errors.New("CoAPメッセージのコードがありません")
+	}
+	ret := &CoapMessage{
+		Version:     1,
+		Type:        CoapTypeConfirmable,
+		TokenLength: tokenLength,
+		Code:        (CoapCode)(raw[0])}
+	if err := ret.parseTokenAndBody(raw[1:]); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// ConvertToTCPBytes : MessageをCoAP over TCPの[]byteに変換する
+func (message *CoapMessage) ConvertToTCPBytes() []byte {
+	body := message.BuildOptions()
+	if len(message.Payload) > 0 {
+		body = append(body, 0xFF)
+		body = append(body, message.Payload...)
+	}
+
+	length := (uint32)(len(body))
+	ret := []byte{0}
+	switch {
+	case length < coapTCPByteBase:
+		ret[0] = (byte)(length << 4)
+	case length < coapTCPWordBase:
+		ret[0] = coapTCPLengthByte << 4
+		ret = append(ret, (byte)(length-coapTCPByteBase))
+	case length < coapTCPDWordBase:
+		ret[0] = coapTCPLengthWord << 4
+		extended := make([]byte, 2)
+		binary.BigEndian.PutUint16(extended, (uint16)(length-coapTCPWordBase))
+		ret = append(ret, extended...)
+	default:
+		ret[0] = coapTCPLengthDWord << 4
+		extended := make([]byte, 4)
+		binary.BigEndian.PutUint32(extended, length-coapTCPDWordBase)
+		ret = append(ret, extended...)
+	}
+	ret[0] += (byte)(len(message.Token))
+	ret = append(ret, (byte)(message.Code))
+	ret = append(ret, message.Token...)
+	return append(ret, body...)
+}
+
+// handleSignal : Signalingメッセージを処理する
+// Pingには同じトークンでPongを返し、Release / Abortを受信したら受信動作を止める
+// 処理した場合はtrueを返す
+// RFC8323 5. Signaling参照
+func (coap *Coap) handleSignal(message *CoapMessage) (bool, error) {
+	if message == nil || !coap.stream || message.Code>>5 != 7 {
+		return false, nil
+	}
+	switch message.Code {
+	case CoapCodePing:
+		coap.sendSignal(CoapCodePong, message.Token, []CoapOption{})
+	case CoapCodeRelease:
+		return true, errors.New("サーバーから接続の解放を要求されました")
+	case CoapCodeAbort:
+		return true, errors.New("サーバーから接続が中止されました: " + string(message.Payload))
+	default:
+		// CSM / Pongは処理の必要なし
+	}
+	return true, nil
+}
+
+// sendSignal : Signalingメッセージを送信する
+func (coap *Coap) sendSignal(code CoapCode, token []byte, options []CoapOption) {
+	message := &CoapMessage{
+		Version:     1,
+		Code:        code,
+		Token:       token,
+		TokenLength: (byte)(len(token)),
+		Options:     options}
+	coap.write(message.ConvertToTCPBytes())
+}
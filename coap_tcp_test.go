@@ -0,0 +1,207 @@
+package inventoryd
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// coapTestTCPServer : CoAP over TCPのサーバーの代わりに、受け付けた接続でメッセージを送受信する
+type coapTestTCPServer struct {
+	t    *testing.T
+	conn net.Conn
+	coap *Coap // 受信にreadTCPMessage / ParseTCPMessageを使うためのもの
+}
+
+// newCoapTestTCPPair : 127.0.0.1で待ち受けたサーバーにTCPで接続し、
+// InitializeTCPで初期化したクライアントとサーバーを返す
+func newCoapTestTCPPair(t *testing.T, recvHandler func(*CoapMessage)) (*Coap, *coapTestTCPServer) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	acceptCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(acceptCh)
+			return
+		}
+		acceptCh <- conn
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Coap{}
+	client.InitializeTCP(conn, recvHandler)
+	serverConn, ok := <-acceptCh
+	if !ok {
+		t.Fatal("接続を受け付けられません")
+	}
+	t.Cleanup(func() {
+		serverConn.Close()
+		client.Close()
+	})
+	return client, &coapTestTCPServer{t: t, conn: serverConn, coap: &Coap{Connection: serverConn, stream: true}}
+}
+
+// read : メッセージを1つ受信する
+func (server *coapTestTCPServer) read() *CoapMessage {
+	server.t.Helper()
+	server.conn.SetReadDeadline(time.Now().Add(time.Second))
+	tokenLength, raw, err := server.coap.readTCPMessage()
+	if err != nil {
+		server.t.Fatal(err)
+	}
+	message, err := server.coap.ParseTCPMessage(tokenLength, raw)
+	if err != nil {
+		server.t.Fatal(err)
+	}
+	return message
+}
+
+// write : メッセージを送信する
+func (server *coapTestTCPServer) write(message *CoapMessage) {
+	server.t.Helper()
+	message.TokenLength = (byte)(len(message.Token))
+	if _, err := server.conn.Write(message.ConvertToTCPBytes()); err != nil {
+		server.t.Fatal(err)
+	}
+}
+
+// waitCoapTestTCPClosed : クライアントの受信動作が止まるのを待ち、その原因のエラーを返す
+func waitCoapTestTCPClosed(t *testing.T, client *Coap) error {
+	t.Helper()
+	select {
+	case <-client.recvErrorCh:
+		return client.Err()
+	case <-time.After(time.Second):
+		t.Fatal("受信動作が止まりません")
+	}
+	return nil
+}
+
+// TestCoapTCPCapabilities : 接続後に最初にCSMを送信し、サーバーのCSMには応答しないことを確認する
+// RFC8323 5.3 Capabilities and Settings Messages (CSMs)参照
+func TestCoapTCPCapabilities(t *testing.T) {
+	client, server := newCoapTestTCPPair(t, func(*CoapMessage) {})
+	csm := server.read()
+	if csm.Code != CoapCodeCSM {
+		t.Fatalf("最初のメッセージがCSMではありません %s", csm.Code)
+	}
+	maxMessageSize := csm.findOption(coapOptionNoMaxMessageSize)
+	if maxMessageSize == nil || parseCoapUintOptionValue(maxMessageSize.Value) != coapTCPMaxMessageSize {
+		t.Fatal("CSMのMax-Message-Sizeが不正です")
+	}
+	if csm.findOption(coapOptionNoBlockWiseTransfer) == nil {
+		t.Fatal("CSMにBlock-Wise-Transferがありません")
+	}
+
+	server.write(&CoapMessage{Code: CoapCodeCSM, Options: []CoapOption{
+		CoapOption{coapOptionNoMaxMessageSize, coapUintOptionValue(1152)}}})
+	// CSMの後のPingへのPongが最初に届けば、CSMには何も返していない
+	server.write(&CoapMessage{Code: CoapCodePing, Token: []byte{0x01}})
+	if pong := server.read(); pong.Code != CoapCodePong {
+		t.Fatalf("CSMに応答しています %s", pong.Code)
+	}
+	if err := client.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCoapTCPLengthBoundaries : Lenの境界値(13 / 269 / 65805)で長さを正しく符号化し、送受信できることを確認する
+// RFC8323 3.2 Message Format参照
+func TestCoapTCPLengthBoundaries(t *testing.T) {
+	// 符号化のみ(65804 / 65805は受信できる最大長を超える)
+	for _, c := range []struct {
+		length uint32 // Options + 0xFF + Payloadの長さ
+		header []byte // 先頭バイトとExtended Length
+	}{
+		{12, []byte{0xC0}},
+		{13, []byte{0xD0, 0x00}},
+		{268, []byte{0xD0, 0xFF}},
+		{269, []byte{0xE0, 0x00, 0x00}},
+		{65804, []byte{0xE0, 0xFF, 0xFF}},
+		{65805, []byte{0xF0, 0x00, 0x00, 0x00, 0x00}},
+		{65806, []byte{0xF0, 0x00, 0x00, 0x00, 0x01}},
+	} {
+		message := &CoapMessage{Code: CoapCodeContent, Payload: make([]byte, c.length-1)}
+		raw := message.ConvertToTCPBytes()
+		if !bytes.Equal(raw[:len(c.header)], c.header) || len(raw) != len(c.header)+1+(int)(c.length) {
+			t.Fatalf("length=%d の符号化が不正です %x", c.length, raw[:len(c.header)])
+		}
+	}
+
+	// 受信できる長さの境界値は、ハンドラへの受け渡しとレスポンスの送信を確認する
+	receivedCh := make(chan *CoapMessage, 1)
+	var client *Coap
+	client, server := newCoapTestTCPPair(t, func(message *CoapMessage) {
+		client.SendResponse(message, CoapCodeContent, []CoapOption{}, message.Payload)
+		receivedCh <- message
+	})
+	server.read() // CSM
+	for _, length := range []int{12, 13, 14, 268, 269, 270} {
+		payload := bytes.Repeat([]byte{(byte)(length)}, length-1)
+		server.write(&CoapMessage{Code: CoapCodePost, Token: []byte{(byte)(length)}, Payload: payload})
+		select {
+		case received := <-receivedCh:
+			if !bytes.Equal(received.Payload, payload) {
+				t.Fatalf("length=%d のPayloadが一致しません", length)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("length=%d を受信できません", length)
+		}
+		response := server.read()
+		if response.Code != CoapCodeContent || !bytes.Equal(response.Token, []byte{(byte)(length)}) ||
+			!bytes.Equal(response.Payload, payload) {
+			t.Fatalf("length=%d のレスポンスが不正です", length)
+		}
+	}
+
+	// 最大長を超えるメッセージを受信したら受信動作を止める
+	server.write(&CoapMessage{Code: CoapCodePost, Payload: make([]byte, coapTCPDWordBase)})
+	if err := waitCoapTestTCPClosed(t, client); err == nil {
+		t.Fatal("最大長を超えるメッセージがエラーになりません")
+	}
+}
+
+// TestCoapTCPPing : Pingに同じトークンでPongを返すことを確認する
+// RFC8323 5.4 Ping and Pong Messages参照
+func TestCoapTCPPing(t *testing.T) {
+	client, server := newCoapTestTCPPair(t, func(*CoapMessage) {})
+	server.read() // CSM
+	for _, token := range [][]byte{{}, {0x01}, {0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}} {
+		server.write(&CoapMessage{Code: CoapCodePing, Token: token})
+		pong := server.read()
+		if pong.Code != CoapCodePong || !bytes.Equal(pong.Token, token) {
+			t.Fatalf("Pongが不正です code=%s token=%x", pong.Code, pong.Token)
+		}
+	}
+	if err := client.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCoapTCPReleaseAbort : Release / Abortを受信したら受信動作を止めることを確認する
+// RFC8323 5.5 Release Messages / 5.6 Abort Messages参照
+func TestCoapTCPReleaseAbort(t *testing.T) {
+	client, server := newCoapTestTCPPair(t, func(*CoapMessage) {})
+	server.read() // CSM
+	server.write(&CoapMessage{Code: CoapCodeRelease})
+	if err := waitCoapTestTCPClosed(t, client); err == nil {
+		t.Fatal("Releaseでエラーになりません")
+	}
+
+	client, server = newCoapTestTCPPair(t, func(*CoapMessage) {})
+	server.read() // CSM
+	server.write(&CoapMessage{Code: CoapCodeAbort, Payload: []byte("shutdown")})
+	err := waitCoapTestTCPClosed(t, client)
+	if err == nil || !strings.Contains(err.Error(), "shutdown") {
+		t.Fatalf("Abortの診断メッセージがエラーに含まれません %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package inventoryd
+
+import (
+	"bytes"
+	"testing"
+)
+
+// coapOptionBoundaries : Option Delta / Option Lengthの拡張部の境界値
+// RFC7252 3.1 Option Format参照(13未満は4bit、13-268は1byte、269以上は2byteの拡張部)
+var coapOptionBoundaries = []uint{0, 1, 12, 13, 14, 268, 269, 270, 65804}
+
+// coapOptionNibble : 境界値に対応する4bitの値
+func coapOptionNibble(value uint) byte {
+	if value < coapOptByteBase {
+		return (byte)(value)
+	} else if value < coapOptWordBase {
+		return coapOptCodeByte
+	}
+	return coapOptCodeWord
+}
+
+// assertCoapMessageEqual : 2つのメッセージが同じ内容かを確認する
+func assertCoapMessageEqual(t *testing.T, expected, actual *CoapMessage) {
+	t.Helper()
+	if expected.Version != actual.Version || expected.Type != actual.Type || expected.Code != actual.Code ||
+		expected.MessageID != actual.MessageID {
+		t.Fatalf("ヘッダが一致しません expected=%+v actual=%+v", expected, actual)
+	}
+	if !bytes.Equal(expected.Token, actual.Token) {
+		t.Fatalf("トークンが一致しません expected=%x actual=%x", expected.Token, actual.Token)
+	}
+	if len(expected.Options) != len(actual.Options) {
+		t.Fatalf("オプションの数が一致しません expected=%d actual=%d", len(expected.Options), len(actual.Options))
+	}
+	for i := range expected.Options {
+		if expected.Options[i].No != actual.Options[i].No || !bytes.Equal(expected.Options[i].Value, actual.Options[i].Value) {
+			t.Fatalf("%d番目のオプションが一致しません expected=%d actual=%d", i, expected.Options[i].No, actual.Options[i].No)
+		}
+	}
+	if !bytes.Equal(expected.Payload, actual.Payload) {
+		t.Fatalf("ペイロードが一致しません expected=%x actual=%x", expected.Payload, actual.Payload)
+	}
+}
+
+// TestCoapOptionBoundaries : Option Delta / Option Lengthの境界値で生成と解析が一致することを確認する
+func TestCoapOptionBoundaries(t *testing.T) {
+	coap := &Coap{}
+	for _, delta := range coapOptionBoundaries {
+		for _, length := range coapOptionBoundaries {
+			option := CoapOption{No: delta, Value: bytes.Repeat([]byte{0xAB}, (int)(length))}
+			raw := option.BuildOption(0)
+			if raw[0]>>4 != coapOptionNibble(delta) || raw[0]&0x0F != coapOptionNibble(length) {
+				t.Fatalf("delta=%d length=%d の4bitの値が不正です %02x", delta, length, raw[0])
+			}
+
+			parsed := &CoapOption{}
+			parsedLength, err := parsed.ParseOption(raw, 0)
+			if err != nil {
+				t.Fatalf("delta=%d length=%d %s", delta, length, err)
+			}
+			if parsedLength != len(raw) || parsed.No != delta || !bytes.Equal(parsed.Value, option.Value) {
+				t.Fatalf("delta=%d length=%d の解析結果が一致しません", delta, length)
+			}
+
+			message := &CoapMessage{
+				Version:   1,
+				Type:      CoapTypeConfirmable,
+				Code:      CoapCodePost,
+				MessageID: 0x1234,
+				Token:     []byte{1, 2, 3, 4},
+				Options:   []CoapOption{CoapOption{coapOptionNoURIPath, []byte("rd")}, option},
+				Payload:   []byte("payload")}
+			// ConvertToBytesでオプションは番号順に並び替えられる
+			actual, err := coap.ParseMessage(message.ConvertToBytes())
+			if err != nil {
+				t.Fatalf("delta=%d length=%d %s", delta, length, err)
+			}
+			assertCoapMessageEqual(t, message, actual)
+		}
+	}
+}
+
+// TestCoapOptionExtendedTruncated : 拡張部や値が不足しているオプションがエラーになることを確認する
+func TestCoapOptionExtendedTruncated(t *testing.T) {
+	for _, raw := range [][]byte{
+		{},
+		{0xD0},       // Deltaの1byteの拡張部がない
+		{0xE0, 0x00}, // Deltaの2byteの拡張部が不足
+		{0x0D},       // Lengthの1byteの拡張部がない
+		{0x02, 0x00}, // 値が不足
+		{0xF0},       // Deltaに予約済みの値
+		{0x0F},       // Lengthに予約済みの値
+	} {
+		option := &CoapOption{}
+		if _, err := option.ParseOption(raw, 0); err == nil {
+			t.Fatalf("%x がエラーになりません", raw)
+		}
+	}
+}
+
+// FuzzParseMessage : 任意のデータの解析でpanicしないこと、
+// 解析できたメッセージは生成し直して再度解析しても同じ内容になることを確認する
+func FuzzParseMessage(f *testing.F) {
+	f.Add([]byte{0x40, 0x00, 0x12, 0x34})
+	f.Add([]byte{0x44, 0x01, 0x12, 0x34, 0x01, 0x02, 0x03, 0x04, 0xB2, 'r', 'd', 0xFF, 'x'})
+	f.Add([]byte{0x42, 0x45, 0x00, 0x01, 0xAA, 0xBB, 0xD1, 0x00, 0x2A, 0xE1, 0x00, 0x00, 0x01})
+	f.Add([]byte{0x50, 0x45, 0x00, 0x01, 0x60, 0x11, 0x2D, 0xFF})
+	coap := &Coap{}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		message, err := coap.ParseMessage(raw)
+		if err != nil {
+			return
+		}
+		actual, err := coap.ParseMessage(message.ConvertToBytes())
+		if err != nil {
+			t.Fatalf("生成し直したメッセージを解析できません %s", err)
+		}
+		assertCoapMessageEqual(t, message, actual)
+	})
+}
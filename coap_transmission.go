@@ -0,0 +1,220 @@
+package inventoryd
+
+import (
+	"math/rand"
+	"time"
+)
+
+// 送信パラメータ
+// RFC7252 4.8 Transmission Parameters / 4.8.2 Time Values Derived from Transmission Parameters参照
+// テストで再送の間隔と記録の保持期間を短縮するため変数とする
+var (
+	coapAckTimeout       time.Duration = 2 * time.Second
+	coapAckRandomFactor  float64       = 1.5
+	coapMaxRetransmit    int           = 4
+	coapExchangeLifetime time.Duration = 247 * time.Second
+	coapNonLifetime      time.Duration = 145 * time.Second
+)
+
+// coapRetransmission : ACKを待っているCONメッセージ
+// RFC7252 4.2 Messages Transmitted Reliably参照
+// failedはMAX_RETRANSMIT回再送してもACKが無かった場合に呼び出す(nilの場合は何もしない)
+type coapRetransmission struct {
+	raw     []byte
+	count   int
+	timeout time.Duration
+	timer   *time.Timer
+	failed  func()
+}
+
+// coapReceivedMessage : 受信したメッセージの記録(重複検出用)
+// RFC7252 4.5 Message Deduplication参照
+type coapReceivedMessage struct {
+	messageID uint16
+	response  []byte // 送信したレスポンス(未送信の場合はnil)
+	expire    time.Time
+}
+
+// coapReceivedQueue : 保持期間が同じ受信したメッセージの記録を受信順に並べたもの
+// 保持期間が同じため受信順は期限順となり、期限切れの記録は先頭から取り除ける
+type coapReceivedQueue []*coapReceivedMessage
+
+// prune : 期限切れの記録を先頭から取り除き、receivedMessagesからも削除する
+// 同じメッセージIDが期限切れの後に再び記録されている場合は、新しい記録を残す
+func (queue *coapReceivedQueue) prune(receivedMessages map[uint16]*coapReceivedMessage, now time.Time) {
+	for len(*queue) > 0 && now.After((*queue)[0].expire) {
+		received := (*queue)[0]
+		(*queue)[0] = nil
+		*queue = (*queue)[1:]
+		if receivedMessages[received.messageID] == received {
+			delete(receivedMessages, received.messageID)
+		}
+	}
+}
+
+// write : メッセージを送信する
+// 再送タイマーと受信処理から同時に送信されるため排他する
+func (coap *Coap) write(raw []byte) {
+	coap.writeMutex.Lock()
+	defer coap.writeMutex.Unlock()
+	coap.Connection.Write(raw)
+}
+
+// startRetransmission : CONメッセージの再送を開始する
+// 初回のタイムアウトはACK_TIMEOUTからACK_TIMEOUT * ACK_RANDOM_FACTORの間のランダムな値とし、
+// 再送の度に2倍とする。MAX_RETRANSMIT回再送してもACKが無ければ諦める
+func (coap *Coap) startRetransmission(messageID uint16, raw []byte, failed func()) {
+	coap.mutex.Lock()
+	defer coap.mutex.Unlock()
+	timeout := coapAckTimeout + (time.Duration)(rand.Float64()*(coapAckRandomFactor-1)*(float64)(coapAckTimeout))
+	retransmission := &coapRetransmission{raw: raw, timeout: timeout, failed: failed}
+	retransmission.timer = time.AfterFunc(timeout, func() { coap.retransmit(messageID) })
+	coap.retransmissions[messageID] = retransmission
+}
+
+// retransmit : タイムアウトしたCONメッセージを再送する
+func (coap *Coap) retransmit(messageID uint16) {
+	coap.mutex.Lock()
+	retransmission, exist := coap.retransmissions[messageID]
+	if !exist {
+		coap.mutex.Unlock()
+		return
+	}
+	if retransmission.count >= coapMaxRetransmit {
+		delete(coap.retransmissions, messageID)
+		coap.mutex.Unlock()
+		if retransmission.failed != nil {
+			retransmission.failed()
+		}
+		return
+	}
+	retransmission.count++
+	retransmission.timeout *= 2
+	retransmission.timer.Reset(retransmission.timeout)
+	coap.mutex.Unlock()
+	coap.write(retransmission.raw)
+}
+
+// stopRetransmission : ACKまたはRSTを受信したCONメッセージの再送を止める
+func (coap *Coap) stopRetransmission(messageID uint16) {
+	coap.mutex.Lock()
+	defer coap.mutex.Unlock()
+	if retransmission, exist := coap.retransmissions[messageID]; exist {
+		retransmission.timer.Stop()
+		delete(coap.retransmissions, messageID)
+	}
+}
+
+// stopAllRetransmissions : 全ての再送を止める
+// 接続を閉じる際に使用し、ACKを待っていたメッセージは再送を諦めたものとしてfailedを呼び出す
+func (coap *Coap) stopAllRetransmissions() {
+	coap.mutex.Lock()
+	failures := []func(){}
+	for messageID, retransmission := range coap.retransmissions {
+		retransmission.timer.Stop()
+		delete(coap.retransmissions, messageID)
+		if retransmission.failed != nil {
+			failures = append(failures, retransmission.failed)
+		}
+	}
+	coap.mutex.Unlock()
+	for _, failed := range failures {
+		failed()
+	}
+}
+
+// sendConfirmable : 応答を待たないCONメッセージを送信し、届いたかどうかをdeliveredに通知する
+// ACKを受信した場合はtrue、Resetを受信した場合およびMAX_RETRANSMIT回再送してもACKが無い場合はfalseとする
+// TCPではACKが無いため、送信した時点で届いたものとする
+func (coap *Coap) sendConfirmable(message *CoapMessage, delivered func(bool)) {
+	raw := coap.encode(message)
+	if coap.stream {
+		coap.write(raw)
+		delivered(true)
+		return
+	}
+	coap.mutex.Lock()
+	coap.deliveries[message.MessageID] = delivered
+	coap.mutex.Unlock()
+	coap.startRetransmission(message.MessageID, raw, func() {
+		if delivered := coap.removeDelivery(message.MessageID); delivered != nil {
+			delivered(false)
+		}
+	})
+	coap.write(raw)
+}
+
+// handleDelivery : sendConfirmableで送信したメッセージへのACK / Resetであれば処理する
+// 処理した場合はtrueを返す
+func (coap *Coap) handleDelivery(message *CoapMessage) bool {
+	if message.Type != CoapTypeAcknowledgement && message.Type != CoapTypeReset {
+		return false
+	}
+	delivered := coap.removeDelivery(message.MessageID)
+	if delivered == nil {
+		return false
+	}
+	coap.stopRetransmission(message.MessageID)
+	delivered(message.Type == CoapTypeAcknowledgement)
+	return true
+}
+
+// removeDelivery : 届いたかどうかを待っているメッセージの登録を削除し、通知先を返す
+// 登録されていない場合はnilを返す
+func (coap *Coap) removeDelivery(messageID uint16) func(bool) {
+	coap.mutex.Lock()
+	defer coap.mutex.Unlock()
+	delivered, exist := coap.deliveries[messageID]
+	if !exist {
+		return nil
+	}
+	delete(coap.deliveries, messageID)
+	return delivered
+}
+
+// isDuplicate : 受信済みのメッセージ(相手の再送)かを判定する
+// 重複したCONメッセージに対して既にレスポンスを送信していれば、同じレスポンスを再送する
+// 記録はCONの場合はEXCHANGE_LIFETIME、NONの場合はNON_LIFETIMEの間保持する
+// 期限切れの記録はCON / NONそれぞれのキューの先頭から取り除くため、記録の数によらず処理量は一定となる
+func (coap *Coap) isDuplicate(message *CoapMessage) bool {
+	if coap.stream {
+		// TCPでは重複は発生しない
+		return false
+	}
+	if message.Type != CoapTypeConfirmable && message.Type != CoapTypeNonConfirmable {
+		return false
+	}
+	coap.mutex.Lock()
+	now := time.Now()
+	coap.receivedConfirmables.prune(coap.receivedMessages, now)
+	coap.receivedNonConfirmables.prune(coap.receivedMessages, now)
+	received, exist := coap.receivedMessages[message.MessageID]
+	if !exist {
+		received = &coapReceivedMessage{messageID: message.MessageID}
+		if message.Type == CoapTypeNonConfirmable {
+			received.expire = now.Add(coapNonLifetime)
+			coap.receivedNonConfirmables = append(coap.receivedNonConfirmables, received)
+		} else {
+			received.expire = now.Add(coapExchangeLifetime)
+			coap.receivedConfirmables = append(coap.receivedConfirmables, received)
+		}
+		coap.receivedMessages[message.MessageID] = received
+		coap.mutex.Unlock()
+		return false
+	}
+	response := received.response
+	coap.mutex.Unlock()
+	if response != nil {
+		coap.write(response)
+	}
+	return true
+}
+
+// storeResponse : 重複したメッセージに再送するため、送信したレスポンスを記録する
+func (coap *Coap) storeResponse(messageID uint16, raw []byte) {
+	coap.mutex.Lock()
+	defer coap.mutex.Unlock()
+	if received, exist := coap.receivedMessages[messageID]; exist {
+		received.response = raw
+	}
+}
@@ -0,0 +1,304 @@
+package inventoryd
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// coapTestPeer : net.Pipeで接続したCoapの相手
+// Coapが送信したデータグラムは全てpacketChに渡す(再送タイマーからの送信を止めないため常に読み続ける)
+type coapTestPeer struct {
+	t         *testing.T
+	conn      net.Conn
+	packetCh  chan []byte
+	messageID uint16 // requestで送信したメッセージID
+}
+
+// newCoapTestPeer : net.Pipeで接続したCoapとテスト用の相手を生成する
+func newCoapTestPeer(t *testing.T, recvHandler func(*CoapMessage)) (*Coap, *coapTestPeer) {
+	local, remote := net.Pipe()
+	peer := &coapTestPeer{t: t, conn: remote, packetCh: make(chan []byte, 16)}
+	go func() {
+		for {
+			buf := make([]byte, 1500)
+			readLen, err := remote.Read(buf)
+			if err != nil {
+				close(peer.packetCh)
+				return
+			}
+			peer.packetCh <- buf[:readLen]
+		}
+	}()
+	coap := &Coap{}
+	coap.Initialize(local, recvHandler)
+	t.Cleanup(func() {
+		remote.Close()
+		coap.Close()
+	})
+	return coap, peer
+}
+
+// write : メッセージを送信する
+func (peer *coapTestPeer) write(message *CoapMessage) {
+	peer.t.Helper()
+	if _, err := peer.conn.Write(message.ConvertToBytes()); err != nil {
+		peer.t.Fatal(err)
+	}
+}
+
+// read : Coapが送信したメッセージを受信する
+func (peer *coapTestPeer) read() *CoapMessage {
+	peer.t.Helper()
+	select {
+	case raw := <-peer.packetCh:
+		message, err := (&Coap{}).ParseMessage(raw)
+		if err != nil {
+			peer.t.Fatal(err)
+		}
+		return message
+	case <-time.After(time.Second):
+		peer.t.Fatal("メッセージを受信できません")
+		return nil
+	}
+}
+
+// expectSilence : waitの間Coapが何も送信しないことを確認する
+func (peer *coapTestPeer) expectSilence(wait time.Duration) {
+	peer.t.Helper()
+	select {
+	case raw := <-peer.packetCh:
+		peer.t.Fatalf("想定外のメッセージを受信しました %x", raw)
+	case <-time.After(wait):
+	}
+}
+
+// setCoapTestTransmissionParams : 再送の間隔を短縮し、テスト終了時に元に戻す
+func setCoapTestTransmissionParams(t *testing.T, ackTimeout time.Duration) {
+	savedAckTimeout, savedMaxRetransmit := coapAckTimeout, coapMaxRetransmit
+	coapAckTimeout, coapMaxRetransmit = ackTimeout, 4
+	t.Cleanup(func() {
+		coapAckTimeout, coapMaxRetransmit = savedAckTimeout, savedMaxRetransmit
+	})
+}
+
+// TestCoapRetransmission : ACKが無いCONのリクエストを間隔を倍にしながらMAX_RETRANSMIT回再送し、
+// 再送を諦めた時点でctxの終了を待たずにSendRequestがエラーを返すことを確認する
+// RFC7252 4.2 Messages Transmitted Reliably参照
+func TestCoapRetransmission(t *testing.T) {
+	setCoapTestTransmissionParams(t, 20*time.Millisecond)
+	coap, peer := newCoapTestPeer(t, func(*CoapMessage) {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errCh := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		_, err := coap.SendRequest(ctx, CoapCodeGet, []CoapOption{}, []byte{})
+		errCh <- err
+	}()
+
+	first := peer.read()
+	sent := []time.Time{time.Now()}
+	for i := 0; i < coapMaxRetransmit; i++ {
+		message := peer.read()
+		sent = append(sent, time.Now())
+		if message.MessageID != first.MessageID || !bytes.Equal(message.Token, first.Token) {
+			t.Fatalf("%d回目の再送が元のリクエストと異なります", i+1)
+		}
+	}
+	// 初回はACK_TIMEOUT以上、以降は前回の2倍の間隔で再送する(読み取りの遅れを考慮して下限のみ確認する)
+	minimum := coapAckTimeout
+	for i := 1; i < len(sent); i++ {
+		if interval := sent[i].Sub(sent[i-1]); interval < minimum/2 {
+			t.Fatalf("%d回目の再送の間隔が短すぎます %v", i, interval)
+		}
+		minimum *= 2
+	}
+
+	select {
+	case err := <-errCh:
+		if err == nil || err == context.DeadlineExceeded {
+			t.Fatalf("再送を諦めた際のエラーが不正です %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("再送を諦めた後もSendRequestが戻りません")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("SendRequestが戻るまでに時間がかかりすぎています %v", elapsed)
+	}
+	peer.expectSilence(4 * coapAckTimeout)
+
+	coap.mutex.Lock()
+	remaining := len(coap.retransmissions) + len(coap.exchanges) + len(coap.exchangesByToken)
+	coap.mutex.Unlock()
+	if remaining != 0 {
+		t.Fatal("再送を諦めたリクエストの記録が残っています")
+	}
+}
+
+// TestCoapRetransmissionAcknowledged : ACKを受信したCONのリクエストは再送しないことを確認する
+func TestCoapRetransmissionAcknowledged(t *testing.T) {
+	setCoapTestTransmissionParams(t, 20*time.Millisecond)
+	coap, peer := newCoapTestPeer(t, func(*CoapMessage) {})
+
+	resultCh := make(chan *CoapResult, 1)
+	go func() {
+		result, err := coap.SendRequest(context.Background(), CoapCodeGet, []CoapOption{}, []byte{})
+		if err != nil {
+			t.Error(err)
+		}
+		resultCh <- result
+	}()
+	request := peer.read()
+	// 1回再送させてからACKを返す
+	peer.read()
+	peer.write(&CoapMessage{
+		Version:     1,
+		Type:        CoapTypeAcknowledgement,
+		Code:        CoapCodeContent,
+		MessageID:   request.MessageID,
+		TokenLength: request.TokenLength,
+		Token:       request.Token,
+		Options:     []CoapOption{},
+		Payload:     []byte("ok")})
+	select {
+	case result := <-resultCh:
+		if result == nil || result.Code != CoapCodeContent || string(result.Message.Payload) != "ok" {
+			t.Fatal("レスポンスが不正です")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("レスポンスを受け取れません")
+	}
+	peer.expectSilence(8 * coapAckTimeout)
+}
+
+// TestCoapConfirmableDelivery : sendConfirmableで送信したメッセージについて、
+// ACKの受信とMAX_RETRANSMIT回の再送の失敗がdeliveredに通知されることを確認する
+func TestCoapConfirmableDelivery(t *testing.T) {
+	setCoapTestTransmissionParams(t, 10*time.Millisecond)
+	coap, peer := newCoapTestPeer(t, func(*CoapMessage) {})
+
+	deliveredCh := make(chan bool, 2)
+	request := &CoapMessage{Code: CoapCodeGet, TokenLength: 1, Token: []byte{0x01}}
+	messageID := coap.SendConfirmableRelatedMessage(request, CoapCodeContent, []CoapOption{}, []byte{},
+		func(delivered bool) { deliveredCh <- delivered })
+	peer.read()
+	peer.write(&CoapMessage{Version: 1, Type: CoapTypeAcknowledgement, Code: CoapCodeEmpty, MessageID: messageID, Options: []CoapOption{}})
+	if delivered := <-deliveredCh; !delivered {
+		t.Fatal("ACKを受信したメッセージが届いていないと通知されました")
+	}
+
+	coap.SendConfirmableRelatedMessage(request, CoapCodeContent, []CoapOption{}, []byte{},
+		func(delivered bool) { deliveredCh <- delivered })
+	for i := 0; i <= coapMaxRetransmit; i++ {
+		peer.read()
+	}
+	select {
+	case delivered := <-deliveredCh:
+		if delivered {
+			t.Fatal("再送を諦めたメッセージが届いたと通知されました")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("再送を諦めたことが通知されません")
+	}
+	if len(deliveredCh) != 0 {
+		t.Fatal("通知が重複しています")
+	}
+}
+
+// TestCoapDuplicate : 重複したCONのリクエストは処理せずに同じレスポンスを再送し、
+// 重複したNONのリクエストは処理しないことを確認する
+// RFC7252 4.5 Message Deduplication参照
+func TestCoapDuplicate(t *testing.T) {
+	receivedCh := make(chan *CoapMessage, 4)
+	var coap *Coap
+	// レスポンスを受信した時点で処理した数を確認できるよう、レスポンスより先に記録する
+	coap, peer := newCoapTestPeer(t, func(message *CoapMessage) {
+		receivedCh <- message
+		if message.Type == CoapTypeConfirmable {
+			coap.SendResponse(message, CoapCodeContent, []CoapOption{}, []byte{(byte)(len(receivedCh))})
+		}
+	})
+	request := &CoapMessage{
+		Version:     1,
+		Type:        CoapTypeConfirmable,
+		Code:        CoapCodeGet,
+		MessageID:   0x1234,
+		TokenLength: 1,
+		Token:       []byte{0x01},
+		Options:     []CoapOption{CoapOption{coapOptionNoURIPath, []byte("3")}}}
+
+	peer.write(request)
+	response := peer.read()
+	peer.write(request)
+	if duplicate := peer.read(); !bytes.Equal(duplicate.ConvertToBytes(), response.ConvertToBytes()) {
+		t.Fatal("重複したリクエストに同じレスポンスが再送されません")
+	}
+	if len(receivedCh) != 1 {
+		t.Fatalf("重複したCONのリクエストを処理しました %d", len(receivedCh))
+	}
+
+	nonConfirmable := *request
+	nonConfirmable.Type = CoapTypeNonConfirmable
+	nonConfirmable.MessageID = 0x1235
+	peer.write(&nonConfirmable)
+	peer.write(&nonConfirmable)
+	// 後続のCONのリクエストへのレスポンスで、NONのリクエストの処理の完了を待つ
+	request.MessageID = 0x1236
+	peer.write(request)
+	peer.read()
+	if len(receivedCh) != 3 {
+		t.Fatalf("重複したNONのリクエストを処理しました %d", len(receivedCh))
+	}
+	peer.expectSilence(50 * time.Millisecond)
+}
+
+// TestCoapDuplicateExpire : 保持期間を過ぎた受信の記録は取り除かれ、
+// 同じメッセージIDのメッセージを新しいメッセージとして扱うことを確認する
+func TestCoapDuplicateExpire(t *testing.T) {
+	savedExchangeLifetime, savedNonLifetime := coapExchangeLifetime, coapNonLifetime
+	coapExchangeLifetime, coapNonLifetime = 100*time.Millisecond, 40*time.Millisecond
+	defer func() {
+		coapExchangeLifetime, coapNonLifetime = savedExchangeLifetime, savedNonLifetime
+	}()
+	coap := &Coap{receivedMessages: map[uint16]*coapReceivedMessage{}}
+	message := func(messageType uint8, messageID uint16) *CoapMessage {
+		return &CoapMessage{Version: 1, Type: messageType, Code: CoapCodeGet, MessageID: messageID}
+	}
+
+	for messageID := uint16(0); messageID < 100; messageID++ {
+		if coap.isDuplicate(message(CoapTypeConfirmable, messageID)) {
+			t.Fatalf("初めて受信したメッセージ %d を重複と判定しました", messageID)
+		}
+	}
+	if coap.isDuplicate(message(CoapTypeNonConfirmable, 1000)) {
+		t.Fatal("初めて受信したNONを重複と判定しました")
+	}
+	if !coap.isDuplicate(message(CoapTypeConfirmable, 0)) || !coap.isDuplicate(message(CoapTypeNonConfirmable, 1000)) {
+		t.Fatal("保持期間内の重複を検出できません")
+	}
+
+	// NONの記録のみ期限切れとなる
+	time.Sleep(60 * time.Millisecond)
+	if coap.isDuplicate(message(CoapTypeNonConfirmable, 1000)) {
+		t.Fatal("期限切れのNONの記録で重複と判定しました")
+	}
+	if len(coap.receivedMessages) != 101 || len(coap.receivedConfirmables) != 100 || len(coap.receivedNonConfirmables) != 1 {
+		t.Fatalf("期限切れのNONの記録が取り除かれません %d", len(coap.receivedMessages))
+	}
+
+	// CONの記録の期限切れ後に、同じメッセージIDをNONで記録し直す
+	time.Sleep(60 * time.Millisecond)
+	if coap.isDuplicate(message(CoapTypeNonConfirmable, 0)) {
+		t.Fatal("期限切れのCONの記録で重複と判定しました")
+	}
+	if len(coap.receivedMessages) > 2 || len(coap.receivedConfirmables) != 0 {
+		t.Fatalf("期限切れのCONの記録が取り除かれません %d", len(coap.receivedMessages))
+	}
+	if !coap.isDuplicate(message(CoapTypeNonConfirmable, 0)) {
+		t.Fatal("記録し直したメッセージの重複を検出できません")
+	}
+}
@@ -1,31 +1,31 @@
 package inventoryd
 
-// DLTS1.2における以下の要求は現時点では実装しない
-// Handshakeの再送
-// Handshakeの並び替え
-// Handshakeの断片化の対応
-
 import (
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 )
 
-// 暗号スイートはTLS_PSK_WITH_AES_128_CCM_8で固定
-// Lwm2mで最低限サポートしなければならない暗号スイートとして規定されている
-// OMA-TS-LightweightM2M-V1_0_2-20180209-A 7.1.7 Pre-Shared Keys参照
-// TLS_PSK_WITH_AES_128_CCM_8 : RFC6655 4. PSK-Based AES-CCM Cipher Suites参照
+// 暗号スイートはdtls_cipher.go参照
 const (
 	dtlsVersion          uint16        = 0xfefd // DTLS1.2
-	dtlsCipherSuite      uint16        = 0xc0a8 // TLS_PSK_WITH_AES_128_CCM_8
 	dtlsCompress         byte          = 0x00   // None
-	dtlsPacketSize       int           = 1024
-	dtlsHandshakeTimeout time.Duration = 5 * time.Second
+	dtlsPacketSize       int           = 1500   // 1024byteのブロック(CoAP Block-wise)を含むレコードを受信できる長さ
+	dtlsHandshakeTimeout time.Duration = 60 * time.Second
+)
+
+// Handshakeの再送タイマー
+// 初期値1秒、再送の度に2倍とし、最大60秒とする
+// RFC6347 4.2.4.1 Timer Values参照
+const (
+	dtlsRetransmitInitialTimeout time.Duration = 1 * time.Second
+	dtlsRetransmitMaxTimeout     time.Duration = 60 * time.Second
 )
 
 // Dtls : Dtls接続管理
@@ -35,6 +35,8 @@ type Dtls struct {
 	ClientEpoch    uint16
 	ServerSequence uint64
 	ClientSequence uint64
+	ServerMACKey   []byte
+	ClientMACKey   []byte
 	ServerWriteKey []byte
 	ClientWriteKey []byte
 	ServerIV       []byte
@@ -42,46 +44,108 @@ type Dtls struct {
 	ClientEncrypt  bool
 	ServerEncrypt  bool
 	Handshake      *DtlsHandshakeParams
+
+	cipherSuite            *dtlsCipherSuite     // ServerHelloで選択された暗号スイート
+	previousClientSequence uint64               // Change Cipher Spec前のEpochのSequence(Handshake再送用)
+	handshakeError         error                // ハンドシェイクを継続できないエラー
+	retransmitRequested    bool                 // 相手からHandshakeの再送を受信した
+	receivedData           [][]byte             // 受信済みで読み出していないApplication Data
+	lastFlight             []*dtlsFlightMessage // サーバーの再送に備えて保持する最後のフライト
+	replayWindow           uint64               // 受信済みSequenceのビットマップ(bit 0がServerSequence)
+
+	// レコードの送信(Sequenceの読み出しと加算、Connection.Write)を排他する
+	// Writeと、Readから呼ばれるフライトの再送が同じSequenceで暗号化する(nonceを再利用する)ことを防ぐ
+	writeMutex sync.Mutex
 }
 
+// Anti-Replay
+// ServerSequenceを受信済みの最大のSequenceとし、そこから64個前までのSequenceを受信済みか記録する
+// 記録範囲より前のSequence、受信済みのSequenceのレコードは破棄する
+// 暗号化前(Epoch 0)のレコードはハンドシェイクのmessage_seqで重複を検出するため対象外とする
+// RFC6347 4.1.2.6 Anti-Replay参照
+const dtlsReplayWindowSize uint64 = 64
+
 // DTLS Content Type
 // RFC5246 A.1 Record Layer参照
 // (Content TypeはTLS1.2と同一のため、RFC6347内に記載が無い)
 const (
 	dtlsContentTypeChangeCipherSpec byte = 20
+	dtlsContentTypeAlert            byte = 21
 	dtlsContentTypeHandshake        byte = 22
 	dtlsContentTypeApplicationData  byte = 23
 )
 
+// Connection IDについてはdtls_cid.go、Alertについてはdtls_alert.go参照
+
 // DtlsPacket : DTLSのパケット
+// Typeがtls12_cidの場合のみConnectionIDをヘッダに含める
 type DtlsPacket struct {
 	Type          byte
 	Epoch         uint16
 	Sequence      uint64
+	ConnectionID  []byte
 	ContentLength uint16
 	Content       []byte
 }
 
-const (
-	dtlsAesCcmMACLength byte = 8 // Number of octets in authentication field(MACのバイト長)
-	dtlsAesCCMLength    byte = 3 // Number of octets in length field(15 - nonceのバイト長)
-)
+// DtlsDial : DLTSの初期化(PSKモード)
+// sessionを指定した場合はセッションの再開を試みる
+// サーバーが再開を拒否した場合はフルハンドシェイクとなる
+// ctxが終了した場合はハンドシェイクを中止する(フライトの再送を含む)
+func DtlsDial(ctx context.Context, host string, identity []byte, psk []byte, session *DtlsSession) (*Dtls, error) {
+	handshake := &DtlsHandshakeParams{Identity: identity}
+	handshake.PreMasterSecret = DtlsPreMasterSecretFromPSK(psk)
+	handshake.CipherSuites = dtlsDefaultCipherSuites
+	return dtlsDial(ctx, host, handshake, session)
+}
+
+// DtlsDialRawPublicKey : DLTSの初期化(RPKモード)
+// サーバーの公開鍵はserverPublicKeyと一致しなければならない
+func DtlsDialRawPublicKey(ctx context.Context, host string, privateKey *ecdsa.PrivateKey, serverPublicKey *ecdsa.PublicKey, session *DtlsSession) (*Dtls, error) {
+	handshake := &DtlsHandshakeParams{PrivateKey: privateKey, ServerPublicKey: serverPublicKey}
+	handshake.CipherSuites = dtlsEcdheEcdsaCipherSuites
+	return dtlsDial(ctx, host, handshake, session)
+}
+
+// DtlsDialCertificate : DLTSの初期化(Certificateモード)
+// certificateはクライアントの証明書(DER)
+// サーバーの証明書はserverCertificateを信頼する証明書として検証する(nilの場合はシステムの証明書で検証する)
+func DtlsDialCertificate(ctx context.Context, host string, privateKey *ecdsa.PrivateKey, certificate []byte, serverCertificate *x509.Certificate, session *DtlsSession) (*Dtls, error) {
+	serverName, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(certificate) == 0 {
+		return nil, errors.New("クライアントの証明書がありません")
+	}
+	handshake := &DtlsHandshakeParams{
+		PrivateKey:        privateKey,
+		Certificate:       certificate,
+		ServerCertificate: serverCertificate,
+		ServerName:        serverName}
+	handshake.CipherSuites = dtlsEcdheEcdsaCipherSuites
+	return dtlsDial(ctx, host, handshake, session)
+}
 
-// DtlsDial : DLTSの初期化
-func DtlsDial(host string, identity []byte, psk []byte) (*Dtls, error) {
+// dtlsDial : 接続してハンドシェイクを実行する
+// ハンドシェイクの期限はctxの期限とdtlsHandshakeTimeoutの早い方とする
+// (Register等の呼び出し元の期限を超えてフライトを再送し続けない)
+func dtlsDial(ctx context.Context, host string, handshake *DtlsHandshakeParams, session *DtlsSession) (*Dtls, error) {
 	rand.Seed(time.Now().UnixNano())
 
-	conn, err := net.Dial("udp", host)
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", host)
 	if err != nil {
 		return nil, err
 	}
 	dtls := &Dtls{Connection: conn}
-	handshake := &DtlsHandshakeParams{Identity: identity}
-	handshake.PreMasterSecret = DtlsPreMasterSecretFromPSK(psk)
 	handshake.ClientRandom = DtlsClientRandom()
+	if session != nil {
+		handshake.Session = session.ID
+		handshake.MasterSecret = session.MasterSecret
+	}
 	dtls.Handshake = handshake
-	ctx, cancel := context.WithTimeout(context.Background(), dtlsHandshakeTimeout)
-	notifyCh := make(chan bool)
+	ctx, cancel := context.WithTimeout(ctx, dtlsHandshakeTimeout)
+	notifyCh := make(chan bool, 1)
 	defer cancel()
 	go dtls.processHandshake(ctx, notifyCh)
 	select {
@@ -99,31 +163,57 @@ func DtlsDial(host string, identity []byte, psk []byte) (*Dtls, error) {
 	}
 }
 
+// Read : Application Dataを読み出す
+// 1つのデータグラムに複数のレコードが含まれる場合は、残りを次回以降に返す
+// 不正なレコードは破棄して読み出しを続ける(RFC6347 4.1.2.7 Handling Invalid Records参照)
+// close_notifyまたはfatalのAlertを受信した場合は*DtlsAlertErrorを返す
 func (dtls *Dtls) Read(data []byte) (int, error) {
-	buf := make([]byte, dtlsPacketSize)
-	readLen, err := dtls.Connection.Read(buf)
-	if err != nil {
-		return 0, err
-	}
-	packet := dtls.ParsePacket(buf[:readLen])
-	if packet == nil {
-		return 0, errors.New("不正なDTLSパケットを検出しました")
+	for len(dtls.receivedData) == 0 {
+		buf := make([]byte, dtlsPacketSize)
+		readLen, err := dtls.Connection.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		packets := dtls.ParsePackets(buf[:readLen])
+		if alert := receivedAlert(packets); alert != nil {
+			return 0, alert
+		}
+		for _, packet := range packets {
+			if packet.Type == dtlsContentTypeApplicationData {
+				dtls.receivedData = append(dtls.receivedData, packet.Content)
+			}
+		}
+		// 短縮ハンドシェイクの最後のフライトが届かずサーバーが再送してきた場合は再送する
+		if dtls.retransmitRequested && dtls.lastFlight != nil {
+			dtls.retransmitRequested = false
+			dtls.sendFlight(dtls.lastFlight)
+		}
 	}
-	copy(data, packet.Content)
-	return len(packet.Content), nil
+	content := dtls.receivedData[0]
+	dtls.receivedData = dtls.receivedData[1:]
+	copy(data, content)
+	return len(content), nil
 }
 
+// Write : Application Dataを送信する
+// 再送するフライトの送信(sendFlight)と同時に呼び出されてもよい
 func (dtls *Dtls) Write(data []byte) (int, error) {
 	buf := make([]byte, len(data))
 	copy(buf, data)
 
+	dtls.writeMutex.Lock()
+	defer dtls.writeMutex.Unlock()
 	packet := &DtlsPacket{
 		Type:     dtlsContentTypeApplicationData,
 		Epoch:    dtls.ClientEpoch,
 		Sequence: dtls.ClientSequence}
-	packet.Content = dtls.encrypt(buf, packet.Type)
-	dtls.Connection.Write(packet.ToBytes())
+	dtls.encrypt(packet, buf)
+	// 送信に失敗してもSequenceは使用済みとし、同じnonceで別の内容を暗号化しない
+	_, err := dtls.Connection.Write(packet.ToBytes())
 	dtls.ClientSequence++
+	if err != nil {
+		return 0, err
+	}
 	return len(buf), nil
 }
 
@@ -158,138 +248,34 @@ func (dtls *Dtls) SetWriteDeadline(t time.Time) error {
 	return dtls.Connection.SetWriteDeadline(t)
 }
 
-// encrypt : AES_128_CCM_8で暗号化する
-func (dtls *Dtls) encrypt(data []byte, contentType byte) []byte {
+// encrypt : 選択された暗号スイートで暗号化し、パケットの内容とする
+// サーバーのConnection IDが合意されている場合はtls12_cidのレコードとする
+func (dtls *Dtls) encrypt(packet *DtlsPacket, data []byte) {
 	epochSequence := make([]byte, 8)
-	binary.BigEndian.PutUint64(epochSequence, dtls.ClientSequence)
-	binary.BigEndian.PutUint16(epochSequence[0:2], dtls.ClientEpoch)
-	aad := dtlsGenerateAAD(epochSequence, contentType, (uint16)(len(data)))
-	nonce := dtlsGenerateNonce(dtls.ClientIV, epochSequence)
-	paddingLength := (aes.BlockSize - (len(data) % aes.BlockSize)) % aes.BlockSize
-	paddedData := append(data, make([]byte, paddingLength)...)
-	mac := dtlsGenerateMAC(aad, nonce, (uint16)(len(data)), paddedData, dtls.ClientWriteKey)
-
-	plainText := append(mac, paddedData...)
-	block, err := aes.NewCipher(dtls.ClientWriteKey)
-	if err != nil {
-		panic(err)
+	binary.BigEndian.PutUint64(epochSequence, packet.Sequence)
+	binary.BigEndian.PutUint16(epochSequence[0:2], packet.Epoch)
+	connectionID := dtls.Handshake.ServerConnectionID
+	if len(connectionID) > 0 {
+		data = innerPlaintext(data, packet.Type)
+		packet.Type = dtlsContentTypeTls12Cid
+		packet.ConnectionID = connectionID
 	}
-	counterIV := make([]byte, aes.BlockSize)
-	counterIV[0] = dtlsAesCCMLength - 1
-	copy(counterIV[1:13], nonce)
-	cipherText := make([]byte, len(plainText))
-
-	stream := cipher.NewCTR(block, counterIV)
-	stream.XORKeyStream(cipherText, plainText)
-	encryptedMac := cipherText[0:dtlsAesCcmMACLength]
-	encryptedData := cipherText[aes.BlockSize:(aes.BlockSize + len(data))]
-	ret := make([]byte, len(epochSequence)+len(data)+(int)(dtlsAesCcmMACLength))
-	copy(ret[0:len(epochSequence)], epochSequence)
-	copy(ret[len(epochSequence):(len(epochSequence)+len(data))], encryptedData)
-	copy(ret[(len(epochSequence)+len(data)):], encryptedMac)
-
-	return ret
+	packet.Content = dtls.cipherSuite.seal(dtls.ClientWriteKey, dtls.ClientIV, dtls.ClientMACKey, epochSequence, packet.Type, connectionID, data)
 }
 
-// decrypt : AES_128_CCM_8で検証および復号する
-func (dtls *Dtls) decrypt(data []byte, contentType byte) ([]byte, bool) {
-	epochSequence := make([]byte, 8)
-	copy(epochSequence, data[0:8])
-	encryptedData := make([]byte, len(data)-(int)(dtlsAesCcmMACLength)-8)
-	copy(encryptedData, data[8:(len(data)-(int)(dtlsAesCcmMACLength))])
-	encryptedMAC := make([]byte, (int)(dtlsAesCcmMACLength))
-	copy(encryptedMAC, data[(len(data)-(int)(dtlsAesCcmMACLength)):])
-
-	paddingLength := (aes.BlockSize - (len(encryptedData) % aes.BlockSize)) % aes.BlockSize
-	paddedData := append(encryptedData, make([]byte, paddingLength)...)
-	nonce := dtlsGenerateNonce(dtls.ServerIV, epochSequence)
-
-	cipherText := append(append(encryptedMAC, make([]byte, aes.BlockSize-dtlsAesCcmMACLength)...), paddedData...)
-	block, err := aes.NewCipher(dtls.ServerWriteKey)
-	if err != nil {
-		panic(err)
-	}
-	counterIV := make([]byte, aes.BlockSize)
-	counterIV[0] = dtlsAesCCMLength - 1
-	copy(counterIV[1:13], nonce)
-	plainText := make([]byte, len(cipherText))
-
-	stream := cipher.NewCTR(block, counterIV)
-	stream.XORKeyStream(plainText, cipherText)
-	decryptedMac := plainText[0:dtlsAesCcmMACLength]
-	decryptedData := plainText[aes.BlockSize:(aes.BlockSize + len(encryptedData))]
-
-	aad := dtlsGenerateAAD(epochSequence, contentType, (uint16)(len(decryptedData)))
-	decryptedPaddedData := append(decryptedData, make([]byte, paddingLength)...)
-	mac := dtlsGenerateMAC(aad, nonce, (uint16)(len(decryptedData)), decryptedPaddedData, dtls.ServerWriteKey)
-	macForVerify := mac[0:dtlsAesCcmMACLength]
-
-	for i := 0; i < (int)(dtlsAesCcmMACLength); i++ {
-		if decryptedMac[i] != macForVerify[i] {
-			return nil, false
-		}
+// decrypt : 選択された暗号スイートで検証および復号する
+func (dtls *Dtls) decrypt(data []byte, contentType byte, connectionID []byte, epoch uint16, sequence uint64) ([]byte, bool) {
+	if dtls.cipherSuite == nil {
+		return nil, false
 	}
-	return decryptedData, true
-}
-
-// dtlsGenerateAAD : AAD(Additional authenticated data)を生成する
-// RFC5246 6.2.3.3 AEAD Ciphers参照
-// additional_data = seq_num || TLSCompressed.type || TLSCompressed.version || TLSCompressed.length;
-// 基本はTLS1.2と同じだが、seq_numがDTLSではepochとsequenceに分かれている
-func dtlsGenerateAAD(epochSequence []byte, contentType byte, length uint16) []byte {
-	ret := make([]byte, 13)
-	copy(ret[0:8], epochSequence)
-	ret[8] = contentType
-	binary.BigEndian.PutUint16(ret[9:11], dtlsVersion)
-	binary.BigEndian.PutUint16(ret[11:13], length)
-	return ret
-}
-
-// dtlsGenerateNonce : nonce(number used once)を生成する
-// 一度しか使用されないことを保証するため、epochとsequenceを使用する
-// RFC6655 : 3. RSA-Based AES-CCM Cipher Suites参照
-// struct {
-//   uint32 client_write_IV; // low order 32-bits
-//   uint64 seq_num;         // TLS sequence number
-// } CCMClientNonce.
-// In DTLS, the 64-bit seq_num is the 16-bit epoch concatenated with the 48-bit seq_num.
-func dtlsGenerateNonce(iv []byte, epochSequence []byte) []byte {
-	nonce := make([]byte, 16)
-	copy(nonce[0:4], iv)
-	copy(nonce[4:16], epochSequence)
-	return nonce
-}
-
-// dtlsGenerateMAC : MAC(Message Authentucation Code)を生成する
-// RFC3610 2.2.  Authentication参照
-// aadは2^64まで拡張可能だが、DTLSとの組み合わせの使用においては13byte固定と考えてよいため、
-// aadの長さによる場合分けは省略する
-// Golangの標準パッケージにはCBC-MACがないため、CBC暗号化の最終ブロックを取得することにより代用する
-func dtlsGenerateMAC(aad []byte, nonce []byte, length uint16, paddedData []byte, key []byte) []byte {
-	flag := (1 << 6) + (((dtlsAesCcmMACLength)-2)/2)<<3 + ((dtlsAesCCMLength) - 1)
-	blocksForMAC := make([]byte, 2*aes.BlockSize)
-	blocksForMAC[0] = flag
-	copy(blocksForMAC[1:13], nonce)
-	binary.BigEndian.PutUint16(blocksForMAC[14:16], length)
-
-	binary.BigEndian.PutUint16(blocksForMAC[16:18], (uint16)(len(aad)))
-	copy(blocksForMAC[18:(18+len(aad))], aad)
-	blocksForMAC = append(blocksForMAC, paddedData...)
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil
-	}
-	// CBC-MACのIVは全て0の16byte
-	iv := make([]byte, aes.BlockSize)
-	cbc := cipher.NewCBCEncrypter(block, iv)
-	cipherText := make([]byte, len(blocksForMAC))
-	cbc.CryptBlocks(cipherText, []byte(blocksForMAC))
-
-	return cipherText[len(cipherText)-aes.BlockSize:]
+	epochSequence := make([]byte, 8)
+	binary.BigEndian.PutUint64(epochSequence, sequence)
+	binary.BigEndian.PutUint16(epochSequence[0:2], epoch)
+	return dtls.cipherSuite.open(dtls.ServerWriteKey, dtls.ServerIV, dtls.ServerMACKey, epochSequence, contentType, connectionID, data)
 }
 
 // ParsePacket : パケット生データからDTLSパケットを生成する
+// tls12_cidのレコードは復号後に本来のContent Typeに戻す
 func (dtls *Dtls) ParsePacket(raw []byte) *DtlsPacket {
 	if len(raw) < 13 {
 		return nil
@@ -298,49 +284,151 @@ func (dtls *Dtls) ParsePacket(raw []byte) *DtlsPacket {
 	packet.Type = raw[0]
 	packet.Epoch = binary.BigEndian.Uint16(raw[3:5])
 	packet.Sequence = binary.BigEndian.Uint64(append([]byte{0, 0}, raw[5:11]...))
-	packet.ContentLength = binary.BigEndian.Uint16(raw[11:13])
+	headerLength := 13
+	if packet.Type == dtlsContentTypeTls12Cid {
+		// Connection IDの長さはレコードに含まれないため、自分が提示した長さを使用する
+		headerLength += len(dtls.Handshake.ClientConnectionID)
+		if len(raw) < headerLength || !dtls.ServerEncrypt {
+			return nil
+		}
+		packet.ConnectionID = raw[11:(headerLength - 2)]
+	}
+	packet.ContentLength = binary.BigEndian.Uint16(raw[(headerLength - 2):headerLength])
 
-	if len(raw) < 13+(int)(packet.ContentLength) {
+	if len(raw) < headerLength+(int)(packet.ContentLength) {
 		return nil
 	}
+	content := raw[headerLength:(headerLength + (int)(packet.ContentLength))]
 
-	if dtls.ServerEncrypt {
-		decrypted, verify := dtls.decrypt(raw[13:(13+packet.ContentLength)], packet.Type)
-		if verify {
-			packet.Content = decrypted
-		} else {
+	if dtls.ServerEncrypt && packet.Epoch == 0 {
+		// 暗号化開始後のEpoch 0のレコードは再送されたChange Cipher Specのみ受け付ける
+		if packet.Type != dtlsContentTypeChangeCipherSpec {
+			return nil
+		}
+		packet.Content = content
+		return packet
+	} else if packet.Epoch != dtls.ServerEpoch {
+		// 現在のEpoch以外のレコードは破棄する
+		// (Change Cipher Specより先に届いた次のEpochのレコードはサーバーの再送を待つ)
+		return nil
+	} else if dtls.ServerEncrypt {
+		if dtls.isReplayed(packet.Sequence) {
+			return nil
+		}
+		decrypted, verify := dtls.decrypt(content, packet.Type, packet.ConnectionID, packet.Epoch, packet.Sequence)
+		if !verify {
 			return nil
 		}
+		// 検証に成功したレコードのみ受信済みとして記録する
+		dtls.updateReplayWindow(packet.Sequence)
+		if packet.Type == dtlsContentTypeTls12Cid {
+			decrypted, packet.Type, verify = parseInnerPlaintext(decrypted)
+			if !verify {
+				return nil
+			}
+		}
+		packet.Content = decrypted
 	} else {
-		packet.Content = raw[13:(13 + packet.ContentLength)]
+		packet.Content = content
 	}
 	switch packet.Type {
 	case dtlsContentTypeHandshake:
-		handshake := &DtlsHandshake{Params: dtls.Handshake}
-		handshake.Parse(packet.Content)
+		dtls.receiveHandshake(packet.Content)
 	case dtlsContentTypeChangeCipherSpec:
+		// 次のEpochからAnti-Replayの記録をやり直す
 		dtls.ServerEncrypt = true
-	case dtlsContentTypeApplicationData:
+		dtls.ServerEpoch++
+		dtls.ServerSequence = 0
+		dtls.replayWindow = 0
+	case dtlsContentTypeAlert, dtlsContentTypeApplicationData:
 		// 処理は必要ない
 	default:
 	}
 	return packet
 }
 
+// isReplayed : 受信済み、または記録範囲より前のSequenceか
+func (dtls *Dtls) isReplayed(sequence uint64) bool {
+	if sequence > dtls.ServerSequence {
+		return false
+	}
+	diff := dtls.ServerSequence - sequence
+	if diff >= dtlsReplayWindowSize {
+		return true
+	}
+	return dtls.replayWindow&(1<<diff) != 0
+}
+
+// updateReplayWindow : Sequenceを受信済みとして記録する
+func (dtls *Dtls) updateReplayWindow(sequence uint64) {
+	if sequence > dtls.ServerSequence {
+		shift := sequence - dtls.ServerSequence
+		if shift >= dtlsReplayWindowSize {
+			dtls.replayWindow = 1
+		} else {
+			dtls.replayWindow = dtls.replayWindow<<shift | 1
+		}
+		dtls.ServerSequence = sequence
+		return
+	}
+	dtls.replayWindow |= 1 << (dtls.ServerSequence - sequence)
+}
+
+// ParsePackets : 1つのデータグラムに含まれる全てのレコードを解析する
+// RFC6347 4.1.1 Transport Layer Mapping参照
+// 破棄したレコードは飛ばして次のレコードを解析し、長さが不正なレコード以降は破棄する
+func (dtls *Dtls) ParsePackets(raw []byte) []*DtlsPacket {
+	ret := make([]*DtlsPacket, 0)
+	for parsedIndex := 0; parsedIndex < len(raw); {
+		recordLength := dtls.recordLength(raw[parsedIndex:])
+		if recordLength == 0 {
+			break
+		}
+		packet := dtls.ParsePacket(raw[parsedIndex:(parsedIndex + recordLength)])
+		if packet != nil {
+			ret = append(ret, packet)
+		}
+		parsedIndex += recordLength
+	}
+	return ret
+}
+
+// recordLength : ヘッダを含むレコードの長さ
+// レコードが不完全な場合は0を返す
+func (dtls *Dtls) recordLength(raw []byte) int {
+	headerLength := 13
+	if len(raw) > 0 && raw[0] == dtlsContentTypeTls12Cid {
+		headerLength += len(dtls.Handshake.ClientConnectionID)
+	}
+	if len(raw) < headerLength {
+		return 0
+	}
+	length := headerLength + (int)(binary.BigEndian.Uint16(raw[(headerLength-2):headerLength]))
+	if len(raw) < length {
+		return 0
+	}
+	return length
+}
+
 // ToBytes : DTLSのパケットをバイトスライスに変換する
+// tls12_cidのレコードはsequenceとlengthの間にConnection IDを含める
+// RFC9146 4. Record Layer Extensions参照
 func (packet *DtlsPacket) ToBytes() []byte {
-	ret := make([]byte, 13)
+	ret := make([]byte, 11, 13+len(packet.ConnectionID)+len(packet.Content))
 	ret[0] = packet.Type
 	binary.BigEndian.PutUint16(ret[1:3], dtlsVersion)
 	binary.BigEndian.PutUint64(ret[3:11], packet.Sequence)
 	binary.BigEndian.PutUint16(ret[3:5], packet.Epoch)
+	if packet.Type == dtlsContentTypeTls12Cid {
+		ret = append(ret, packet.ConnectionID...)
+	}
 	packet.ContentLength = (uint16)(len(packet.Content))
-	binary.BigEndian.PutUint16(ret[11:13], packet.ContentLength)
+	ret = append(ret, (byte)(packet.ContentLength>>8), (byte)(packet.ContentLength&0xff))
 	ret = append(ret, (packet.Content)...)
 	return ret
 }
 
 // Length : DTLSパケット全体の長さ
 func (packet *DtlsPacket) Length() uint16 {
-	return packet.ContentLength + 13
+	return packet.ContentLength + 13 + (uint16)(len(packet.ConnectionID))
 }
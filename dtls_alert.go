@@ -0,0 +1,58 @@
+package inventoryd
+
+import "fmt"
+
+// Alert Level / Alert Description
+// RFC5246 7.2 Alert Protocol参照
+const (
+	dtlsAlertLevelWarning byte = 1
+	dtlsAlertLevelFatal   byte = 2
+
+	dtlsAlertDescriptionCloseNotify byte = 0
+)
+
+// DtlsAlertError : 接続を継続できないAlert(close_notifyまたはfatal)を受信した場合のエラー
+type DtlsAlertError struct {
+	Level       byte
+	Description byte
+}
+
+// Error : エラーメッセージ
+func (err *DtlsAlertError) Error() string {
+	if err.IsCloseNotify() {
+		return "DTLSの接続がサーバーから閉じられました"
+	}
+	return fmt.Sprintf("DTLSのAlertを受信しました(level: %d, description: %d)", err.Level, err.Description)
+}
+
+// IsCloseNotify : close_notifyによる正常な切断か
+func (err *DtlsAlertError) IsCloseNotify() bool {
+	return err.Description == dtlsAlertDescriptionCloseNotify
+}
+
+// parseAlert : Alertレコードの内容を解析する
+// close_notifyとfatalのAlertのみエラーとして返し、それ以外のwarningは無視する
+// RFC5246 7.2.1 Closure Alerts / 7.2.2 Error Alerts参照
+func parseAlert(content []byte) *DtlsAlertError {
+	if len(content) != 2 {
+		return nil
+	}
+	alert := &DtlsAlertError{Level: content[0], Description: content[1]}
+	if alert.Level == dtlsAlertLevelFatal || alert.IsCloseNotify() {
+		return alert
+	}
+	return nil
+}
+
+// receivedAlert : 受信したパケットに含まれる、接続を継続できないAlertを取得する
+func receivedAlert(packets []*DtlsPacket) *DtlsAlertError {
+	for _, packet := range packets {
+		if packet.Type != dtlsContentTypeAlert {
+			continue
+		}
+		if alert := parseAlert(packet.Content); alert != nil {
+			return alert
+		}
+	}
+	return nil
+}
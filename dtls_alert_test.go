@@ -0,0 +1,90 @@
+package inventoryd
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestDtlsParseAlert : close_notifyとfatalのAlertのみエラーとし、それ以外のwarningと不正な長さは無視することを確認する
+// RFC5246 7.2 Alert Protocol参照
+func TestDtlsParseAlert(t *testing.T) {
+	cases := []struct {
+		name        string
+		content     []byte
+		isError     bool
+		closeNotify bool
+	}{
+		{"close_notify", []byte{dtlsAlertLevelWarning, dtlsAlertDescriptionCloseNotify}, true, true},
+		{"fatal(handshake_failure)", []byte{dtlsAlertLevelFatal, 40}, true, false},
+		{"fatal(bad_record_mac)", []byte{dtlsAlertLevelFatal, 20}, true, false},
+		{"warning(no_renegotiation)", []byte{dtlsAlertLevelWarning, 100}, false, false},
+		{"短い", []byte{dtlsAlertLevelFatal}, false, false},
+		{"長い", []byte{dtlsAlertLevelFatal, 40, 0}, false, false},
+	}
+	for _, c := range cases {
+		alert := parseAlert(c.content)
+		if (alert != nil) != c.isError {
+			t.Fatalf("%s の結果が不正です", c.name)
+		}
+		if alert == nil {
+			continue
+		}
+		if alert.Level != c.content[0] || alert.Description != c.content[1] || alert.IsCloseNotify() != c.closeNotify {
+			t.Fatalf("%s のAlertが不正です %+v", c.name, alert)
+		}
+		if alert.Error() == "" {
+			t.Fatalf("%s のエラーメッセージがありません", c.name)
+		}
+	}
+}
+
+// TestDtlsReadAlert : Readでfatalのみエラーとして返し、warningの後のApplication Dataは読み出せることを確認する
+func TestDtlsReadAlert(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	dtls := newDtlsTestEncrypted(local)
+
+	go func() {
+		datagram := dtlsTestServerRecord(dtlsContentTypeAlert, 1, 1, []byte{dtlsAlertLevelWarning, 100})
+		datagram = append(datagram, dtlsTestServerRecord(dtlsContentTypeApplicationData, 1, 2, []byte("data"))...)
+		remote.Write(datagram)
+		remote.Write(dtlsTestServerRecord(dtlsContentTypeAlert, 1, 3, []byte{dtlsAlertLevelFatal, 40}))
+	}()
+
+	buf := make([]byte, dtlsPacketSize)
+	n, err := dtls.Read(buf)
+	if err != nil || string(buf[:n]) != "data" {
+		t.Fatalf("warningのAlertの後のApplication Dataを読み出せません %v", err)
+	}
+	_, err = dtls.Read(buf)
+	var alert *DtlsAlertError
+	if !errors.As(err, &alert) || alert.Level != dtlsAlertLevelFatal || alert.Description != 40 {
+		t.Fatalf("fatalのAlertがエラーになりません %v", err)
+	}
+}
+
+// TestCoapDtlsAlert : DTLSのclose_notifyを受信したら受信動作を止め、Errで*DtlsAlertErrorを取得できることを確認する
+func TestCoapDtlsAlert(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	coap := &Coap{}
+	coap.Initialize(newDtlsTestEncrypted(local), func(*CoapMessage) {})
+	defer coap.Close()
+
+	if err := coap.Err(); err != nil {
+		t.Fatalf("Alertの受信前にエラーになっています %v", err)
+	}
+	remote.Write(dtlsTestServerRecord(dtlsContentTypeAlert, 1, 1, []byte{dtlsAlertLevelWarning, dtlsAlertDescriptionCloseNotify}))
+	select {
+	case <-coap.recvErrorCh:
+	case <-time.After(time.Second):
+		t.Fatal("close_notifyで受信動作が止まりません")
+	}
+	var alert *DtlsAlertError
+	if err := coap.Err(); !errors.As(err, &alert) || !alert.IsCloseNotify() {
+		t.Fatalf("close_notifyがErrで取得できません %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package inventoryd
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Connection ID
+// ハンドシェイクで合意したConnection IDをレコードに付加することで、
+// NATの再割り当て等で送信元アドレスが変わってもサーバーがセッションを特定できるようにする
+// RFC9146 Connection Identifier for DTLS 1.2参照
+// クライアントの接続先アドレスは変わらないため、クライアント側のConnection IDは長さ0で提示する
+// (サーバーからのレコードにはConnection IDを付加させず、サーバーへのレコードにのみ付加する)
+const (
+	dtlsExtensionConnectionID uint16 = 54 // RFC9146 3. Specifying the Connection Identifier参照
+	dtlsContentTypeTls12Cid   byte   = 25 // RFC9146 4. Record Layer Extensions参照
+)
+
+// connectionIDExtension : ClientHelloに付加するConnection ID拡張を生成する
+// opaque cid<0..2^8-1>
+func (handshake *DtlsHandshakeParams) connectionIDExtension() []byte {
+	data := append([]byte{(byte)(len(handshake.ClientConnectionID))}, handshake.ClientConnectionID...)
+	return dtlsExtension(dtlsExtensionConnectionID, data)
+}
+
+// parseServerHelloExtensions : ServerHelloの拡張を解析する
+// 拡張はcompression_methodの後に続く(12byteのハンドシェイクヘッダを含むrawを渡す)
+// サーバーがConnection ID拡張を返さなかった場合はConnection IDを使用しない
+func (handshake *DtlsHandshakeParams) parseServerHelloExtensions(raw []byte) error {
+	handshake.ServerConnectionID = nil
+	length := (int)(binary.BigEndian.Uint32(append([]byte{0}, raw[1:4]...)))
+	extensionsIndex := 50 + len(handshake.Session)
+	if len(raw) < 12+length || 12+length <= extensionsIndex {
+		return nil
+	}
+	raw = raw[extensionsIndex:(12 + length)]
+	if len(raw) < 2 || len(raw) < 2+(int)(binary.BigEndian.Uint16(raw[0:2])) {
+		return errors.New("不正なServerHelloの拡張を検出しました")
+	}
+	extensions := raw[2:(2 + binary.BigEndian.Uint16(raw[0:2]))]
+	for len(extensions) >= 4 {
+		extensionType := binary.BigEndian.Uint16(extensions[0:2])
+		extensionLength := (int)(binary.BigEndian.Uint16(extensions[2:4]))
+		if len(extensions) < 4+extensionLength {
+			return errors.New("不正なServerHelloの拡張を検出しました")
+		}
+		data := extensions[4:(4 + extensionLength)]
+		if extensionType == dtlsExtensionConnectionID {
+			if len(data) < 1 || len(data) != 1+(int)(data[0]) {
+				return errors.New("不正なConnection IDを検出しました")
+			}
+			handshake.ServerConnectionID = append([]byte{}, data[1:]...)
+		}
+		extensions = extensions[(4 + extensionLength):]
+	}
+	return nil
+}
+
+// innerPlaintext : Connection IDを付加するレコードの平文を生成する
+// DTLSInnerPlaintext = content || real_type || zeros(パディングは付加しない)
+// RFC9146 4. Record Layer Extensions参照
+func innerPlaintext(content []byte, contentType byte) []byte {
+	return append(append([]byte{}, content...), contentType)
+}
+
+// parseInnerPlaintext : DTLSInnerPlaintextから内容と本来のContent Typeを取得する
+// 末尾の0を取り除いた最後のバイトが本来のContent Type
+func parseInnerPlaintext(raw []byte) ([]byte, byte, bool) {
+	for i := len(raw) - 1; i >= 0; i-- {
+		if raw[i] != 0 {
+			return raw[:i], raw[i], true
+		}
+	}
+	return nil, 0, false
+}
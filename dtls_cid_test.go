@@ -0,0 +1,164 @@
+package inventoryd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// dtlsTestServerHelloWithExtensions : 拡張を付加したServerHello(12byteのハンドシェイクヘッダを含む)を生成する
+func dtlsTestServerHelloWithExtensions(extensions []byte) []byte {
+	body := []byte{0xfe, 0xfd}
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0x00)
+	body = append(body, (byte)(dtlsCipherSuitePskAes128Ccm8>>8), (byte)(dtlsCipherSuitePskAes128Ccm8&0xff), dtlsCompress)
+	body = append(body, (byte)(len(extensions)>>8), (byte)(len(extensions)&0xff))
+	body = append(body, extensions...)
+	return dtlsTestHandshake(dtlsHandshakeTypeServerHello, 1, body)
+}
+
+// TestDtlsConnectionIDExtension : ClientHelloで長さ0のConnection IDを提示し、
+// ServerHelloのConnection ID拡張からサーバーへのレコードに付加するConnection IDを取得することを確認する
+// RFC9146 3. Specifying the Connection Identifier参照
+func TestDtlsConnectionIDExtension(t *testing.T) {
+	params := &DtlsHandshakeParams{}
+	if extension := params.connectionIDExtension(); !bytes.Equal(extension, []byte{0x00, 0x36, 0x00, 0x01, 0x00}) {
+		t.Fatalf("ClientHelloのConnection ID拡張が不正です %x", extension)
+	}
+
+	cases := []struct {
+		name         string
+		extensions   []byte
+		connectionID []byte
+		valid        bool
+	}{
+		{"拡張無し", []byte{}, nil, true},
+		{"Connection ID", dtlsExtension(dtlsExtensionConnectionID, []byte{0x04, 0xc0, 0xc1, 0xc2, 0xc3}), []byte{0xc0, 0xc1, 0xc2, 0xc3}, true},
+		{"他の拡張の後", append(dtlsExtension(dtlsExtensionECPointFormats, []byte{0x01, 0x00}),
+			dtlsExtension(dtlsExtensionConnectionID, []byte{0x01, 0xc0})...), []byte{0xc0}, true},
+		{"長さ0のConnection ID", dtlsExtension(dtlsExtensionConnectionID, []byte{0x00}), []byte{}, true},
+		{"Connection IDの長さが不正", dtlsExtension(dtlsExtensionConnectionID, []byte{0x04, 0xc0}), nil, false},
+		{"拡張の長さが不正", []byte{0x00, 0x36, 0x00, 0x05, 0x04}, nil, false},
+	}
+	for _, c := range cases {
+		params := &DtlsHandshakeParams{ServerConnectionID: []byte{0xff}}
+		err := params.parseServerHelloExtensions(dtlsTestServerHelloWithExtensions(c.extensions))
+		if (err == nil) != c.valid {
+			t.Fatalf("%s の結果が不正です err=%v", c.name, err)
+		}
+		if c.valid && !bytes.Equal(params.ServerConnectionID, c.connectionID) {
+			t.Fatalf("%s のConnection IDが不正です %x", c.name, params.ServerConnectionID)
+		}
+		if c.valid && (c.connectionID == nil) != (params.ServerConnectionID == nil) {
+			t.Fatalf("%s でConnection IDの有無が不正です", c.name)
+		}
+	}
+}
+
+// TestDtlsConnectionIDRecord : サーバーのConnection IDが合意されている場合、
+// tls12_cidのレコードにConnection IDを含め、DTLSInnerPlaintextを暗号化して送信することを確認する
+// RFC9146 4. Record Layer Extensions / 5. Record Payload Protection参照
+func TestDtlsConnectionIDRecord(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	suite := findDtlsCipherSuite(dtlsCipherSuitePskAes128Ccm8)
+	connectionID := []byte{0xc0, 0xc1, 0xc2, 0xc3}
+	dtls := &Dtls{
+		Connection:     local,
+		ClientEpoch:    1,
+		ClientSequence: 5,
+		Handshake:      &DtlsHandshakeParams{ServerConnectionID: connectionID},
+		cipherSuite:    suite,
+		ClientWriteKey: dtlsTestKey,
+		ClientIV:       dtlsTestIV}
+
+	recordCh := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, dtlsPacketSize)
+		n, _ := remote.Read(buf)
+		recordCh <- buf[:n]
+	}()
+	if _, err := dtls.Write(dtlsTestPlainText); err != nil {
+		t.Fatal(err)
+	}
+	record := <-recordCh
+
+	// type || version || epoch || sequence_number || cid || length || encrypted_record
+	header := []byte{dtlsContentTypeTls12Cid, 0xfe, 0xfd, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05}
+	header = append(header, connectionID...)
+	if len(record) < len(header)+2 || !bytes.Equal(record[:len(header)], header) {
+		t.Fatalf("tls12_cidのレコードのヘッダが不正です %x", record)
+	}
+	length := (int)(binary.BigEndian.Uint16(record[len(header):(len(header) + 2)]))
+	if len(record) != len(header)+2+length {
+		t.Fatalf("tls12_cidのレコードの長さが不正です %d", length)
+	}
+	plainText, ok := suite.open(dtlsTestKey, dtlsTestIV, nil, dtlsTestEpochSequence, dtlsContentTypeTls12Cid, connectionID, record[(len(header)+2):])
+	if !ok {
+		t.Fatal("Connection IDを含むAADで復号できません")
+	}
+	if expected := append(append([]byte{}, dtlsTestPlainText...), dtlsContentTypeApplicationData); !bytes.Equal(plainText, expected) {
+		t.Fatalf("DTLSInnerPlaintextが不正です %x", plainText)
+	}
+}
+
+// TestDtlsConnectionIDParsePackets : 自分が提示したConnection IDの長さでtls12_cidのレコードを区切り、
+// 復号したDTLSInnerPlaintextのパディングを取り除いて本来のContent Typeに戻すことを確認する
+func TestDtlsConnectionIDParsePackets(t *testing.T) {
+	suite := findDtlsCipherSuite(dtlsCipherSuitePskAes128Ccm8)
+	connectionID := []byte{0xd0, 0xd1}
+	dtls := &Dtls{
+		ServerEpoch:    1,
+		ServerEncrypt:  true,
+		Handshake:      &DtlsHandshakeParams{ClientConnectionID: connectionID},
+		cipherSuite:    suite,
+		ServerWriteKey: dtlsTestKey,
+		ServerIV:       dtlsTestIV}
+
+	cidRecord := func(sequence uint64, recordConnectionID, plainText []byte) []byte {
+		epochSequence := make([]byte, 8)
+		binary.BigEndian.PutUint64(epochSequence, sequence)
+		binary.BigEndian.PutUint16(epochSequence[0:2], 1)
+		packet := &DtlsPacket{
+			Type:         dtlsContentTypeTls12Cid,
+			Epoch:        1,
+			Sequence:     sequence,
+			ConnectionID: recordConnectionID,
+			Content:      suite.seal(dtlsTestKey, dtlsTestIV, nil, epochSequence, dtlsContentTypeTls12Cid, recordConnectionID, plainText)}
+		return packet.ToBytes()
+	}
+	datagram := []byte{}
+	// パディング無し
+	datagram = append(datagram, cidRecord(1, connectionID, innerPlaintext([]byte("first"), dtlsContentTypeApplicationData))...)
+	// 0のパディング付き
+	datagram = append(datagram, cidRecord(2, connectionID,
+		append(innerPlaintext([]byte("second"), dtlsContentTypeApplicationData), 0x00, 0x00, 0x00))...)
+	// 全て0(Content Typeが無い)
+	datagram = append(datagram, cidRecord(3, connectionID, make([]byte, 4))...)
+	// 暗号化後にConnection IDを書き換えたもの(AADが一致しない)
+	tampered := cidRecord(4, connectionID, innerPlaintext([]byte("tampered"), dtlsContentTypeApplicationData))
+	tampered[12] = 0xff
+	datagram = append(datagram, tampered...)
+	// 後続のレコードも区切れる
+	datagram = append(datagram, cidRecord(5, connectionID, innerPlaintext([]byte("last"), dtlsContentTypeApplicationData))...)
+
+	packets := dtls.ParsePackets(datagram)
+	expected := []string{"first", "second", "last"}
+	if len(packets) != len(expected) {
+		t.Fatalf("受け付けたレコードの数が不正です %d", len(packets))
+	}
+	for i, packet := range packets {
+		if packet.Type != dtlsContentTypeApplicationData || string(packet.Content) != expected[i] ||
+			!bytes.Equal(packet.ConnectionID, connectionID) {
+			t.Fatalf("%d番目のレコードが不正です type=%d content=%q", i, packet.Type, packet.Content)
+		}
+	}
+
+	// 暗号化前のtls12_cidのレコードは受け付けない
+	dtls.ServerEncrypt = false
+	if packet := dtls.ParsePacket(cidRecord(6, connectionID, innerPlaintext([]byte("plain"), dtlsContentTypeApplicationData))); packet != nil {
+		t.Fatal("暗号化前のtls12_cidのレコードを受け付けました")
+	}
+}
@@ -0,0 +1,403 @@
+package inventoryd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+)
+
+// 暗号スイート
+// TLS_PSK_WITH_AES_128_CCM_8はLwm2mで最低限サポートしなければならない暗号スイートとして規定されている
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 7.1.7 Pre-Shared Keys参照
+// TLS_PSK_WITH_AES_128_CCM / CCM_8 : RFC6655 4. PSK-Based AES-CCM Cipher Suites参照
+// TLS_PSK_WITH_AES_128_GCM_SHA256  : RFC5487 3. PSK Key Exchange Algorithm with SHA-256/384参照
+// TLS_PSK_WITH_AES_128_CBC_SHA256  : RFC5487 3. PSK Key Exchange Algorithm with SHA-256/384参照
+// いずれもPRFはSHA-256を使用する
+const (
+	dtlsCipherSuitePskAes128Ccm8      uint16 = 0xc0a8 // TLS_PSK_WITH_AES_128_CCM_8
+	dtlsCipherSuitePskAes128Ccm       uint16 = 0xc0a4 // TLS_PSK_WITH_AES_128_CCM
+	dtlsCipherSuitePskAes128GcmSha256 uint16 = 0x00a8 // TLS_PSK_WITH_AES_128_GCM_SHA256
+	dtlsCipherSuitePskAes128CbcSha256 uint16 = 0x00ae // TLS_PSK_WITH_AES_128_CBC_SHA256
+)
+
+// dtlsDefaultCipherSuites : ClientHelloで提示する暗号スイート(優先順)
+var dtlsDefaultCipherSuites = []uint16{
+	dtlsCipherSuitePskAes128Ccm8,
+	dtlsCipherSuitePskAes128Ccm,
+	dtlsCipherSuitePskAes128GcmSha256,
+	dtlsCipherSuitePskAes128CbcSha256}
+
+// dtlsCipherSuite : 暗号スイートごとの鍵長とレコードの保護方式
+// sealは平文から暗号化したレコードの内容を生成し、openはレコードの内容を検証して平文を返す
+// epochSequenceはレコードのepoch(2byte)とsequence(6byte)を連結したもの
+// connectionIDはConnection IDを付加するレコードの場合に指定する(AADの構成が変わる)
+type dtlsCipherSuite struct {
+	ID           uint16
+	MACKeyLength int
+	KeyLength    int
+	IVLength     int
+	seal         func(key, iv, macKey, epochSequence []byte, contentType byte, connectionID, data []byte) []byte
+	open         func(key, iv, macKey, epochSequence []byte, contentType byte, connectionID, data []byte) ([]byte, bool)
+}
+
+// dtlsCipherSuites : 対応している暗号スイート
+var dtlsCipherSuites = []*dtlsCipherSuite{
+	&dtlsCipherSuite{
+		ID:        dtlsCipherSuitePskAes128Ccm8,
+		KeyLength: 16,
+		IVLength:  4,
+		seal:      dtlsSealAesCcm(8),
+		open:      dtlsOpenAesCcm(8)},
+	&dtlsCipherSuite{
+		ID:        dtlsCipherSuitePskAes128Ccm,
+		KeyLength: 16,
+		IVLength:  4,
+		seal:      dtlsSealAesCcm(16),
+		open:      dtlsOpenAesCcm(16)},
+	&dtlsCipherSuite{
+		ID:        dtlsCipherSuitePskAes128GcmSha256,
+		KeyLength: 16,
+		IVLength:  4,
+		seal:      dtlsSealAesGcm,
+		open:      dtlsOpenAesGcm},
+	&dtlsCipherSuite{
+		ID:           dtlsCipherSuitePskAes128CbcSha256,
+		MACKeyLength: 32,
+		KeyLength:    16,
+		seal:         dtlsSealAesCbcSha256,
+		open:         dtlsOpenAesCbcSha256},
+	&dtlsCipherSuite{
+		ID:        dtlsCipherSuiteEcdheEcdsaAes128Ccm8,
+		KeyLength: 16,
+		IVLength:  4,
+		seal:      dtlsSealAesCcm(8),
+		open:      dtlsOpenAesCcm(8)}}
+
+// findDtlsCipherSuite : 指定したIDの暗号スイートを取得する
+func findDtlsCipherSuite(id uint16) *dtlsCipherSuite {
+	for _, suite := range dtlsCipherSuites {
+		if suite.ID == id {
+			return suite
+		}
+	}
+	return nil
+}
+
+// KeyBlockLength : Key Blockの長さ
+// RFC5246 6.3 Key Calculation参照
+func (suite *dtlsCipherSuite) KeyBlockLength() int {
+	return 2 * (suite.MACKeyLength + suite.KeyLength + suite.IVLength)
+}
+
+const (
+	dtlsAesCCMLength        byte = 3  // Number of octets in length field(15 - nonceのバイト長)
+	dtlsExplicitNonceLength int  = 8  // AEADのexplicit nonceのバイト長(epochとsequenceを使用する)
+	dtlsAesGcmTagLength     int  = 16 // GCMの認証タグのバイト長
+)
+
+// dtlsSealAesCcm : AES_128_CCM / AES_128_CCM_8で暗号化する
+// macLengthはNumber of octets in authentication field(MACのバイト長)
+func dtlsSealAesCcm(macLength int) func(key, iv, macKey, epochSequence []byte, contentType byte, connectionID, data []byte) []byte {
+	return func(key, iv, macKey, epochSequence []byte, contentType byte, connectionID, data []byte) []byte {
+		aad := dtlsGenerateAAD(epochSequence, contentType, connectionID, (uint16)(len(data)))
+		nonce := dtlsGenerateNonce(iv, epochSequence)
+		ret := append([]byte{}, epochSequence...)
+		return append(ret, dtlsAesCcmSeal(key, nonce, aad, data, macLength)...)
+	}
+}
+
+// dtlsOpenAesCcm : AES_128_CCM / AES_128_CCM_8で検証および復号する
+func dtlsOpenAesCcm(macLength int) func(key, iv, macKey, epochSequence []byte, contentType byte, connectionID, data []byte) ([]byte, bool) {
+	return func(key, iv, macKey, epochSequence []byte, contentType byte, connectionID, data []byte) ([]byte, bool) {
+		if len(data) < dtlsExplicitNonceLength+macLength {
+			return nil, false
+		}
+		nonce := dtlsGenerateNonce(iv, data[0:dtlsExplicitNonceLength])
+		cipherText := data[dtlsExplicitNonceLength:]
+		aad := dtlsGenerateAAD(epochSequence, contentType, connectionID, (uint16)(len(cipherText)-macLength))
+		return dtlsAesCcmOpen(key, nonce, aad, cipherText, macLength)
+	}
+}
+
+// dtlsAesCcmSeal : 12byteのnonceを使用してCCMで暗号化し、暗号文の後ろに暗号化したMACを付加する
+// RFC3610 2.3. Encryption参照
+func dtlsAesCcmSeal(key, nonce, aad, data []byte, macLength int) []byte {
+	paddingLength := (aes.BlockSize - (len(data) % aes.BlockSize)) % aes.BlockSize
+	paddedData := append(append([]byte{}, data...), make([]byte, paddingLength)...)
+	mac := dtlsGenerateMAC(aad, nonce, (uint16)(len(data)), paddedData, key, macLength)
+
+	// 先頭ブロックはMACの暗号化に使用する
+	plainText := make([]byte, aes.BlockSize, aes.BlockSize+len(paddedData))
+	copy(plainText, mac)
+	plainText = append(plainText, paddedData...)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	counterIV := make([]byte, aes.BlockSize)
+	counterIV[0] = dtlsAesCCMLength - 1
+	copy(counterIV[1:13], nonce)
+	cipherText := make([]byte, len(plainText))
+
+	stream := cipher.NewCTR(block, counterIV)
+	stream.XORKeyStream(cipherText, plainText)
+	encryptedMac := cipherText[0:macLength]
+	encryptedData := cipherText[aes.BlockSize:(aes.BlockSize + len(data))]
+	return append(append([]byte{}, encryptedData...), encryptedMac...)
+}
+
+// dtlsAesCcmOpen : 12byteのnonceを使用してCCMで検証および復号する
+// RFC3610 2.5. Decryption and Authentication Checking参照
+func dtlsAesCcmOpen(key, nonce, aad, data []byte, macLength int) ([]byte, bool) {
+	if len(data) < macLength {
+		return nil, false
+	}
+	encryptedData := make([]byte, len(data)-macLength)
+	copy(encryptedData, data[:(len(data)-macLength)])
+	encryptedMAC := make([]byte, macLength)
+	copy(encryptedMAC, data[(len(data)-macLength):])
+
+	paddingLength := (aes.BlockSize - (len(encryptedData) % aes.BlockSize)) % aes.BlockSize
+	paddedData := append(encryptedData, make([]byte, paddingLength)...)
+
+	cipherText := append(append(encryptedMAC, make([]byte, aes.BlockSize-macLength)...), paddedData...)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	counterIV := make([]byte, aes.BlockSize)
+	counterIV[0] = dtlsAesCCMLength - 1
+	copy(counterIV[1:13], nonce)
+	plainText := make([]byte, len(cipherText))
+
+	stream := cipher.NewCTR(block, counterIV)
+	stream.XORKeyStream(plainText, cipherText)
+	decryptedMac := plainText[0:macLength]
+	decryptedData := plainText[aes.BlockSize:(aes.BlockSize + len(encryptedData))]
+
+	decryptedPaddedData := append(append([]byte{}, decryptedData...), make([]byte, paddingLength)...)
+	mac := dtlsGenerateMAC(aad, nonce, (uint16)(len(decryptedData)), decryptedPaddedData, key, macLength)
+
+	if !hmac.Equal(decryptedMac, mac) {
+		return nil, false
+	}
+	return decryptedData, true
+}
+
+// dtlsSealAesGcm : AES_128_GCMで暗号化する
+// RFC5288 3. AES-GCM Cipher Suites参照
+// nonceの構成はCCMと同じく、client_write_IV(4byte) || explicit nonce(8byte)
+func dtlsSealAesGcm(key, iv, macKey, epochSequence []byte, contentType byte, connectionID, data []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	nonce := dtlsGenerateNonce(iv, epochSequence)[0:aead.NonceSize()]
+	aad := dtlsGenerateAAD(epochSequence, contentType, connectionID, (uint16)(len(data)))
+	ret := append([]byte{}, epochSequence...)
+	return aead.Seal(ret, nonce, data, aad)
+}
+
+// dtlsOpenAesGcm : AES_128_GCMで検証および復号する
+func dtlsOpenAesGcm(key, iv, macKey, epochSequence []byte, contentType byte, connectionID, data []byte) ([]byte, bool) {
+	if len(data) < dtlsExplicitNonceLength+dtlsAesGcmTagLength {
+		return nil, false
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	nonce := dtlsGenerateNonce(iv, data[0:dtlsExplicitNonceLength])[0:aead.NonceSize()]
+	encryptedData := data[dtlsExplicitNonceLength:]
+	aad := dtlsGenerateAAD(epochSequence, contentType, connectionID, (uint16)(len(encryptedData)-dtlsAesGcmTagLength))
+	decryptedData, err := aead.Open(nil, nonce, encryptedData, aad)
+	if err != nil {
+		return nil, false
+	}
+	return decryptedData, true
+}
+
+// dtlsSealAesCbcSha256 : HMAC-SHA256で認証し、AES_128_CBCで暗号化する
+// RFC5246 6.2.3.2 CBC Block Cipher参照
+// MAC = HMAC_hash(MAC_write_key, seq_num || type || version || length || content)
+// IVはレコードごとにランダムに生成し、暗号文の先頭に付加する
+func dtlsSealAesCbcSha256(key, iv, macKey, epochSequence []byte, contentType byte, connectionID, data []byte) []byte {
+	mac := dtlsGenerateHMAC(macKey, epochSequence, contentType, connectionID, data, nil)
+	plainText := append(append([]byte{}, data...), mac...)
+	// パディングはパディング長の値のバイトをパディング長+1バイト付加する
+	paddingLength := aes.BlockSize - (len(plainText) % aes.BlockSize)
+	for i := 0; i < paddingLength; i++ {
+		plainText = append(plainText, (byte)(paddingLength-1))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	recordIV := make([]byte, aes.BlockSize)
+	rand.Read(recordIV)
+	cipherText := make([]byte, len(plainText))
+	cipher.NewCBCEncrypter(block, recordIV).CryptBlocks(cipherText, plainText)
+	return append(recordIV, cipherText...)
+}
+
+// dtlsOpenAesCbcSha256 : AES_128_CBCで復号し、HMAC-SHA256で検証する
+func dtlsOpenAesCbcSha256(key, iv, macKey, epochSequence []byte, contentType byte, connectionID, data []byte) ([]byte, bool) {
+	// 復号後はMACとパディング長の1byteを含む必要がある
+	if len(data) < aes.BlockSize+sha256.Size+1 || len(data)%aes.BlockSize != 0 {
+		return nil, false
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	plainText := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, data[0:aes.BlockSize]).CryptBlocks(plainText, data[aes.BlockSize:])
+
+	// パディングの検証とMACの計算量がパディングの値によって変わらないようにする
+	// 処理時間の差からパディングの正否が分かると、パディングオラクル(Lucky13)になるため
+	// RFC5246 6.2.3.2 CBC Block Cipher参照
+	paddingLength, paddingGood := dtlsExtractPadding(plainText)
+	// パディング長が不正でもMACの位置が負にならないよう、分岐せずに0に切り詰める
+	dataLength := len(plainText) - paddingLength - sha256.Size
+	dataLength = subtle.ConstantTimeSelect((int)((uint32)(dataLength)>>31), 0, dataLength)
+	decryptedData := plainText[:dataLength]
+	// パディング部分も続けてハッシュに入力し、HMACに入力する長さをパディング長によらず一定にする
+	// なお、SHA-256のブロック境界による圧縮関数の呼び出し回数の差は残る
+	mac := dtlsGenerateHMAC(macKey, epochSequence, contentType, connectionID, decryptedData, plainText[(dataLength+sha256.Size):])
+	macGood := subtle.ConstantTimeCompare(plainText[dataLength:(dataLength+sha256.Size)], mac)
+	if (int)(paddingGood)&macGood != 1 {
+		return nil, false
+	}
+	return decryptedData, true
+}
+
+// dtlsExtractPadding : パディング長+1のバイト数と、パディングが正しいかどうか(正しい場合は1)を返す
+// パディングの値によらず常に末尾256byte(平文がそれより短い場合は平文全体)を走査する
+// パディングが不正な場合は末尾1byteのみをパディングとして扱う
+func dtlsExtractPadding(plainText []byte) (int, byte) {
+	paddingValue := plainText[len(plainText)-1]
+	// パディング長+1が平文の長さ以下であれば最上位ビットが0になる
+	t := (uint)(len(plainText)-1) - (uint)(paddingValue)
+	good := (byte)((int32)(^t) >> 31)
+
+	toCheck := 256
+	if toCheck > len(plainText) {
+		toCheck = len(plainText)
+	}
+	for i := 0; i < toCheck; i++ {
+		// iがパディング長以下であればmaskは0xff
+		t := (uint)(paddingValue) - (uint)(i)
+		mask := (byte)((int32)(^t) >> 31)
+		b := plainText[len(plainText)-1-i]
+		good &^= mask&paddingValue ^ mask&b
+	}
+	// 全てのビットが1のままの場合のみ0xffとする
+	good &= good << 4
+	good &= good << 2
+	good &= good << 1
+	good = (byte)((int8)(good) >> 7)
+
+	paddingValue &= good
+	return (int)(paddingValue) + 1, good & 1
+}
+
+// dtlsGenerateHMAC : CBCモードで使用するHMAC-SHA256を生成する
+// MACの入力はAEADのAADと同じ構成に内容を連結したもの
+// extraはMACの算出後にハッシュに入力するだけのデータで、復号時の計算量を揃えるために使用する
+func dtlsGenerateHMAC(macKey, epochSequence []byte, contentType byte, connectionID, data, extra []byte) []byte {
+	hash := hmac.New(sha256.New, macKey)
+	hash.Write(dtlsGenerateAAD(epochSequence, contentType, connectionID, (uint16)(len(data))))
+	hash.Write(data)
+	mac := hash.Sum(nil)
+	hash.Write(extra)
+	return mac
+}
+
+// dtlsGenerateAAD : AAD(Additional authenticated data)を生成する
+// RFC5246 6.2.3.3 AEAD Ciphers参照
+// additional_data = seq_num || TLSCompressed.type || TLSCompressed.version || TLSCompressed.length;
+// 基本はTLS1.2と同じだが、seq_numがDTLSではepochとsequenceに分かれている
+// Connection IDを付加するレコードの場合は以下の構成となる(RFC9146 5. Record Payload Protection参照)
+// seq_num_placeholder || tls12_cid || cid_length || tls12_cid || version || epoch || sequence_number || cid || length_of_DTLSInnerPlaintext
+func dtlsGenerateAAD(epochSequence []byte, contentType byte, connectionID []byte, length uint16) []byte {
+	if len(connectionID) > 0 {
+		ret := make([]byte, 21, 23+len(connectionID))
+		for i := 0; i < 8; i++ {
+			ret[i] = 0xff
+		}
+		ret[8] = dtlsContentTypeTls12Cid
+		ret[9] = (byte)(len(connectionID))
+		ret[10] = dtlsContentTypeTls12Cid
+		binary.BigEndian.PutUint16(ret[11:13], dtlsVersion)
+		copy(ret[13:21], epochSequence)
+		ret = append(ret, connectionID...)
+		ret = append(ret, (byte)(length>>8), (byte)(length&0xff))
+		return ret
+	}
+	ret := make([]byte, 13)
+	copy(ret[0:8], epochSequence)
+	ret[8] = contentType
+	binary.BigEndian.PutUint16(ret[9:11], dtlsVersion)
+	binary.BigEndian.PutUint16(ret[11:13], length)
+	return ret
+}
+
+// dtlsGenerateNonce : nonce(number used once)を生成する
+// 一度しか使用されないことを保証するため、epochとsequenceを使用する
+// RFC6655 : 3. RSA-Based AES-CCM Cipher Suites参照
+//
+//	struct {
+//	  uint32 client_write_IV; // low order 32-bits
+//	  uint64 seq_num;         // TLS sequence number
+//	} CCMClientNonce.
+//
+// In DTLS, the 64-bit seq_num is the 16-bit epoch concatenated with the 48-bit seq_num.
+func dtlsGenerateNonce(iv []byte, epochSequence []byte) []byte {
+	nonce := make([]byte, 16)
+	copy(nonce[0:4], iv)
+	copy(nonce[4:16], epochSequence)
+	return nonce
+}
+
+// dtlsGenerateMAC : MAC(Message Authentucation Code)を生成する
+// RFC3610 2.2.  Authentication参照
+// aadは2^64まで拡張可能だが、DTLSとの組み合わせの使用においては2^16-2^8未満と考えてよいため、
+// aadの長さによる場合分けは省略する(Connection IDを付加する場合はaadが13byteを超える)
+// Golangの標準パッケージにはCBC-MACがないため、CBC暗号化の最終ブロックを取得することにより代用する
+func dtlsGenerateMAC(aad []byte, nonce []byte, length uint16, paddedData []byte, key []byte, macLength int) []byte {
+	flag := (byte)(1<<6) + (byte)((macLength-2)/2)<<3 + (dtlsAesCCMLength - 1)
+	aadBlockLength := (2 + len(aad) + aes.BlockSize - 1) / aes.BlockSize * aes.BlockSize
+	blocksForMAC := make([]byte, aes.BlockSize+aadBlockLength)
+	blocksForMAC[0] = flag
+	copy(blocksForMAC[1:13], nonce)
+	binary.BigEndian.PutUint16(blocksForMAC[14:16], length)
+
+	binary.BigEndian.PutUint16(blocksForMAC[16:18], (uint16)(len(aad)))
+	copy(blocksForMAC[18:(18+len(aad))], aad)
+	blocksForMAC = append(blocksForMAC, paddedData...)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil
+	}
+	// CBC-MACのIVは全て0の16byte
+	iv := make([]byte, aes.BlockSize)
+	cbc := cipher.NewCBCEncrypter(block, iv)
+	cipherText := make([]byte, len(blocksForMAC))
+	cbc.CryptBlocks(cipherText, []byte(blocksForMAC))
+
+	return cipherText[(len(cipherText) - aes.BlockSize):(len(cipherText) - aes.BlockSize + macLength)]
+}
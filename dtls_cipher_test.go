@@ -0,0 +1,195 @@
+package inventoryd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"testing"
+)
+
+// レコード単位の既知の値のテストで使用する鍵等
+// DTLSのAADとnonceの構成を含む公開されたテストベクタは無いため、期待値はPythonのpyca/cryptographyで以下のとおり算出した
+// (Connection IDありの場合はaadをRFC9146 5. Record Payload Protectionの構成にする)
+//
+//	aad = epoch_sequence + b"\x17\xfe\xfd" + len(plain_text).to_bytes(2, "big")
+//	CCM_8 / CCM : epoch_sequence + AESCCM(key, tag_length=8 / 16).encrypt(iv + epoch_sequence, plain_text, aad)
+//	GCM         : epoch_sequence + AESGCM(key).encrypt(iv + epoch_sequence, plain_text, aad)
+//	CBC         : IV(f0f1...ff) + AES-CBC(key, IV).encrypt(plain_text + HMAC-SHA256(mac_key, aad + plain_text) + パディング)
+//
+// AES-CCM / AES-GCM自体はTestDtlsCipherPublishedVectorsで公開されたテストベクタと照合する
+var (
+	dtlsTestKey           = dtlsTestHex("000102030405060708090a0b0c0d0e0f")
+	dtlsTestIV            = dtlsTestHex("a0a1a2a3")
+	dtlsTestMacKey        = dtlsTestHex("202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f")
+	dtlsTestEpochSequence = dtlsTestHex("0001000000000005")
+	dtlsTestConnectionID  = dtlsTestHex("c0c1c2c3")
+	dtlsTestPlainText     = []byte("0123456789abcdefghij")
+)
+
+// dtlsTestHex : 16進文字列をバイト列にする
+func dtlsTestHex(value string) []byte {
+	ret, err := hex.DecodeString(value)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// dtlsCipherKnownAnswers : 暗号スイートごとの既知の暗号文
+// CBCはIVがランダムのため、IVをf0f1...ffに固定した暗号文を復号のみ確認する
+var dtlsCipherKnownAnswers = []struct {
+	id           uint16
+	connectionID []byte
+	cipherText   string
+}{
+	{dtlsCipherSuitePskAes128Ccm8, nil,
+		"00010000000000051ccc3c049b93f204240e3687f04e388919e03c6160cc961a8e783067"},
+	{dtlsCipherSuitePskAes128Ccm8, dtlsTestConnectionID,
+		"00010000000000051ccc3c049b93f204240e3687f04e388919e03c618a545002e21b52e8"},
+	{dtlsCipherSuitePskAes128Ccm, nil,
+		"00010000000000051ccc3c049b93f204240e3687f04e388919e03c61f9df3e51efa7d8179a4067247ff43495"},
+	{dtlsCipherSuitePskAes128Ccm, dtlsTestConnectionID,
+		"00010000000000051ccc3c049b93f204240e3687f04e388919e03c61c1b1028e2c07e52be7271858f272b228"},
+	{dtlsCipherSuitePskAes128GcmSha256, nil,
+		"0001000000000005fc3b63b510a2dca3cc7cd29d17796ac2a5f76e1b3759a4c10ae82de108cefed4ec3b35ae"},
+	{dtlsCipherSuitePskAes128GcmSha256, dtlsTestConnectionID,
+		"0001000000000005fc3b63b510a2dca3cc7cd29d17796ac2a5f76e1b908e076c7af1c63a79bbe1b22ba8a68f"},
+	{dtlsCipherSuitePskAes128CbcSha256, nil,
+		"f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff71e21619aa870db1922c69f851b5160fe18ad06b4db647efff2dc816e8aaeef8" +
+			"c4e51ca21446eb5029511be7e3a64bfe87f4db231fd902915b1a05f3ea2adc19"},
+	{dtlsCipherSuitePskAes128CbcSha256, dtlsTestConnectionID,
+		"f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff71e21619aa870db1922c69f851b5160f5027d12348b6b9359971e250de186b0e" +
+			"3a522c2f23822204aee9a6b48cc0f6ae9d5267c6089a16402174ba30576e50e4"},
+}
+
+// TestDtlsCipherKnownAnswer : 既知の暗号文と暗号化 / 復号の結果が一致することを確認する
+// Connection IDを指定した場合はRFC9146 5. Record Payload ProtectionのAADを使用する
+func TestDtlsCipherKnownAnswer(t *testing.T) {
+	for _, c := range dtlsCipherKnownAnswers {
+		suite := findDtlsCipherSuite(c.id)
+		expected := dtlsTestHex(c.cipherText)
+		if c.id != dtlsCipherSuitePskAes128CbcSha256 {
+			actual := suite.seal(dtlsTestKey, dtlsTestIV, dtlsTestMacKey, dtlsTestEpochSequence, dtlsContentTypeApplicationData, c.connectionID, dtlsTestPlainText)
+			if !bytes.Equal(actual, expected) {
+				t.Fatalf("suite=%04x cid=%x の暗号文が一致しません expected=%x actual=%x", c.id, c.connectionID, expected, actual)
+			}
+		}
+		plainText, ok := suite.open(dtlsTestKey, dtlsTestIV, dtlsTestMacKey, dtlsTestEpochSequence, dtlsContentTypeApplicationData, c.connectionID, expected)
+		if !ok || !bytes.Equal(plainText, dtlsTestPlainText) {
+			t.Fatalf("suite=%04x cid=%x を復号できません", c.id, c.connectionID)
+		}
+
+		// Connection IDの有無を取り違えると検証に失敗する
+		otherConnectionID := dtlsTestConnectionID
+		if c.connectionID != nil {
+			otherConnectionID = nil
+		}
+		if _, ok := suite.open(dtlsTestKey, dtlsTestIV, dtlsTestMacKey, dtlsTestEpochSequence, dtlsContentTypeApplicationData, otherConnectionID, expected); ok {
+			t.Fatalf("suite=%04x cid=%x がAADの異なる復号に成功しました", c.id, c.connectionID)
+		}
+	}
+}
+
+// TestDtlsCipherPublishedVectors : 公開されたテストベクタとCCM / GCMの結果が一致することを確認する
+// CCMはNIST SP800-38C Appendix C Example 3(12byteのnonce、8byteのMAC)
+// GCMはThe Galois/Counter Mode of Operation (GCM) Appendix B Test Case 4(96bitのIV)
+// GCMのAADはDTLSのAADとは異なるため、暗号文のみ照合する(暗号文はAADによらない)
+func TestDtlsCipherPublishedVectors(t *testing.T) {
+	key := dtlsTestHex("404142434445464748494a4b4c4d4e4f")
+	nonce := dtlsTestHex("101112131415161718191a1b")
+	aad := dtlsTestHex("000102030405060708090a0b0c0d0e0f10111213")
+	plainText := dtlsTestHex("202122232425262728292a2b2c2d2e2f3031323334353637")
+	expected := dtlsTestHex("e3b201a9f5b71a7a9b1ceaeccd97e70b6176aad9a4428aa5484392fbc1b09951")
+	if actual := dtlsAesCcmSeal(key, nonce, aad, plainText, 8); !bytes.Equal(actual, expected) {
+		t.Fatalf("CCMの暗号文が一致しません %x", actual)
+	}
+	if actual, ok := dtlsAesCcmOpen(key, nonce, aad, expected, 8); !ok || !bytes.Equal(actual, plainText) {
+		t.Fatal("CCMの暗号文を復号できません")
+	}
+
+	// client_write_IV(4byte) || explicit nonce(8byte)がTest Case 4のIVとなるようにする
+	key = dtlsTestHex("feffe9928665731c6d6a8f9467308308")
+	iv := dtlsTestHex("cafebabe")
+	explicitNonce := dtlsTestHex("facedbaddecaf888")
+	plainText = dtlsTestHex("d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a72" +
+		"1c3c0c95956809532fcf0e2449a6b525b16aedf5aa0de657ba637b39")
+	expected = dtlsTestHex("42831ec2217774244b7221b784d0d49ce3aa212f2c02a4e035c17e2329aca12e" +
+		"21d514b25466931c7d8f6a5aac84aa051ba30b396a0aac973d58e091")
+	sealed := dtlsSealAesGcm(key, iv, nil, explicitNonce, dtlsContentTypeApplicationData, nil, plainText)
+	if !bytes.Equal(sealed[:dtlsExplicitNonceLength], explicitNonce) ||
+		!bytes.Equal(sealed[dtlsExplicitNonceLength:(len(sealed)-dtlsAesGcmTagLength)], expected) {
+		t.Fatalf("GCMの暗号文が一致しません %x", sealed)
+	}
+}
+
+// TestDtlsCipherRoundTrip : 長さの異なるデータを暗号化して復号でき、改ざんを検出することを確認する
+func TestDtlsCipherRoundTrip(t *testing.T) {
+	for _, id := range []uint16{dtlsCipherSuitePskAes128Ccm8, dtlsCipherSuitePskAes128Ccm, dtlsCipherSuitePskAes128GcmSha256, dtlsCipherSuitePskAes128CbcSha256} {
+		suite := findDtlsCipherSuite(id)
+		for _, length := range []int{0, 1, 15, 16, 17, 31, 32, 33, 255} {
+			data := bytes.Repeat([]byte{0x5A}, length)
+			sealed := suite.seal(dtlsTestKey, dtlsTestIV, dtlsTestMacKey, dtlsTestEpochSequence, dtlsContentTypeApplicationData, nil, data)
+			opened, ok := suite.open(dtlsTestKey, dtlsTestIV, dtlsTestMacKey, dtlsTestEpochSequence, dtlsContentTypeApplicationData, nil, sealed)
+			if !ok || !bytes.Equal(opened, data) {
+				t.Fatalf("suite=%04x length=%d を復号できません", id, length)
+			}
+			for i := range sealed {
+				tampered := append([]byte{}, sealed...)
+				tampered[i] ^= 0x01
+				if _, ok := suite.open(dtlsTestKey, dtlsTestIV, dtlsTestMacKey, dtlsTestEpochSequence, dtlsContentTypeApplicationData, nil, tampered); ok {
+					t.Fatalf("suite=%04x length=%d の%dbyte目の改ざんを検出できません", id, length, i)
+				}
+			}
+		}
+	}
+}
+
+// TestDtlsOpenAesCbcSha256Padding : パディングが不正な暗号文をpanicせずに拒否することを確認する
+func TestDtlsOpenAesCbcSha256Padding(t *testing.T) {
+	block, err := aes.NewCipher(dtlsTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordIV := make([]byte, aes.BlockSize)
+	for _, lastByte := range []byte{0x00, 0x0F, 0x10, 0x1F, 0x20, 0x2F, 0x30, 0xFF} {
+		for _, blocks := range []int{3, 4} {
+			// パディング長の値以外は0のため、パディングもMACも一致しない
+			plainText := make([]byte, blocks*aes.BlockSize)
+			plainText[len(plainText)-1] = lastByte
+			cipherText := make([]byte, len(plainText))
+			cipher.NewCBCEncrypter(block, recordIV).CryptBlocks(cipherText, plainText)
+			data := append(append([]byte{}, recordIV...), cipherText...)
+			if _, ok := dtlsOpenAesCbcSha256(dtlsTestKey, nil, dtlsTestMacKey, dtlsTestEpochSequence, dtlsContentTypeApplicationData, nil, data); ok {
+				t.Fatalf("padding=%02x blocks=%d の復号に成功しました", lastByte, blocks)
+			}
+		}
+	}
+}
+
+// TestDtlsExtractPadding : パディング長と正否を取り出し、不正な場合は末尾1byteのみをパディングとすることを確認する
+func TestDtlsExtractPadding(t *testing.T) {
+	cases := []struct {
+		plainText []byte
+		length    int
+		good      byte
+	}{
+		{[]byte{0x00}, 1, 1},
+		{[]byte{0xAA, 0x00}, 1, 1},
+		{[]byte{0xAA, 0x01, 0x01}, 2, 1},
+		{[]byte{0xAA, 0x00, 0x01}, 1, 0},
+		{[]byte{0x01, 0x01}, 2, 1},
+		{[]byte{0x02, 0x02}, 1, 0},
+		{append([]byte{0xAA}, bytes.Repeat([]byte{0x0F}, 16)...), 16, 1},
+		{append([]byte{0x0E}, bytes.Repeat([]byte{0x0F}, 15)...), 1, 0},
+		{bytes.Repeat([]byte{0xFF}, 256), 256, 1},
+		{append([]byte{0xFE}, bytes.Repeat([]byte{0xFF}, 255)...), 1, 0},
+		{bytes.Repeat([]byte{0xFF}, 255), 1, 0},
+	}
+	for i, c := range cases {
+		length, good := dtlsExtractPadding(c.plainText)
+		if length != c.length || good != c.good {
+			t.Fatalf("case %d のパディングが不正です length=%d good=%d", i, length, good)
+		}
+	}
+}
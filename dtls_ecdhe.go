@@ -0,0 +1,276 @@
+package inventoryd
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+)
+
+// Raw Public Key(RPK)モードおよびCertificate(X.509)モードのパラメータ
+// 暗号スイートはTLS_ECDHE_ECDSA_WITH_AES_128_CCM_8で固定
+// Lwm2mでRPK / Certificateモードの場合にサポートしなければならない暗号スイートとして規定されている
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 7.1.8 Raw Public Key Certificates / 7.1.9 X.509 Certificates参照
+// TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8 : RFC7251 2. ECC-Based AES-CCM Cipher Suites参照
+// 公開鍵はSubjectPublicKeyInfo(DER)、秘密鍵はPKCS#8またはSEC1(DER)とする
+const (
+	dtlsCipherSuiteEcdheEcdsaAes128Ccm8 uint16 = 0xc0ae // TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8
+
+	dtlsNamedCurveSecp256r1           uint16 = 23     // RFC8422 5.1.1 Supported Elliptic Curves Extension参照
+	dtlsECCurveTypeNamedCurve         byte   = 3      // RFC8422 5.4 Server Key Exchange参照
+	dtlsECPointFormatUncompressed     byte   = 0      // RFC8422 5.1.2 Supported Point Formats Extension参照
+	dtlsSignatureEcdsaSecp256r1Sha256 uint16 = 0x0403 // RFC5246 7.4.1.4.1 Signature Algorithms参照
+	dtlsCertificateTypeRawPublicKey   byte   = 2      // RFC7250 3. Structure of the Raw Public Key Extension参照
+)
+
+// TLS Extension Type
+// https://www.iana.org/assignments/tls-extensiontype-values/tls-extensiontype-values.xhtml参照
+const (
+	dtlsExtensionSupportedGroups       uint16 = 10
+	dtlsExtensionECPointFormats        uint16 = 11
+	dtlsExtensionSignatureAlgorithms   uint16 = 13
+	dtlsExtensionClientCertificateType uint16 = 19
+	dtlsExtensionServerCertificateType uint16 = 20
+)
+
+// dtlsEcdheEcdsaCipherSuites : RPK / CertificateモードでClientHelloで提示する暗号スイート
+var dtlsEcdheEcdsaCipherSuites = []uint16{dtlsCipherSuiteEcdheEcdsaAes128Ccm8}
+
+// DtlsParsePublicKey : SubjectPublicKeyInfo(DER)からECDSAの公開鍵を取得する
+func DtlsParsePublicKey(der []byte) (*ecdsa.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("ECDSAの公開鍵ではありません")
+	}
+	return publicKey, nil
+}
+
+// DtlsParsePrivateKey : PKCS#8またはSEC1(DER)からECDSAの秘密鍵を取得する
+func DtlsParsePrivateKey(der []byte) (*ecdsa.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		privateKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("ECDSAの秘密鍵ではありません")
+		}
+		return privateKey, nil
+	}
+	return x509.ParseECPrivateKey(der)
+}
+
+// ecdheEcdsaExtensions : RPK / CertificateモードのClientHelloに付加する拡張を生成する
+// 楕円曲線はsecp256r1、署名はecdsa_secp256r1_sha256とする
+// RPKモードでは証明書をクライアント/サーバーともRaw Public Keyのみとし、
+// Certificateモードでは証明書の種類の拡張を付加しない(X.509となる)
+func (handshake *DtlsHandshakeParams) ecdheEcdsaExtensions() []byte {
+	ret := []byte{}
+	ret = append(ret, dtlsExtension(dtlsExtensionSupportedGroups, []byte{0x00, 0x02, 0x00, (byte)(dtlsNamedCurveSecp256r1)})...)
+	ret = append(ret, dtlsExtension(dtlsExtensionECPointFormats, []byte{0x01, dtlsECPointFormatUncompressed})...)
+	ret = append(ret, dtlsExtension(dtlsExtensionSignatureAlgorithms,
+		[]byte{0x00, 0x02, (byte)(dtlsSignatureEcdsaSecp256r1Sha256 >> 8), (byte)(dtlsSignatureEcdsaSecp256r1Sha256 & 0xff)})...)
+	if handshake.certificateMode() {
+		return ret
+	}
+	ret = append(ret, dtlsExtension(dtlsExtensionClientCertificateType, []byte{0x01, dtlsCertificateTypeRawPublicKey})...)
+	ret = append(ret, dtlsExtension(dtlsExtensionServerCertificateType, []byte{0x01, dtlsCertificateTypeRawPublicKey})...)
+	return ret
+}
+
+// dtlsExtension : 拡張を生成する
+// extension_type(2byte) || length(2byte) || extension_data
+func dtlsExtension(extensionType uint16, data []byte) []byte {
+	ret := make([]byte, 4)
+	binary.BigEndian.PutUint16(ret[0:2], extensionType)
+	binary.BigEndian.PutUint16(ret[2:4], (uint16)(len(data)))
+	return append(ret, data...)
+}
+
+// certificateMode : Certificate(X.509)モードか
+func (handshake *DtlsHandshakeParams) certificateMode() bool {
+	return len(handshake.Certificate) > 0
+}
+
+// dtlsUint24Vector : 3byteの長さを先頭に付加する
+func dtlsUint24Vector(data []byte) []byte {
+	lengthBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(lengthBytes, (uint32)(len(data)))
+	return append(lengthBytes[1:4], data...)
+}
+
+// parseDtlsUint24Vector : 先頭の3byteの長さの分のデータと、残りのデータを取得する
+func parseDtlsUint24Vector(raw []byte) ([]byte, []byte, error) {
+	if len(raw) < 3 {
+		return nil, nil, errors.New("不正なCertificateを検出しました")
+	}
+	length := (int)(binary.BigEndian.Uint32(append([]byte{0}, raw[0:3]...)))
+	if len(raw) < 3+length {
+		return nil, nil, errors.New("不正なCertificateを検出しました")
+	}
+	return raw[3:(3 + length)], raw[(3 + length):], nil
+}
+
+// parseServerCertificate : サーバーのCertificateを検証する
+// RPKモードでは証明書として送られてきた公開鍵がServer Public Keyと一致しなければエラー
+// RFC7250 3. Structure of the Raw Public Key Extension参照
+// CertificateモードについてはparseServerX509Certificate参照
+func (handshake *DtlsHandshakeParams) parseServerCertificate(body []byte) error {
+	if handshake.certificateMode() {
+		return handshake.parseServerX509Certificate(body)
+	}
+	subjectPublicKeyInfo, _, err := parseDtlsUint24Vector(body)
+	if err != nil {
+		return err
+	}
+	publicKey, err := DtlsParsePublicKey(subjectPublicKeyInfo)
+	if err != nil {
+		return err
+	}
+	if handshake.ServerPublicKey == nil || !handshake.ServerPublicKey.Equal(publicKey) {
+		return errors.New("サーバーの公開鍵が一致しません")
+	}
+	handshake.serverCertificateKey = publicKey
+	return nil
+}
+
+// parseServerX509Certificate : サーバーのCertificate(X.509)を検証する
+// certificate_listの先頭がサーバーの証明書で、以降は中間証明書
+// RFC5246 7.4.2 Server Certificate参照
+// Server Public Key(/0/x/4)の証明書を信頼する証明書とし、ホスト名も検証する(TLSの場合と同じ)
+// 公開鍵はClientHelloで提示したsecp256r1のECDSAでなければならない
+func (handshake *DtlsHandshakeParams) parseServerX509Certificate(body []byte) error {
+	certificateList, _, err := parseDtlsUint24Vector(body)
+	if err != nil {
+		return err
+	}
+	certificates := []*x509.Certificate{}
+	for len(certificateList) > 0 {
+		var der []byte
+		der, certificateList, err = parseDtlsUint24Vector(certificateList)
+		if err != nil {
+			return err
+		}
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return errors.New("サーバーの証明書がありません")
+	}
+
+	options := x509.VerifyOptions{DNSName: handshake.ServerName, Intermediates: x509.NewCertPool()}
+	if handshake.ServerCertificate != nil {
+		options.Roots = x509.NewCertPool()
+		options.Roots.AddCert(handshake.ServerCertificate)
+	}
+	for _, certificate := range certificates[1:] {
+		options.Intermediates.AddCert(certificate)
+	}
+	if _, err := certificates[0].Verify(options); err != nil {
+		return err
+	}
+	publicKey, ok := certificates[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok || publicKey.Curve != elliptic.P256() {
+		return errors.New("サーバーの証明書の公開鍵がsecp256r1のECDSAではありません")
+	}
+	handshake.serverCertificateKey = publicKey
+	return nil
+}
+
+// parseServerKeyExchange : ServerKeyExchangeの署名を検証し、サーバーのECDH公開鍵を取得する
+// RFC8422 5.4 Server Key Exchange参照
+// 署名対象 : ClientRandom || ServerRandom || ServerECDHParams
+func (handshake *DtlsHandshakeParams) parseServerKeyExchange(body []byte) error {
+	if len(body) < 4 || body[0] != dtlsECCurveTypeNamedCurve ||
+		binary.BigEndian.Uint16(body[1:3]) != dtlsNamedCurveSecp256r1 {
+		return errors.New("未対応の楕円曲線が指定されました")
+	}
+	pointLength := (int)(body[3])
+	paramsLength := 4 + pointLength
+	if len(body) < paramsLength+4 {
+		return errors.New("不正なServerKeyExchangeを検出しました")
+	}
+	if binary.BigEndian.Uint16(body[paramsLength:(paramsLength+2)]) != dtlsSignatureEcdsaSecp256r1Sha256 {
+		return errors.New("未対応の署名アルゴリズムが指定されました")
+	}
+	signatureLength := (int)(binary.BigEndian.Uint16(body[(paramsLength + 2):(paramsLength + 4)]))
+	if len(body) < paramsLength+4+signatureLength {
+		return errors.New("不正なServerKeyExchangeを検出しました")
+	}
+	signature := body[(paramsLength + 4):(paramsLength + 4 + signatureLength)]
+
+	if handshake.serverCertificateKey == nil {
+		return errors.New("サーバーのCertificateを受信していません")
+	}
+	signed := append(append(append([]byte{}, handshake.ClientRandom...), handshake.ServerRandom...), body[:paramsLength]...)
+	hash := sha256.Sum256(signed)
+	if !ecdsa.VerifyASN1(handshake.serverCertificateKey, hash[:], signature) {
+		return errors.New("ServerKeyExchangeの署名の検証に失敗しました")
+	}
+	handshake.serverECDHPublicKey = body[4:paramsLength]
+	return nil
+}
+
+// generateECDHPreMasterSecret : ECDHの鍵を生成し、PreMasterSecretを算出する
+// PreMasterSecretは共有点のx座標
+// RFC8422 5.10 ECDH, ECDSA, and RSA Computations参照
+func (handshake *DtlsHandshakeParams) generateECDHPreMasterSecret() error {
+	serverPublicKey, err := ecdh.P256().NewPublicKey(handshake.serverECDHPublicKey)
+	if err != nil {
+		return err
+	}
+	privateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	preMasterSecret, err := privateKey.ECDH(serverPublicKey)
+	if err != nil {
+		return err
+	}
+	handshake.ecdhPrivateKey = privateKey
+	handshake.PreMasterSecret = preMasterSecret
+	return nil
+}
+
+// clientCertificateBody : クライアントのCertificateの内容を生成する
+// RPKモードはSubjectPublicKeyInfo、Certificateモードはクライアントの証明書のみのcertificate_listとする
+func (handshake *DtlsHandshakeParams) clientCertificateBody() []byte {
+	if handshake.certificateMode() {
+		return dtlsUint24Vector(dtlsUint24Vector(handshake.Certificate))
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&handshake.PrivateKey.PublicKey)
+	if err != nil {
+		return []byte{0, 0, 0}
+	}
+	return dtlsUint24Vector(publicKey)
+}
+
+// clientECDHKeyExchangeBody : ECDHEのClientKeyExchangeの内容を生成する
+// RFC8422 5.7 Client Key Exchange参照
+func (handshake *DtlsHandshakeParams) clientECDHKeyExchangeBody() []byte {
+	publicKey := handshake.ecdhPrivateKey.PublicKey().Bytes()
+	return append([]byte{(byte)(len(publicKey))}, publicKey...)
+}
+
+// certificateVerifyBody : CertificateVerifyの内容を生成する
+// これまでのハンドシェイクメッセージのハッシュにクライアントの秘密鍵で署名する
+// RFC5246 7.4.8 Certificate Verify参照
+func (handshake *DtlsHandshakeParams) certificateVerifyBody() []byte {
+	hash := sha256.Sum256(handshake.Messages)
+	signature, err := ecdsa.SignASN1(rand.Reader, handshake.PrivateKey, hash[:])
+	if err != nil {
+		return []byte{}
+	}
+	ret := make([]byte, 4)
+	binary.BigEndian.PutUint16(ret[0:2], dtlsSignatureEcdsaSecp256r1Sha256)
+	binary.BigEndian.PutUint16(ret[2:4], (uint16)(len(signature)))
+	return append(ret, signature...)
+}
@@ -1,12 +1,20 @@
 package inventoryd
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"time"
 )
 
@@ -23,6 +31,32 @@ type DtlsHandshakeParams struct {
 	MasterSecret    []byte
 	Messages        []byte
 	Verified        bool
+	Resumed         bool     // Session IDによる短縮ハンドシェイク
+	CipherSuites    []uint16 // ClientHelloで提示する暗号スイート
+	CipherSuite     uint16   // ServerHelloで選択された暗号スイート
+
+	// RPK / Certificateモードの鍵(PSKモードの場合はnil)
+	PrivateKey      *ecdsa.PrivateKey
+	ServerPublicKey *ecdsa.PublicKey // RPKモードでサーバーに期待する公開鍵
+
+	// Certificateモードの証明書(RPKモードの場合はnil)
+	Certificate       []byte            // クライアントの証明書(DER)
+	ServerCertificate *x509.Certificate // サーバーの証明書の検証で信頼する証明書(nilの場合はシステムの証明書)
+	ServerName        string            // サーバーの証明書で検証するホスト名
+
+	// Connection ID(RFC9146)
+	ClientConnectionID []byte // ClientHelloで提示する、サーバーからのレコードに付加させるConnection ID
+	ServerConnectionID []byte // ServerHelloで合意した、サーバーへのレコードに付加するConnection ID(合意しない場合はnil)
+
+	received              map[byte]bool                     // 受信済みのHandshakeType
+	fragments             map[uint16]*dtlsHandshakeFragment // 受信中のハンドシェイク(キーはmessage_seq)
+	nextServerSequence    uint16                            // 次に処理するサーバーのmessage_seq
+	serverSequenceStarted bool
+
+	serverCertificateKey *ecdsa.PublicKey // サーバーのCertificateの公開鍵
+	serverECDHPublicKey  []byte           // ServerKeyExchangeのECDH公開鍵
+	ecdhPrivateKey       *ecdh.PrivateKey
+	certificateRequested bool // CertificateRequestを受信した
 }
 
 // DtlsHandshake : Dtlsのハンドシェイク
@@ -38,32 +72,352 @@ const (
 	dtlsHandshakeTypeClientHello        byte = 1
 	dtlsHandshakeTypeServerHello        byte = 2
 	dtlsHandshakeTypeHelloVerifyRequest byte = 3
+	dtlsHandshakeTypeCertificate        byte = 11
+	dtlsHandshakeTypeServerKeyExchange  byte = 12
+	dtlsHandshakeTypeCertificateRequest byte = 13
 	dtlsHandshakeTypeServerHelloDone    byte = 14
+	dtlsHandshakeTypeCertificateVerify  byte = 15
 	dtlsHandshakeTypeClientKeyExchange  byte = 16
 	dtlsHandshakeTypeFinished           byte = 20
 )
 
 const dtlsChangeCipherSpecMessage byte = 1
 
+// 再構成するハンドシェイクの最大長
+// 不正な長さによる過大なメモリ確保を防ぐ
+const dtlsMaxHandshakeLength uint32 = 16384
+
+// 再構成のために保持するハンドシェイクのmessage_seqの範囲(次に処理するmessage_seqからの数)
+// 範囲外のmessage_seqのハンドシェイクは破棄し、保持するメモリを制限する
+const dtlsHandshakeReceiveWindow int = 16
+
 // processHandshake : ハンドシェイクを実行する
+// ハンドシェイクはフライト単位で送信し、相手のフライトを受信できなければ再送する
+// RFC6347 4.2.4 Timeout and Retransmission参照
+// フルハンドシェイクの流れは以下の通り
+//
+//	Client                    Server
+//	ClientHello         -->                         Flight 1
+//	                    <--   HelloVerifyRequest    Flight 2
+//	ClientHello         -->                         Flight 3
+//	                    <--   ServerHello           Flight 4
+//	                          ServerHelloDone
+//	ClientKeyExchange   -->                         Flight 5
+//	ChangeCipherSpec
+//	Finished
+//	                    <--   ChangeCipherSpec      Flight 6
+//	                          Finished
+//
+// ClientHelloで前回のSession IDを提示し、サーバーが同じSession IDを返した場合は
+// 短縮ハンドシェイクとなり、Flight 4以降は以下の通りとなる
+// RFC5246 7.3 Handshake Protocol Overview参照
+//
+//	                    <--   ServerHello           Flight 4
+//	                          ChangeCipherSpec
+//	                          Finished
+//	ChangeCipherSpec    -->                         Flight 5
+//	Finished
 func (dtls *Dtls) processHandshake(ctx context.Context, successNotify chan bool) {
-	if err := dtls.GetCookie(); err != nil {
+	if err := dtls.GetCookie(ctx); err != nil {
 		successNotify <- false
+		return
 	}
-	if err := dtls.GetSession(); err != nil {
+	if err := dtls.GetSession(ctx); err != nil {
 		successNotify <- false
+		return
 	}
-	if err := dtls.SendClientKeyExchange(); err != nil {
-		successNotify <- false
+	if dtls.Handshake.Resumed {
+		if err := dtls.FinishResumption(); err != nil {
+			successNotify <- false
+			return
+		}
+	} else {
+		if err := dtls.Finish(ctx); err != nil {
+			successNotify <- false
+			return
+		}
 	}
-	if err := dtls.SendChangeCipherSpec(); err != nil {
-		successNotify <- false
+	successNotify <- true
+}
+
+// dtlsFlightMessage : フライトを構成するメッセージ
+// 再送時は同じ内容を新しいレコードのSequenceで送信するため、暗号化前の内容を保持する
+type dtlsFlightMessage struct {
+	Type    byte
+	Epoch   uint16
+	Content []byte
+}
+
+// sendFlight : フライトを送信する
+// 現在のEpochのメッセージは必要に応じて暗号化し、
+// Change Cipher Spec前のEpochのメッセージは前のEpochのSequenceで送信する
+// 接続後はReadから呼び出されるため、Writeと排他する
+func (dtls *Dtls) sendFlight(flight []*dtlsFlightMessage) error {
+	dtls.writeMutex.Lock()
+	defer dtls.writeMutex.Unlock()
+	for _, message := range flight {
+		packet := &DtlsPacket{
+			Type:  message.Type,
+			Epoch: message.Epoch}
+		if message.Epoch == dtls.ClientEpoch {
+			packet.Sequence = dtls.ClientSequence
+			if dtls.ClientEncrypt {
+				dtls.encrypt(packet, message.Content)
+			} else {
+				packet.Content = message.Content
+			}
+			dtls.ClientSequence++
+		} else {
+			packet.Sequence = dtls.previousClientSequence
+			packet.Content = message.Content
+			dtls.previousClientSequence++
+		}
+		if _, err := dtls.Connection.Write(packet.ToBytes()); err != nil {
+			return err
+		}
 	}
-	dtls.GenerateSecurityParams()
-	if err := dtls.SendFinished(); err != nil {
-		successNotify <- false
+	return nil
+}
+
+// exchangeFlight : フライトを送信し、相手のフライトを受信し終わるまで待つ
+// タイマーが切れるか、相手が前のフライトを再送してきた場合は自分のフライトを再送する
+// タイマーはフライトの送信時に設定し、それ以外のデータグラムを受信しても延長しない
+// receivedは相手のフライトを全て受信し終わったらtrueを返す
+func (dtls *Dtls) exchangeFlight(ctx context.Context, flight []*dtlsFlightMessage, received func() bool) error {
+	if err := dtls.sendFlight(flight); err != nil {
+		return err
 	}
-	successNotify <- true
+	defer dtls.Connection.SetReadDeadline(time.Time{})
+
+	timeout := dtlsRetransmitInitialTimeout
+	flightDeadline := time.Now().Add(timeout)
+	buf := make([]byte, dtlsPacketSize)
+	for !received() {
+		if dtls.handshakeError != nil {
+			return dtls.handshakeError
+		}
+		deadline := flightDeadline
+		ctxDeadline, hasDeadline := ctx.Deadline()
+		lastChance := hasDeadline && !ctxDeadline.After(deadline)
+		if lastChance {
+			deadline = ctxDeadline
+		}
+		dtls.Connection.SetReadDeadline(deadline)
+		readLen, err := dtls.Connection.Read(buf)
+		if err != nil {
+			netErr, ok := err.(net.Error)
+			if !ok || !netErr.Timeout() || lastChance {
+				return err
+			}
+			timeout *= 2
+			if timeout > dtlsRetransmitMaxTimeout {
+				timeout = dtlsRetransmitMaxTimeout
+			}
+			if err := dtls.sendFlight(flight); err != nil {
+				return err
+			}
+			flightDeadline = time.Now().Add(timeout)
+			continue
+		}
+
+		dtls.retransmitRequested = false
+		packets := dtls.ParsePackets(buf[:readLen])
+		if alert := receivedAlert(packets); alert != nil {
+			return alert
+		}
+		if dtls.handshakeError != nil {
+			return dtls.handshakeError
+		}
+		if dtls.retransmitRequested && !received() {
+			if err := dtls.sendFlight(flight); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dtlsHandshakeFragment : 断片化されたハンドシェイクの再構成バッファ
+// RFC6347 4.2.3 Handshake Message Fragmentation and Reassembly参照
+type dtlsHandshakeFragment struct {
+	Type     byte
+	Length   uint32
+	Body     []byte
+	received []bool // 受信済みのバイト
+}
+
+// isComplete : 全ての断片を受信したか
+func (fragment *dtlsHandshakeFragment) isComplete() bool {
+	for _, received := range fragment.received {
+		if !received {
+			return false
+		}
+	}
+	return true
+}
+
+// toBytes : 断片化されていないハンドシェイクのバイトスライスに変換する
+// Finishedの際のVerify Dataの算出には断片化されていない形式を使用する
+func (fragment *dtlsHandshakeFragment) toBytes(sequence uint16) []byte {
+	ret := make([]byte, 12)
+	ret[0] = fragment.Type
+	lengthBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(lengthBytes, fragment.Length)
+	copy(ret[1:4], lengthBytes[1:4])
+	binary.BigEndian.PutUint16(ret[4:6], sequence)
+	copy(ret[9:12], lengthBytes[1:4])
+	return append(ret, fragment.Body...)
+}
+
+// receiveHandshake : 受信したハンドシェイクを処理する
+// ハンドシェイクは断片化されたり、順番が入れ替わって届く場合があるため、
+// message_seqごとに再構成し、message_seqの順に処理する
+// 1つのレコードに複数のハンドシェイクが含まれる場合もある
+// 処理済みのmessage_seqのハンドシェイクは相手の再送であり、こちらのフライトが届いていないため再送を要求する
+func (dtls *Dtls) receiveHandshake(raw []byte) {
+	params := dtls.Handshake
+	for len(raw) >= 12 {
+		handshakeType := raw[0]
+		length := binary.BigEndian.Uint32(append([]byte{0}, raw[1:4]...))
+		sequence := binary.BigEndian.Uint16(raw[4:6])
+		fragmentOffset := binary.BigEndian.Uint32(append([]byte{0}, raw[6:9]...))
+		fragmentLength := binary.BigEndian.Uint32(append([]byte{0}, raw[9:12]...))
+		if len(raw) < 12+(int)(fragmentLength) || fragmentOffset+fragmentLength > length || length > dtlsMaxHandshakeLength {
+			return
+		}
+		body := raw[12:(12 + fragmentLength)]
+		raw = raw[(12 + fragmentLength):]
+
+		// HelloVerifyRequestはmessage_seqの管理外とする(stateless cookie)
+		if handshakeType == dtlsHandshakeTypeHelloVerifyRequest {
+			if fragmentOffset == 0 && fragmentLength == length {
+				fragment := &dtlsHandshakeFragment{Type: handshakeType, Length: length, Body: body}
+				dtls.parseHandshake(fragment.toBytes(sequence))
+			}
+			continue
+		}
+
+		if params.serverSequenceStarted && sequence < params.nextServerSequence {
+			dtls.retransmitRequested = true
+			continue
+		}
+		if (int)(sequence) >= (int)(params.nextServerSequence)+dtlsHandshakeReceiveWindow {
+			continue
+		}
+		if params.fragments == nil {
+			params.fragments = make(map[uint16]*dtlsHandshakeFragment)
+		}
+		fragment, exist := params.fragments[sequence]
+		if !exist {
+			fragment = &dtlsHandshakeFragment{
+				Type:     handshakeType,
+				Length:   length,
+				Body:     make([]byte, length),
+				received: make([]bool, length)}
+			params.fragments[sequence] = fragment
+		}
+		if fragment.Type != handshakeType || fragment.Length != length {
+			continue
+		}
+		copy(fragment.Body[fragmentOffset:], body)
+		for i := fragmentOffset; i < fragmentOffset+fragmentLength; i++ {
+			fragment.received[i] = true
+		}
+	}
+	dtls.processBufferedHandshakes()
+}
+
+// processBufferedHandshakes : 再構成の終わったハンドシェイクをmessage_seqの順に処理する
+// サーバーの最初のmessage_seqはHelloVerifyRequestの有無や実装により異なるため、
+// ServerHelloのmessage_seqを起点とする
+func (dtls *Dtls) processBufferedHandshakes() {
+	params := dtls.Handshake
+	if !params.serverSequenceStarted {
+		for sequence, fragment := range params.fragments {
+			if fragment.Type == dtlsHandshakeTypeServerHello && fragment.isComplete() {
+				params.nextServerSequence = sequence
+				params.serverSequenceStarted = true
+				break
+			}
+		}
+		if !params.serverSequenceStarted {
+			return
+		}
+		for sequence := range params.fragments {
+			if sequence < params.nextServerSequence {
+				delete(params.fragments, sequence)
+			}
+		}
+	}
+
+	for {
+		fragment, exist := params.fragments[params.nextServerSequence]
+		if !exist || !fragment.isComplete() {
+			return
+		}
+		dtls.parseHandshake(fragment.toBytes(params.nextServerSequence))
+		delete(params.fragments, params.nextServerSequence)
+		params.nextServerSequence++
+	}
+}
+
+// parseHandshake : 断片化されていないハンドシェイクを解析する
+// ServerHelloで選択された暗号スイートが提示したものでなければハンドシェイクを失敗とする
+// 短縮ハンドシェイクの場合はサーバーのFinishedを復号するため、ServerHelloの時点で鍵を生成する
+func (dtls *Dtls) parseHandshake(raw []byte) {
+	handshake := &DtlsHandshake{Params: dtls.Handshake}
+	if err := handshake.Parse(raw); err != nil {
+		dtls.handshakeError = err
+		return
+	}
+	if handshake.Type == dtlsHandshakeTypeServerHello {
+		if err := dtls.Handshake.parseServerHelloExtensions(raw); err != nil {
+			dtls.handshakeError = err
+			return
+		}
+		dtls.cipherSuite = dtls.Handshake.selectedCipherSuite()
+		if dtls.cipherSuite == nil {
+			dtls.handshakeError = errors.New("サーバーが提示していない暗号スイートを選択しました")
+			return
+		}
+		if dtls.Handshake.Resumed {
+			dtls.GenerateSecurityParams()
+		}
+	}
+	switch handshake.Type {
+	case dtlsHandshakeTypeCertificate:
+		if err := dtls.Handshake.parseServerCertificate(raw[12:]); err != nil {
+			dtls.handshakeError = err
+			return
+		}
+	case dtlsHandshakeTypeServerKeyExchange:
+		if err := dtls.Handshake.parseServerKeyExchange(raw[12:]); err != nil {
+			dtls.handshakeError = err
+			return
+		}
+	case dtlsHandshakeTypeCertificateRequest:
+		dtls.Handshake.certificateRequested = true
+	}
+	if dtls.Handshake.received == nil {
+		dtls.Handshake.received = make(map[byte]bool)
+	}
+	dtls.Handshake.received[handshake.Type] = true
+}
+
+// selectedCipherSuite : ServerHelloで選択された暗号スイートを取得する
+// ClientHelloで提示していない暗号スイートの場合はnilを返す
+func (handshake *DtlsHandshakeParams) selectedCipherSuite() *dtlsCipherSuite {
+	for _, cipherSuite := range handshake.CipherSuites {
+		if cipherSuite == handshake.CipherSuite {
+			return findDtlsCipherSuite(cipherSuite)
+		}
+	}
+	return nil
+}
+
+// hasReceived : 指定した種類のハンドシェイクを受信済みか
+func (handshake *DtlsHandshakeParams) hasReceived(handshakeType byte) bool {
+	return handshake.received[handshakeType]
 }
 
 // DtlsPreMasterSecretFromPSK : PSKからPreMasterSecretを生成する
@@ -98,23 +452,32 @@ func DtlsClientRandom() []byte {
 }
 
 // GenerateSecurityParams : Master Secret / KeyBlockを生成する
+// 短縮ハンドシェイクの場合は前回のMaster Secretをそのまま使用する
 func (dtls *Dtls) GenerateSecurityParams() {
-	dtls.Handshake.MasterSecret = dtlsPrf(
-		dtls.Handshake.PreMasterSecret,
-		[]byte("master secret"),
-		append(dtls.Handshake.ClientRandom, dtls.Handshake.ServerRandom...),
-		48)
+	if !dtls.Handshake.Resumed {
+		dtls.Handshake.MasterSecret = dtlsPrf(
+			dtls.Handshake.PreMasterSecret,
+			[]byte("master secret"),
+			append(dtls.Handshake.ClientRandom, dtls.Handshake.ServerRandom...),
+			48)
+	}
 
+	// Key Blockは暗号スイートにより長さが異なる
+	// client_write_MAC_key || server_write_MAC_key || client_write_key || server_write_key || client_write_IV || server_write_IV
+	// RFC5246 6.3 Key Calculation参照
+	suite := dtls.cipherSuite
 	keyBlock := dtlsPrf(
 		dtls.Handshake.MasterSecret,
 		[]byte("key expansion"),
 		append(dtls.Handshake.ServerRandom, dtls.Handshake.ClientRandom...),
-		40)
+		suite.KeyBlockLength())
 
-	dtls.ClientWriteKey = keyBlock[0:16]
-	dtls.ServerWriteKey = keyBlock[16:32]
-	dtls.ClientIV = keyBlock[32:36]
-	dtls.ServerIV = keyBlock[36:40]
+	dtls.ClientMACKey, keyBlock = keyBlock[:suite.MACKeyLength], keyBlock[suite.MACKeyLength:]
+	dtls.ServerMACKey, keyBlock = keyBlock[:suite.MACKeyLength], keyBlock[suite.MACKeyLength:]
+	dtls.ClientWriteKey, keyBlock = keyBlock[:suite.KeyLength], keyBlock[suite.KeyLength:]
+	dtls.ServerWriteKey, keyBlock = keyBlock[:suite.KeyLength], keyBlock[suite.KeyLength:]
+	dtls.ClientIV, keyBlock = keyBlock[:suite.IVLength], keyBlock[suite.IVLength:]
+	dtls.ServerIV = keyBlock[:suite.IVLength]
 }
 
 // GenerateClientVerifyData : ClientからのFinishedのVerify Dataを生成する
@@ -169,133 +532,173 @@ func dtlsPrf(secret []byte, label []byte, seed []byte, length int) []byte {
 // If HelloVerifyRequest is used, the initial ClientHello and HelloVerifyRequest are not included
 // in the calculation of the handshake_messages (for the CertificateVerify message) and
 // verify_data (for the Finished message).
-func (dtls *Dtls) GetCookie() error {
-	packet := &DtlsPacket{
-		Type:     dtlsContentTypeHandshake,
-		Epoch:    dtls.ClientEpoch,
-		Sequence: dtls.ClientSequence}
+func (dtls *Dtls) GetCookie(ctx context.Context) error {
 	handshake := &DtlsHandshake{
 		Type:     dtlsHandshakeTypeClientHello,
 		Sequence: dtls.Handshake.ClientSequence,
 		Params:   dtls.Handshake}
-	packet.Content = handshake.ToBytes()
-	dtls.Connection.Write(packet.ToBytes())
-	dtls.ClientSequence++
+	flight := []*dtlsFlightMessage{
+		&dtlsFlightMessage{Type: dtlsContentTypeHandshake, Epoch: dtls.ClientEpoch, Content: handshake.ToBytes()}}
 	dtls.Handshake.ClientSequence++
 
-	buf := make([]byte, dtlsPacketSize)
-	readLen, err := dtls.Connection.Read(buf)
-	if err != nil {
-		return err
-	}
-	helloVerifyRequest := dtls.ParsePacket(buf[:readLen])
-	if helloVerifyRequest == nil {
-		return errors.New("不正なDTLSハンドシェイクを検出しました")
-	}
-	return nil
+	return dtls.exchangeFlight(ctx, flight, func() bool {
+		return dtls.Handshake.hasReceived(dtlsHandshakeTypeHelloVerifyRequest)
+	})
 }
 
 // GetSession : Session IDを取得する
-func (dtls *Dtls) GetSession() error {
-	packet := &DtlsPacket{
-		Type:     dtlsContentTypeHandshake,
-		Epoch:    dtls.ClientEpoch,
-		Sequence: dtls.ClientSequence}
+func (dtls *Dtls) GetSession(ctx context.Context) error {
 	handshake := &DtlsHandshake{
 		Type:     dtlsHandshakeTypeClientHello,
 		Sequence: dtls.Handshake.ClientSequence,
 		Params:   dtls.Handshake}
-	packet.Content = handshake.ToBytes()
-	dtls.Handshake.Messages = append(dtls.Handshake.Messages, (packet.Content)...)
-
-	dtls.Connection.Write(packet.ToBytes())
-	dtls.ClientSequence++
+	content := handshake.ToBytes()
+	dtls.Handshake.Messages = append(dtls.Handshake.Messages, content...)
+	flight := []*dtlsFlightMessage{
+		&dtlsFlightMessage{Type: dtlsContentTypeHandshake, Epoch: dtls.ClientEpoch, Content: content}}
 	dtls.Handshake.ClientSequence++
 
-	buf := make([]byte, dtlsPacketSize)
-	readLen, err := dtls.Connection.Read(buf)
-	if err != nil {
-		return err
-	}
-	serverHello := dtls.ParsePacket(buf[:readLen])
-	if serverHello == nil {
-		return errors.New("不正なDTLSハンドシェイクを検出しました")
-	}
-	serverHelloDone := dtls.ParsePacket(buf[(serverHello.Length()):readLen])
-	if serverHelloDone == nil {
-		return errors.New("不正なDTLSハンドシェイクを検出しました")
-	}
-	return nil
-}
-
-// SendClientKeyExchange : Client Key Exchangeを送信する
-func (dtls *Dtls) SendClientKeyExchange() error {
-	packet := &DtlsPacket{
-		Type:     dtlsContentTypeHandshake,
-		Epoch:    dtls.ClientEpoch,
-		Sequence: dtls.ClientSequence}
-	handshake := &DtlsHandshake{
-		Type:     dtlsHandshakeTypeClientKeyExchange,
-		Sequence: dtls.Handshake.ClientSequence,
-		Params:   dtls.Handshake}
-	packet.Content = handshake.ToBytes()
-	dtls.Handshake.Messages = append(dtls.Handshake.Messages, (packet.Content)...)
-	dtls.Connection.Write(packet.ToBytes())
-	dtls.ClientSequence++
-	dtls.Handshake.ClientSequence++
-	return nil
+	// フルハンドシェイクはServerHelloDone、短縮ハンドシェイクはFinishedまで受信する
+	return dtls.exchangeFlight(ctx, flight, func() bool {
+		return dtls.Handshake.hasReceived(dtlsHandshakeTypeServerHelloDone) ||
+			dtls.Handshake.hasReceived(dtlsHandshakeTypeFinished)
+	})
 }
 
-// SendChangeCipherSpec : Change Cipher Specを送信する
+// Finish : Client Key Exchange / Change Cipher Spec / Finishedを送信し、
+// サーバーのFinishedを検証する
 // Change Cipher Specの際にEpochを加算し、Sequenceはクリアする
 // The epoch number is initially zero and is incremented each time a ChangeCipherSpec message is sent.
 // Sequence numbers are maintained separately for each epoch, with each sequence_number initially being 0 for each epoch.
 // 詳細はRFC6347 4.1 Record Layer参照
 // なお、Change Cipher SpecはHandshakeではないため、Finishedの際のVerify Dataの算出には含めない
-func (dtls *Dtls) SendChangeCipherSpec() error {
-	packet := &DtlsPacket{
-		Type:     dtlsContentTypeChangeCipherSpec,
-		Epoch:    dtls.ClientEpoch,
-		Sequence: dtls.ClientSequence}
-	packet.Content = []byte{dtlsChangeCipherSpecMessage}
-	dtls.Connection.Write(packet.ToBytes())
+func (dtls *Dtls) Finish(ctx context.Context) error {
+	// RPK / Certificateモードの場合はECDHでPreMasterSecretを算出し、
+	// CertificateRequestを受信していればCertificateとCertificateVerifyも送信する
+	// RFC8422 2. Key Exchange Algorithm参照
+	handshakeTypes := []byte{dtlsHandshakeTypeClientKeyExchange}
+	if dtls.Handshake.PrivateKey != nil {
+		if err := dtls.Handshake.generateECDHPreMasterSecret(); err != nil {
+			return err
+		}
+		if dtls.Handshake.certificateRequested {
+			handshakeTypes = []byte{
+				dtlsHandshakeTypeCertificate,
+				dtlsHandshakeTypeClientKeyExchange,
+				dtlsHandshakeTypeCertificateVerify}
+		}
+	}
+
+	flight := []*dtlsFlightMessage{}
+	for _, handshakeType := range handshakeTypes {
+		handshake := &DtlsHandshake{
+			Type:     handshakeType,
+			Sequence: dtls.Handshake.ClientSequence,
+			Params:   dtls.Handshake}
+		content := handshake.ToBytes()
+		dtls.Handshake.Messages = append(dtls.Handshake.Messages, content...)
+		dtls.Handshake.ClientSequence++
+		flight = append(flight, &dtlsFlightMessage{Type: dtlsContentTypeHandshake, Epoch: dtls.ClientEpoch, Content: content})
+	}
+
+	dtls.GenerateSecurityParams()
+
+	finished := &DtlsHandshake{
+		Type:     dtlsHandshakeTypeFinished,
+		Sequence: dtls.Handshake.ClientSequence,
+		Params:   dtls.Handshake}
+	finishedContent := finished.ToBytes()
+	dtls.Handshake.Messages = append(dtls.Handshake.Messages, finishedContent...)
+	dtls.Handshake.ClientSequence++
+
+	flight = append(flight,
+		&dtlsFlightMessage{Type: dtlsContentTypeChangeCipherSpec, Epoch: dtls.ClientEpoch, Content: []byte{dtlsChangeCipherSpecMessage}},
+		&dtlsFlightMessage{Type: dtlsContentTypeHandshake, Epoch: dtls.ClientEpoch + 1, Content: finishedContent})
+	dtls.previousClientSequence = dtls.ClientSequence
 	dtls.ClientEpoch++
 	dtls.ClientSequence = 0
 	dtls.ClientEncrypt = true
+
+	err := dtls.exchangeFlight(ctx, flight, func() bool {
+		return dtls.Handshake.hasReceived(dtlsHandshakeTypeFinished)
+	})
+	if err != nil {
+		return err
+	}
+	if !dtls.Handshake.Verified {
+		return errors.New("サーバーのFinishedの検証に失敗しました")
+	}
 	return nil
 }
 
-// SendFinished : Finishedを送信する
-func (dtls *Dtls) SendFinished() error {
-	packet := &DtlsPacket{
-		Type:     dtlsContentTypeHandshake,
-		Epoch:    dtls.ClientEpoch,
-		Sequence: dtls.ClientSequence}
-	handshake := &DtlsHandshake{
+// FinishResumption : 短縮ハンドシェイクのChange Cipher Spec / Finishedを送信する
+// 最後のフライトはサーバーからの応答が無いため、サーバーが再送してきた場合に備えて保持しておく
+func (dtls *Dtls) FinishResumption() error {
+	if !dtls.Handshake.Verified {
+		return errors.New("サーバーのFinishedの検証に失敗しました")
+	}
+
+	finished := &DtlsHandshake{
 		Type:     dtlsHandshakeTypeFinished,
 		Sequence: dtls.Handshake.ClientSequence,
 		Params:   dtls.Handshake}
-	plainHandshake := handshake.ToBytes()
-	dtls.Handshake.Messages = append(dtls.Handshake.Messages, plainHandshake...)
-	packet.Content = dtls.encrypt(plainHandshake, packet.Type)
-	dtls.Connection.Write(packet.ToBytes())
-	dtls.ClientSequence++
+	finishedContent := finished.ToBytes()
+	dtls.Handshake.Messages = append(dtls.Handshake.Messages, finishedContent...)
 	dtls.Handshake.ClientSequence++
 
-	buf := make([]byte, dtlsPacketSize)
-	readLen, err := dtls.Connection.Read(buf)
+	flight := []*dtlsFlightMessage{
+		&dtlsFlightMessage{Type: dtlsContentTypeChangeCipherSpec, Epoch: dtls.ClientEpoch, Content: []byte{dtlsChangeCipherSpecMessage}},
+		&dtlsFlightMessage{Type: dtlsContentTypeHandshake, Epoch: dtls.ClientEpoch + 1, Content: finishedContent}}
+	dtls.previousClientSequence = dtls.ClientSequence
+	dtls.ClientEpoch++
+	dtls.ClientSequence = 0
+	dtls.ClientEncrypt = true
+	dtls.lastFlight = flight
+	return dtls.sendFlight(flight)
+}
+
+// DtlsSession : セッション再開用に保持するセッション情報
+// 接続先やIdentityが変わった場合は使用しない
+type DtlsSession struct {
+	Host         string `json:"host"`
+	Identity     []byte `json:"identity"`
+	ID           []byte `json:"id"`
+	MasterSecret []byte `json:"masterSecret"`
+}
+
+// Session : 確立したセッションの情報を取得する
+// Host / Identityは接続時の設定と照合するため、呼び出し側で設定する
+// サーバーがSession IDを払い出さなかった場合(セッション再開非対応)はnilを返す
+func (dtls *Dtls) Session() *DtlsSession {
+	if len(dtls.Handshake.Session) == 0 {
+		return nil
+	}
+	return &DtlsSession{
+		ID:           dtls.Handshake.Session,
+		MasterSecret: dtls.Handshake.MasterSecret}
+}
+
+// LoadDtlsSession : ファイルからセッション情報を読み出す
+func LoadDtlsSession(sessionPath string) (*DtlsSession, error) {
+	bytes, err := ioutil.ReadFile(sessionPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	changeCipherSpec := dtls.ParsePacket(buf[:readLen])
-	if changeCipherSpec == nil {
-		return errors.New("不正なDTLSハンドシェイクを検出しました")
+	session := &DtlsSession{}
+	if err := json.Unmarshal(bytes, session); err != nil {
+		return nil, err
 	}
-	serverVefiry := dtls.ParsePacket(buf[(changeCipherSpec.Length()):readLen])
-	if serverVefiry == nil {
-		return errors.New("不正なDTLSハンドシェイクを検出しました")
+	return session, nil
+}
+
+// Save : セッション情報をファイルに保存する
+// Master Secretを含むため、所有者のみ読み書き可能とする
+func (session *DtlsSession) Save(sessionPath string) error {
+	jsonStr, err := json.Marshal(session)
+	if err != nil {
+		return err
 	}
-	return nil
+	return ioutil.WriteFile(sessionPath, jsonStr, 0600)
 }
 
 // ToBytes : DTLSのハンドシェイクをバイトスライスに変換する
@@ -313,15 +716,33 @@ func (handshake *DtlsHandshake) ToBytes() []byte {
 		ret = append(ret, handshake.Params.Session...)
 		ret = append(ret, (byte)(len(handshake.Params.Cookie)))
 		ret = append(ret, handshake.Params.Cookie...)
-		cipherSuiteBytes := make([]byte, 2)
-		binary.BigEndian.PutUint16(cipherSuiteBytes, dtlsCipherSuite)
-		ret = append(ret, []byte{0x00, 0x02}...)
-		ret = append(ret, cipherSuiteBytes...)
+		cipherSuitesBytes := make([]byte, 2+2*len(handshake.Params.CipherSuites))
+		binary.BigEndian.PutUint16(cipherSuitesBytes[0:2], (uint16)(2*len(handshake.Params.CipherSuites)))
+		for i, cipherSuite := range handshake.Params.CipherSuites {
+			binary.BigEndian.PutUint16(cipherSuitesBytes[(2+2*i):(4+2*i)], cipherSuite)
+		}
+		ret = append(ret, cipherSuitesBytes...)
 		ret = append(ret, []byte{0x01, dtlsCompress}...)
+		extensions := handshake.Params.connectionIDExtension()
+		if handshake.Params.PrivateKey != nil {
+			extensions = append(extensions, handshake.Params.ecdheEcdsaExtensions()...)
+		}
+		extensionsLength := make([]byte, 2)
+		binary.BigEndian.PutUint16(extensionsLength, (uint16)(len(extensions)))
+		ret = append(ret, extensionsLength...)
+		ret = append(ret, extensions...)
+	case dtlsHandshakeTypeCertificate:
+		ret = append(ret, handshake.Params.clientCertificateBody()...)
 	case dtlsHandshakeTypeClientKeyExchange:
-		ret = append(ret, make([]byte, 2)...)
-		binary.BigEndian.PutUint16(ret[12:14], (uint16)(len(handshake.Params.Identity)))
-		ret = append(ret, handshake.Params.Identity...)
+		if handshake.Params.PrivateKey != nil {
+			ret = append(ret, handshake.Params.clientECDHKeyExchangeBody()...)
+		} else {
+			ret = append(ret, make([]byte, 2)...)
+			binary.BigEndian.PutUint16(ret[12:14], (uint16)(len(handshake.Params.Identity)))
+			ret = append(ret, handshake.Params.Identity...)
+		}
+	case dtlsHandshakeTypeCertificateVerify:
+		ret = append(ret, handshake.Params.certificateVerifyBody()...)
 	case dtlsHandshakeTypeFinished:
 		ret = append(ret, handshake.Params.GenerateClientVerifyData()...)
 	default:
@@ -335,29 +756,53 @@ func (handshake *DtlsHandshake) ToBytes() []byte {
 }
 
 // Parse : 生データのハンドシェイク部を解析する
-func (handshake *DtlsHandshake) Parse(raw []byte) {
+// 本体の長さが不足している場合はエラーを返す
+// RFC6347 4.2.1 Denial-of-Service Countermeasures、RFC5246 7.4 Handshake Protocol参照
+func (handshake *DtlsHandshake) Parse(raw []byte) error {
+	if len(raw) < 12 {
+		return errors.New("ハンドシェイクのヘッダが不足しています")
+	}
 	handshake.Type = raw[0]
-	length := binary.BigEndian.Uint32(append([]byte{0}, raw[1:4]...))
+	length := (int)(binary.BigEndian.Uint32(append([]byte{0}, raw[1:4]...)))
 	handshake.Sequence = binary.BigEndian.Uint16(raw[4:6])
 	handshake.Params.ServerSequence = handshake.Sequence
+	if len(raw) < 12+length {
+		return errors.New("ハンドシェイクの本体が不足しています")
+	}
+	body := raw[12:(12 + length)]
 	switch handshake.Type {
 	case dtlsHandshakeTypeHelloVerifyRequest:
-		handshake.Params.Cookie = raw[15:47]
+		// server_version(2) + cookie長(1) + cookie
+		if len(body) < 3 || len(body) < 3+(int)(body[2]) {
+			return errors.New("不正なHelloVerifyRequestを検出しました")
+		}
+		handshake.Params.Cookie = append([]byte{}, body[3:(3+(int)(body[2]))]...)
 	case dtlsHandshakeTypeServerHello:
-		handshake.Params.ServerRandom = raw[14:46]
-		handshake.Params.Session = raw[47:79]
+		// server_version(2) + random(32) + session_id長(1) + session_id + cipher_suite(2) + compression_method(1)
+		if len(body) < 35 || len(body) < 38+(int)(body[34]) {
+			return errors.New("不正なServerHelloを検出しました")
+		}
+		// 受信バッファを参照したままにすると、Key Block算出時のappendでSession IDが上書きされるためコピーする
+		handshake.Params.ServerRandom = append([]byte{}, body[2:34]...)
+		sessionLength := (int)(body[34])
+		session := append([]byte{}, body[35:(35+sessionLength)]...)
+		// 提示したSession IDが返ってきた場合は短縮ハンドシェイク
+		handshake.Params.Resumed = len(handshake.Params.Session) > 0 && bytes.Equal(handshake.Params.Session, session)
+		handshake.Params.Session = session
+		handshake.Params.CipherSuite = binary.BigEndian.Uint16(body[(35 + sessionLength):(37 + sessionLength)])
 		handshake.Params.Messages = append(handshake.Params.Messages, raw[:(12+length)]...)
-	case dtlsHandshakeTypeServerHelloDone:
+	case dtlsHandshakeTypeCertificate, dtlsHandshakeTypeServerKeyExchange,
+		dtlsHandshakeTypeCertificateRequest, dtlsHandshakeTypeServerHelloDone:
 		handshake.Params.Messages = append(handshake.Params.Messages, raw[:(12+length)]...)
 	case dtlsHandshakeTypeFinished:
 		verifyData := handshake.Params.GenerateServerVerifyData()
-		serverVerify := raw[12:24]
-		handshake.Params.Verified = true
-		for i := 0; i < len(verifyData); i++ {
-			if verifyData[i] != serverVerify[i] {
-				handshake.Params.Verified = false
-			}
+		if len(body) != len(verifyData) {
+			return errors.New("不正なFinishedを検出しました")
 		}
+		handshake.Params.Verified = subtle.ConstantTimeCompare(verifyData, body) == 1
+		// 短縮ハンドシェイクではクライアントのFinishedの算出にサーバーのFinishedを含める
+		handshake.Params.Messages = append(handshake.Params.Messages, raw[:(12+length)]...)
 	default:
 	}
+	return nil
 }
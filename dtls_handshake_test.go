@@ -0,0 +1,185 @@
+package inventoryd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// dtlsTestHandshake : ハンドシェイクのヘッダ(断片化なし)と本体を連結する
+func dtlsTestHandshake(handshakeType byte, sequence uint16, body []byte) []byte {
+	fragment := &dtlsHandshakeFragment{Type: handshakeType, Length: (uint32)(len(body)), Body: body}
+	return fragment.toBytes(sequence)
+}
+
+// TestDtlsHandshakeParseTruncated : 本体が短いハンドシェイクの解析がpanicせずエラーになることを確認する
+func TestDtlsHandshakeParseTruncated(t *testing.T) {
+	cases := []struct {
+		handshakeType byte
+		validLength   int // この長さ以上であれば解析できる
+	}{
+		{dtlsHandshakeTypeHelloVerifyRequest, 3 + 32},
+		{dtlsHandshakeTypeServerHello, 38},
+		{dtlsHandshakeTypeFinished, 12},
+	}
+	for _, c := range cases {
+		for length := 0; length < c.validLength; length++ {
+			body := make([]byte, length)
+			if c.handshakeType == dtlsHandshakeTypeHelloVerifyRequest && length >= 3 {
+				body[2] = 32 // cookie長
+			}
+			handshake := &DtlsHandshake{Params: &DtlsHandshakeParams{}}
+			if err := handshake.Parse(dtlsTestHandshake(c.handshakeType, 1, body)); err == nil {
+				t.Fatalf("type=%d length=%d がエラーになりません", c.handshakeType, length)
+			}
+		}
+	}
+
+	// ヘッダのLengthが実際の本体より長い
+	raw := dtlsTestHandshake(dtlsHandshakeTypeServerHello, 1, make([]byte, 38))
+	raw[3] = 0xFF
+	handshake := &DtlsHandshake{Params: &DtlsHandshakeParams{}}
+	if err := handshake.Parse(raw); err == nil {
+		t.Fatal("本体が不足したServerHelloがエラーになりません")
+	}
+}
+
+// TestDtlsHandshakeParseCookie : HelloVerifyRequestのcookie長に従ってcookieを取得することを確認する
+func TestDtlsHandshakeParseCookie(t *testing.T) {
+	for _, cookieLength := range []int{0, 1, 32, 255} {
+		body := []byte{0xFE, 0xFD, (byte)(cookieLength)}
+		for i := 0; i < cookieLength; i++ {
+			body = append(body, (byte)(i))
+		}
+		handshake := &DtlsHandshake{Params: &DtlsHandshakeParams{}}
+		if err := handshake.Parse(dtlsTestHandshake(dtlsHandshakeTypeHelloVerifyRequest, 0, body)); err != nil {
+			t.Fatal(err)
+		}
+		if len(handshake.Params.Cookie) != cookieLength {
+			t.Fatalf("cookie長が一致しません expected=%d actual=%d", cookieLength, len(handshake.Params.Cookie))
+		}
+	}
+}
+
+// TestDtlsReceiveHandshakeWindow : 範囲外のmessage_seqのハンドシェイクを保持しないことを確認する
+func TestDtlsReceiveHandshakeWindow(t *testing.T) {
+	dtls := &Dtls{Handshake: &DtlsHandshakeParams{}}
+	for sequence := 0; sequence < 1000; sequence++ {
+		// 最初の断片のみを送り、再構成が終わらないようにする
+		raw := make([]byte, 12+1)
+		raw[0] = dtlsHandshakeTypeCertificate
+		raw[3] = 100 // length
+		binary.BigEndian.PutUint16(raw[4:6], (uint16)(sequence))
+		raw[11] = 1 // fragment_length
+		dtls.receiveHandshake(raw)
+	}
+	if len(dtls.Handshake.fragments) > dtlsHandshakeReceiveWindow {
+		t.Fatalf("保持しているハンドシェイクが多すぎます %d", len(dtls.Handshake.fragments))
+	}
+}
+
+// dtlsTestFragment : ハンドシェイクの本体のうちoffsetからlengthバイトを断片として切り出す
+func dtlsTestFragment(handshakeType byte, sequence uint16, body []byte, offset, length int) []byte {
+	raw := make([]byte, 12)
+	raw[0] = handshakeType
+	raw[1], raw[2], raw[3] = (byte)(len(body)>>16), (byte)(len(body)>>8), (byte)(len(body))
+	binary.BigEndian.PutUint16(raw[4:6], sequence)
+	raw[6], raw[7], raw[8] = (byte)(offset>>16), (byte)(offset>>8), (byte)(offset)
+	raw[9], raw[10], raw[11] = (byte)(length>>16), (byte)(length>>8), (byte)(length)
+	return append(raw, body[offset:(offset+length)]...)
+}
+
+// dtlsTestServerHelloBody : TLS_PSK_WITH_AES_128_CCM_8を選択するServerHelloの本体
+func dtlsTestServerHelloBody() []byte {
+	body := []byte{0xfe, 0xfd}
+	for i := 0; i < 32; i++ {
+		body = append(body, (byte)(i))
+	}
+	body = append(body, 0) // Session ID無し
+	return append(body, (byte)(dtlsCipherSuitePskAes128Ccm8>>8), (byte)(dtlsCipherSuitePskAes128Ccm8&0xff), dtlsCompress)
+}
+
+// newDtlsTestReassembly : ServerHello(message_seq=1)とServerHelloDone(message_seq=2)を受信するDtls
+func newDtlsTestReassembly() *Dtls {
+	return &Dtls{Handshake: &DtlsHandshakeParams{CipherSuites: []uint16{dtlsCipherSuitePskAes128Ccm8}}}
+}
+
+// assertDtlsTestReassembled : ServerHelloとServerHelloDoneが断片化されていない形式で処理されたことを確認する
+func assertDtlsTestReassembled(t *testing.T, dtls *Dtls, serverHello []byte) {
+	t.Helper()
+	params := dtls.Handshake
+	if dtls.handshakeError != nil {
+		t.Fatal(dtls.handshakeError)
+	}
+	if !params.hasReceived(dtlsHandshakeTypeServerHello) || !params.hasReceived(dtlsHandshakeTypeServerHelloDone) {
+		t.Fatal("再構成したハンドシェイクが処理されていません")
+	}
+	if !bytes.Equal(params.ServerRandom, serverHello[2:34]) {
+		t.Fatalf("ServerRandomが一致しません %x", params.ServerRandom)
+	}
+	expected := append(dtlsTestHandshake(dtlsHandshakeTypeServerHello, 1, serverHello),
+		dtlsTestHandshake(dtlsHandshakeTypeServerHelloDone, 2, []byte{})...)
+	if !bytes.Equal(params.Messages, expected) {
+		t.Fatalf("Finishedの検証に使うハンドシェイクが断片化されていない形式と一致しません %x", params.Messages)
+	}
+	if params.nextServerSequence != 3 || len(params.fragments) != 0 {
+		t.Fatalf("再構成後の状態が不正です next=%d fragments=%d", params.nextServerSequence, len(params.fragments))
+	}
+}
+
+// TestDtlsReceiveHandshakeFragments : 断片化され、順番が入れ替わったハンドシェイクを再構成することを確認する
+// RFC6347 4.2.3 Handshake Message Fragmentation and Reassembly参照
+func TestDtlsReceiveHandshakeFragments(t *testing.T) {
+	serverHello := dtlsTestServerHelloBody()
+	dtls := newDtlsTestReassembly()
+
+	// ServerHelloDoneが先に届いても、ServerHelloが揃うまで処理しない
+	dtls.receiveHandshake(dtlsTestHandshake(dtlsHandshakeTypeServerHelloDone, 2, []byte{}))
+	if dtls.Handshake.hasReceived(dtlsHandshakeTypeServerHelloDone) {
+		t.Fatal("ServerHelloより先にServerHelloDoneを処理しています")
+	}
+
+	// ServerHelloを後ろの断片から、重複する範囲を含めて届ける
+	dtls.receiveHandshake(dtlsTestFragment(dtlsHandshakeTypeServerHello, 1, serverHello, 30, len(serverHello)-30))
+	dtls.receiveHandshake(dtlsTestFragment(dtlsHandshakeTypeServerHello, 1, serverHello, 10, 25))
+	if dtls.Handshake.hasReceived(dtlsHandshakeTypeServerHello) {
+		t.Fatal("不完全なServerHelloを処理しています")
+	}
+	dtls.receiveHandshake(dtlsTestFragment(dtlsHandshakeTypeServerHello, 1, serverHello, 0, 10))
+	assertDtlsTestReassembled(t, dtls, serverHello)
+}
+
+// TestDtlsReceiveHandshakeMultipleMessages : 1つのレコードに含まれる複数のハンドシェイクと断片を処理することを確認する
+func TestDtlsReceiveHandshakeMultipleMessages(t *testing.T) {
+	serverHello := dtlsTestServerHelloBody()
+
+	// ServerHelloとServerHelloDoneが1つのレコードに含まれる
+	dtls := newDtlsTestReassembly()
+	dtls.receiveHandshake(append(dtlsTestHandshake(dtlsHandshakeTypeServerHello, 1, serverHello),
+		dtlsTestHandshake(dtlsHandshakeTypeServerHelloDone, 2, []byte{})...))
+	assertDtlsTestReassembled(t, dtls, serverHello)
+
+	// ServerHelloの後半の断片とServerHelloDoneが1つのレコードに含まれ、前半の断片が後から届く
+	dtls = newDtlsTestReassembly()
+	dtls.receiveHandshake(append(dtlsTestFragment(dtlsHandshakeTypeServerHello, 1, serverHello, 20, len(serverHello)-20),
+		dtlsTestHandshake(dtlsHandshakeTypeServerHelloDone, 2, []byte{})...))
+	dtls.receiveHandshake(dtlsTestFragment(dtlsHandshakeTypeServerHello, 1, serverHello, 0, 20))
+	assertDtlsTestReassembled(t, dtls, serverHello)
+}
+
+// TestDtlsReceiveHandshakeRetransmitted : 処理済みのmessage_seqを再び受信したら再送を要求し、二重に処理しないことを確認する
+func TestDtlsReceiveHandshakeRetransmitted(t *testing.T) {
+	serverHello := dtlsTestServerHelloBody()
+	dtls := newDtlsTestReassembly()
+	flight := append(dtlsTestHandshake(dtlsHandshakeTypeServerHello, 1, serverHello),
+		dtlsTestHandshake(dtlsHandshakeTypeServerHelloDone, 2, []byte{})...)
+	dtls.receiveHandshake(flight)
+	if dtls.retransmitRequested {
+		t.Fatal("初回の受信で再送を要求しています")
+	}
+	dtls.receiveHandshake(flight)
+	if !dtls.retransmitRequested {
+		t.Fatal("相手の再送に対して再送を要求していません")
+	}
+	assertDtlsTestReassembled(t, dtls, serverHello)
+}
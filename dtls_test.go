@@ -0,0 +1,933 @@
+package inventoryd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dtlsLossyConn : 指定した順番の受信 / 送信データグラムを破棄するnet.PacketConn
+// 順番は1から数える
+type dtlsLossyConn struct {
+	net.PacketConn
+	mutex      sync.Mutex
+	reads      int
+	writes     int
+	dropReads  map[int]bool
+	dropWrites map[int]bool
+	onDrop     func(addr net.Addr) // 受信データグラムを破棄した際に呼び出す(nilの場合は何もしない)
+	flights    int                 // 受信したクライアントのフライトの数(破棄したものを含む)
+}
+
+// isDtlsTestFlightStart : クライアントのフライトの先頭(ClientHello / ClientKeyExchange)のデータグラムか
+// クライアントはレコードごとにデータグラムを送信する
+func isDtlsTestFlightStart(datagram []byte) bool {
+	if len(datagram) < 14 || datagram[0] != dtlsContentTypeHandshake {
+		return false
+	}
+	return datagram[13] == dtlsHandshakeTypeClientHello || datagram[13] == dtlsHandshakeTypeClientKeyExchange
+}
+
+// ReadFrom : 破棄する順番のデータグラムは読み捨てて次を待つ
+func (conn *dtlsLossyConn) ReadFrom(buf []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := conn.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return n, addr, err
+		}
+		conn.mutex.Lock()
+		conn.reads++
+		if isDtlsTestFlightStart(buf[:n]) {
+			conn.flights++
+		}
+		drop := conn.dropReads[conn.reads]
+		conn.mutex.Unlock()
+		if !drop {
+			return n, addr, nil
+		}
+		if conn.onDrop != nil {
+			conn.onDrop(addr)
+		}
+	}
+}
+
+// WriteTo : 破棄する順番のデータグラムは送信したことにして送らない
+func (conn *dtlsLossyConn) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	conn.mutex.Lock()
+	conn.writes++
+	drop := conn.dropWrites[conn.writes]
+	conn.mutex.Unlock()
+	if drop {
+		return len(buf), nil
+	}
+	return conn.PacketConn.WriteTo(buf, addr)
+}
+
+// dtlsTestServer : ハンドシェイクのみ行うテスト用のDTLSサーバー
+// 暗号スイートはsuiteで指定し、privateKeyを設定した場合はECDHE_ECDSA、それ以外はPSKとする
+// フライトはひとつのデータグラムで送信し、クライアントが再送してきたら同じフライトを再送する
+// クライアントがsessionIDを提示し、resumeMasterSecretが設定されていれば短縮ハンドシェイクとする
+type dtlsTestServer struct {
+	conn               net.PacketConn
+	psk                []byte
+	suite              *dtlsCipherSuite
+	cookie             []byte
+	sessionID          []byte // ServerHelloで払い出すSession ID(nilの場合は払い出さない)
+	resumeMasterSecret []byte // 再開を受け付けるセッションのMaster Secret(nilの場合は再開しない)
+	resumed            bool
+	clientRandom       []byte
+	serverRandom       []byte
+	messages           []byte
+	helloFlight        [][]byte // ServerHello / ServerHelloDone
+	resumeFinished     []byte   // 短縮ハンドシェイクでServerHelloに続けて送るFinished
+	finishedFlight     [][]byte // ChangeCipherSpec / Finished
+	masterSecret       []byte
+	clientKey          []byte
+	clientIV           []byte
+	serverKey          []byte
+	serverIV           []byte
+	sequence           uint64 // Epoch 0のSequence
+	encryptedSequence  uint64 // Epoch 1のSequence
+
+	// ECDHE_ECDSA(RPK / Certificateモード)
+	privateKey         *ecdsa.PrivateKey
+	certificates       [][]byte // Certificateモードで送信する証明書(DER)の列(nilの場合はRaw Public Keyを送信する)
+	requestCertificate bool     // CertificateRequestを送信する
+	ecdhKey            *ecdh.PrivateKey
+	clientPublicKey    *ecdsa.PublicKey // クライアントのCertificateの公開鍵
+	clientVerified     bool             // クライアントのCertificateVerifyを検証した
+}
+
+// sendRecords : レコードをひとつのデータグラムで送信する
+func (server *dtlsTestServer) sendRecords(addr net.Addr, records [][]byte) error {
+	datagram := []byte{}
+	for _, record := range records {
+		datagram = append(datagram, record...)
+	}
+	_, err := server.conn.WriteTo(datagram, addr)
+	return err
+}
+
+// plainRecord : Epoch 0のレコードを生成する
+func (server *dtlsTestServer) plainRecord(contentType byte, content []byte) []byte {
+	packet := &DtlsPacket{Type: contentType, Sequence: server.sequence, Content: content}
+	server.sequence++
+	return packet.ToBytes()
+}
+
+// encryptedRecord : Epoch 1の暗号化したハンドシェイクのレコードを生成する
+func (server *dtlsTestServer) encryptedRecord(content []byte) []byte {
+	epochSequence := make([]byte, 8)
+	binary.BigEndian.PutUint64(epochSequence, server.encryptedSequence)
+	binary.BigEndian.PutUint16(epochSequence[0:2], 1)
+	packet := &DtlsPacket{
+		Type:     dtlsContentTypeHandshake,
+		Epoch:    1,
+		Sequence: server.encryptedSequence,
+		Content:  server.suite.seal(server.serverKey, server.serverIV, nil, epochSequence, dtlsContentTypeHandshake, nil, content)}
+	server.encryptedSequence++
+	return packet.ToBytes()
+}
+
+// generateKeys : Master SecretからKey Blockを生成する
+func (server *dtlsTestServer) generateKeys() {
+	keyBlock := dtlsPrf(server.masterSecret, []byte("key expansion"),
+		append(append([]byte{}, server.serverRandom...), server.clientRandom...), server.suite.KeyBlockLength())
+	server.clientKey, server.serverKey = keyBlock[0:16], keyBlock[16:32]
+	server.clientIV, server.serverIV = keyBlock[32:36], keyBlock[36:40]
+}
+
+// serve : クライアントのFinishedを受信し、サーバーのFinishedを送信するまで処理する
+func (server *dtlsTestServer) serve() error {
+	buf := make([]byte, dtlsPacketSize)
+	for {
+		readLen, addr, err := server.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		raw := buf[:readLen]
+		for len(raw) >= 13 {
+			contentType := raw[0]
+			epochSequence := raw[3:11]
+			length := (int)(binary.BigEndian.Uint16(raw[11:13]))
+			if len(raw) < 13+length {
+				return errors.New("レコードが不足しています")
+			}
+			content := raw[13:(13 + length)]
+			raw = raw[(13 + length):]
+			if contentType != dtlsContentTypeHandshake {
+				continue
+			}
+			if binary.BigEndian.Uint16(epochSequence[0:2]) == 1 {
+				done, err := server.receiveFinished(addr, epochSequence, content)
+				if err != nil || done {
+					return err
+				}
+				continue
+			}
+			if err := server.receiveHandshake(addr, content); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// receiveHandshake : Epoch 0のハンドシェイク(ClientHello / ClientKeyExchange)を処理する
+func (server *dtlsTestServer) receiveHandshake(addr net.Addr, message []byte) error {
+	body := message[12:]
+	switch message[0] {
+	case dtlsHandshakeTypeClientHello:
+		sessionLength := (int)(body[34])
+		cookieLength := (int)(body[35+sessionLength])
+		if cookieLength == 0 {
+			verifyRequest := append([]byte{0xfe, 0xfd, (byte)(len(server.cookie))}, server.cookie...)
+			return server.sendRecords(addr, [][]byte{
+				server.plainRecord(dtlsContentTypeHandshake, dtlsTestHandshake(dtlsHandshakeTypeHelloVerifyRequest, 0, verifyRequest))})
+		}
+		if server.helloFlight == nil {
+			offeredSession := body[35:(35 + sessionLength)]
+			server.resumed = server.resumeMasterSecret != nil && sessionLength > 0 && bytes.Equal(offeredSession, server.sessionID)
+			server.clientRandom = append([]byte{}, body[2:34]...)
+			server.serverRandom = DtlsClientRandom()
+			serverHello := []byte{0xfe, 0xfd}
+			serverHello = append(serverHello, server.serverRandom...)
+			serverHello = append(append(serverHello, (byte)(len(server.sessionID))), server.sessionID...)
+			serverHello = append(serverHello, (byte)(server.suite.ID>>8), (byte)(server.suite.ID&0xff), dtlsCompress)
+			serverHelloMessage := dtlsTestHandshake(dtlsHandshakeTypeServerHello, 1, serverHello)
+			server.messages = append(append([]byte{}, message...), serverHelloMessage...)
+			server.helloFlight = [][]byte{serverHelloMessage}
+			if server.resumed {
+				// 短縮ハンドシェイクはServerHello / ChangeCipherSpec / Finishedを送る
+				// RFC5246 7.3 Handshake Protocol Overview参照
+				server.masterSecret = server.resumeMasterSecret
+				server.generateKeys()
+				hash := sha256.Sum256(server.messages)
+				server.resumeFinished = dtlsTestHandshake(dtlsHandshakeTypeFinished, (uint16)(len(server.helloFlight)+1),
+					dtlsPrf(server.masterSecret, []byte("server finished"), hash[:], 12))
+				server.messages = append(server.messages, server.resumeFinished...)
+			} else {
+				if err := server.appendEcdheEcdsaMessages(); err != nil {
+					return err
+				}
+				server.appendHelloMessage(dtlsHandshakeTypeServerHelloDone, []byte{})
+			}
+		}
+		records := [][]byte{}
+		for _, content := range server.helloFlight {
+			records = append(records, server.plainRecord(dtlsContentTypeHandshake, content))
+		}
+		if server.resumed {
+			records = append(records,
+				server.plainRecord(dtlsContentTypeChangeCipherSpec, []byte{dtlsChangeCipherSpecMessage}),
+				server.encryptedRecord(server.resumeFinished))
+		}
+		return server.sendRecords(addr, records)
+	case dtlsHandshakeTypeCertificate:
+		if server.masterSecret != nil {
+			return nil
+		}
+		publicKey, err := server.parseClientCertificate(body)
+		if err != nil {
+			return err
+		}
+		server.clientPublicKey = publicKey
+		server.messages = append(server.messages, message...)
+	case dtlsHandshakeTypeClientKeyExchange:
+		if server.masterSecret != nil {
+			return nil
+		}
+		server.messages = append(server.messages, message...)
+		preMasterSecret := DtlsPreMasterSecretFromPSK(server.psk)
+		if server.privateKey != nil {
+			clientKey, err := ecdh.P256().NewPublicKey(body[1:(1 + (int)(body[0]))])
+			if err != nil {
+				return err
+			}
+			if preMasterSecret, err = server.ecdhKey.ECDH(clientKey); err != nil {
+				return err
+			}
+		}
+		server.masterSecret = dtlsPrf(preMasterSecret, []byte("master secret"),
+			append(append([]byte{}, server.clientRandom...), server.serverRandom...), 48)
+		server.generateKeys()
+	case dtlsHandshakeTypeCertificateVerify:
+		if server.clientVerified {
+			return nil
+		}
+		// ClientKeyExchangeまでのハンドシェイクに対する署名
+		hash := sha256.Sum256(server.messages)
+		if server.clientPublicKey == nil || binary.BigEndian.Uint16(body[0:2]) != dtlsSignatureEcdsaSecp256r1Sha256 ||
+			!ecdsa.VerifyASN1(server.clientPublicKey, hash[:], body[4:]) {
+			return errors.New("クライアントのCertificateVerifyの検証に失敗しました")
+		}
+		server.clientVerified = true
+		server.messages = append(server.messages, message...)
+	}
+	return nil
+}
+
+// appendHelloMessage : ServerHelloに続けて送るハンドシェイクを追加する
+func (server *dtlsTestServer) appendHelloMessage(handshakeType byte, body []byte) {
+	message := dtlsTestHandshake(handshakeType, (uint16)(len(server.helloFlight)+1), body)
+	server.messages = append(server.messages, message...)
+	server.helloFlight = append(server.helloFlight, message)
+}
+
+// appendEcdheEcdsaMessages : ECDHE_ECDSAの場合にCertificate / ServerKeyExchange / CertificateRequestを追加する
+// RFC8422 5.4 Server Key Exchange参照
+func (server *dtlsTestServer) appendEcdheEcdsaMessages() error {
+	if server.privateKey == nil {
+		return nil
+	}
+	if server.certificates != nil {
+		certificateList := []byte{}
+		for _, certificate := range server.certificates {
+			certificateList = append(certificateList, dtlsUint24Vector(certificate)...)
+		}
+		server.appendHelloMessage(dtlsHandshakeTypeCertificate, dtlsUint24Vector(certificateList))
+	} else {
+		publicKey, err := x509.MarshalPKIXPublicKey(&server.privateKey.PublicKey)
+		if err != nil {
+			return err
+		}
+		server.appendHelloMessage(dtlsHandshakeTypeCertificate, dtlsUint24Vector(publicKey))
+	}
+
+	ecdhKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	server.ecdhKey = ecdhKey
+	point := ecdhKey.PublicKey().Bytes()
+	params := append([]byte{dtlsECCurveTypeNamedCurve, 0x00, (byte)(dtlsNamedCurveSecp256r1), (byte)(len(point))}, point...)
+	hash := sha256.Sum256(append(append(append([]byte{}, server.clientRandom...), server.serverRandom...), params...))
+	signature, err := ecdsa.SignASN1(rand.Reader, server.privateKey, hash[:])
+	if err != nil {
+		return err
+	}
+	serverKeyExchange := append(append([]byte{}, params...),
+		(byte)(dtlsSignatureEcdsaSecp256r1Sha256>>8), (byte)(dtlsSignatureEcdsaSecp256r1Sha256&0xff),
+		(byte)(len(signature)>>8), (byte)(len(signature)&0xff))
+	server.appendHelloMessage(dtlsHandshakeTypeServerKeyExchange, append(serverKeyExchange, signature...))
+
+	if server.requestCertificate {
+		// certificate_types(ecdsa_sign) / supported_signature_algorithms / certificate_authorities(無し)
+		// RFC5246 7.4.4 Certificate Request参照
+		server.appendHelloMessage(dtlsHandshakeTypeCertificateRequest, []byte{
+			0x01, 64,
+			0x00, 0x02, (byte)(dtlsSignatureEcdsaSecp256r1Sha256 >> 8), (byte)(dtlsSignatureEcdsaSecp256r1Sha256 & 0xff),
+			0x00, 0x00})
+	}
+	return nil
+}
+
+// parseClientCertificate : クライアントのCertificateから公開鍵を取得する
+func (server *dtlsTestServer) parseClientCertificate(body []byte) (*ecdsa.PublicKey, error) {
+	data, _, err := parseDtlsUint24Vector(body)
+	if err != nil {
+		return nil, err
+	}
+	if server.certificates == nil {
+		return DtlsParsePublicKey(data)
+	}
+	der, _, err := parseDtlsUint24Vector(data)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := certificate.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("クライアントの証明書の公開鍵がECDSAではありません")
+	}
+	return publicKey, nil
+}
+
+// receiveFinished : クライアントのFinishedを検証し、ChangeCipherSpec / Finishedを送信する
+// 短縮ハンドシェイクの場合はクライアントのFinishedが最後のため、検証のみ行う
+func (server *dtlsTestServer) receiveFinished(addr net.Addr, epochSequence, content []byte) (bool, error) {
+	if server.masterSecret == nil {
+		return false, nil
+	}
+	if server.finishedFlight == nil {
+		message, ok := server.suite.open(server.clientKey, server.clientIV, nil, epochSequence, dtlsContentTypeHandshake, nil, content)
+		if !ok || len(message) != 12+12 || message[0] != dtlsHandshakeTypeFinished {
+			return false, errors.New("クライアントのFinishedを復号できません")
+		}
+		hash := sha256.Sum256(server.messages)
+		if string(message[12:]) != string(dtlsPrf(server.masterSecret, []byte("client finished"), hash[:], 12)) {
+			return false, errors.New("クライアントのFinishedの検証に失敗しました")
+		}
+		if server.resumed {
+			return true, nil
+		}
+		server.messages = append(server.messages, message...)
+		hash = sha256.Sum256(server.messages)
+		finished := dtlsTestHandshake(dtlsHandshakeTypeFinished, (uint16)(len(server.helloFlight)+1),
+			dtlsPrf(server.masterSecret, []byte("server finished"), hash[:], 12))
+		server.finishedFlight = [][]byte{
+			server.plainRecord(dtlsContentTypeChangeCipherSpec, []byte{dtlsChangeCipherSpecMessage}),
+			server.encryptedRecord(finished)}
+	}
+	return true, server.sendRecords(addr, server.finishedFlight)
+}
+
+// TestDtlsHandshakeRetransmission : フライトが失われてもタイマーによる再送でハンドシェイクが完了することを確認する
+// 失われたフライトごとにクライアントのフライトが1回だけ再送され、それ以外に再送されないことを確認する
+// RFC6347 4.2.4 Timeout and Retransmission参照
+func TestDtlsHandshakeRetransmission(t *testing.T) {
+	cases := []struct {
+		name       string
+		dropReads  map[int]bool
+		dropWrites map[int]bool
+		losses     int
+	}{
+		{"損失なし", nil, nil, 0},
+		{"最初のClientHelloの損失", map[int]bool{1: true}, nil, 1},
+		{"ServerHelloのフライトの損失", nil, map[int]bool{2: true}, 1},
+		{"最初のClientHelloとServerHelloのフライトの損失", map[int]bool{1: true}, map[int]bool{2: true}, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer packetConn.Close()
+			psk := []byte("0123456789abcdef")
+			conn := &dtlsLossyConn{PacketConn: packetConn, dropReads: c.dropReads, dropWrites: c.dropWrites}
+			server := &dtlsTestServer{
+				conn:   conn,
+				psk:    psk,
+				suite:  findDtlsCipherSuite(dtlsCipherSuitePskAes128Ccm8),
+				cookie: []byte("cookie-0123456789abcdef-01234567")}
+			serverErrCh := make(chan error, 1)
+			go func() { serverErrCh <- server.serve() }()
+
+			dtls, err := DtlsDial(context.Background(), packetConn.LocalAddr().String(), []byte("identity"), psk, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dtls.Close()
+			if err := <-serverErrCh; err != nil {
+				t.Fatal(err)
+			}
+
+			// 再送が無ければFlight 1 / 3 / 5の3フライト
+			conn.mutex.Lock()
+			defer conn.mutex.Unlock()
+			if expected := 3 + c.losses; conn.flights != expected {
+				t.Fatalf("クライアントのフライトの数が再送の予定と一致しません flights=%d expected=%d", conn.flights, expected)
+			}
+		})
+	}
+}
+
+// TestDtlsHandshakeRetransmissionStrayDatagrams : 相手のフライト以外のデータグラムを受信し続けても、
+// フライトの送信時に設定したタイマーで再送することを確認する
+func TestDtlsHandshakeRetransmissionStrayDatagrams(t *testing.T) {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+
+	// 最初のClientHelloを破棄し、以降はタイムアウトより短い間隔で不正なデータグラムを送り続ける
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	var strayOnce sync.Once
+	conn := &dtlsLossyConn{PacketConn: packetConn, dropReads: map[int]bool{1: true}}
+	conn.onDrop = func(addr net.Addr) {
+		strayOnce.Do(func() {
+			go func() {
+				ticker := time.NewTicker(dtlsRetransmitInitialTimeout / 4)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-stopCh:
+						return
+					case <-ticker.C:
+						packetConn.WriteTo([]byte{0xff}, addr)
+					}
+				}
+			}()
+		})
+	}
+	psk := []byte("0123456789abcdef")
+	server := &dtlsTestServer{
+		conn:   conn,
+		psk:    psk,
+		suite:  findDtlsCipherSuite(dtlsCipherSuitePskAes128Ccm8),
+		cookie: []byte("cookie-0123456789abcdef-01234567")}
+	go server.serve()
+
+	dialCh := make(chan error, 1)
+	go func() {
+		dtls, err := DtlsDial(context.Background(), packetConn.LocalAddr().String(), []byte("identity"), psk, nil)
+		if err == nil {
+			dtls.Close()
+		}
+		dialCh <- err
+	}()
+	select {
+	case err := <-dialCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(4 * dtlsRetransmitInitialTimeout):
+		t.Fatal("不正なデータグラムの受信によって再送が遅れています")
+	}
+}
+
+// TestDtlsHandshakeContextDeadline : 応答の無いサーバーに対して、dtlsHandshakeTimeoutまで再送を続けず
+// 呼び出し元のctxの期限でハンドシェイクを中止することを確認する
+func TestDtlsHandshakeContextDeadline(t *testing.T) {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dtlsRetransmitInitialTimeout+dtlsRetransmitInitialTimeout/2)
+	defer cancel()
+	dialCh := make(chan error, 1)
+	go func() {
+		dtls, err := DtlsDial(ctx, packetConn.LocalAddr().String(), []byte("identity"), []byte("0123456789abcdef"), nil)
+		if err == nil {
+			dtls.Close()
+		}
+		dialCh <- err
+	}()
+	select {
+	case err := <-dialCh:
+		if err == nil {
+			t.Fatal("応答の無いサーバーに接続できました")
+		}
+	case <-time.After(3 * dtlsRetransmitInitialTimeout):
+		t.Fatal("ctxの期限を過ぎてもハンドシェイクが終了しません")
+	}
+}
+
+// TestDtlsWriteError : 送信に失敗した場合にエラーを返し、Sequenceは使用済みとすることを確認する
+func TestDtlsWriteError(t *testing.T) {
+	local, remote := net.Pipe()
+	remote.Close()
+	dtls := &Dtls{
+		Connection:     local,
+		Handshake:      &DtlsHandshakeParams{},
+		cipherSuite:    findDtlsCipherSuite(dtlsCipherSuitePskAes128Ccm8),
+		ClientWriteKey: make([]byte, 16),
+		ClientIV:       make([]byte, 4)}
+	if _, err := dtls.Write([]byte("data")); err == nil {
+		t.Fatal("送信の失敗がエラーになりません")
+	}
+	if dtls.ClientSequence != 1 {
+		t.Fatalf("送信に失敗したSequenceが再利用されます %d", dtls.ClientSequence)
+	}
+}
+
+// startDtlsTestServer : テスト用のDTLSサーバーを127.0.0.1で起動し、接続先とserveの結果を受け取るチャネルを返す
+func startDtlsTestServer(t *testing.T, server *dtlsTestServer) (string, chan error) {
+	t.Helper()
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { packetConn.Close() })
+	server.conn = &dtlsLossyConn{PacketConn: packetConn}
+	serverErrCh := make(chan error, 1)
+	go func() { serverErrCh <- server.serve() }()
+	return packetConn.LocalAddr().String(), serverErrCh
+}
+
+// dialDtlsTestServer : テスト用のDTLSサーバーを起動し、PSKモードで接続する
+// サーバーがハンドシェイクを終えるまで待つ
+func dialDtlsTestServer(t *testing.T, server *dtlsTestServer, session *DtlsSession) (*Dtls, *dtlsLossyConn) {
+	t.Helper()
+	host, serverErrCh := startDtlsTestServer(t, server)
+	dtls, err := DtlsDial(context.Background(), host, []byte("identity"), server.psk, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dtls.Close() })
+	if err := <-serverErrCh; err != nil {
+		t.Fatal(err)
+	}
+	return dtls, server.conn.(*dtlsLossyConn)
+}
+
+// TestDtlsSessionResumption : 前回のセッションを提示して短縮ハンドシェイクで再開し、
+// サーバーが再開を拒否した場合はフルハンドシェイクになることを確認する
+// RFC5246 7.3 Handshake Protocol Overview参照
+func TestDtlsSessionResumption(t *testing.T) {
+	psk := []byte("0123456789abcdef")
+	cookie := []byte("cookie-0123456789abcdef-01234567")
+	sessionID := bytes.Repeat([]byte{0x5A}, 32)
+	suite := findDtlsCipherSuite(dtlsCipherSuitePskAes128Ccm8)
+
+	// フルハンドシェイクでSession IDを払い出す
+	first := &dtlsTestServer{psk: psk, suite: suite, cookie: cookie, sessionID: sessionID}
+	dtls, _ := dialDtlsTestServer(t, first, nil)
+	session := dtls.Session()
+	if dtls.Handshake.Resumed || session == nil {
+		t.Fatal("フルハンドシェイクでセッションを取得できません")
+	}
+	if !bytes.Equal(session.ID, sessionID) || !bytes.Equal(session.MasterSecret, first.masterSecret) {
+		t.Fatal("取得したセッションがサーバーと一致しません")
+	}
+
+	// 短縮ハンドシェイクではClientKeyExchangeを送らない(Flight 1 / 3のみ)
+	second := &dtlsTestServer{psk: psk, suite: suite, cookie: cookie, sessionID: sessionID, resumeMasterSecret: first.masterSecret}
+	dtls, conn := dialDtlsTestServer(t, second, session)
+	if !dtls.Handshake.Resumed || !second.resumed {
+		t.Fatal("短縮ハンドシェイクになっていません")
+	}
+	if conn.flights != 2 {
+		t.Fatalf("短縮ハンドシェイクのフライトの数が不正です %d", conn.flights)
+	}
+	if !bytes.Equal(dtls.Handshake.MasterSecret, session.MasterSecret) {
+		t.Fatal("再開したセッションのMaster Secretが一致しません")
+	}
+
+	// サーバーが別のSession IDを返した場合はフルハンドシェイクとなる
+	otherSessionID := bytes.Repeat([]byte{0xA5}, 32)
+	third := &dtlsTestServer{psk: psk, suite: suite, cookie: cookie, sessionID: otherSessionID}
+	dtls, _ = dialDtlsTestServer(t, third, session)
+	if dtls.Handshake.Resumed || third.resumed {
+		t.Fatal("再開を拒否されたのに短縮ハンドシェイクになっています")
+	}
+	if renewed := dtls.Session(); renewed == nil || !bytes.Equal(renewed.ID, otherSessionID) {
+		t.Fatal("新しいセッションを取得できません")
+	}
+}
+
+// TestDtlsSessionSave : セッション情報を所有者のみ読み書き可能なファイルに保存し、読み出せることを確認する
+func TestDtlsSessionSave(t *testing.T) {
+	sessionPath := filepath.Join(t.TempDir(), "session.json")
+	session := &DtlsSession{
+		Host:         "localhost:5684",
+		Identity:     []byte("identity"),
+		ID:           bytes.Repeat([]byte{0x5A}, 32),
+		MasterSecret: bytes.Repeat([]byte{0x01}, 48)}
+	if err := session.Save(sessionPath); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(sessionPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("セッション情報のファイルの権限が不正です %o", info.Mode().Perm())
+	}
+	loaded, err := LoadDtlsSession(sessionPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, session) {
+		t.Fatalf("読み出したセッション情報が一致しません %+v", loaded)
+	}
+}
+
+// dtlsTestPrivateKey : テスト用のsecp256r1の鍵を生成する
+func dtlsTestPrivateKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// dtlsTestCertificate : テスト用の証明書を生成する
+// parentがnilの場合は自己署名とする
+func dtlsTestCertificate(t *testing.T, template *x509.Certificate, key *ecdsa.PrivateKey, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+// TestDtlsHandshakeRawPublicKey : RPKモードでECDHE_ECDSAのハンドシェイクが完了し、
+// サーバーの公開鍵が期待と異なる場合は失敗することを確認する
+// CertificateRequestを受信した場合はクライアントの公開鍵とCertificateVerifyを送信する
+func TestDtlsHandshakeRawPublicKey(t *testing.T) {
+	suite := findDtlsCipherSuite(dtlsCipherSuiteEcdheEcdsaAes128Ccm8)
+	cookie := []byte("cookie-0123456789abcdef-01234567")
+	serverKey := dtlsTestPrivateKey(t)
+	clientKey := dtlsTestPrivateKey(t)
+	server := &dtlsTestServer{suite: suite, cookie: cookie, privateKey: serverKey, requestCertificate: true}
+	host, serverErrCh := startDtlsTestServer(t, server)
+	dtls, err := DtlsDialRawPublicKey(context.Background(), host, clientKey, &serverKey.PublicKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dtls.Close()
+	if err := <-serverErrCh; err != nil {
+		t.Fatal(err)
+	}
+	if !server.clientVerified || !server.clientPublicKey.Equal(&clientKey.PublicKey) {
+		t.Fatal("クライアントの公開鍵を検証できません")
+	}
+
+	other := &dtlsTestServer{suite: suite, cookie: cookie, privateKey: dtlsTestPrivateKey(t)}
+	host, _ = startDtlsTestServer(t, other)
+	if dtls, err := DtlsDialRawPublicKey(context.Background(), host, clientKey, &serverKey.PublicKey, nil); err == nil {
+		dtls.Close()
+		t.Fatal("期待と異なるサーバーの公開鍵でハンドシェイクが完了しました")
+	}
+}
+
+// TestDtlsHandshakeCertificate : CertificateモードでECDHE_ECDSAのハンドシェイクが完了し、
+// サーバーの証明書を信頼する証明書とホスト名で検証することを確認する
+func TestDtlsHandshakeCertificate(t *testing.T) {
+	caKey := dtlsTestPrivateKey(t)
+	ca := dtlsTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "inventoryd test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign}, caKey, nil, nil)
+	otherCA := dtlsTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "inventoryd other CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign}, dtlsTestPrivateKey(t), nil, nil)
+	serverKey := dtlsTestPrivateKey(t)
+	serverCertificate := dtlsTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, serverKey, ca, caKey)
+	otherHostCertificate := dtlsTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, serverKey, ca, caKey)
+	clientKey := dtlsTestPrivateKey(t)
+	clientCertificate := dtlsTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(5),
+		Subject:      pkix.Name{CommonName: "inventoryd"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, clientKey, nil, nil)
+
+	cases := []struct {
+		name              string
+		serverCertificate *x509.Certificate
+		trusted           *x509.Certificate
+		valid             bool
+	}{
+		{"信頼する証明書で署名されている", serverCertificate, ca, true},
+		{"サーバーの証明書そのものを信頼する", serverCertificate, serverCertificate, true},
+		{"信頼していない証明書で署名されている", serverCertificate, otherCA, false},
+		{"ホスト名が一致しない", otherHostCertificate, ca, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := &dtlsTestServer{
+				suite:              findDtlsCipherSuite(dtlsCipherSuiteEcdheEcdsaAes128Ccm8),
+				cookie:             []byte("cookie-0123456789abcdef-01234567"),
+				privateKey:         serverKey,
+				certificates:       [][]byte{c.serverCertificate.Raw},
+				requestCertificate: true}
+			host, serverErrCh := startDtlsTestServer(t, server)
+			dtls, err := DtlsDialCertificate(context.Background(), host, clientKey, clientCertificate.Raw, c.trusted, nil)
+			if !c.valid {
+				if err == nil {
+					dtls.Close()
+					t.Fatal("検証できないサーバーの証明書でハンドシェイクが完了しました")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dtls.Close()
+			if err := <-serverErrCh; err != nil {
+				t.Fatal(err)
+			}
+			if !server.clientVerified || !server.clientPublicKey.Equal(&clientKey.PublicKey) {
+				t.Fatal("クライアントの証明書を検証できません")
+			}
+		})
+	}
+}
+
+// newDtlsTestEncrypted : 暗号化開始後(Epoch 1)のテスト用のDtlsを生成する
+// 鍵はdtls_cipher_test.goの既知の値のテストのものを使用する
+func newDtlsTestEncrypted(conn net.Conn) *Dtls {
+	return &Dtls{
+		Connection:     conn,
+		ServerEpoch:    1,
+		ClientEpoch:    1,
+		ServerEncrypt:  true,
+		ClientEncrypt:  true,
+		Handshake:      &DtlsHandshakeParams{},
+		cipherSuite:    findDtlsCipherSuite(dtlsCipherSuitePskAes128Ccm8),
+		ServerWriteKey: dtlsTestKey,
+		ServerIV:       dtlsTestIV,
+		ClientWriteKey: dtlsTestKey,
+		ClientIV:       dtlsTestIV}
+}
+
+// dtlsTestServerRecord : newDtlsTestEncryptedのDtlsが受信するサーバーのレコードを生成する
+// Epoch 0のレコードは暗号化しない
+func dtlsTestServerRecord(contentType byte, epoch uint16, sequence uint64, content []byte) []byte {
+	packet := &DtlsPacket{Type: contentType, Epoch: epoch, Sequence: sequence, Content: content}
+	if epoch > 0 {
+		epochSequence := make([]byte, 8)
+		binary.BigEndian.PutUint64(epochSequence, sequence)
+		binary.BigEndian.PutUint16(epochSequence[0:2], epoch)
+		packet.Content = findDtlsCipherSuite(dtlsCipherSuitePskAes128Ccm8).seal(
+			dtlsTestKey, dtlsTestIV, nil, epochSequence, contentType, nil, content)
+	}
+	return packet.ToBytes()
+}
+
+// TestDtlsParsePacketReplay : 受信済みのSequence、記録範囲(64)より前のSequence、
+// 現在以外のEpochのレコードを破棄することを確認する
+// RFC6347 4.1.2.6 Anti-Replay参照
+func TestDtlsParsePacketReplay(t *testing.T) {
+	dtls := newDtlsTestEncrypted(nil)
+	cases := []struct {
+		name     string
+		epoch    uint16
+		sequence uint64
+		accepted bool
+	}{
+		{"最初のレコード", 1, 5, true},
+		{"受信済み", 1, 5, false},
+		{"順番が入れ替わったレコード", 1, 3, true},
+		{"入れ替わったレコードの再送", 1, 3, false},
+		{"先に進んだレコード", 1, 70, true},
+		{"記録範囲外(70-6=64)", 1, 6, false},
+		{"記録範囲の最も古いSequence(70-7=63)", 1, 7, true},
+		{"記録範囲の最も古いSequenceの再送", 1, 7, false},
+		{"次のEpoch", 2, 71, false},
+		{"暗号化前のEpochのApplication Data", 0, 72, false},
+		{"記録範囲を超えて進んだレコード", 1, 200, true},
+		{"以前受信したSequence", 1, 70, false},
+	}
+	for _, c := range cases {
+		record := dtlsTestServerRecord(dtlsContentTypeApplicationData, c.epoch, c.sequence, []byte(c.name))
+		packet := dtls.ParsePacket(record)
+		if (packet != nil) != c.accepted {
+			t.Fatalf("%s (epoch=%d sequence=%d) の結果が不正です", c.name, c.epoch, c.sequence)
+		}
+		if packet != nil && string(packet.Content) != c.name {
+			t.Fatalf("%s の内容が不正です %q", c.name, packet.Content)
+		}
+	}
+
+	// 検証に失敗したレコードは受信済みとして記録しない
+	record := dtlsTestServerRecord(dtlsContentTypeApplicationData, 1, 201, []byte("data"))
+	tampered := append([]byte{}, record...)
+	tampered[len(tampered)-1] ^= 0x01
+	if dtls.ParsePacket(tampered) != nil || dtls.ParsePacket(record) == nil {
+		t.Fatal("検証に失敗したレコードのSequenceが受信済みになっています")
+	}
+}
+
+// TestDtlsWriteDuringRetransmission : 接続後にReadがサーバーの再送を受けてフライトを再送している間に
+// Writeしても、同じEpochのSequence(nonce)を重複して使用しないことを確認する(-raceで実行する)
+func TestDtlsWriteDuringRetransmission(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	dtls := newDtlsTestEncrypted(local)
+	dtls.Handshake.serverSequenceStarted = true
+	dtls.Handshake.nextServerSequence = 5
+	dtls.lastFlight = []*dtlsFlightMessage{&dtlsFlightMessage{
+		Type:    dtlsContentTypeHandshake,
+		Epoch:   1,
+		Content: dtlsTestHandshake(dtlsHandshakeTypeFinished, 4, make([]byte, 12))}}
+
+	const count = 100
+	// クライアントが送信したレコードのSequenceを記録する
+	sequencesCh := make(chan []uint64, 1)
+	go func() {
+		sequences := []uint64{}
+		buf := make([]byte, dtlsPacketSize)
+		for len(sequences) < count*2 {
+			readLen, err := remote.Read(buf)
+			if err != nil || readLen < 13 {
+				break
+			}
+			sequences = append(sequences, binary.BigEndian.Uint64(append([]byte{0, 0}, buf[5:11]...)))
+		}
+		sequencesCh <- sequences
+	}()
+	go func() {
+		buf := make([]byte, dtlsPacketSize)
+		dtls.Read(buf)
+	}()
+
+	// サーバーの再送(受信済みのmessage_seqのFinished)とWriteを同時に行う
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < count; i++ {
+			record := dtlsTestServerRecord(dtlsContentTypeHandshake, 1, (uint64)(i+1), dtlsTestHandshake(dtlsHandshakeTypeFinished, 4, make([]byte, 12)))
+			if _, err := remote.Write(record); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < count; i++ {
+			if _, err := dtls.Write([]byte("data")); err != nil {
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	select {
+	case sequences := <-sequencesCh:
+		if len(sequences) != count*2 {
+			t.Fatalf("送信したレコードの数が不正です %d", len(sequences))
+		}
+		used := make(map[uint64]bool)
+		for _, sequence := range sequences {
+			if used[sequence] {
+				t.Fatalf("Sequence %d を重複して使用しました", sequence)
+			}
+			used[sequence] = true
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("送信したレコードを受信できません")
+	}
+	local.Close()
+}
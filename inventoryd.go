@@ -15,6 +15,7 @@ import (
 const (
 	inventorydModelsDir    string = "models"
 	inventorydResourcesDir string = "resources"
+	inventorydSessionFile  string = "session.json"
 )
 
 // Inventoryd : SORACOM Inventory対応
@@ -29,6 +30,12 @@ type Config struct {
 	ObserveInterval    int    `json:"observeInterval"`
 	BootstrapServer    string `json:"bootstrapServer"`
 	EndpointClientName string `json:"endpointClientName"`
+	DtlsSessionCache   bool   `json:"dtlsSessionCache"`
+
+	// NotifyをCONで送信するパス(例 : /5/0/5)
+	// 指定したパスを含むObserve、および指定したパスの中のObserveが対象となる
+	// デフォルトはFirmware UpdateのUpdate Result(/5/0/5)
+	ConfirmableNotify []string `json:"confirmableNotify"`
 }
 
 // Initialize : Inventorydの初期化
@@ -43,6 +50,11 @@ func (daemon *Inventoryd) Initialize(config *Config, handler Lwm2mHandler) error
 	if err != nil {
 		return err
 	}
+	daemon.Lwm2m.confirmablePaths = daemon.Config.ConfirmableNotify
+	// DTLSセッションを保存し、再起動後もセッションを再開できるようにする
+	if daemon.Config.DtlsSessionCache {
+		daemon.Lwm2m.dtlsSessionPath = filepath.Join(daemon.Config.RootPath, inventorydSessionFile)
+	}
 	return nil
 }
 
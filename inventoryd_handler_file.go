@@ -74,6 +74,19 @@ func (handler *HandlerFile) CreateInstance(instance *Lwm2mInstance) CoapCode {
 	return CoapCodeCreated
 }
 
+// DeleteInstance : インスタンスを削除する
+func (handler *HandlerFile) DeleteInstance(instance *Lwm2mInstance) CoapCode {
+	instancePath := filepath.Join(
+		handler.ResourceDirPath,
+		strconv.Itoa((int)(instance.objectID)),
+		strconv.Itoa((int)(instance.ID)))
+	err := os.RemoveAll(instancePath)
+	if err != nil {
+		return CoapCodeNotAllowed
+	}
+	return CoapCodeDeleted
+}
+
 // ListObjectIDs : 利用可能なオブジェクトIDを取得する
 func (handler *HandlerFile) ListObjectIDs() ([]uint16, CoapCode) {
 	ret := make([]uint16, 0)
@@ -118,6 +131,7 @@ func (handler *HandlerFile) ListInstanceIDs(object *Lwm2mObject) ([]uint16, Coap
 }
 
 // ListResourceIDs : インスタンス下にあるリソースIDを取得する
+// 複数インスタンスのリソースはディレクトリとなる
 func (handler *HandlerFile) ListResourceIDs(instance *Lwm2mInstance) ([]uint16, CoapCode) {
 	ret := make([]uint16, 0)
 	instancePath := filepath.Join(
@@ -129,11 +143,45 @@ func (handler *HandlerFile) ListResourceIDs(instance *Lwm2mInstance) ([]uint16,
 		return []uint16{}, CoapCodeNotAllowed
 	}
 
+	for _, file := range files {
+		resourceID, err := strconv.Atoi(file.Name())
+		if err == nil {
+			ret = append(ret, (uint16)(resourceID))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret, CoapCodeContent
+}
+
+// DeleteResource : リソースのファイル(複数インスタンスのリソースはディレクトリ)を削除する
+// .read / .writeのファイルは削除しない
+func (handler *HandlerFile) DeleteResource(resource *Lwm2mResource) CoapCode {
+	err := os.RemoveAll(handler.resourcePath(resource))
+	if err != nil {
+		return CoapCodeNotAllowed
+	}
+	return CoapCodeDeleted
+}
+
+// ListResourceInstanceIDs : 複数インスタンスのリソース下にあるResource InstanceのIDを取得する
+// 例 : resources/3/0/6/0, resources/3/0/6/1 であれば0と1
+// リソースが単一の値のファイル(または.read)であれば、Resource Instance 0のみとする
+func (handler *HandlerFile) ListResourceInstanceIDs(resource *Lwm2mResource) ([]uint16, CoapCode) {
+	resourcePath := handler.resourcePath(resource)
+	if isSingleValueResourceFile(resourcePath) {
+		return []uint16{0}, CoapCodeContent
+	}
+	ret := make([]uint16, 0)
+	files, err := ioutil.ReadDir(resourcePath)
+	if err != nil {
+		return []uint16{}, CoapCodeNotAllowed
+	}
+
 	for _, file := range files {
 		if !file.IsDir() {
-			resourceID, err := strconv.Atoi(file.Name())
+			resourceInstanceID, err := strconv.Atoi(file.Name())
 			if err == nil {
-				ret = append(ret, (uint16)(resourceID))
+				ret = append(ret, (uint16)(resourceInstanceID))
 			}
 		}
 	}
@@ -146,13 +194,135 @@ func (handler *HandlerFile) ListResourceIDs(instance *Lwm2mInstance) ([]uint16,
 // リソースIDに拡張子.readが付いたファイルが存在し、かつ実行可能であれば、
 // 通常のリソースに優先して実行し、結果を返す
 func (handler *HandlerFile) ReadResource(resource *Lwm2mResource) (string, CoapCode) {
-	instancePath := filepath.Join(
+	return readResourceFile(handler.resourcePath(resource), resource.Definition.Type)
+}
+
+// ReadResourceInstance : Resource Instanceに対するRead
+// 複数インスタンスのリソースのディレクトリにあるResource InstanceのIDのファイルを読み出す
+// リソースが単一の値のファイル(または.read)であれば、その値をResource Instance 0として読み出す
+// .readの扱いはReadResourceと同様
+func (handler *HandlerFile) ReadResourceInstance(resource *Lwm2mResource, resourceInstanceID uint16) (string, CoapCode) {
+	resourcePath := handler.resourcePath(resource)
+	if isSingleValueResourceFile(resourcePath) {
+		if resourceInstanceID != 0 {
+			return "", CoapCodeNotFound
+		}
+		return readResourceFile(resourcePath, resource.Definition.Type)
+	}
+	resourceInstancePath := filepath.Join(resourcePath, strconv.Itoa((int)(resourceInstanceID)))
+	return readResourceFile(resourceInstancePath, resource.Definition.Type)
+}
+
+// WriteResource : Resourceに対するWrite
+// ResourceにWriteする
+// リソースIDに拡張子.writeが付いたファイルが存在し、かつ実行可能であれば、
+// 通常のリソースに優先して実行する
+// サーバからの入力値は標準入力に渡す
+func (handler *HandlerFile) WriteResource(resource *Lwm2mResource, value string) CoapCode {
+	return writeResourceFile(handler.resourcePath(resource), resource.Definition.Type, value)
+}
+
+// WriteResourceInstances : 複数インスタンスのリソースに対するWrite
+// リソースのディレクトリ内のResource InstanceのファイルをWriteした値で置き換える
+// valuesに含まれないResource Instanceのファイルは削除する(.read / .writeは残す)
+// .writeの扱いはWriteResourceと同様
+// リソースに.writeがあり、ディレクトリが無ければ、Resource Instance 0の値のみを.writeに渡す
+// リソースが単一の値のファイルであれば、Resource Instance 0のファイルとしてディレクトリに移してから置き換える
+func (handler *HandlerFile) WriteResourceInstances(resource *Lwm2mResource, values map[uint16]string) CoapCode {
+	resourcePath := handler.resourcePath(resource)
+
+	dir, err := os.Stat(resourcePath)
+	if os.IsNotExist(err) {
+		if file, err := os.Stat(resourcePath + ".write"); err == nil && !file.IsDir() {
+			value, exist := values[0]
+			if !exist || len(values) != 1 {
+				log.Printf("Resource Instance 0以外は.writeに書き込めません %s\n", resourcePath)
+				return CoapCodeNotAllowed
+			}
+			return writeResourceFile(resourcePath, resource.Definition.Type, value)
+		}
+		if err := os.Mkdir(resourcePath, 0755); err != nil {
+			return CoapCodeNotAllowed
+		}
+	} else if err != nil {
+		return CoapCodeNotAllowed
+	} else if !dir.IsDir() {
+		if err := moveSingleValueResourceFile(resourcePath); err != nil {
+			log.Printf("リソースのファイルをディレクトリに移せません %s\n", err)
+			return CoapCodeNotAllowed
+		}
+	}
+
+	resourceInstanceIDs, code := handler.ListResourceInstanceIDs(resource)
+	if code != CoapCodeContent {
+		return CoapCodeNotAllowed
+	}
+	for _, resourceInstanceID := range resourceInstanceIDs {
+		if _, exist := values[resourceInstanceID]; exist {
+			continue
+		}
+		if err := os.Remove(filepath.Join(resourcePath, strconv.Itoa((int)(resourceInstanceID)))); err != nil {
+			return CoapCodeNotAllowed
+		}
+	}
+
+	for resourceInstanceID, value := range values {
+		resourceInstancePath := filepath.Join(resourcePath, strconv.Itoa((int)(resourceInstanceID)))
+		code := writeResourceFile(resourceInstancePath, resource.Definition.Type, value)
+		if code != CoapCodeChanged {
+			return code
+		}
+	}
+	return CoapCodeChanged
+}
+
+// resourcePath : リソースのファイル(複数インスタンスのリソースはディレクトリ)のパスを取得する
+func (handler *HandlerFile) resourcePath(resource *Lwm2mResource) string {
+	return filepath.Join(
 		handler.ResourceDirPath,
 		strconv.Itoa((int)(resource.objectID)),
-		strconv.Itoa((int)(resource.instanceID)))
+		strconv.Itoa((int)(resource.instanceID)),
+		strconv.Itoa((int)(resource.ID)))
+}
 
+// isSingleValueResourceFile : 複数インスタンスのリソースが、ディレクトリではなく
+// 単一の値のファイル(またはリソースIDに拡張子.readが付いたファイル)で置かれているかを確認する
+func isSingleValueResourceFile(resourcePath string) bool {
+	if file, err := os.Stat(resourcePath); err == nil {
+		return !file.IsDir()
+	} else if !os.IsNotExist(err) {
+		return false
+	}
+	file, err := os.Stat(resourcePath + ".read")
+	return err == nil && !file.IsDir()
+}
+
+// moveSingleValueResourceFile : 単一の値のリソースのファイルを、
+// リソースIDのディレクトリのResource Instance 0のファイルに移す
+// 例 : resources/3/0/6 -> resources/3/0/6/0
+func moveSingleValueResourceFile(resourcePath string) error {
+	log.Printf("リソースのファイルをResource Instance 0に移します %s\n", resourcePath)
+	tempPath := resourcePath + ".tmp"
+	if err := os.Rename(resourcePath, tempPath); err != nil {
+		return err
+	}
+	if err := os.Mkdir(resourcePath, 0755); err != nil {
+		os.Rename(tempPath, resourcePath)
+		return err
+	}
+	if err := os.Rename(tempPath, filepath.Join(resourcePath, "0")); err != nil {
+		os.Remove(resourcePath)
+		os.Rename(tempPath, resourcePath)
+		return err
+	}
+	return nil
+}
+
+// readResourceFile : リソース(またはResource Instance)のファイルを読み出す
+// 拡張子.readが付いたファイルが存在し、かつ実行可能であれば、通常のファイルに優先して実行し、結果を返す
+func readResourceFile(resourcePath string, resourceType byte) (string, CoapCode) {
 	// .readファイルの存在確認と実行
-	executableResourcePath := filepath.Join(instancePath, strconv.Itoa((int)(resource.ID))+".read")
+	executableResourcePath := resourcePath + ".read"
 	file, err := os.Stat(executableResourcePath)
 	if !os.IsNotExist(err) && !file.IsDir() {
 		_, err := exec.LookPath(executableResourcePath)
@@ -168,9 +338,9 @@ func (handler *HandlerFile) ReadResource(resource *Lwm2mResource) (string, CoapC
 		}
 
 		var ret string
-		if resource.Definition.Type == lwm2mResourceTypeOpaque {
+		if resourceType == lwm2mResourceTypeOpaque {
 			ret = base64.StdEncoding.EncodeToString(out)
-		} else if resource.Definition.Type != lwm2mResourceTypeString {
+		} else if resourceType != lwm2mResourceTypeString {
 			ret = string(out)
 			ret = strings.TrimSpace(ret)
 		} else {
@@ -179,27 +349,24 @@ func (handler *HandlerFile) ReadResource(resource *Lwm2mResource) (string, CoapC
 		return ret, CoapCodeContent
 	}
 
-	resourcePath := filepath.Join(instancePath, strconv.Itoa((int)(resource.ID)))
 	buf, err := ioutil.ReadFile(resourcePath)
 	if err != nil {
 		return "", CoapCodeNotAllowed
 	}
 
-	if resource.Definition.Type == lwm2mResourceTypeOpaque {
+	if resourceType == lwm2mResourceTypeOpaque {
 		return base64.StdEncoding.EncodeToString(buf), CoapCodeContent
 	}
 	return string(buf), CoapCodeContent
 }
 
-// WriteResource : Resourceに対するWrite
-// ResourceにWriteする
-// リソースIDに拡張子.writeが付いたファイルが存在し、かつ実行可能であれば、
-// 通常のリソースに優先して実行する
+// writeResourceFile : リソース(またはResource Instance)のファイルに書き込む
+// 拡張子.writeが付いたファイルが存在し、かつ実行可能であれば、通常のファイルに優先して実行する
 // サーバからの入力値は標準入力に渡す
-func (handler *HandlerFile) WriteResource(resource *Lwm2mResource, value string) CoapCode {
+func writeResourceFile(resourcePath string, resourceType byte, value string) CoapCode {
 	var buf []byte
 	var err error
-	if resource.Definition.Type == lwm2mResourceTypeOpaque {
+	if resourceType == lwm2mResourceTypeOpaque {
 		buf, err = base64.StdEncoding.DecodeString(value)
 		if err != nil {
 			return CoapCodeNotAllowed
@@ -208,13 +375,8 @@ func (handler *HandlerFile) WriteResource(resource *Lwm2mResource, value string)
 		buf = []byte(value)
 	}
 
-	instancePath := filepath.Join(
-		handler.ResourceDirPath,
-		strconv.Itoa((int)(resource.objectID)),
-		strconv.Itoa((int)(resource.instanceID)))
-
 	// .writeファイルの存在確認と実行
-	executableResourcePath := filepath.Join(instancePath, strconv.Itoa((int)(resource.ID))+".write")
+	executableResourcePath := resourcePath + ".write"
 	file, err := os.Stat(executableResourcePath)
 	if !os.IsNotExist(err) && !file.IsDir() {
 		_, err := exec.LookPath(executableResourcePath)
@@ -234,11 +396,6 @@ func (handler *HandlerFile) WriteResource(resource *Lwm2mResource, value string)
 		return CoapCodeChanged
 	}
 
-	resourcePath := filepath.Join(
-		handler.ResourceDirPath,
-		strconv.Itoa((int)(resource.objectID)),
-		strconv.Itoa((int)(resource.instanceID)),
-		strconv.Itoa((int)(resource.ID)))
 	err = ioutil.WriteFile(resourcePath, buf, 0644)
 	if err != nil {
 		return CoapCodeNotAllowed
@@ -252,11 +409,7 @@ func (handler *HandlerFile) WriteResource(resource *Lwm2mResource, value string)
 // シェル経由でコマンドを実行する
 // UNIX (Like) OSでの実行は要検討
 func (handler *HandlerFile) ExecuteResource(resource *Lwm2mResource, value string) CoapCode {
-	resourcePath := filepath.Join(
-		handler.ResourceDirPath,
-		strconv.Itoa((int)(resource.objectID)),
-		strconv.Itoa((int)(resource.instanceID)),
-		strconv.Itoa((int)(resource.ID)))
+	resourcePath := handler.resourcePath(resource)
 	_, err := exec.LookPath(resourcePath)
 	if err != nil {
 		log.Printf("実行不可能なファイルです %s\n", err)
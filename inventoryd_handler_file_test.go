@@ -0,0 +1,122 @@
+package inventoryd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newHandlerFileTest : 一時ディレクトリのHandlerFileと、/3/0/6(複数インスタンスの整数のリソース)を生成する
+func newHandlerFileTest(t *testing.T, files map[string]string) (*HandlerFile, *Lwm2mResource) {
+	root := t.TempDir()
+	writeLwm2mTestFiles(t, root, files)
+	resource := &Lwm2mResource{
+		ID:         6,
+		objectID:   3,
+		instanceID: 0,
+		Definition: &Lwm2mResourceDefinition{Type: lwm2mResourceTypeInteger, Multi: true}}
+	return &HandlerFile{ResourceDirPath: root}, resource
+}
+
+// readHandlerFileTestInstances : 全Resource InstanceをListResourceInstanceIDsとReadResourceInstanceで読み出す
+// 例 : [0=1 1=5]
+func readHandlerFileTestInstances(t *testing.T, handler *HandlerFile, resource *Lwm2mResource) string {
+	t.Helper()
+	resourceInstanceIDs, code := handler.ListResourceInstanceIDs(resource)
+	if code != CoapCodeContent {
+		t.Fatalf("Resource InstanceのIDを取得できません %s", code)
+	}
+	values := []string{}
+	for _, resourceInstanceID := range resourceInstanceIDs {
+		value, code := handler.ReadResourceInstance(resource, resourceInstanceID)
+		if code != CoapCodeContent {
+			t.Fatalf("Resource Instance %d を読み出せません %s", resourceInstanceID, code)
+		}
+		values = append(values, fmt.Sprintf("%d=%s", resourceInstanceID, value))
+	}
+	return fmt.Sprint(values)
+}
+
+// TestHandlerFileResourceInstances : ディレクトリのResource Instanceの読み出しと、
+// Writeで指定されなかったResource Instanceのみを削除して置き換えることを確認する
+func TestHandlerFileResourceInstances(t *testing.T) {
+	handler, resource := newHandlerFileTest(t, map[string]string{
+		"3/0/6/0":      "1",
+		"3/0/6/1":      "5",
+		"3/0/6/1.read": "#!/bin/sh\necho 6\n",
+		"3/0/6/2":      "7",
+	})
+	if values := readHandlerFileTestInstances(t, handler, resource); values != "[0=1 1=6 2=7]" {
+		t.Fatalf("Resource Instanceの値が不正です %s", values)
+	}
+
+	if code := handler.WriteResourceInstances(resource, map[uint16]string{0: "2", 3: "8"}); code != CoapCodeChanged {
+		t.Fatalf("Writeに失敗しました %s", code)
+	}
+	if values := readHandlerFileTestInstances(t, handler, resource); values != "[0=2 3=8]" {
+		t.Fatalf("Write後のResource Instanceの値が不正です %s", values)
+	}
+	// .readは削除しない
+	if _, err := os.Stat(filepath.Join(handler.ResourceDirPath, "3", "0", "6", "1.read")); err != nil {
+		t.Fatal(".readが削除されました")
+	}
+}
+
+// TestHandlerFileSingleValueResource : 複数インスタンスのリソースが単一の値のファイルであれば、
+// Resource Instance 0として読み出し、Writeではディレクトリに移してから置き換えることを確認する
+func TestHandlerFileSingleValueResource(t *testing.T) {
+	handler, resource := newHandlerFileTest(t, map[string]string{"3/0/6": "1"})
+	if values := readHandlerFileTestInstances(t, handler, resource); values != "[0=1]" {
+		t.Fatalf("単一の値のファイルの値が不正です %s", values)
+	}
+	if _, code := handler.ReadResourceInstance(resource, 1); code != CoapCodeNotFound {
+		t.Fatalf("存在しないResource Instanceの読み出し結果が不正です %s", code)
+	}
+
+	if code := handler.WriteResourceInstances(resource, map[uint16]string{1: "5"}); code != CoapCodeChanged {
+		t.Fatalf("Writeに失敗しました %s", code)
+	}
+	if values := readHandlerFileTestInstances(t, handler, resource); values != "[1=5]" {
+		t.Fatalf("Write後のResource Instanceの値が不正です %s", values)
+	}
+	if file, err := os.Stat(filepath.Join(handler.ResourceDirPath, "3", "0", "6")); err != nil || !file.IsDir() {
+		t.Fatal("リソースのファイルがディレクトリに移されていません")
+	}
+}
+
+// TestHandlerFileSingleValueScript : 複数インスタンスのリソースに.read / .writeがあり、ディレクトリが無ければ、
+// Resource Instance 0として実行することを確認する
+func TestHandlerFileSingleValueScript(t *testing.T) {
+	handler, resource := newHandlerFileTest(t, map[string]string{
+		"3/0/6.read":  "#!/bin/sh\necho 3\n",
+		"3/0/6.write": "#!/bin/sh\ncat > \"$(dirname \"$0\")/written\"\n",
+	})
+	if values := readHandlerFileTestInstances(t, handler, resource); values != "[0=3]" {
+		t.Fatalf(".readの値が不正です %s", values)
+	}
+
+	if code := handler.WriteResourceInstances(resource, map[uint16]string{0: "4"}); code != CoapCodeChanged {
+		t.Fatalf(".writeへのWriteに失敗しました %s", code)
+	}
+	written, err := ioutil.ReadFile(filepath.Join(handler.ResourceDirPath, "3", "0", "written"))
+	if err != nil || string(written) != "4" {
+		t.Fatalf(".writeに渡された値が不正です %q", written)
+	}
+	if code := handler.WriteResourceInstances(resource, map[uint16]string{0: "4", 1: "5"}); code != CoapCodeNotAllowed {
+		t.Fatalf("Resource Instance 0以外の.writeへのWriteの結果が不正です %s", code)
+	}
+}
+
+// TestHandlerFileResourceInstancesStatError : リソースのパスを確認できない場合(インスタンスの位置がファイル)、
+// パニックせずに4.05を返すことを確認する
+func TestHandlerFileResourceInstancesStatError(t *testing.T) {
+	handler, resource := newHandlerFileTest(t, map[string]string{"3/0": "not a directory"})
+	if code := handler.WriteResourceInstances(resource, map[uint16]string{0: "1"}); code != CoapCodeNotAllowed {
+		t.Fatalf("Writeの結果が不正です %s", code)
+	}
+	if _, code := handler.ListResourceInstanceIDs(resource); code != CoapCodeNotAllowed {
+		t.Fatalf("ListResourceInstanceIDsの結果が不正です %s", code)
+	}
+}
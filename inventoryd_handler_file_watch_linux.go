@@ -0,0 +1,297 @@
+//go:build linux
+
+package inventoryd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// リソースディレクトリの監視に使用するinotifyのイベント
+// ファイルの書き込み完了、ファイル / ディレクトリの作成、削除、移動を監視する
+const handlerFileWatchEvents uint32 = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// handlerFileWatch : inotifyによるリソースディレクトリの監視
+// watchesはwatch descriptorと監視しているディレクトリのパスのID(ルートは空)の対応
+// pendingはchangedに送信できていない変更があったパス(キーはパスの文字列)
+// inotifyとself-pipeの読み出し側をepollで待ち、stopはself-pipeに書き込んでreadEventsを起こす
+// fdはreadEventsのみが閉じる(読み出し中に別のgoroutineから閉じると、再利用されたfdを読み出す恐れがあるため)
+type handlerFileWatch struct {
+	fd      int
+	epfd    int
+	wakeFds [2]int // self-pipe(0:読み出し側、1:書き込み側)
+	root    string
+	watches map[int][]uint16
+	changed chan<- []uint16
+	pending map[string][]uint16
+	wakeCh  chan struct{}
+	stopCh  chan struct{}
+	stopped bool
+	mutex   sync.Mutex
+}
+
+// WatchResources : リソースディレクトリをinotifyで監視する
+// ルート / オブジェクト / インスタンス / 複数インスタンスのリソースのディレクトリを監視し、
+// リソース(またはResource Instance)のファイルが書き込まれたらリソースのパス、
+// インスタンスが追加 / 削除されたらオブジェクトのパスを通知する
+func (handler *HandlerFile) WatchResources(changed chan<- []uint16, stopCh chan bool) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	watch := &handlerFileWatch{
+		fd:      fd,
+		epfd:    -1,
+		wakeFds: [2]int{-1, -1},
+		root:    handler.ResourceDirPath,
+		watches: make(map[int][]uint16),
+		changed: changed,
+		pending: make(map[string][]uint16),
+		wakeCh:  make(chan struct{}, 1),
+		stopCh:  make(chan struct{})}
+	if err := watch.openEpoll(); err != nil {
+		watch.closeFds()
+		return err
+	}
+	watch.mutex.Lock()
+	err = watch.addDir([]uint16{})
+	watch.mutex.Unlock()
+	if err != nil {
+		watch.closeFds()
+		return err
+	}
+	go watch.readEvents()
+	go watch.deliver()
+	go func() {
+		<-stopCh
+		watch.stop()
+	}()
+	return nil
+}
+
+// IsWatchable : 変更を監視できるリソースか
+// .readの実行ファイルが存在するリソースは、実行しなければ値が分からないため監視できない
+// 複数インスタンスのリソースは、いずれかのResource Instanceに.readがあれば監視できない
+func (handler *HandlerFile) IsWatchable(resource *Lwm2mResource) bool {
+	resourcePath := handler.resourcePath(resource)
+	file, err := os.Stat(resourcePath + ".read")
+	if !os.IsNotExist(err) && !(err == nil && file.IsDir()) {
+		return false
+	}
+	if !resource.Definition.Multi {
+		return true
+	}
+	files, err := ioutil.ReadDir(resourcePath)
+	if err != nil {
+		return true
+	}
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".read") {
+			return false
+		}
+	}
+	return true
+}
+
+// openEpoll : self-pipeを生成し、inotifyとself-pipeの読み出し側をepollに登録する
+func (watch *handlerFileWatch) openEpoll() error {
+	if err := syscall.Pipe2(watch.wakeFds[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		watch.wakeFds = [2]int{-1, -1}
+		return err
+	}
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	watch.epfd = epfd
+	for _, fd := range []int{watch.fd, watch.wakeFds[0]} {
+		event := &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: (int32)(fd)}
+		if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeFds : inotify / epoll / self-pipeのfdを閉じる
+func (watch *handlerFileWatch) closeFds() {
+	for _, fd := range []int{watch.fd, watch.epfd, watch.wakeFds[0], watch.wakeFds[1]} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+}
+
+// addDir : ディレクトリと、その中のオブジェクト / インスタンス / リソースのディレクトリを監視対象に追加する
+// リソースより下のディレクトリは監視しない
+// mutexをロックしてから呼び出す
+func (watch *handlerFileWatch) addDir(ids []uint16) error {
+	dirPath := watch.root
+	for _, id := range ids {
+		dirPath = filepath.Join(dirPath, strconv.Itoa((int)(id)))
+	}
+	wd, err := syscall.InotifyAddWatch(watch.fd, dirPath, handlerFileWatchEvents)
+	if err != nil {
+		return err
+	}
+	watch.watches[wd] = ids
+	if len(ids) >= 3 {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		id, err := strconv.Atoi(file.Name())
+		if err != nil || !file.IsDir() {
+			continue
+		}
+		if err := watch.addDir(append(append([]uint16{}, ids...), (uint16)(id))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readEvents : inotifyのイベントを読み出し、変更があったパスを通知する
+// self-pipeが読み出し可能になったら(stopが呼ばれたら)fdを閉じて終了する
+func (watch *handlerFileWatch) readEvents() {
+	defer watch.closeFds()
+	buf := make([]byte, syscall.SizeofInotifyEvent*64+syscall.PathMax)
+	events := make([]syscall.EpollEvent, 2)
+	for {
+		count, err := syscall.EpollWait(watch.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for _, event := range events[:count] {
+			if (int)(event.Fd) == watch.wakeFds[0] {
+				return
+			}
+		}
+		readLen, err := syscall.Read(watch.fd, buf)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		watch.mutex.Lock()
+		if watch.stopped || err != nil {
+			watch.mutex.Unlock()
+			return
+		}
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= readLen {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + (int)(event.Len)
+			if nameEnd > readLen {
+				break
+			}
+			name := strings.TrimRight(string(buf[nameStart:nameEnd]), "\x00")
+			watch.handleEvent(event, name)
+			offset = nameEnd
+		}
+		watch.mutex.Unlock()
+	}
+}
+
+// handleEvent : inotifyのイベントを処理する
+// 新しいオブジェクト / インスタンスのディレクトリが作成されたら監視対象に追加する
+// mutexをロックしてから呼び出す
+func (watch *handlerFileWatch) handleEvent(event *syscall.InotifyEvent, name string) {
+	ids, exist := watch.watches[(int)(event.Wd)]
+	if !exist {
+		return
+	}
+	if event.Mask&syscall.IN_IGNORED != 0 {
+		// 監視していたディレクトリが削除された
+		delete(watch.watches, (int)(event.Wd))
+		return
+	}
+	id, err := strconv.Atoi(name)
+	if err != nil {
+		// .read / .writeなど、リソース以外のファイル
+		return
+	}
+	path := append(append([]uint16{}, ids...), (uint16)(id))
+
+	if event.Mask&syscall.IN_ISDIR != 0 {
+		if len(path) > 3 {
+			return
+		}
+		if event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			watch.addDir(path)
+		}
+		if len(path) == 2 {
+			// インスタンスの追加 / 削除はオブジェクトの変更として通知する
+			path = path[:1]
+		}
+	} else {
+		if len(path) < 3 || event.Mask&syscall.IN_CREATE != 0 {
+			// ファイルの作成は書き込み完了(IN_CLOSE_WRITE)で通知する
+			return
+		}
+		// Resource Instanceの変更はリソースの変更として通知する
+		path = path[:3]
+	}
+	watch.notify(path)
+}
+
+// notify : 変更があったパスを通知待ちに追加する
+// 通知が溜まっていても破棄せず、送信するまでに同じパスが変更された場合は1回の通知にまとめる
+// mutexをロックしてから呼び出す
+func (watch *handlerFileWatch) notify(path []uint16) {
+	watch.pending[fmt.Sprint(path)] = path
+	select {
+	case watch.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// deliver : 通知待ちのパスをchangedに送信する
+// 送信を待つ間もmutexはロックしないため、inotifyのイベントの読み出しは止まらない
+func (watch *handlerFileWatch) deliver() {
+	for {
+		select {
+		case <-watch.wakeCh:
+		case <-watch.stopCh:
+			return
+		}
+		watch.mutex.Lock()
+		pending := watch.pending
+		watch.pending = make(map[string][]uint16)
+		watch.mutex.Unlock()
+		for _, path := range pending {
+			select {
+			case watch.changed <- path:
+			case <-watch.stopCh:
+				return
+			}
+		}
+	}
+}
+
+// stop : 監視を止める
+// self-pipeに書き込んでepollで待っているreadEventsを起こし、readEventsがfdを閉じる
+func (watch *handlerFileWatch) stop() {
+	watch.mutex.Lock()
+	defer watch.mutex.Unlock()
+	if watch.stopped {
+		return
+	}
+	watch.stopped = true
+	close(watch.stopCh)
+	syscall.Write(watch.wakeFds[1], []byte{0})
+}
@@ -0,0 +1,188 @@
+//go:build linux
+
+package inventoryd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestWatchResourcesOverflow : 通知を受け取らない間の変更も破棄されずに通知されることを確認する
+// 同じリソースの複数回の変更は1回の通知にまとまってよい
+func TestWatchResourcesOverflow(t *testing.T) {
+	root, err := ioutil.TempDir("", "inventoryd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	instanceDir := filepath.Join(root, "3", "0")
+	if err := os.MkdirAll(instanceDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &HandlerFile{ResourceDirPath: root}
+	changed := make(chan []uint16, 1)
+	stopCh := make(chan bool, 1)
+	if err := handler.WatchResources(changed, stopCh); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { stopCh <- true }()
+
+	// チャネルのバッファ(lwm2mWatchBufferSize)を超える数のリソースを、受け取らずに2回ずつ書き込む
+	resourceCount := lwm2mWatchBufferSize * 2
+	expected := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		for id := 0; id < resourceCount; id++ {
+			err := ioutil.WriteFile(filepath.Join(instanceDir, strconv.Itoa(id)), []byte(strconv.Itoa(i)), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected[fmt.Sprint([]uint16{3, 0, (uint16)(id)})] = true
+		}
+	}
+
+	timeout := time.After(5 * time.Second)
+	for len(expected) > 0 {
+		select {
+		case path := <-changed:
+			delete(expected, fmt.Sprint(path))
+		case <-timeout:
+			t.Fatalf("通知されなかった変更があります %d件", len(expected))
+		}
+	}
+}
+
+// startWatchResourcesTest : 一時ディレクトリにdirsのディレクトリを作成して監視を開始する
+// 戻り値のstopで監視を止める
+func startWatchResourcesTest(t *testing.T, dirs ...string) (string, chan []uint16, func()) {
+	root, err := ioutil.TempDir("", "inventoryd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := &HandlerFile{ResourceDirPath: root}
+	changed := make(chan []uint16, lwm2mWatchBufferSize)
+	stopCh := make(chan bool, 1)
+	if err := handler.WatchResources(changed, stopCh); err != nil {
+		t.Fatal(err)
+	}
+	stopped := false
+	stop := func() {
+		if !stopped {
+			stopped = true
+			stopCh <- true
+		}
+	}
+	t.Cleanup(stop)
+	return root, changed, stop
+}
+
+// expectWatchResourcesChanged : 次に通知されるパスがexpectedであることを確認する
+func expectWatchResourcesChanged(t *testing.T, changed chan []uint16, expected []uint16) {
+	t.Helper()
+	select {
+	case path := <-changed:
+		if fmt.Sprint(path) != fmt.Sprint(expected) {
+			t.Fatalf("通知されたパスが不正です %v (%vを期待)", path, expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("%v の変更が通知されません", expected)
+	}
+}
+
+// TestWatchResources : リソースの書き込みはリソースの変更、インスタンスの追加 / 削除はオブジェクトの変更、
+// Resource Instanceの書き込みはリソースの変更として通知し、リソース以外のファイルは通知しないことを確認する
+func TestWatchResources(t *testing.T) {
+	root, changed, _ := startWatchResourcesTest(t, "3/0")
+	write := func(path string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(root, filepath.FromSlash(path)), []byte("1"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdir := func(path string) {
+		t.Helper()
+		if err := os.Mkdir(filepath.Join(root, filepath.FromSlash(path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("3/0/9")
+	expectWatchResourcesChanged(t, changed, []uint16{3, 0, 9})
+
+	// 追加したインスタンスのディレクトリも監視対象になる
+	mkdir("3/1")
+	expectWatchResourcesChanged(t, changed, []uint16{3})
+	write("3/1/0")
+	expectWatchResourcesChanged(t, changed, []uint16{3, 1, 0})
+
+	mkdir("3/0/6")
+	expectWatchResourcesChanged(t, changed, []uint16{3, 0, 6})
+	write("3/0/6/1")
+	expectWatchResourcesChanged(t, changed, []uint16{3, 0, 6})
+
+	// .read / .writeは通知しない
+	write("3/0/9.read")
+	write("3/0/13")
+	expectWatchResourcesChanged(t, changed, []uint16{3, 0, 13})
+
+	if err := os.Remove(filepath.Join(root, "3", "1", "0")); err != nil {
+		t.Fatal(err)
+	}
+	expectWatchResourcesChanged(t, changed, []uint16{3, 1, 0})
+	if err := os.Remove(filepath.Join(root, "3", "1")); err != nil {
+		t.Fatal(err)
+	}
+	expectWatchResourcesChanged(t, changed, []uint16{3})
+}
+
+// countInotifyFds : このプロセスが開いているinotifyのfdの数を返す
+func countInotifyFds(t *testing.T) int {
+	t.Helper()
+	files, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip(err)
+	}
+	count := 0
+	for _, file := range files {
+		if link, err := os.Readlink(filepath.Join("/proc/self/fd", file.Name())); err == nil && link == "anon_inode:inotify" {
+			count++
+		}
+	}
+	return count
+}
+
+// TestWatchResourcesStop : 監視を止めると、監視しているディレクトリが無くなっていてもinotifyのfdを閉じることを確認する
+func TestWatchResourcesStop(t *testing.T) {
+	before := countInotifyFds(t)
+	root, _, stop := startWatchResourcesTest(t, "3/0")
+	if countInotifyFds(t) <= before {
+		t.Fatal("inotifyのfdが開かれていません")
+	}
+
+	// 全ての監視が解除された状態(IN_IGNOREDを処理済み)で止める
+	if err := os.RemoveAll(root); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	stop()
+
+	deadline := time.Now().Add(time.Second)
+	for countInotifyFds(t) > before {
+		if time.Now().After(deadline) {
+			t.Fatal("監視を止めてもinotifyのfdが閉じられません")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
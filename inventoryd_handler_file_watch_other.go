@@ -0,0 +1,18 @@
+//go:build !linux
+
+package inventoryd
+
+import (
+	"errors"
+)
+
+// WatchResources : リソースディレクトリを監視する
+// inotifyが利用できない環境では監視せず、定期的な確認のみとする
+func (handler *HandlerFile) WatchResources(changed chan<- []uint16, stopCh chan bool) error {
+	return errors.New("この環境ではリソースの監視に対応していません")
+}
+
+// IsWatchable : 変更を監視できるリソースか
+func (handler *HandlerFile) IsWatchable(resource *Lwm2mResource) bool {
+	return false
+}
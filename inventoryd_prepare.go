@@ -24,7 +24,9 @@ func CreateDefaultConfig(configPath string) error {
 		RootPath:           rootPath,
 		ObserveInterval:    5,
 		BootstrapServer:    "bootstrap.soracom.io:5683",
-		EndpointClientName: endpointClientName}
+		EndpointClientName: endpointClientName,
+		DtlsSessionCache:   true,
+		ConfirmableNotify:  []string{"/5/0/5"}}
 	_, err := os.Stat(rootPath)
 	if os.IsNotExist(err) {
 		err := os.MkdirAll(rootPath, 0755)
@@ -269,6 +271,11 @@ func (daemon *Inventoryd) createDefaultInstance(
 			ioutil.WriteFile(resourcePath, []byte(defaultScript), 0755)
 			continue
 		}
+		// 複数インスタンスのリソースはディレクトリとし、Resource Instance 0を生成する
+		if resourceDefinition.Multi {
+			os.Mkdir(resourcePath, 0755)
+			resourcePath = filepath.Join(resourcePath, "0")
+		}
 		switch resourceDefinition.Type {
 		case lwm2mResourceTypeString, lwm2mResourceTypeOpaque:
 			ioutil.WriteFile(resourcePath, []byte{}, 0644)
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"log"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,10 +18,19 @@ type Lwm2m struct {
 	Connection           *Coap
 	Location             string
 	definitions          lwm2mObjectDefinitions
+	observedObject       []*Lwm2mObservedObject
 	observedInstance     []*Lwm2mObservedInstance
 	observedResource     []*Lwm2mObservedResource
+	observeMutex         sync.Mutex                  // Observeのリストと、各Observeの状態(pending等)の排他
+	attributes           map[string]*lwm2mAttributes // Write-Attributesで設定された属性(キーはパス)
+	attributesMutex      sync.Mutex
+	confirmablePaths     []string             // NotifyをCONで送信するパス
+	watcher              Lwm2mResourceWatcher // リソースを監視している場合のみ(lwm2m_watch.go参照)
+	objectsChangedCh     chan bool            // インスタンスの追加 / 削除をUpdateで通知するためのチャネル
 	lifetime             int
 	registered           bool
+	dtlsSession          *DtlsSession // セッション再開用
+	dtlsSessionPath      string       // セッション情報の保存先(空の場合は保存しない)
 }
 
 // LWM2M関係の定数
@@ -34,11 +45,14 @@ const (
 
 // Lwm2mHandler : Lwm2mの各種Operationの処理ハンドラ
 // OMA-TS-LightweightM2M-V1_0_2-20180209-A
-// Read    : 5.4.1 Read参照(Objectに対するReadはInventoryのAPIに無いため対象外)
-// Write   : 5.4.3 Write参照
-// Execute : 5.4.5 Execute参照
-// Discover / Write-Attributes は対象外
-// Create / DeleteはBootstrapにて限定的に対応
+// Read             : 5.4.1 Read参照
+// Discover         : 5.4.2 Discover参照
+// Write            : 5.4.3 Write参照
+// Write-Attributes : 5.4.4 Write-Attributes参照
+// Execute          : 5.4.5 Execute参照
+// Create           : 5.4.6 Create参照
+// Delete           : 5.4.7 Delete参照
+// 複数インスタンスのリソース(定義のMultiがtrue)はResource Instance単位で読み書きする
 type Lwm2mHandler interface {
 
 	// 通常CoapCodeDeleteを返す
@@ -47,6 +61,9 @@ type Lwm2mHandler interface {
 	// 通常CoapCodeCreatedを返す
 	CreateInstance(instance *Lwm2mInstance) CoapCode
 
+	// 通常CoapCodeDeletedを返す
+	DeleteInstance(instance *Lwm2mInstance) CoapCode
+
 	// 通常CoapCodeContentを返す
 	ListObjectIDs() ([]uint16, CoapCode)
 
@@ -66,6 +83,67 @@ type Lwm2mHandler interface {
 	ExecuteResource(resource *Lwm2mResource, value string) CoapCode
 }
 
+// Lwm2mResourceInstanceHandler : 複数インスタンスのリソースをResource Instanceごとに扱うハンドラ
+// Lwm2mHandlerに加えて実装されている場合のみ使用する(型アサーションで確認する)
+// 実装されていない場合、複数インスタンスのリソースはResource Instance 0のみを持つものとして
+// ReadResource / WriteResourceで読み書きする
+type Lwm2mResourceInstanceHandler interface {
+	// 複数インスタンスのリソースの下にあるResource InstanceのIDを取得する
+	// 通常CoapCodeContentを返す
+	ListResourceInstanceIDs(resource *Lwm2mResource) ([]uint16, CoapCode)
+
+	// 通常CoapCodeContentを返す
+	ReadResourceInstance(resource *Lwm2mResource, resourceInstanceID uint16) (string, CoapCode)
+
+	// 複数インスタンスのリソースの全Resource Instanceをvalues(IDと値の対応)で置き換える
+	// 通常CoapCodeChangedを返す
+	WriteResourceInstances(resource *Lwm2mResource, values map[uint16]string) CoapCode
+}
+
+// Lwm2mResourceDeleteHandler : リソースを削除できるハンドラ
+// Lwm2mHandlerに加えて実装されている場合のみ使用する(型アサーションで確認する)
+// 実装されていない場合、指定されなかったリソースの削除が必要なWriteのReplaceは4.05とする
+type Lwm2mResourceDeleteHandler interface {
+	// WriteのReplaceで指定されなかったリソースを削除する
+	// 通常CoapCodeDeletedを返す
+	DeleteResource(resource *Lwm2mResource) CoapCode
+}
+
+// listResourceInstanceIDs : 複数インスタンスのリソースの下にあるResource InstanceのIDを取得する
+// ハンドラがLwm2mResourceInstanceHandlerを実装していなければ、Resource Instance 0のみとする
+func listResourceInstanceIDs(handler Lwm2mHandler, resource *Lwm2mResource) ([]uint16, CoapCode) {
+	if instanceHandler, ok := handler.(Lwm2mResourceInstanceHandler); ok {
+		return instanceHandler.ListResourceInstanceIDs(resource)
+	}
+	return []uint16{0}, CoapCodeContent
+}
+
+// readResourceInstance : Resource Instanceを読み出す
+// ハンドラがLwm2mResourceInstanceHandlerを実装していなければ、Resource Instance 0をリソースとして読み出す
+func readResourceInstance(handler Lwm2mHandler, resource *Lwm2mResource, resourceInstanceID uint16) (string, CoapCode) {
+	if instanceHandler, ok := handler.(Lwm2mResourceInstanceHandler); ok {
+		return instanceHandler.ReadResourceInstance(resource, resourceInstanceID)
+	}
+	if resourceInstanceID != 0 {
+		return "", CoapCodeNotFound
+	}
+	return handler.ReadResource(resource)
+}
+
+// writeResourceInstances : 複数インスタンスのリソースの全Resource Instanceを置き換える
+// ハンドラがLwm2mResourceInstanceHandlerを実装していなければ、Resource Instance 0のみの書き込みに限り
+// リソースとして書き込む
+func writeResourceInstances(handler Lwm2mHandler, resource *Lwm2mResource, values map[uint16]string) CoapCode {
+	if instanceHandler, ok := handler.(Lwm2mResourceInstanceHandler); ok {
+		return instanceHandler.WriteResourceInstances(resource, values)
+	}
+	value, exist := values[0]
+	if !exist || len(values) != 1 {
+		return CoapCodeNotAllowed
+	}
+	return handler.WriteResource(resource, value)
+}
+
 // Initialize : Lwm2m構造体を初期化する
 func (lwm2m *Lwm2m) Initialize(
 	endpointClientName string,
@@ -74,6 +152,8 @@ func (lwm2m *Lwm2m) Initialize(
 	lwm2m.endpointClientName = endpointClientName
 	lwm2m.definitions = definitions
 	lwm2m.handler = handler
+	lwm2m.attributes = make(map[string]*lwm2mAttributes)
+	lwm2m.objectsChangedCh = make(chan bool, 1)
 	if !lwm2m.searchDMSecurityInstance() {
 		return errors.New("セキュリティ設定が見つかりませんでした")
 	}
@@ -85,7 +165,22 @@ func (lwm2m *Lwm2m) Initialize(
 	return nil
 }
 
+// CheckSecurityParams : 接続に必要なセキュリティパラメータが揃っているかを確認する
+// RPKモードの場合はサーバーの公開鍵も必要とする
+// NoSecモードの場合、およびDTLS(coaps)以外でCertificateモードでない場合はパラメータは不要とする
+// (TLSの場合はサーバー証明書の検証のみで接続する)
+// Security ModeとURIのセキュリティの有無が一致しない場合はエラーとする(checkSecureURI参照)
 func (lwm2m *Lwm2m) CheckSecurityParams() error {
+	mode := lwm2m.getSecurityMode()
+	if err := checkSecureURI(mode, lwm2m.getDMServerURI()); err != nil {
+		return err
+	}
+	if mode == Lwm2mSecurityModeNoSec {
+		return nil
+	}
+	if !strings.HasPrefix(lwm2m.getDMServerURI(), "coaps://") && mode != Lwm2mSecurityModeCertificate {
+		return nil
+	}
 	identity := lwm2m.getIdentity()
 	psk := lwm2m.getSecretKey()
 	if len(identity) == 0 || len(psk) == 0 {
@@ -93,10 +188,14 @@ func (lwm2m *Lwm2m) CheckSecurityParams() error {
 -bオプションにてブートストラップを実行するか、
 --psk string(base64) --identity stringオプションにてセキュリティパラメータを指定してください`)
 	}
+	if mode == Lwm2mSecurityModeRPK && len(lwm2m.getServerPublicKey()) == 0 {
+		return errors.New("RPKモードではサーバーの公開鍵(/0/x/4)が必要です")
+	}
 	return nil
 }
 
 // StartUpdate : Update動作を開始する
+// インスタンスが追加 / 削除された場合は、オブジェクトとインスタンスのリストを含むUpdateを送信する
 // stopChを受信したら停止する
 func (lwm2m *Lwm2m) StartUpdate(interval time.Duration, stopCh chan bool) {
 
@@ -114,6 +213,11 @@ func (lwm2m *Lwm2m) StartUpdate(interval time.Duration, stopCh chan bool) {
 			if err != nil {
 				log.Print(err)
 			}
+		case <-lwm2m.objectsChangedCh:
+			err := lwm2m.UpdateObjects()
+			if err != nil {
+				log.Print(err)
+			}
 		case <-stopCh:
 			lwm2m.close()
 			return
@@ -122,16 +226,22 @@ func (lwm2m *Lwm2m) StartUpdate(interval time.Duration, stopCh chan bool) {
 }
 
 // StartObserving : Observe動作を開始する
+// ハンドラがリソースの変更を監視できる場合は、変更があったリソースを即座にNotifyする
 // stopChを受信したら停止する
 func (lwm2m *Lwm2m) StartObserving(interval time.Duration, stopCh chan bool) {
 
+	watchStopCh := make(chan bool, 1)
+	changedCh := lwm2m.startWatching(watchStopCh)
 	t := time.NewTicker(interval)
 	defer t.Stop()
 	for {
 		select {
 		case <-t.C:
 			lwm2m.Observe()
+		case path := <-changedCh:
+			lwm2m.NotifyChanged(path)
 		case <-stopCh:
+			watchStopCh <- true
 			return
 		}
 	}
@@ -139,23 +249,37 @@ func (lwm2m *Lwm2m) StartObserving(interval time.Duration, stopCh chan bool) {
 
 // ReceiveMessage : メッセージ受信ハンドラ
 func (lwm2m *Lwm2m) ReceiveMessage(message *CoapMessage) {
-	if message.Type == CoapTypeAcknowledgement {
-		switch message.Code {
-		case CoapCodeCreated:
-			lwm2m.RegisterDone(message)
-		case CoapCodeChanged:
-			lwm2m.UpdateDone(message)
-		}
-	} else if message.Type == CoapTypeConfirmable {
+	// Register / Updateのレスポンスは各Operationで処理する
+	if message.Type == CoapTypeConfirmable {
 		switch message.Code {
 		case CoapCodeGet:
-			// READとOBSERVEがGET Codeで要求されるが、
+			// READ / OBSERVE / DISCOVERがGET Codeで要求される
+			// AcceptがLink FormatのものをDISCOVERとし、
 			// Observeも値を返すのでREADの変形として処理する
-			lwm2m.ReadRequest(message)
+			if accept, ok := message.Accept(); ok && accept == coapContentFormatLinkFormat {
+				lwm2m.DiscoverRequest(message)
+			} else {
+				lwm2m.ReadRequest(message)
+			}
 		case CoapCodePut:
-			lwm2m.WriteRequest(message)
+			// WRITEとWRITE-ATTRIBUTESがPUT Codeで要求される
+			if message.isWriteAttributes() {
+				lwm2m.WriteAttributesRequest(message)
+			} else {
+				lwm2m.WriteRequest(message)
+			}
 		case CoapCodePost:
-			lwm2m.ExecuteRequest(message)
+			// EXECUTE / WRITE(Partial Update) / CREATEがPOST Codeで要求される
+			// オブジェクトを対象とするものをCREATEとする
+			if message.isPartialUpdate() {
+				lwm2m.WriteRequest(message)
+			} else if message.isCreate() {
+				lwm2m.CreateRequest(message)
+			} else {
+				lwm2m.ExecuteRequest(message)
+			}
+		case CoapCodeDelete:
+			lwm2m.DeleteRequest(message)
 		}
 	} else if message.Type == CoapTypeReset {
 		// Resetが発生するのはObserveが解除されているリソースに対してNotifyした時
@@ -247,6 +371,27 @@ func (lwm2m *Lwm2m) getShortServerID() int {
 	return shoftServerID
 }
 
+// findObject : オブジェクトを検索する
+// 定義の無いオブジェクトは、リソースを読み書きできないため存在しないものとする
+func (lwm2m *Lwm2m) findObject(objectID uint16) *Lwm2mObject {
+	definition := lwm2m.definitions.findObjectDefinitionByID(objectID)
+	if definition == nil {
+		return nil
+	}
+	objectIDs, code := lwm2m.handler.ListObjectIDs()
+	if code != CoapCodeContent {
+		return nil
+	}
+	for _, id := range objectIDs {
+		if id == objectID {
+			return &Lwm2mObject{
+				ID:         objectID,
+				Definition: definition}
+		}
+	}
+	return nil
+}
+
 // findInstance : インスタンスを検索する
 func (lwm2m *Lwm2m) findInstance(objectID, instanceID uint16) *Lwm2mInstance {
 	objectIDs, code := lwm2m.handler.ListObjectIDs()
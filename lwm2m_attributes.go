@@ -0,0 +1,374 @@
+package inventoryd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notification Attributes
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.1.2 Attributes参照
+const (
+	lwm2mAttributeMinimumPeriod = "pmin"
+	lwm2mAttributeMaximumPeriod = "pmax"
+	lwm2mAttributeGreaterThan   = "gt"
+	lwm2mAttributeLessThan      = "lt"
+	lwm2mAttributeStep          = "st"
+)
+
+// Serverオブジェクトのデフォルト通知周期
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A E.2 LwM2M Object: LwM2M Server参照
+const (
+	lwm2mResourceIDServerDefaultMinimumPeriod uint16 = 2
+	lwm2mResourceIDServerDefaultMaximumPeriod uint16 = 3
+)
+
+// lwm2mAttributes : Notification Attributes
+// 設定されていない属性はnilとする
+// pmin / pmaxは秒単位で、Observeの確認周期(ObserveInterval)ごとに判定する
+type lwm2mAttributes struct {
+	pmin *int
+	pmax *int
+	gt   *float64
+	lt   *float64
+	st   *float64
+}
+
+// WriteAttributesRequest : Write-Attributesを処理する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.4.4 Write-Attributes参照
+// 属性はURI Queryで指定され、値の無い属性(例 : pmin)はその属性の削除を表す
+// gt / lt / stは数値型のリソースにのみ設定できる
+func (lwm2m *Lwm2m) WriteAttributesRequest(message *CoapMessage) error {
+	idCount, objectID, instanceID, resourceID, err := message.extractResourceID()
+	if err != nil {
+		return err
+	}
+
+	var path string
+	var resourceDefinition *Lwm2mResourceDefinition
+	switch idCount {
+	case 1:
+		path = fmt.Sprintf("/%d", objectID)
+		if lwm2m.findObject(objectID) == nil {
+			lwm2m.Connection.SendResponse(message, CoapCodeNotFound, []CoapOption{}, []byte{})
+			return nil
+		}
+	case 2:
+		path = fmt.Sprintf("/%d/%d", objectID, instanceID)
+		if lwm2m.findInstance(objectID, instanceID) == nil {
+			lwm2m.Connection.SendResponse(message, CoapCodeNotFound, []CoapOption{}, []byte{})
+			return nil
+		}
+	case 3:
+		path = fmt.Sprintf("/%d/%d/%d", objectID, instanceID, resourceID)
+		resource := lwm2m.findResource(objectID, instanceID, resourceID)
+		if resource == nil || resource.Definition == nil {
+			lwm2m.Connection.SendResponse(message, CoapCodeNotFound, []CoapOption{}, []byte{})
+			return nil
+		}
+		resourceDefinition = resource.Definition
+	default:
+		lwm2m.Connection.SendResponse(message, CoapCodeNotAllowed, []CoapOption{}, []byte{})
+		return nil
+	}
+	log.Printf("WRITE-ATTRIBUTES %s", path)
+
+	lwm2m.attributesMutex.Lock()
+	attributes := lwm2mAttributes{}
+	if current, exist := lwm2m.attributes[path]; exist {
+		attributes = *current
+	}
+	lwm2m.attributesMutex.Unlock()
+
+	for _, option := range message.Options {
+		if option.No != coapOptionNoURIQuery {
+			continue
+		}
+		if err := attributes.set(string(option.Value), resourceDefinition); err != nil {
+			lwm2m.Connection.SendResponse(message, CoapCodeBadRequest, []CoapOption{}, []byte{})
+			return err
+		}
+	}
+	if err := attributes.validate(); err != nil {
+		lwm2m.Connection.SendResponse(message, CoapCodeBadRequest, []CoapOption{}, []byte{})
+		return err
+	}
+
+	lwm2m.attributesMutex.Lock()
+	lwm2m.attributes[path] = &attributes
+	lwm2m.attributesMutex.Unlock()
+	lwm2m.refreshObservedAttributes()
+
+	lwm2m.Connection.SendResponse(message, CoapCodeChanged, []CoapOption{}, []byte{})
+	return nil
+}
+
+// isWriteAttributes : Write-Attributesのメッセージかを判定する
+// Write-AttributesはPUTでURI Queryがあり、Payloadが無いもの
+func (message *CoapMessage) isWriteAttributes() bool {
+	return message.Code == CoapCodePut && len(message.Payload) == 0 && message.findOption(coapOptionNoURIQuery) != nil
+}
+
+// set : URI Query(例 : pmin=10)の属性を設定する
+// 値が無い場合は属性を削除する
+// resourceDefinitionはリソースに対する設定の場合のみ指定する
+func (attributes *lwm2mAttributes) set(query string, resourceDefinition *Lwm2mResourceDefinition) error {
+	name := query
+	value := ""
+	hasValue := false
+	if index := strings.Index(query, "="); index >= 0 {
+		name = query[:index]
+		value = query[(index + 1):]
+		hasValue = true
+	}
+
+	switch name {
+	case lwm2mAttributeMinimumPeriod, lwm2mAttributeMaximumPeriod:
+		var period *int
+		if hasValue {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				return errors.New("不正な通知周期が指定されました: " + query)
+			}
+			period = &parsed
+		}
+		if name == lwm2mAttributeMinimumPeriod {
+			attributes.pmin = period
+		} else {
+			attributes.pmax = period
+		}
+	case lwm2mAttributeGreaterThan, lwm2mAttributeLessThan, lwm2mAttributeStep:
+		if resourceDefinition == nil ||
+			(resourceDefinition.Type != lwm2mResourceTypeInteger && resourceDefinition.Type != lwm2mResourceTypeFloat) {
+			return errors.New("gt / lt / stは数値型のリソースにのみ指定できます")
+		}
+		var threshold *float64
+		if hasValue {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return errors.New("不正な閾値が指定されました: " + query)
+			}
+			threshold = &parsed
+		}
+		switch name {
+		case lwm2mAttributeGreaterThan:
+			attributes.gt = threshold
+		case lwm2mAttributeLessThan:
+			attributes.lt = threshold
+		default:
+			attributes.st = threshold
+		}
+	default:
+		return errors.New("未対応の属性が指定されました: " + query)
+	}
+	return nil
+}
+
+// validate : 属性の組み合わせを確認する
+// pmax >= pmin、lt < gt、lt + 2 * st < gtでなければならない
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.1.2 Attributes参照
+func (attributes *lwm2mAttributes) validate() error {
+	if attributes.pmin != nil && attributes.pmax != nil && *attributes.pmax < *attributes.pmin {
+		return errors.New("pmaxはpmin以上でなければなりません")
+	}
+	if attributes.st != nil && *attributes.st <= 0 {
+		return errors.New("stは正の値でなければなりません")
+	}
+	if attributes.gt != nil && attributes.lt != nil {
+		step := 0.0
+		if attributes.st != nil {
+			step = *attributes.st
+		}
+		if *attributes.lt+2*step >= *attributes.gt {
+			return errors.New("ltとgtの関係が不正です")
+		}
+	}
+	return nil
+}
+
+// merge : 上位の属性に下位(より詳細なパス)の属性を上書きする
+func (attributes lwm2mAttributes) merge(other *lwm2mAttributes) lwm2mAttributes {
+	if other == nil {
+		return attributes
+	}
+	if other.pmin != nil {
+		attributes.pmin = other.pmin
+	}
+	if other.pmax != nil {
+		attributes.pmax = other.pmax
+	}
+	if other.gt != nil {
+		attributes.gt = other.gt
+	}
+	if other.lt != nil {
+		attributes.lt = other.lt
+	}
+	if other.st != nil {
+		attributes.st = other.st
+	}
+	return attributes
+}
+
+// linkParams : Discoverのリンクに付加する属性(例 : ;pmin=10;gt=50)を生成する
+func (attributes *lwm2mAttributes) linkParams() string {
+	if attributes == nil {
+		return ""
+	}
+	ret := ""
+	if attributes.pmin != nil {
+		ret += ";" + lwm2mAttributeMinimumPeriod + "=" + strconv.Itoa(*attributes.pmin)
+	}
+	if attributes.pmax != nil {
+		ret += ";" + lwm2mAttributeMaximumPeriod + "=" + strconv.Itoa(*attributes.pmax)
+	}
+	if attributes.gt != nil {
+		ret += ";" + lwm2mAttributeGreaterThan + "=" + strconv.FormatFloat(*attributes.gt, 'g', -1, 64)
+	}
+	if attributes.lt != nil {
+		ret += ";" + lwm2mAttributeLessThan + "=" + strconv.FormatFloat(*attributes.lt, 'g', -1, 64)
+	}
+	if attributes.st != nil {
+		ret += ";" + lwm2mAttributeStep + "=" + strconv.FormatFloat(*attributes.st, 'g', -1, 64)
+	}
+	return ret
+}
+
+// beforeMinimumPeriod : 前回のNotifyからpmin秒経過していなければtrueを返す
+func (attributes lwm2mAttributes) beforeMinimumPeriod(lastNotified, now time.Time) bool {
+	return attributes.pmin != nil && now.Sub(lastNotified) < (time.Duration)(*attributes.pmin)*time.Second
+}
+
+// exceedsMaximumPeriod : 前回のNotifyからpmax秒経過していればtrueを返す
+// pmaxが0の場合は無効とする
+func (attributes lwm2mAttributes) exceedsMaximumPeriod(lastNotified, now time.Time) bool {
+	return attributes.pmax != nil && *attributes.pmax > 0 &&
+		now.Sub(lastNotified) >= (time.Duration)(*attributes.pmax)*time.Second
+}
+
+// isNotifiableChange : 値の変化がNotifyの条件を満たすかを判定する
+// gt / lt / stが無い場合は値が変化したらNotifyする
+// ある場合はgt / ltを跨いだ場合、または前回Notifyした値からst以上変化した場合にNotifyする
+// 数値として解釈できない場合は値が変化したらNotifyする
+func (attributes lwm2mAttributes) isNotifiableChange(lastValue, value string) bool {
+	if value == lastValue {
+		return false
+	}
+	if attributes.gt == nil && attributes.lt == nil && attributes.st == nil {
+		return true
+	}
+	last, err := strconv.ParseFloat(lastValue, 64)
+	if err != nil {
+		return true
+	}
+	current, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return true
+	}
+	if attributes.gt != nil && (last > *attributes.gt) != (current > *attributes.gt) {
+		return true
+	}
+	if attributes.lt != nil && (last < *attributes.lt) != (current < *attributes.lt) {
+		return true
+	}
+	if attributes.st != nil && math.Abs(current-last) >= *attributes.st {
+		return true
+	}
+	return false
+}
+
+// findAttributes : パスに直接設定されている属性を取得する
+// 設定されていない場合はnilを返す
+func (lwm2m *Lwm2m) findAttributes(path string) *lwm2mAttributes {
+	lwm2m.attributesMutex.Lock()
+	defer lwm2m.attributesMutex.Unlock()
+	return lwm2m.attributes[path]
+}
+
+// removeAttributes : パスとその中のパスに設定されている属性を削除する
+// インスタンスが削除された場合に使用する
+func (lwm2m *Lwm2m) removeAttributes(path string) {
+	lwm2m.attributesMutex.Lock()
+	defer lwm2m.attributesMutex.Unlock()
+	for attributesPath := range lwm2m.attributes {
+		if attributesPath == path || strings.HasPrefix(attributesPath, path+"/") {
+			delete(lwm2m.attributes, attributesPath)
+		}
+	}
+}
+
+// objectAttributes : オブジェクトに適用される属性を取得する
+// Serverオブジェクトのデフォルト通知周期をオブジェクトの属性で上書きする
+func (lwm2m *Lwm2m) objectAttributes(objectID uint16) lwm2mAttributes {
+	return lwm2m.defaultAttributes().merge(lwm2m.findAttributes(fmt.Sprintf("/%d", objectID)))
+}
+
+// instanceAttributes : インスタンスに適用される属性を取得する
+// オブジェクトに適用される属性をインスタンスの属性で上書きする
+func (lwm2m *Lwm2m) instanceAttributes(objectID, instanceID uint16) lwm2mAttributes {
+	return lwm2m.objectAttributes(objectID).
+		merge(lwm2m.findAttributes(fmt.Sprintf("/%d/%d", objectID, instanceID)))
+}
+
+// resourceAttributes : リソースに適用される属性を取得する
+// インスタンスに適用される属性をリソースの属性で上書きする
+func (lwm2m *Lwm2m) resourceAttributes(objectID, instanceID, resourceID uint16) lwm2mAttributes {
+	return lwm2m.instanceAttributes(objectID, instanceID).
+		merge(lwm2m.findAttributes(fmt.Sprintf("/%d/%d/%d", objectID, instanceID, resourceID)))
+}
+
+// defaultAttributes : Serverオブジェクトのデフォルト通知周期(/1/x/2, /1/x/3)を取得する
+// 取得できない場合は設定なしとする
+func (lwm2m *Lwm2m) defaultAttributes() lwm2mAttributes {
+	attributes := lwm2mAttributes{}
+	attributes.pmin = lwm2m.readServerPeriod(lwm2mResourceIDServerDefaultMinimumPeriod)
+	attributes.pmax = lwm2m.readServerPeriod(lwm2mResourceIDServerDefaultMaximumPeriod)
+	return attributes
+}
+
+// readServerPeriod : Serverオブジェクトの通知周期のリソースを読み出す
+func (lwm2m *Lwm2m) readServerPeriod(resourceID uint16) *int {
+	resource := lwm2m.findResource(lwm2mObjectIDServer, lwm2m.dmServerInstanceID, resourceID)
+	if resource == nil {
+		return nil
+	}
+	value, code := lwm2m.handler.ReadResource(resource)
+	if code != CoapCodeContent {
+		return nil
+	}
+	period, err := strconv.Atoi(value)
+	if err != nil {
+		return nil
+	}
+	return &period
+}
+
+// refreshObservedAttributes : Observe中のインスタンス / リソースに適用される属性を更新する
+func (lwm2m *Lwm2m) refreshObservedAttributes() {
+	lwm2m.observeMutex.Lock()
+	defer lwm2m.observeMutex.Unlock()
+	for _, observe := range lwm2m.observedObject {
+		observe.attributes = lwm2m.objectAttributes(observe.object.ID)
+		lwm2m.refreshObservedInstanceAttributes(observe.instances)
+	}
+	lwm2m.refreshObservedInstanceAttributes(lwm2m.observedInstance)
+	for _, observe := range lwm2m.observedResource {
+		resource := observe.resource
+		observe.attributes = lwm2m.resourceAttributes(resource.objectID, resource.instanceID, resource.ID)
+	}
+}
+
+// refreshObservedInstanceAttributes : Observe中のインスタンスとそのリソースに適用される属性を更新する
+// Observeを登録する際と、Write-Attributesで属性が変更された際に呼び出す
+func (lwm2m *Lwm2m) refreshObservedInstanceAttributes(observedInstances []*Lwm2mObservedInstance) {
+	for _, observe := range observedInstances {
+		observe.attributes = lwm2m.instanceAttributes(observe.instance.objectID, observe.instance.ID)
+		for _, resourceObserve := range observe.resources {
+			resource := resourceObserve.resource
+			resourceObserve.attributes = lwm2m.resourceAttributes(resource.objectID, resource.instanceID, resource.ID)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package inventoryd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lwm2mTestAttributesString : 属性を比較用の文字列(Discoverのリンクの属性と同じ形式)に変換する
+// 関数の戻り値に対してlinkParamsを呼び出せないため、一度変数で受ける
+func lwm2mTestAttributesString(attributes lwm2mAttributes) string {
+	return attributes.linkParams()
+}
+
+// TestLwm2mAttributesSet : URI Queryの属性の解析と、値の無い属性による削除を確認する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.1.2 Attributes参照
+func TestLwm2mAttributesSet(t *testing.T) {
+	numeric := &Lwm2mResourceDefinition{Type: lwm2mResourceTypeInteger}
+	float := &Lwm2mResourceDefinition{Type: lwm2mResourceTypeFloat}
+	text := &Lwm2mResourceDefinition{Type: lwm2mResourceTypeString}
+	cases := []struct {
+		queries    []string
+		definition *Lwm2mResourceDefinition
+		expected   string
+		valid      bool
+	}{
+		{[]string{"pmin=10", "pmax=60"}, nil, ";pmin=10;pmax=60", true},
+		{[]string{"pmin=10", "pmin"}, nil, "", true},
+		{[]string{"pmin=0", "pmax=0"}, nil, ";pmin=0;pmax=0", true},
+		{[]string{"gt=50", "lt=-1.5", "st=0.5"}, float, ";gt=50;lt=-1.5;st=0.5", true},
+		{[]string{"gt=50", "gt"}, numeric, "", true},
+		{[]string{"pmin=-1"}, nil, "", false},
+		{[]string{"pmax=ten"}, nil, "", false},
+		{[]string{"gt=abc"}, numeric, "", false},
+		{[]string{"gt=50"}, nil, "", false},
+		{[]string{"lt=10"}, text, "", false},
+		{[]string{"epmin=10"}, nil, "", false},
+	}
+	for _, c := range cases {
+		attributes := lwm2mAttributes{}
+		var err error
+		for _, query := range c.queries {
+			if err = attributes.set(query, c.definition); err != nil {
+				break
+			}
+		}
+		if (err == nil) != c.valid {
+			t.Fatalf("%v の結果が不正です err=%v", c.queries, err)
+		}
+		if c.valid && lwm2mTestAttributesString(attributes) != c.expected {
+			t.Fatalf("%v の属性が不正です %s", c.queries, lwm2mTestAttributesString(attributes))
+		}
+	}
+}
+
+// TestLwm2mAttributesValidate : pmax >= pmin、st > 0、lt + 2 * st < gtの確認
+func TestLwm2mAttributesValidate(t *testing.T) {
+	numeric := &Lwm2mResourceDefinition{Type: lwm2mResourceTypeFloat}
+	cases := []struct {
+		queries []string
+		valid   bool
+	}{
+		{[]string{"pmin=10", "pmax=10"}, true},
+		{[]string{"pmin=10", "pmax=9"}, false},
+		{[]string{"st=0"}, false},
+		{[]string{"st=-1"}, false},
+		{[]string{"lt=10", "gt=20"}, true},
+		{[]string{"lt=20", "gt=20"}, false},
+		{[]string{"lt=10", "gt=20", "st=4.9"}, true},
+		{[]string{"lt=10", "gt=20", "st=5"}, false},
+	}
+	for _, c := range cases {
+		attributes := lwm2mAttributes{}
+		for _, query := range c.queries {
+			if err := attributes.set(query, numeric); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := attributes.validate(); (err == nil) != c.valid {
+			t.Fatalf("%v の結果が不正です err=%v", c.queries, err)
+		}
+	}
+}
+
+// TestLwm2mAttributesConditions : pmin / pmaxの経過と、gt / lt / stによる値の変化の判定を確認する
+func TestLwm2mAttributesConditions(t *testing.T) {
+	pmin, pmax, disabled := 10, 60, 0
+	attributes := lwm2mAttributes{pmin: &pmin, pmax: &pmax}
+	last := time.Now()
+	if !attributes.beforeMinimumPeriod(last, last.Add(9*time.Second)) || attributes.beforeMinimumPeriod(last, last.Add(10*time.Second)) {
+		t.Fatal("pminの判定が不正です")
+	}
+	if attributes.exceedsMaximumPeriod(last, last.Add(59*time.Second)) || !attributes.exceedsMaximumPeriod(last, last.Add(60*time.Second)) {
+		t.Fatal("pmaxの判定が不正です")
+	}
+	if (lwm2mAttributes{pmax: &disabled}).exceedsMaximumPeriod(last, last.Add(time.Hour)) {
+		t.Fatal("pmax=0が無効になりません")
+	}
+
+	gt, lt, st := 50.0, 20.0, 5.0
+	cases := []struct {
+		attributes lwm2mAttributes
+		last       string
+		value      string
+		notifiable bool
+	}{
+		{lwm2mAttributes{}, "1", "1", false},
+		{lwm2mAttributes{}, "1", "2", true},
+		{lwm2mAttributes{gt: &gt}, "40", "49", false},
+		{lwm2mAttributes{gt: &gt}, "49", "51", true},
+		{lwm2mAttributes{gt: &gt}, "51", "49", true},
+		{lwm2mAttributes{lt: &lt}, "25", "19", true},
+		{lwm2mAttributes{lt: &lt}, "25", "21", false},
+		{lwm2mAttributes{st: &st}, "30", "34.9", false},
+		{lwm2mAttributes{st: &st}, "30", "25", true},
+		{lwm2mAttributes{gt: &gt, lt: &lt, st: &st}, "30", "33", false},
+		{lwm2mAttributes{gt: &gt}, "on", "off", true},
+	}
+	for _, c := range cases {
+		if c.attributes.isNotifiableChange(c.last, c.value) != c.notifiable {
+			t.Fatalf("%s : %s -> %s の判定が不正です", c.attributes.linkParams(), c.last, c.value)
+		}
+	}
+}
+
+// TestLwm2mAttributesInheritance : Serverオブジェクトのデフォルト通知周期を、
+// オブジェクト / インスタンス / リソースの属性の順に上書きして適用することを確認する
+func TestLwm2mAttributesInheritance(t *testing.T) {
+	files := map[string]string{
+		"1/0/2": "5",
+		"1/0/3": "300",
+		"3/0/0": "inventoryd",
+		"3/0/9": "80",
+	}
+	lwm2m, peer := newLwm2mTestClient(t, files)
+	writeAttributes := func(path string, queries ...string) {
+		t.Helper()
+		options := []CoapOption{}
+		for _, query := range queries {
+			options = append(options, CoapOption{coapOptionNoURIQuery, []byte(query)})
+		}
+		if response := peer.request(lwm2mTestRequest(CoapCodePut, path, options, []byte{})); response.Code != CoapCodeChanged {
+			t.Fatalf("%s のWrite-Attributesに失敗しました %s", path, response.Code)
+		}
+	}
+
+	if attributes := lwm2mTestAttributesString(lwm2m.resourceAttributes(3, 0, 9)); attributes != ";pmin=5;pmax=300" {
+		t.Fatalf("デフォルトの通知周期が不正です %s", attributes)
+	}
+	writeAttributes("/3", "pmax=100")
+	writeAttributes("/3/0", "pmin=10")
+	writeAttributes("/3/0/9", "gt=50", "pmax=20")
+	cases := []struct {
+		name       string
+		attributes lwm2mAttributes
+		expected   string
+	}{
+		{"/3", lwm2m.objectAttributes(3), ";pmin=5;pmax=100"},
+		{"/3/0", lwm2m.instanceAttributes(3, 0), ";pmin=10;pmax=100"},
+		{"/3/0/0", lwm2m.resourceAttributes(3, 0, 0), ";pmin=10;pmax=100"},
+		{"/3/0/9", lwm2m.resourceAttributes(3, 0, 9), ";pmin=10;pmax=20;gt=50"},
+	}
+	for _, c := range cases {
+		if attributes := lwm2mTestAttributesString(c.attributes); attributes != c.expected {
+			t.Fatalf("%s に適用される属性が不正です %s", c.name, attributes)
+		}
+	}
+
+	// Observe中のインスタンスとリソースには、登録時と属性の変更時に適用される
+	observe := lwm2mTestRequest(CoapCodeGet, "/3/0", []CoapOption{CoapOption{coapOptionNoObserve, []byte{}}}, []byte{})
+	if response := peer.request(observe); response.Code != CoapCodeContent {
+		t.Fatalf("Observeに失敗しました %s", response.Code)
+	}
+	observedAttributes := func() (string, []string) {
+		lwm2m.observeMutex.Lock()
+		defer lwm2m.observeMutex.Unlock()
+		observedInstance := lwm2m.observedInstance[0]
+		resources := []string{}
+		for _, observedResource := range observedInstance.resources {
+			resources = append(resources, lwm2mTestAttributesString(observedResource.attributes))
+		}
+		return lwm2mTestAttributesString(observedInstance.attributes), resources
+	}
+	instanceAttributes, resourceAttributes := observedAttributes()
+	if instanceAttributes != ";pmin=10;pmax=100" || strings.Join(resourceAttributes, ",") != ";pmin=10;pmax=100,;pmin=10;pmax=20;gt=50" {
+		t.Fatalf("Observe登録時の属性が不正です %s %v", instanceAttributes, resourceAttributes)
+	}
+	writeAttributes("/3/0", "pmin")
+	instanceAttributes, resourceAttributes = observedAttributes()
+	if instanceAttributes != ";pmin=5;pmax=100" || strings.Join(resourceAttributes, ",") != ";pmin=5;pmax=100,;pmin=5;pmax=20;gt=50" {
+		t.Fatalf("属性の変更がObserveに適用されません %s %v", instanceAttributes, resourceAttributes)
+	}
+}
+
+// TestLwm2mReadWithoutAttributes : Observeでない通常のReadでは、
+// 属性の取得に必要なServerオブジェクトのデフォルト通知周期を読み出さないことを確認する
+func TestLwm2mReadWithoutAttributes(t *testing.T) {
+	// 1/0/2は読み出されるたびにカウンタのファイルに追記する
+	files := map[string]string{
+		"1/0/2":      "",
+		"1/0/2.read": "#!/bin/sh\necho >> \"$(dirname \"$0\")/count\"\necho 5\n",
+		"3/0/0":      "inventoryd",
+		"3/0/9":      "80",
+	}
+	lwm2m, peer := newLwm2mTestClient(t, files)
+	handler := lwm2m.handler.(*HandlerFile)
+	readCount := func() int {
+		buf, err := ioutil.ReadFile(filepath.Join(handler.ResourceDirPath, "1", "0", "count"))
+		if err != nil {
+			return 0
+		}
+		return strings.Count(string(buf), "\n")
+	}
+
+	for _, path := range []string{"/3", "/3/0", "/3/0/9"} {
+		if response := peer.request(lwm2mTestRequest(CoapCodeGet, path, []CoapOption{}, []byte{})); response.Code != CoapCodeContent {
+			t.Fatalf("%s のReadに失敗しました %s", path, response.Code)
+		}
+	}
+	if count := readCount(); count != 0 {
+		t.Fatalf("通常のReadでデフォルト通知周期が読み出されました %d", count)
+	}
+
+	observe := lwm2mTestRequest(CoapCodeGet, "/3/0", []CoapOption{CoapOption{coapOptionNoObserve, []byte{}}}, []byte{})
+	if response := peer.request(observe); response.Code != CoapCodeContent {
+		t.Fatalf("Observeに失敗しました %s", response.Code)
+	}
+	if readCount() == 0 {
+		t.Fatal("Observeの登録時にデフォルト通知周期が読み出されません")
+	}
+}
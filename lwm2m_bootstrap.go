@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"net"
 )
 
 // lwm2mBootstrap : ブートストラップの管理
@@ -22,20 +21,29 @@ func (lwm2m *lwm2mBootstrap) Bootstrap(
 	endpointClientName string,
 	definitions []*Lwm2mObjectDefinition,
 	handler Lwm2mHandler) error {
-	conn, err := net.Dial("udp", bootstrapHost)
+	// スキームが無い場合はcoap://(UDP)とする
+	transport, host, err := findTransport(bootstrapHost)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lwm2mBootstrapTimeout)
+	defer cancel()
+	conn, err := transport.Dial(ctx, host, &TransportParams{SecurityMode: Lwm2mSecurityModeNoSec})
 	if err != nil {
 		return errors.New("failed to access bootstrap host")
 	}
 	coap := &Coap{}
-	coap.Initialize(conn, lwm2m.BootstrapReceiveMessage)
+	if transport.Stream() {
+		coap.InitializeTCP(conn, lwm2m.BootstrapReceiveMessage)
+	} else {
+		coap.Initialize(conn, lwm2m.BootstrapReceiveMessage)
+	}
 	lwm2m.connection = coap
 	lwm2m.finishNotify = make(chan int)
 	lwm2m.definitions = definitions
 	lwm2m.handler = handler
 	lwm2m.connection = coap
 
-	ctx, cancel := context.WithTimeout(context.Background(), lwm2mBootstrapTimeout)
-	defer cancel()
 	err = lwm2m.requestBootStrap(endpointClientName)
 	if err != nil {
 		return err
@@ -62,25 +70,24 @@ func (lwm2m *lwm2mBootstrap) requestBootStrap(endpointClientName string) error {
 	options := []CoapOption{
 		CoapOption{coapOptionNoURIPath, []byte("bs")},
 		CoapOption{coapOptionNoURIQuery, []byte("ep=" + endpointClientName)}}
-	requestCh := make(chan int)
-	lwm2m.connection.SendRequest(CoapCodePost, options, []byte{}, requestCh)
-	select {
-	case <-ctx.Done():
-		// タイムアウトした場合
-		return errors.New("ブートストラップ処理がタイムアウトしました")
-	case <-requestCh:
+	result, err := lwm2m.connection.SendRequest(ctx, CoapCodePost, options, []byte{})
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			return errors.New("ブートストラップ処理がタイムアウトしました")
+		}
+		return err
+	}
+	if result.Code != CoapCodeChanged {
+		return errors.New("ブートストラップ要求が失敗しました(" + result.Code.String() + ")")
 	}
+	lwm2m.BootstrapRequestDone(result.Message)
 	return nil
 }
 
 // BootstrapReceiveMessage : Bootstrap用メッセージ受信ハンドラ
 func (lwm2m *lwm2mBootstrap) BootstrapReceiveMessage(message *CoapMessage) {
-	if message.Type == CoapTypeAcknowledgement {
-		switch message.Code {
-		case CoapCodeChanged:
-			lwm2m.BootstrapRequestDone(message)
-		}
-	} else if message.Type == CoapTypeConfirmable {
+	// Request Bootstrapのレスポンスは要求時に処理する
+	if message.Type == CoapTypeConfirmable {
 		switch message.Code {
 		case CoapCodePut:
 			_, objectID, instanceID, _, _ := message.extractResourceID()
@@ -118,10 +125,10 @@ func (lwm2m *lwm2mBootstrap) processBootstrapWrite(objectID uint16, instanceID u
 
 		resourceID := tlv.ID
 		resourceDefinition := objectDefinition.findResourceByID(resourceID)
-		value := convertTLVValueToString(tlv.Value, resourceDefinition.Type)
-		code := lwm2m.handler.WriteResource(
+		code := writeResourceTLV(
+			lwm2m.handler,
 			&Lwm2mResource{objectID: objectID, instanceID: instanceID, ID: resourceID, Definition: resourceDefinition},
-			value)
+			tlv)
 		if code != CoapCodeChanged {
 			lwm2m.connection.SendResponse(message, code, []CoapOption{}, []byte{})
 			return errors.New("リソースの登録に失敗しました")
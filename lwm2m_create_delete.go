@@ -0,0 +1,154 @@
+package inventoryd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// CreateRequest : Createを処理する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.4.6 Create参照
+// ペイロードがObject InstanceのTLVの場合はそのインスタンスIDで、
+// リソースのTLVのみの場合は空いているインスタンスIDで生成し、Location-Pathで返す
+// 単一インスタンスのオブジェクトは、既にインスタンスがある場合は生成しない
+func (lwm2m *Lwm2m) CreateRequest(message *CoapMessage) error {
+	_, objectID, _, _, err := message.extractResourceID()
+	if err != nil {
+		return err
+	}
+	log.Printf("CREATE /%d", objectID)
+
+	// Security(ID:0)はDevice Managementサーバーからは操作させない
+	objectDefinition := lwm2m.definitions.findObjectDefinitionByID(objectID)
+	if objectDefinition == nil || objectID == lwm2mObjectIDSecurity {
+		lwm2m.Connection.SendResponse(message, CoapCodeNotFound, []CoapOption{}, []byte{})
+		return nil
+	}
+	// JSONの場合、各エントリの名前はオブジェクトからのリソースのパスとし、インスタンスIDは空いているものとする
+	tlvs, code, err := lwm2m.parseWritePayload(message, []uint16{objectID}, false)
+	if err != nil {
+		lwm2m.Connection.SendResponse(message, code, []CoapOption{}, []byte{})
+		return err
+	}
+
+	instanceIDs := []uint16{}
+	if lwm2m.findObject(objectID) != nil {
+		ids, code := lwm2m.handler.ListInstanceIDs(&Lwm2mObject{ID: objectID, Definition: objectDefinition})
+		if code != CoapCodeContent {
+			lwm2m.Connection.SendResponse(message, CoapCodeNotAllowed, []CoapOption{}, []byte{})
+			return errors.New("インスタンスが取得できませんでした")
+		}
+		instanceIDs = ids
+	}
+	if !objectDefinition.Multi && len(instanceIDs) > 0 {
+		lwm2m.Connection.SendResponse(message, CoapCodeBadRequest, []CoapOption{}, []byte{})
+		return errors.New("単一インスタンスのオブジェクトには既にインスタンスが存在します")
+	}
+
+	var instanceID uint16
+	if len(tlvs) == 1 && tlvs[0].TypeOfID == lwm2mTLVTypeObjectInstance {
+		if tlvs[0].UnmarshalContents() != nil || containsInstanceID(instanceIDs, tlvs[0].ID) {
+			lwm2m.Connection.SendResponse(message, CoapCodeBadRequest, []CoapOption{}, []byte{})
+			return errors.New("インスタンスのTLVが不正です")
+		}
+		instanceID = tlvs[0].ID
+		tlvs = tlvs[0].Contents
+	} else {
+		instanceID = availableInstanceID(instanceIDs)
+	}
+	if code := lwm2m.checkResourceTLVs(objectID, tlvs, false); code != CoapCodeChanged {
+		lwm2m.Connection.SendResponse(message, code, []CoapOption{}, []byte{})
+		return nil
+	}
+
+	instance := &Lwm2mInstance{ID: instanceID, objectID: objectID}
+	code = lwm2m.handler.CreateInstance(instance)
+	if code != CoapCodeCreated {
+		lwm2m.Connection.SendResponse(message, code, []CoapOption{}, []byte{})
+		return errors.New("インスタンスの生成に失敗しました")
+	}
+	code = lwm2m.writeInstanceResources(instance, tlvs, false)
+	if code != CoapCodeChanged {
+		// 途中まで生成したインスタンスは残さない
+		lwm2m.handler.DeleteInstance(instance)
+		lwm2m.Connection.SendResponse(message, code, []CoapOption{}, []byte{})
+		return errors.New("リソースの登録に失敗しました")
+	}
+	log.Printf("CREATED /%d/%d", objectID, instanceID)
+
+	options := []CoapOption{
+		CoapOption{coapOptionNoLocationPath, []byte(strconv.Itoa((int)(objectID)))},
+		CoapOption{coapOptionNoLocationPath, []byte(strconv.Itoa((int)(instanceID)))}}
+	lwm2m.Connection.SendResponse(message, CoapCodeCreated, options, []byte{})
+	lwm2m.requestObjectsUpdate()
+	return nil
+}
+
+// DeleteRequest : Deleteを処理する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.4.7 Delete参照
+// Device Managementサーバーからはインスタンスのみ削除できる
+// 削除したインスタンスに設定されていた属性とObserveは解除する
+func (lwm2m *Lwm2m) DeleteRequest(message *CoapMessage) error {
+	idCount, objectID, instanceID, _, err := message.extractResourceID()
+	if err != nil {
+		return err
+	}
+	if idCount != 2 || objectID == lwm2mObjectIDSecurity {
+		lwm2m.Connection.SendResponse(message, CoapCodeNotAllowed, []CoapOption{}, []byte{})
+		return nil
+	}
+	log.Printf("DELETE /%d/%d", objectID, instanceID)
+
+	instance := lwm2m.findInstance(objectID, instanceID)
+	if instance == nil {
+		lwm2m.Connection.SendResponse(message, CoapCodeNotFound, []CoapOption{}, []byte{})
+		return nil
+	}
+	code := lwm2m.handler.DeleteInstance(instance)
+	if code != CoapCodeDeleted {
+		lwm2m.Connection.SendResponse(message, code, []CoapOption{}, []byte{})
+		return errors.New("インスタンスの削除に失敗しました")
+	}
+	lwm2m.removeAttributes(fmt.Sprintf("/%d/%d", objectID, instanceID))
+	lwm2m.observeMutex.Lock()
+	lwm2m.removeInstanceObservations(objectID, instanceID)
+	lwm2m.observeMutex.Unlock()
+
+	lwm2m.Connection.SendResponse(message, CoapCodeDeleted, []CoapOption{}, []byte{})
+	lwm2m.requestObjectsUpdate()
+	return nil
+}
+
+// isCreate : Createのメッセージかを判定する
+// POSTのうち、オブジェクトを対象とするものをCreateとする
+func (message *CoapMessage) isCreate() bool {
+	if message.Code != CoapCodePost {
+		return false
+	}
+	idCount, _, _, _, err := message.extractResourceID()
+	return err == nil && idCount == 1
+}
+
+// availableInstanceID : 使用されていない最小のインスタンスIDを取得する
+// instanceIDsは昇順であること
+func availableInstanceID(instanceIDs []uint16) uint16 {
+	var ret uint16
+	for _, instanceID := range instanceIDs {
+		if instanceID != ret {
+			break
+		}
+		ret++
+	}
+	return ret
+}
+
+// containsInstanceID : インスタンスIDが含まれているかを判定する
+func containsInstanceID(instanceIDs []uint16, instanceID uint16) bool {
+	for _, id := range instanceIDs {
+		if id == instanceID {
+			return true
+		}
+	}
+	return false
+}
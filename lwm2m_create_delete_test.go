@@ -0,0 +1,183 @@
+package inventoryd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRemoveInstanceObservations : 削除したインスタンスとそのリソースのObserveのみ解除されることを確認する
+func TestRemoveInstanceObservations(t *testing.T) {
+	lwm2m := &Lwm2m{}
+	object := &Lwm2mObject{ID: 3303}
+	lwm2m.observedObject = []*Lwm2mObservedObject{
+		&Lwm2mObservedObject{object: object}}
+	lwm2m.observedInstance = []*Lwm2mObservedInstance{
+		&Lwm2mObservedInstance{instance: &Lwm2mInstance{objectID: 3303, ID: 0}},
+		&Lwm2mObservedInstance{instance: &Lwm2mInstance{objectID: 3303, ID: 1}},
+		&Lwm2mObservedInstance{instance: &Lwm2mInstance{objectID: 3304, ID: 0}}}
+	lwm2m.observedResource = []*Lwm2mObservedResource{
+		&Lwm2mObservedResource{resource: &Lwm2mResource{objectID: 3303, instanceID: 0, ID: 5700}},
+		&Lwm2mObservedResource{resource: &Lwm2mResource{objectID: 3303, instanceID: 0, ID: 5701}},
+		&Lwm2mObservedResource{resource: &Lwm2mResource{objectID: 3303, instanceID: 1, ID: 5700}}}
+
+	lwm2m.removeInstanceObservations(3303, 0)
+
+	if len(lwm2m.observedObject) != 1 {
+		t.Fatal("オブジェクトのObserveが解除されています")
+	}
+	if len(lwm2m.observedInstance) != 2 {
+		t.Fatalf("インスタンスのObserveの数が不正です %d", len(lwm2m.observedInstance))
+	}
+	for _, observe := range lwm2m.observedInstance {
+		if observe.instance.objectID == 3303 && observe.instance.ID == 0 {
+			t.Fatal("削除したインスタンスのObserveが解除されていません")
+		}
+	}
+	if len(lwm2m.observedResource) != 1 || lwm2m.observedResource[0].resource.instanceID != 1 {
+		t.Fatal("削除したインスタンスのリソースのObserveが解除されていません")
+	}
+}
+
+// lwm2mTestCreateFiles : Access Control(複数インスタンス)とDevice(単一インスタンス)のインスタンスが1つずつあるファイル
+var lwm2mTestCreateFiles = map[string]string{
+	"2/0/0": "3",
+	"2/0/1": "0",
+	"2/0/3": "1",
+	"3/0/0": "inventoryd",
+}
+
+// TestLwm2mCreate : オブジェクトに対するTLVのPOSTで空いているインスタンスIDのインスタンスを生成し、
+// 2.01とLocation-Pathを返すことを確認する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.4.6 Create参照
+func TestLwm2mCreate(t *testing.T) {
+	lwm2m, peer := newLwm2mTestClient(t, lwm2mTestCreateFiles)
+	root := lwm2m.handler.(*HandlerFile).ResourceDirPath
+	options := []CoapOption{contentFormatOption(coapContentFormatLwm2mTLV)}
+	response := peer.request(lwm2mTestRequest(CoapCodePost, "/2", options, integerResourceTestTLVs(map[uint16]string{0: "1", 1: "0", 3: "1"})))
+	if response.Code != CoapCodeCreated {
+		t.Fatalf("Createに失敗しました %s", response.Code)
+	}
+	locationPath := []string{}
+	for _, option := range response.Options {
+		if option.No == coapOptionNoLocationPath {
+			locationPath = append(locationPath, string(option.Value))
+		}
+	}
+	if strings.Join(locationPath, "/") != "2/1" {
+		t.Fatalf("Location-Pathが不正です %v", locationPath)
+	}
+	value, err := ioutil.ReadFile(filepath.Join(root, "2", "1", "0"))
+	if err != nil || string(value) != "1" {
+		t.Fatalf("生成したインスタンスのリソースが不正です %q", value)
+	}
+}
+
+// TestLwm2mCreateSingleInstance : 既にインスタンスがある単一インスタンスのオブジェクトへのCreateは4.00とし、
+// インスタンスを生成しないことを確認する
+func TestLwm2mCreateSingleInstance(t *testing.T) {
+	lwm2m, peer := newLwm2mTestClient(t, lwm2mTestCreateFiles)
+	root := lwm2m.handler.(*HandlerFile).ResourceDirPath
+	tlv := &Lwm2mTLV{TypeOfID: lwm2mTLVTypeResouce, ID: 0, Length: 4, Value: []byte("test")}
+	options := []CoapOption{contentFormatOption(coapContentFormatLwm2mTLV)}
+	response := peer.request(lwm2mTestRequest(CoapCodePost, "/3", options, marshalLwm2mTLVs([]*Lwm2mTLV{tlv})))
+	if response.Code != CoapCodeBadRequest {
+		t.Fatalf("単一インスタンスのオブジェクトへのCreateの結果が不正です %s", response.Code)
+	}
+	if _, err := os.Stat(filepath.Join(root, "3", "1")); !os.IsNotExist(err) {
+		t.Fatal("単一インスタンスのオブジェクトにインスタンスが生成されました")
+	}
+}
+
+// TestLwm2mDelete : インスタンスに対するDELETEでインスタンスのディレクトリを削除し、2.02を返すこと、
+// オブジェクトとリソースに対するDELETEは4.05とすることを確認する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.4.7 Delete参照
+func TestLwm2mDelete(t *testing.T) {
+	lwm2m, peer := newLwm2mTestClient(t, lwm2mTestCreateFiles)
+	root := lwm2m.handler.(*HandlerFile).ResourceDirPath
+	for _, path := range []string{"/2", "/2/0/0"} {
+		if response := peer.request(lwm2mTestRequest(CoapCodeDelete, path, []CoapOption{}, []byte{})); response.Code != CoapCodeNotAllowed {
+			t.Fatalf("%s に対するDeleteの結果が不正です %s", path, response.Code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "2", "0", "0")); err != nil {
+		t.Fatal("インスタンス以外に対するDeleteでリソースが削除されました")
+	}
+
+	if response := peer.request(lwm2mTestRequest(CoapCodeDelete, "/2/0", []CoapOption{}, []byte{})); response.Code != CoapCodeDeleted {
+		t.Fatalf("Deleteに失敗しました %s", response.Code)
+	}
+	if _, err := os.Stat(filepath.Join(root, "2", "0")); !os.IsNotExist(err) {
+		t.Fatal("インスタンスのディレクトリが削除されていません")
+	}
+	if response := peer.request(lwm2mTestRequest(CoapCodeDelete, "/2/0", []CoapOption{}, []byte{})); response.Code != CoapCodeNotFound {
+		t.Fatalf("削除済みのインスタンスに対するDeleteの結果が不正です %s", response.Code)
+	}
+}
+
+// expectTestUpdate : インスタンスのリストが変わったことが通知され、
+// UpdateObjectsがインスタンスのリストをペイロードとしてUpdateを送信することを確認する
+// StartUpdateはobjectsChangedChを受信するとUpdateObjectsを呼び出す
+func expectTestUpdate(t *testing.T, lwm2m *Lwm2m, peer *coapTestPeer, instancePath string, exists bool) {
+	t.Helper()
+	select {
+	case <-lwm2m.objectsChangedCh:
+	case <-time.After(time.Second):
+		t.Fatal("インスタンスのリストの変更が通知されません")
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- lwm2m.UpdateObjects()
+	}()
+
+	request := peer.read()
+	uriPath := []string{}
+	for _, option := range request.Options {
+		if option.No == coapOptionNoURIPath {
+			uriPath = append(uriPath, string(option.Value))
+		}
+	}
+	if request.Code != CoapCodePost || strings.Join(uriPath, "/") != "rd/"+lwm2m.Location {
+		t.Fatalf("Updateのリクエストが不正です %s %v", request.Code, uriPath)
+	}
+	if strings.Contains(string(request.Payload), "<"+instancePath+">") != exists {
+		t.Fatalf("Updateのインスタンスのリストが不正です %s", request.Payload)
+	}
+	peer.write(&CoapMessage{
+		Version:     1,
+		Type:        CoapTypeAcknowledgement,
+		Code:        CoapCodeChanged,
+		MessageID:   request.MessageID,
+		TokenLength: request.TokenLength,
+		Token:       request.Token})
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Updateが終了しません")
+	}
+}
+
+// TestLwm2mCreateDeleteUpdate : Create / Deleteでインスタンスのリストが変わると、
+// 変更後のリストでUpdateが送信されることを確認する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.3.2 Update参照
+func TestLwm2mCreateDeleteUpdate(t *testing.T) {
+	lwm2m, peer := newLwm2mTestClient(t, lwm2mTestCreateFiles)
+	lwm2m.Location = "5a3f"
+	options := []CoapOption{contentFormatOption(coapContentFormatLwm2mTLV)}
+	response := peer.request(lwm2mTestRequest(CoapCodePost, "/2", options, integerResourceTestTLVs(map[uint16]string{0: "1", 1: "0", 3: "1"})))
+	if response.Code != CoapCodeCreated {
+		t.Fatalf("Createに失敗しました %s", response.Code)
+	}
+	expectTestUpdate(t, lwm2m, peer, "/2/1", true)
+
+	if response := peer.request(lwm2mTestRequest(CoapCodeDelete, "/2/1", []CoapOption{}, []byte{})); response.Code != CoapCodeDeleted {
+		t.Fatalf("Deleteに失敗しました %s", response.Code)
+	}
+	expectTestUpdate(t, lwm2m, peer, "/2/1", false)
+}
@@ -1,25 +1,45 @@
 package inventoryd
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
+	"time"
 )
 
 // Observe : Observe中リソースのチェックおよび変化があった場合のNotifyを実行する
 // OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.5.1 Observe参照
-// オブジェクトレベルのObserveも可能だが、現時点では対応しない
+// Notifyの条件はWrite-Attributesで設定された属性(pmin / pmax / gt / lt / st)に従う
+// リソースの変更を監視している場合は、監視できないリソースを含むObserveとpmaxの確認のみ行う(lwm2m_watch.go参照)
 // 接続がない場合、Registerが終了していない場合は何もしない
 func (lwm2m *Lwm2m) Observe() {
 	if lwm2m.Connection == nil || !lwm2m.registered {
 		return
 	}
+	lwm2m.observeMutex.Lock()
+	defer lwm2m.observeMutex.Unlock()
+	for _, observe := range lwm2m.observedObject {
+		resources := []*Lwm2mObservedResource{}
+		for _, instanceObserve := range observe.instances {
+			resources = append(resources, instanceObserve.resources...)
+		}
+		if lwm2m.requiresPolling(observe.attributes, observe.lastNotified, resources) {
+			lwm2m.NotifyObject(observe)
+		}
+	}
 	for _, observe := range lwm2m.observedInstance {
-		lwm2m.NotifyInstance(observe)
+		if lwm2m.requiresPolling(observe.attributes, observe.lastNotified, observe.resources) {
+			lwm2m.NotifyInstance(observe)
+		}
 	}
 	for _, observe := range lwm2m.observedResource {
-		lwm2m.NotifyResource(observe)
+		if lwm2m.requiresPolling(observe.attributes, observe.lastNotified, []*Lwm2mObservedResource{observe}) {
+			lwm2m.NotifyResource(observe)
+		}
 	}
 }
 
@@ -27,174 +47,490 @@ func (lwm2m *Lwm2m) Observe() {
 // OMA-TS-LightweightM2M-V1_0_2-20180209-A 8.2.6 Information Reporting Interface参照
 // ResetはMessageIDのみ存在するため、メッセージIDとつきあわせて確認する
 func (lwm2m *Lwm2m) ObserveDeregister(message *CoapMessage) {
-	foundIndex := -1
-	for i, observe := range lwm2m.observedInstance {
-		if observe.messageID == message.MessageID {
+	lwm2m.observeMutex.Lock()
+	defer lwm2m.observeMutex.Unlock()
+	lwm2m.removeObservations(func(token []byte, messageID uint16) bool {
+		return messageID == message.MessageID
+	})
+}
+
+// cancelObservation : トークンが一致するObserveを解除する
+// RFC7641 3.6 Cancellation参照
+func (lwm2m *Lwm2m) cancelObservation(token []byte) {
+	lwm2m.observeMutex.Lock()
+	defer lwm2m.observeMutex.Unlock()
+	lwm2m.removeObservations(func(observeToken []byte, messageID uint16) bool {
+		return bytes.Equal(observeToken, token)
+	})
+}
+
+// clearObservations : 全てのObserveを解除する
+// Registerし直した場合、サーバーは以前のObserveを破棄しているため、クライアントも破棄する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.3.1 Register参照
+func (lwm2m *Lwm2m) clearObservations() {
+	lwm2m.observeMutex.Lock()
+	defer lwm2m.observeMutex.Unlock()
+	lwm2m.observedObject = nil
+	lwm2m.observedInstance = nil
+	lwm2m.observedResource = nil
+}
+
+// removeInstanceObservations : 削除したインスタンスと、そのリソースのObserveを解除する
+// オブジェクトのObserveはNotifyの際にインスタンスの削除を反映するため解除しない
+// observeMutexをロックしてから呼び出す
+func (lwm2m *Lwm2m) removeInstanceObservations(objectID, instanceID uint16) {
+	observedInstance := make([]*Lwm2mObservedInstance, 0, len(lwm2m.observedInstance))
+	for _, observe := range lwm2m.observedInstance {
+		if observe.instance.objectID == objectID && observe.instance.ID == instanceID {
+			log.Printf("CANCEL-OBSERVE /%d/%d", objectID, instanceID)
+			continue
+		}
+		observedInstance = append(observedInstance, observe)
+	}
+	lwm2m.observedInstance = observedInstance
+
+	observedResource := make([]*Lwm2mObservedResource, 0, len(lwm2m.observedResource))
+	for _, observe := range lwm2m.observedResource {
+		resource := observe.resource
+		if resource.objectID == objectID && resource.instanceID == instanceID {
+			log.Printf("CANCEL-OBSERVE /%d/%d/%d", objectID, instanceID, resource.ID)
+			continue
+		}
+		observedResource = append(observedResource, observe)
+	}
+	lwm2m.observedResource = observedResource
+}
+
+// removeObservations : 条件に一致するObserveを解除する
+// matchにはObserve時のトークンと、最後に送信したNotifyのメッセージIDが渡される
+// observeMutexをロックしてから呼び出す
+func (lwm2m *Lwm2m) removeObservations(match func(token []byte, messageID uint16) bool) {
+	observedObject := make([]*Lwm2mObservedObject, 0, len(lwm2m.observedObject))
+	for _, observe := range lwm2m.observedObject {
+		if match(observe.request.Token, observe.messageID) {
+			log.Printf("CANCEL-OBSERVE /%d", observe.object.ID)
+			continue
+		}
+		observedObject = append(observedObject, observe)
+	}
+	lwm2m.observedObject = observedObject
+
+	observedInstance := make([]*Lwm2mObservedInstance, 0, len(lwm2m.observedInstance))
+	for _, observe := range lwm2m.observedInstance {
+		if match(observe.request.Token, observe.messageID) {
 			log.Printf("CANCEL-OBSERVE /%d/%d", observe.instance.objectID, observe.instance.ID)
-			foundIndex = i
+			continue
+		}
+		observedInstance = append(observedInstance, observe)
+	}
+	lwm2m.observedInstance = observedInstance
+
+	observedResource := make([]*Lwm2mObservedResource, 0, len(lwm2m.observedResource))
+	for _, observe := range lwm2m.observedResource {
+		if match(observe.request.Token, observe.messageID) {
+			log.Printf("CANCEL-OBSERVE /%d/%d/%d", observe.resource.objectID, observe.resource.instanceID, observe.resource.ID)
+			continue
 		}
+		observedResource = append(observedResource, observe)
+	}
+	lwm2m.observedResource = observedResource
+}
+
+// NotifyObject : オブジェクトに対するNotifyを実行する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.5.2 Notify参照
+// インスタンスが追加 / 削除された場合、およびpmaxが経過した場合は全インスタンスを送り、
+// それ以外は値の変化がNotifyの条件を満たすリソースのみをインスタンスごとに送る
+// observeMutexをロックしてから呼び出す
+func (lwm2m *Lwm2m) NotifyObject(observe *Lwm2mObservedObject) {
+	object := observe.object
+	now := time.Now()
+	// CONのNotifyのACKを待っている場合、pminが経過していない場合は何もしない
+	if observe.pending || observe.attributes.beforeMinimumPeriod(observe.lastNotified, now) {
+		return
 	}
-	if foundIndex >= 0 {
-		// スライスの関数が存在しないため、コピーにて対応する
-		deletedSlice := make([]*Lwm2mObservedInstance, len(lwm2m.observedInstance)-1)
-		copy(deletedSlice[0:foundIndex], lwm2m.observedInstance[0:foundIndex])
-		copy(deletedSlice[foundIndex:len(deletedSlice)], lwm2m.observedInstance[foundIndex+1:len(lwm2m.observedInstance)])
-		lwm2m.observedInstance = deletedSlice
+	instanceIDs, code := lwm2m.handler.ListInstanceIDs(object)
+	if code != CoapCodeContent {
 		return
 	}
 
-	for i, observe := range lwm2m.observedResource {
-		if observe.messageID == message.MessageID {
-			log.Printf("CANCEL-OBSERVE /%d/%d/%d", observe.resource.objectID, observe.resource.instanceID, observe.resource.ID)
-			foundIndex = i
+	var tlvs []*Lwm2mTLV
+	if !observe.hasInstances(instanceIDs) || observe.attributes.exceedsMaximumPeriod(observe.lastNotified, now) {
+		tlvs, observe.instances = lwm2m.readObjectInstances(object, instanceIDs)
+		lwm2m.refreshObservedInstanceAttributes(observe.instances)
+	} else {
+		for _, instanceObserve := range observe.instances {
+			resourceTLVs := lwm2m.readChangedResources(instanceObserve, false)
+			if len(resourceTLVs) == 0 {
+				continue
+			}
+			tlvs = append(tlvs, newObjectInstanceTLV(instanceObserve.instance.ID, resourceTLVs))
+		}
+		// 値がひとつも変わっていない場合は何もしない
+		if len(tlvs) == 0 {
+			return
 		}
 	}
-	if foundIndex >= 0 {
-		// スライスの関数が存在しないため、コピーにて対応する
-		deletedSlice := make([]*Lwm2mObservedResource, len(lwm2m.observedResource)-1)
-		copy(deletedSlice[0:foundIndex], lwm2m.observedResource[0:foundIndex])
-		copy(deletedSlice[foundIndex:len(deletedSlice)], lwm2m.observedResource[foundIndex+1:len(lwm2m.observedResource)])
-		lwm2m.observedResource = deletedSlice
+	log.Printf("Notify /%d", object.ID)
+	observe.lastNotified = now
+	payload, err := lwm2m.encodeContent(observe.contentFormat, fmt.Sprintf("/%d/", object.ID), object.ID, tlvs)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	options := notifyOptions(observe.contentFormat, observe.observeCount)
+	observe.observeCount++
+	observe.messageID = lwm2m.sendNotify(observe.request, observe.confirmable, &observe.pending, options, payload)
+}
+
+// sendNotify : Observeを登録したリクエストに対するNotifyを送信する
+// Payloadがブロックサイズを超える場合は最初のブロックのみ送信する(Coap.SendRelatedMessage参照)
+// CONの場合はACKを受信するまでpendingをtrueとし、その間は次のNotifyを送らない
+// Resetを受信した場合、再送を諦めた場合(MAX_RETRANSMIT回再送してもACKが無い場合と接続を閉じた場合)は
+// pendingを戻してObserveを解除する
+// RFC7641 4.5 Transmission参照
+// observeMutexをロックしてから呼び出す
+func (lwm2m *Lwm2m) sendNotify(request *CoapMessage, confirmable bool, pending *bool, options []CoapOption, payload []byte) uint16 {
+	if !confirmable {
+		return lwm2m.Connection.SendRelatedMessage(request, CoapCodeContent, options, payload)
+	}
+	*pending = true
+	var messageID uint16
+	messageID = lwm2m.Connection.SendConfirmableRelatedMessage(request, CoapCodeContent, options, payload, func(delivered bool) {
+		// 結果は再送タイマーや受信処理から通知され、TCPでは送信中(observeMutexのロック中)に通知されるため、
+		// 別のgoroutineでロックしてから処理する
+		go lwm2m.notifyDelivered(request.Token, &messageID, pending, delivered)
+	})
+	return messageID
+}
+
+// notifyDelivered : CONのNotifyが届いたかどうかを処理する
+// 届いたかどうかに関わらずpendingを戻し、届かなかった場合はObserveを解除する
+// messageIDはsendNotifyがロック中に設定するため、ロックしてから参照する
+func (lwm2m *Lwm2m) notifyDelivered(token []byte, messageID *uint16, pending *bool, delivered bool) {
+	lwm2m.observeMutex.Lock()
+	defer lwm2m.observeMutex.Unlock()
+	*pending = false
+	if delivered {
 		return
 	}
+	// 同じトークンで登録し直されたObserveは解除しない
+	log.Print("Notifyが届かなかったため、Observeを解除します")
+	lwm2m.removeObservations(func(observeToken []byte, observeMessageID uint16) bool {
+		return bytes.Equal(observeToken, token) && observeMessageID == *messageID
+	})
+}
+
+// isConfirmableNotify : 指定したパスのNotifyをCONで送信するかを判定する
+// 設定されたパスとObserveのパスのどちらかがもう一方を含む場合にCONとする
+// 例 : /5/0/5が設定されている場合、/5、/5/0、/5/0/5のObserveが対象
+func (lwm2m *Lwm2m) isConfirmableNotify(path string) bool {
+	for _, confirmablePath := range lwm2m.confirmablePaths {
+		confirmablePath = strings.TrimSuffix(confirmablePath, "/")
+		if path == confirmablePath ||
+			strings.HasPrefix(path, confirmablePath+"/") ||
+			strings.HasPrefix(confirmablePath, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasInstances : Observe中のインスタンスが指定したインスタンスと一致するかを判定する
+func (observe *Lwm2mObservedObject) hasInstances(instanceIDs []uint16) bool {
+	if len(observe.instances) != len(instanceIDs) {
+		return false
+	}
+	for i, instanceObserve := range observe.instances {
+		if instanceObserve.instance.ID != instanceIDs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// notifyOptions : Notifyに付加するオプションを生成する
+// Content-FormatはObserve時に決定したもの
+// Observeオプションの値は通知の順番を表す(先頭の0のバイトは省略する)
+// RFC7641 4.2 Sending Notifications参照
+func notifyOptions(contentFormat uint16, observeCount uint32) []CoapOption {
+	observeCountBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(observeCountBuf, observeCount)
+	if observeCount <= 0xff {
+		observeCountBuf = observeCountBuf[3:4]
+	} else if observeCount <= 0xffff {
+		observeCountBuf = observeCountBuf[2:4]
+	} else if observeCount <= 0xffffff {
+		observeCountBuf = observeCountBuf[1:4]
+	}
+	return []CoapOption{
+		contentFormatOption(contentFormat),
+		CoapOption{coapOptionNoObserve, observeCountBuf}}
+}
+
+// contentFormatOption : Content-Formatオプションを生成する
+func contentFormatOption(contentFormat uint16) CoapOption {
+	contentFormatBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(contentFormatBuf, contentFormat)
+	return CoapOption{coapOptionNoContentFormat, contentFormatBuf}
+}
+
+// encodeContent : TLVデータを指定したContent-Formatのペイロードに変換する
+// basePathはTLVの親のパス(例 : /3/0/)で、JSON / SenMLの場合に使用する
+func (lwm2m *Lwm2m) encodeContent(contentFormat uint16, basePath string, objectID uint16, tlvs []*Lwm2mTLV) ([]byte, error) {
+	objectDefinition := lwm2m.definitions.findObjectDefinitionByID(objectID)
+	switch contentFormat {
+	case coapContentFormatLwm2mJSON:
+		return marshalLwm2mJSON(basePath, objectDefinition, tlvs)
+	case coapContentFormatSenMLJSON:
+		return marshalLwm2mSenMLJSON(basePath, objectDefinition, tlvs)
+	case coapContentFormatSenMLCBOR:
+		return marshalLwm2mSenMLCBOR(basePath, objectDefinition, tlvs)
+	}
+	return marshalLwm2mTLVs(tlvs), nil
+}
+
+// isLwm2mDataFormat : リソースの値の読み書きに対応しているContent-Formatかを判定する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 6.4 Data Formats for Transferring Resource Information、
+// OMA-TS-LightweightM2M_Core-V1_1-20180612-C 7.4 Data Formats for Transferring Resource Information参照
+func isLwm2mDataFormat(contentFormat uint32) bool {
+	switch contentFormat {
+	case coapContentFormatLwm2mTLV, coapContentFormatLwm2mJSON, coapContentFormatSenMLJSON, coapContentFormatSenMLCBOR:
+		return true
+	}
+	return false
+}
+
+// responseContentFormat : Acceptオプションからレスポンスのペイロードの形式を決定する
+// Acceptオプションが無い場合はTLVとする
+// 対応していない形式の場合はfalseを返す
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 6.4 Data Formats for Transferring Resource Information参照
+func (message *CoapMessage) responseContentFormat() (uint16, bool) {
+	accept, exist := message.Accept()
+	if !exist {
+		return coapContentFormatLwm2mTLV, true
+	}
+	if !isLwm2mDataFormat(accept) {
+		return 0, false
+	}
+	return (uint16)(accept), true
 }
 
 // NotifyInstance : インスタンスに対するNotifyを実行する
 // OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.5.2 Notify参照
+// observeMutexをロックしてから呼び出す
 func (lwm2m *Lwm2m) NotifyInstance(observe *Lwm2mObservedInstance) {
 	instance := observe.instance
-	payload := make([]byte, 0)
+	now := time.Now()
+	// CONのNotifyのACKを待っている場合、pminが経過していない場合は何もしない
+	if observe.pending || observe.attributes.beforeMinimumPeriod(observe.lastNotified, now) {
+		return
+	}
+	// pmaxが経過した場合は値が変わっていなくても全リソースを送る
+	tlvs := lwm2m.readChangedResources(observe, observe.attributes.exceedsMaximumPeriod(observe.lastNotified, now))
+
+	// 値がひとつも変わっていない場合は何もしない
+	if len(tlvs) == 0 {
+		return
+	}
+	log.Printf("Notify /%d/%d", instance.objectID, instance.ID)
+	observe.lastNotified = now
+	payload, err := lwm2m.encodeContent(observe.contentFormat, fmt.Sprintf("/%d/%d/", instance.objectID, instance.ID), instance.objectID, tlvs)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	options := notifyOptions(observe.contentFormat, observe.observeCount)
+	observe.observeCount++
+	observe.messageID = lwm2m.sendNotify(observe.request, observe.confirmable, &observe.pending, options, payload)
+}
+
+// readChangedResources : Observe中のインスタンスのリソースのうち、値の変化がNotifyの条件を満たすもののTLVを生成する
+// allがtrueの場合は値の変化に関わらず全リソースのTLVを生成する
+func (lwm2m *Lwm2m) readChangedResources(observe *Lwm2mObservedInstance, all bool) []*Lwm2mTLV {
+	tlvs := make([]*Lwm2mTLV, 0)
 	for _, resourceObserve := range observe.resources {
 		resource := resourceObserve.resource
 		if !resource.Definition.Readable {
 			continue
 		}
-		resourceValue, code := lwm2m.handler.ReadResource(resource)
+		tlv, resourceValue, code := lwm2m.readResourceTLV(resource)
 		if code != CoapCodeContent {
 			continue
 		}
-		// 値が前回と変わっていないリソースは送らない
-		if resourceValue == resourceObserve.lastValue {
+		// 値の変化がNotifyの条件を満たさないリソースは送らない
+		if !all && !resourceObserve.attributes.isNotifiableChange(resourceObserve.lastValue, resourceValue) {
 			continue
 		}
 
 		resourceObserve.lastValue = resourceValue
-		resourceTLVValue := convertStringToTLVValue(resourceValue, resource.Definition.Type)
-		tlv := &Lwm2mTLV{
-			TypeOfID: lwm2mTLVTypeResouce,
-			ID:       (uint16)(resource.ID),
-			Length:   (uint32)(len(resourceTLVValue)),
-			Value:    resourceTLVValue}
-		payload = append(payload, tlv.Marshal()...)
-	}
-
-	// 値がひとつも変わっていない場合は何もしない
-	if len(payload) == 0 {
-		return
-	}
-	log.Printf("Notify /%d/%d", instance.objectID, instance.ID)
-
-	contentFormat := make([]byte, 2)
-	binary.BigEndian.PutUint16(contentFormat, coapContentFormatLwm2mTLV)
-	observeCountBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(observeCountBuf, observe.observeCount)
-	if observe.observeCount <= 0xff {
-		observeCountBuf = observeCountBuf[3:4]
-	} else if observe.observeCount <= 0xffff {
-		observeCountBuf = observeCountBuf[2:4]
-	} else if observe.observeCount <= 0xffffff {
-		observeCountBuf = observeCountBuf[1:4]
+		tlvs = append(tlvs, tlv)
 	}
-	observe.observeCount++
-	options := []CoapOption{
-		CoapOption{coapOptionNoContentFormat, contentFormat},
-		CoapOption{coapOptionNoObserve, observeCountBuf}}
-	observe.messageID = lwm2m.Connection.SendRelatedMessage(CoapCodeContent, observe.token, options, payload)
+	return tlvs
 }
 
 // NotifyResource : リソースに対するNotifyを実行する
 // OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.5.2 Notify参照
+// observeMutexをロックしてから呼び出す
 func (lwm2m *Lwm2m) NotifyResource(observe *Lwm2mObservedResource) {
 	resource := observe.resource
 
 	if !resource.Definition.Readable {
 		return
 	}
-	value, code := lwm2m.handler.ReadResource(resource)
+	now := time.Now()
+	// CONのNotifyのACKを待っている場合、pminが経過していない場合はNotifyしない
+	if observe.pending || observe.attributes.beforeMinimumPeriod(observe.lastNotified, now) {
+		return
+	}
+	tlv, value, code := lwm2m.readResourceTLV(resource)
 	if code != CoapCodeContent {
 		return
 	}
-	// 前回と値が同じ場合はNotifyしない
-	if value == observe.lastValue {
+	// pmaxが経過しておらず、値の変化がNotifyの条件を満たさない場合はNotifyしない
+	if !observe.attributes.exceedsMaximumPeriod(observe.lastNotified, now) &&
+		!observe.attributes.isNotifiableChange(observe.lastValue, value) {
 		return
 	}
 
 	log.Printf("Notify /%d/%d/%d", resource.objectID, resource.instanceID, resource.ID)
 	observe.lastValue = value
-	resourceTLVValue := convertStringToTLVValue(value, resource.Definition.Type)
-	tlv := &Lwm2mTLV{
-		TypeOfID: lwm2mTLVTypeResouce,
-		ID:       (uint16)(resource.ID),
-		Length:   (uint32)(len(resourceTLVValue)),
-		Value:    resourceTLVValue}
-	payload := tlv.Marshal()
-
-	contentFormat := make([]byte, 2)
-	binary.BigEndian.PutUint16(contentFormat, coapContentFormatLwm2mTLV)
-	observeCountBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(observeCountBuf, observe.observeCount)
-	if observe.observeCount <= 0xff {
-		observeCountBuf = observeCountBuf[3:4]
-	} else if observe.observeCount <= 0xffff {
-		observeCountBuf = observeCountBuf[2:4]
-	} else if observe.observeCount <= 0xffffff {
-		observeCountBuf = observeCountBuf[1:4]
+	observe.lastNotified = now
+	payload, err := lwm2m.encodeContent(observe.contentFormat,
+		fmt.Sprintf("/%d/%d/", resource.objectID, resource.instanceID), resource.objectID, []*Lwm2mTLV{tlv})
+	if err != nil {
+		log.Print(err)
+		return
 	}
+
+	options := notifyOptions(observe.contentFormat, observe.observeCount)
 	observe.observeCount++
-	options := []CoapOption{
-		CoapOption{coapOptionNoContentFormat, contentFormat},
-		CoapOption{coapOptionNoObserve, observeCountBuf}}
-	observe.messageID = lwm2m.Connection.SendRelatedMessage(CoapCodeContent, observe.token, options, payload)
+	observe.messageID = lwm2m.sendNotify(observe.request, observe.confirmable, &observe.pending, options, payload)
 }
 
 // ReadRequest : Readを処理する
+// 同じトークンで既にObserveしている場合、Observe=0は登録し直し、Observe=1は解除してReadとして処理する
+// RFC7641 3.6 Cancellation / 4.1 Request参照
 func (lwm2m *Lwm2m) ReadRequest(message *CoapMessage) error {
 	idCount, objectID, instanceID, resourceID, err := message.extractResourceID()
 	if err != nil {
 		return err
 	}
 
-	if idCount == 2 {
-		err := lwm2m.processReadInstance(objectID, instanceID, message)
+	if message.IsObserve() || message.IsObserveCancel() {
+		lwm2m.cancelObservation(message.Token)
+	}
+
+	contentFormat, ok := message.responseContentFormat()
+	if !ok {
+		lwm2m.Connection.SendResponse(message, CoapCodeNotAcceptable, []CoapOption{}, []byte{})
+		return nil
+	}
+
+	if idCount == 1 {
+		err := lwm2m.processReadObject(objectID, contentFormat, message)
+		if err != nil {
+			return err
+		}
+	} else if idCount == 2 {
+		err := lwm2m.processReadInstance(objectID, instanceID, contentFormat, message)
 		if err != nil {
 			return err
 		}
 	} else if idCount == 3 {
-		err := lwm2m.processReadResource(objectID, instanceID, resourceID, message)
+		err := lwm2m.processReadResource(objectID, instanceID, resourceID, contentFormat, message)
 		if err != nil {
 			return err
 		}
+	} else {
+		lwm2m.Connection.SendResponse(message, CoapCodeNotAllowed, []CoapOption{}, []byte{})
 	}
 	return nil
 }
 
 // WriteRequest : Writeを処理する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.4.3 Write参照
+// PUTはReplace、POSTはPartial Updateとして処理する
 func (lwm2m *Lwm2m) WriteRequest(message *CoapMessage) error {
 	idCount, objectID, instanceID, resourceID, err := message.extractResourceID()
 	if err != nil {
 		return err
 	}
 
-	if idCount == 3 {
+	replace := message.Code == CoapCodePut
+	if idCount == 1 && replace {
+		err := lwm2m.processWriteObject(objectID, message)
+		if err != nil {
+			return err
+		}
+	} else if idCount == 2 {
+		err := lwm2m.processWriteInstance(objectID, instanceID, replace, message)
+		if err != nil {
+			return err
+		}
+	} else if idCount == 3 {
 		err := lwm2m.processWriteResource(objectID, instanceID, resourceID, message)
 		if err != nil {
 			return err
 		}
+	} else {
+		lwm2m.Connection.SendResponse(message, CoapCodeNotAllowed, []CoapOption{}, []byte{})
 	}
 	return nil
 }
 
+// isPartialUpdate : Write(Partial Update)のメッセージかを判定する
+// POSTのうち、インスタンスを対象とし、ペイロードがTLV / JSON / SenMLのものをPartial Updateとする
+// リソースを対象とするPOSTはExecuteとなる
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.4.3 Write参照
+func (message *CoapMessage) isPartialUpdate() bool {
+	if message.Code != CoapCodePost {
+		return false
+	}
+	idCount, _, _, _, err := message.extractResourceID()
+	if err != nil || idCount != 2 {
+		return false
+	}
+	contentFormat, exist := message.ContentFormat()
+	return exist && isLwm2mDataFormat(contentFormat)
+}
+
+// parseWritePayload : Write / Createのペイロードを解析し、TLVデータに変換する
+// Content-FormatがTLVまたは無い場合はTLV、それ以外は指定された形式(JSON / SenML JSON / SenML CBOR)として解析する
+// JSON / SenMLの各エントリのパスはbaseIDsで始まり、withInstanceがtrueの場合は続くIDをインスタンスIDとする(parseLwm2mJSON参照)
+// 解析できない場合はレスポンスコードとエラーを返す
+func (lwm2m *Lwm2m) parseWritePayload(message *CoapMessage, baseIDs []uint16, withInstance bool) ([]*Lwm2mTLV, CoapCode, error) {
+	contentFormat, exist := message.ContentFormat()
+	if !exist || contentFormat == coapContentFormatLwm2mTLV {
+		tlvs, err := parseLwm2mTLVs(message.Payload)
+		if err != nil {
+			return nil, CoapCodeBadRequest, err
+		}
+		return tlvs, CoapCodeChanged, nil
+	}
+	var parse func([]byte, *Lwm2mObjectDefinition, []uint16, bool) ([]*Lwm2mTLV, error)
+	switch contentFormat {
+	case coapContentFormatLwm2mJSON:
+		parse = parseLwm2mJSON
+	case coapContentFormatSenMLJSON:
+		parse = parseLwm2mSenMLJSON
+	case coapContentFormatSenMLCBOR:
+		parse = parseLwm2mSenMLCBOR
+	default:
+		return nil, CoapCodeUnsupportedContentFormat, errors.New("対応していないContent-Formatです")
+	}
+	tlvs, err := parse(message.Payload, lwm2m.definitions.findObjectDefinitionByID(baseIDs[0]), baseIDs, withInstance)
+	if err != nil {
+		return nil, CoapCodeBadRequest, err
+	}
+	return tlvs, CoapCodeChanged, nil
+}
+
 // ExecuteRequest : Executeを処理する
+// Executeの対象はリソースのみのため、それ以外のパスへのPOST
+// (Partial UpdateとしてのContent-Formatが無いインスタンスへのPOSTなど)は4.05とする
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.4.5 Execute参照
 func (lwm2m *Lwm2m) ExecuteRequest(message *CoapMessage) error {
 	idCount, objectID, instanceID, resourceID, err := message.extractResourceID()
 	if err != nil {
@@ -206,13 +542,15 @@ func (lwm2m *Lwm2m) ExecuteRequest(message *CoapMessage) error {
 		if err != nil {
 			return err
 		}
+	} else {
+		lwm2m.Connection.SendResponse(message, CoapCodeNotAllowed, []CoapOption{}, []byte{})
 	}
 	return nil
 }
 
 // processReadInstance : インスタンスに対するReadを処理する
 // 例 : READ /1/0
-func (lwm2m *Lwm2m) processReadInstance(objectID uint16, instanceID uint16, message *CoapMessage) error {
+func (lwm2m *Lwm2m) processReadInstance(objectID uint16, instanceID uint16, contentFormat uint16, message *CoapMessage) error {
 	instance := lwm2m.findInstance(objectID, instanceID)
 	if instance == nil {
 		log.Printf("READ /%d/%d Not Found", objectID, instanceID)
@@ -221,66 +559,197 @@ func (lwm2m *Lwm2m) processReadInstance(objectID uint16, instanceID uint16, mess
 	}
 
 	isObserve := message.IsObserve()
-	observedInstance := &Lwm2mObservedInstance{}
 	if isObserve {
 		log.Printf("OBSERVE /%d/%d", objectID, instanceID)
-		observedInstance.token = message.Token
-		observedInstance.instance = instance
-		observedInstance.resources = make([]*Lwm2mObservedResource, 0)
 	} else {
 		log.Printf("READ /%d/%d", objectID, instanceID)
 	}
 
-	resourceIDs, code := lwm2m.handler.ListResourceIDs(instance)
-	if code != CoapCodeContent {
+	tlvs, observedInstance, err := lwm2m.readInstanceResources(instance)
+	if err != nil {
+		lwm2m.Connection.SendResponse(message, CoapCodeNotAllowed, []CoapOption{}, []byte{})
+		return err
+	}
+	payload, err := lwm2m.encodeContent(contentFormat, fmt.Sprintf("/%d/%d/", objectID, instanceID), objectID, tlvs)
+	if err != nil {
 		lwm2m.Connection.SendResponse(message, CoapCodeNotAllowed, []CoapOption{}, []byte{})
-		return errors.New("リソースが取得できませんでした")
+		return err
 	}
 
-	payload := make([]byte, 0)
-	for _, resourceID := range resourceIDs {
-		resource := lwm2m.findResource(objectID, instanceID, resourceID)
-		if resource.Definition.Readable {
-			resourceValue, code := lwm2m.handler.ReadResource(resource)
-			if code != CoapCodeContent {
-				continue
-			}
+	var options []CoapOption
+	// Observe Registerの場合はObserveオプションをつけ、そうでなければつけない
+	if isObserve {
+		options = []CoapOption{
+			contentFormatOption(contentFormat),
+			CoapOption{coapOptionNoObserve, []byte{coapObserveRegister}}}
+		observedInstance.request = message
+		lwm2m.refreshObservedInstanceAttributes([]*Lwm2mObservedInstance{observedInstance})
+		observedInstance.contentFormat = contentFormat
+		observedInstance.confirmable = lwm2m.isConfirmableNotify(fmt.Sprintf("/%d/%d", objectID, instanceID))
+		lwm2m.observeMutex.Lock()
+		lwm2m.observedInstance = append(lwm2m.observedInstance, observedInstance)
+		lwm2m.observeMutex.Unlock()
+	} else {
+		options = []CoapOption{contentFormatOption(contentFormat)}
+	}
+	lwm2m.Connection.SendResponse(message, CoapCodeContent, options, payload)
+	return nil
+}
 
-			resourceTLVValue := convertStringToTLVValue(resourceValue, resource.Definition.Type)
-			tlv := &Lwm2mTLV{
-				TypeOfID: lwm2mTLVTypeResouce,
-				ID:       (uint16)(resourceID),
-				Length:   (uint32)(len(resourceTLVValue)),
-				Value:    resourceTLVValue}
-			payload = append(payload, tlv.Marshal()...)
-
-			if isObserve {
-				observedResource := &Lwm2mObservedResource{resource: resource, lastValue: resourceValue, observeCount: 0}
-				observedInstance.resources = append(observedInstance.resources, observedResource)
-			}
-		}
+// processReadObject : オブジェクトに対するReadを処理する
+// 例 : READ /3303
+// 各インスタンスをObject InstanceのTLVに格納して返す
+func (lwm2m *Lwm2m) processReadObject(objectID uint16, contentFormat uint16, message *CoapMessage) error {
+	object := lwm2m.findObject(objectID)
+	if object == nil {
+		log.Printf("READ /%d Not Found", objectID)
+		lwm2m.Connection.SendResponse(message, CoapCodeNotFound, []CoapOption{}, []byte{})
+		return nil
+	}
+
+	isObserve := message.IsObserve()
+	if isObserve {
+		log.Printf("OBSERVE /%d", objectID)
+	} else {
+		log.Printf("READ /%d", objectID)
 	}
 
-	contentFormat := make([]byte, 2)
-	binary.BigEndian.PutUint16(contentFormat, coapContentFormatLwm2mTLV)
+	instanceIDs, code := lwm2m.handler.ListInstanceIDs(object)
+	if code != CoapCodeContent {
+		lwm2m.Connection.SendResponse(message, CoapCodeNotAllowed, []CoapOption{}, []byte{})
+		return errors.New("インスタンスが取得できませんでした")
+	}
+	tlvs, observedInstances := lwm2m.readObjectInstances(object, instanceIDs)
+	payload, err := lwm2m.encodeContent(contentFormat, fmt.Sprintf("/%d/", objectID), objectID, tlvs)
+	if err != nil {
+		lwm2m.Connection.SendResponse(message, CoapCodeNotAllowed, []CoapOption{}, []byte{})
+		return err
+	}
 
 	var options []CoapOption
 	// Observe Registerの場合はObserveオプションをつけ、そうでなければつけない
 	if isObserve {
 		options = []CoapOption{
-			CoapOption{coapOptionNoContentFormat, contentFormat},
+			contentFormatOption(contentFormat),
 			CoapOption{coapOptionNoObserve, []byte{coapObserveRegister}}}
-		lwm2m.observedInstance = append(lwm2m.observedInstance, observedInstance)
+		lwm2m.refreshObservedInstanceAttributes(observedInstances)
+		observedObject := &Lwm2mObservedObject{
+			request:       message,
+			object:        object,
+			instances:     observedInstances,
+			attributes:    lwm2m.objectAttributes(objectID),
+			lastNotified:  time.Now(),
+			contentFormat: contentFormat,
+			confirmable:   lwm2m.isConfirmableNotify(fmt.Sprintf("/%d", objectID))}
+		lwm2m.observeMutex.Lock()
+		lwm2m.observedObject = append(lwm2m.observedObject, observedObject)
+		lwm2m.observeMutex.Unlock()
 	} else {
-		options = []CoapOption{CoapOption{coapOptionNoContentFormat, contentFormat}}
+		options = []CoapOption{contentFormatOption(contentFormat)}
 	}
 	lwm2m.Connection.SendResponse(message, CoapCodeContent, options, payload)
 	return nil
 }
 
+// readObjectInstances : オブジェクトの各インスタンスを読み出し、Object InstanceのTLVを生成する
+// 読み出し可能なリソースが無いインスタンスも空のObject InstanceのTLVとして含める
+// 読み出したインスタンスはObserve用の情報として返す
+func (lwm2m *Lwm2m) readObjectInstances(object *Lwm2mObject, instanceIDs []uint16) ([]*Lwm2mTLV, []*Lwm2mObservedInstance) {
+	tlvs := make([]*Lwm2mTLV, 0)
+	observedInstances := make([]*Lwm2mObservedInstance, 0)
+	for _, instanceID := range instanceIDs {
+		instance := &Lwm2mInstance{ID: instanceID, objectID: object.ID}
+		resourceTLVs, observedInstance, err := lwm2m.readInstanceResources(instance)
+		if err != nil {
+			continue
+		}
+		observedInstances = append(observedInstances, observedInstance)
+		tlvs = append(tlvs, newObjectInstanceTLV(instanceID, resourceTLVs))
+	}
+	return tlvs, observedInstances
+}
+
+// readInstanceResources : インスタンスの読み出し可能なリソースを読み出し、TLVを生成する
+// 読み出したリソースはObserve用の情報として返す
+// 属性の取得はServerオブジェクトの読み出しを伴うため、ここでは行わずObserveを登録する際に設定する
+func (lwm2m *Lwm2m) readInstanceResources(instance *Lwm2mInstance) ([]*Lwm2mTLV, *Lwm2mObservedInstance, error) {
+	objectID := instance.objectID
+	instanceID := instance.ID
+	observedInstance := &Lwm2mObservedInstance{
+		instance:     instance,
+		resources:    make([]*Lwm2mObservedResource, 0),
+		lastNotified: time.Now()}
+
+	resourceIDs, code := lwm2m.handler.ListResourceIDs(instance)
+	if code != CoapCodeContent {
+		return nil, nil, errors.New("リソースが取得できませんでした")
+	}
+
+	tlvs := make([]*Lwm2mTLV, 0)
+	for _, resourceID := range resourceIDs {
+		resource := lwm2m.findResource(objectID, instanceID, resourceID)
+		if resource == nil || resource.Definition == nil || !resource.Definition.Readable {
+			continue
+		}
+		tlv, resourceValue, code := lwm2m.readResourceTLV(resource)
+		if code != CoapCodeContent {
+			continue
+		}
+		tlvs = append(tlvs, tlv)
+
+		observedResource := &Lwm2mObservedResource{
+			resource:     resource,
+			lastValue:    resourceValue,
+			observeCount: 0}
+		observedInstance.resources = append(observedInstance.resources, observedResource)
+	}
+	return tlvs, observedInstance, nil
+}
+
+// readResourceTLV : リソースを読み出し、TLVを生成する
+// 複数インスタンスのリソースは、各Resource InstanceのTLVをMultiple ResourceのTLVに格納する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 6.4.3 TLV参照
+// valueは値の変化の確認に使用する文字列で、複数インスタンスのリソースは"ID=値"を改行で連結したもの
+func (lwm2m *Lwm2m) readResourceTLV(resource *Lwm2mResource) (*Lwm2mTLV, string, CoapCode) {
+	if !resource.Definition.Multi {
+		value, code := lwm2m.handler.ReadResource(resource)
+		if code != CoapCodeContent {
+			return nil, "", code
+		}
+		resourceTLVValue := convertStringToTLVValue(value, resource.Definition.Type)
+		tlv := &Lwm2mTLV{
+			TypeOfID: lwm2mTLVTypeResouce,
+			ID:       resource.ID,
+			Length:   (uint32)(len(resourceTLVValue)),
+			Value:    resourceTLVValue}
+		return tlv, value, CoapCodeContent
+	}
+
+	resourceInstanceIDs, code := listResourceInstanceIDs(lwm2m.handler, resource)
+	if code != CoapCodeContent {
+		return nil, "", code
+	}
+	contents := make([]*Lwm2mTLV, 0)
+	values := make([]string, 0)
+	for _, resourceInstanceID := range resourceInstanceIDs {
+		value, code := readResourceInstance(lwm2m.handler, resource, resourceInstanceID)
+		if code != CoapCodeContent {
+			return nil, "", code
+		}
+		resourceTLVValue := convertStringToTLVValue(value, resource.Definition.Type)
+		contents = append(contents, &Lwm2mTLV{
+			TypeOfID: lwm2mTLVTypeResouceInstance,
+			ID:       resourceInstanceID,
+			Length:   (uint32)(len(resourceTLVValue)),
+			Value:    resourceTLVValue})
+		values = append(values, fmt.Sprintf("%d=%s", resourceInstanceID, value))
+	}
+	return newMultipleResourceTLV(resource.ID, contents), strings.Join(values, "\n"), CoapCodeContent
+}
+
 // processReadResource : リソースに対するReadを処理する
 // 例 : READ /1/0/1
-func (lwm2m *Lwm2m) processReadResource(objectID, instanceID, resourceID uint16, message *CoapMessage) error {
+func (lwm2m *Lwm2m) processReadResource(objectID, instanceID, resourceID uint16, contentFormat uint16, message *CoapMessage) error {
 	resource := lwm2m.findResource(objectID, instanceID, resourceID)
 	if resource == nil {
 		log.Printf("READ /%d/%d/%d Not Found", objectID, instanceID, resourceID)
@@ -292,8 +761,12 @@ func (lwm2m *Lwm2m) processReadResource(objectID, instanceID, resourceID uint16,
 	observedResource := &Lwm2mObservedResource{}
 	if isObserve {
 		log.Printf("OBSERVE /%d/%d/%d", objectID, instanceID, resourceID)
-		observedResource.token = message.Token
+		observedResource.request = message
 		observedResource.resource = resource
+		observedResource.attributes = lwm2m.resourceAttributes(objectID, instanceID, resourceID)
+		observedResource.lastNotified = time.Now()
+		observedResource.contentFormat = contentFormat
+		observedResource.confirmable = lwm2m.isConfirmableNotify(fmt.Sprintf("/%d/%d/%d", objectID, instanceID, resourceID))
 	} else {
 		log.Printf("READ /%d/%d/%d", objectID, instanceID, resourceID)
 	}
@@ -303,43 +776,212 @@ func (lwm2m *Lwm2m) processReadResource(objectID, instanceID, resourceID uint16,
 		return nil
 	}
 
-	resourceValue, code := lwm2m.handler.ReadResource(resource)
+	tlv, resourceValue, code := lwm2m.readResourceTLV(resource)
 	if code != CoapCodeContent {
 		lwm2m.Connection.SendResponse(message, CoapCodeNotAllowed, []CoapOption{}, []byte{})
 		return errors.New("リソースの読み出しに失敗しました")
 	}
-
-	resourceTLVValue := convertStringToTLVValue(resourceValue, resource.Definition.Type)
-	tlv := &Lwm2mTLV{
-		TypeOfID: lwm2mTLVTypeResouce,
-		ID:       (uint16)(resourceID),
-		Length:   (uint32)(len(resourceTLVValue)),
-		Value:    resourceTLVValue}
-	payload := tlv.Marshal()
-
-	contentFormat := make([]byte, 2)
-	binary.BigEndian.PutUint16(contentFormat, coapContentFormatLwm2mTLV)
+	payload, err := lwm2m.encodeContent(contentFormat, fmt.Sprintf("/%d/%d/", objectID, instanceID), objectID, []*Lwm2mTLV{tlv})
+	if err != nil {
+		lwm2m.Connection.SendResponse(message, CoapCodeNotAllowed, []CoapOption{}, []byte{})
+		return err
+	}
 
 	var options []CoapOption
 	// Observe Registerの場合はObserveオプションをつけ、そうでなければつけない
 	if isObserve {
 		options = []CoapOption{
-			CoapOption{coapOptionNoContentFormat, contentFormat},
+			contentFormatOption(contentFormat),
 			CoapOption{coapOptionNoObserve, []byte{coapObserveRegister}}}
 		observedResource.lastValue = resourceValue
+		lwm2m.observeMutex.Lock()
 		lwm2m.observedResource = append(lwm2m.observedResource, observedResource)
+		lwm2m.observeMutex.Unlock()
 	} else {
-		options = []CoapOption{CoapOption{coapOptionNoContentFormat, contentFormat}}
+		options = []CoapOption{contentFormatOption(contentFormat)}
 	}
 	lwm2m.Connection.SendResponse(message, CoapCodeContent, options, payload)
 
 	return nil
 }
 
+// processWriteObject : オブジェクトに対するWriteを処理する
+// 例 : WRITE /1
+// ペイロードの各Object InstanceのTLVで、それぞれのインスタンスをReplaceする
+// 全てのインスタンスとリソースを確認してから書き込む
+func (lwm2m *Lwm2m) processWriteObject(objectID uint16, message *CoapMessage) error {
+	log.Printf("WRITE /%d", objectID)
+	if lwm2m.findObject(objectID) == nil {
+		lwm2m.Connection.SendResponse(message, CoapCodeNotFound, []CoapOption{}, []byte{})
+		return nil
+	}
+	tlvs, code, err := lwm2m.parseWritePayload(message, []uint16{objectID}, true)
+	if err != nil {
+		lwm2m.Connection.SendResponse(message, code, []CoapOption{}, []byte{})
+		return err
+	}
+
+	instances := make([]*Lwm2mInstance, 0, len(tlvs))
+	for _, tlv := range tlvs {
+		if tlv.TypeOfID != lwm2mTLVTypeObjectInstance || tlv.UnmarshalContents() != nil {
+			lwm2m.Connection.SendResponse(message, CoapCodeBadRequest, []CoapOption{}, []byte{})
+			return errors.New("インスタンスのTLVではありません")
+		}
+		instance := lwm2m.findInstance(objectID, tlv.ID)
+		if instance == nil {
+			lwm2m.Connection.SendResponse(message, CoapCodeNotFound, []CoapOption{}, []byte{})
+			return nil
+		}
+		if code := lwm2m.checkResourceTLVs(objectID, tlv.Contents, true); code != CoapCodeChanged {
+			lwm2m.Connection.SendResponse(message, code, []CoapOption{}, []byte{})
+			return nil
+		}
+		instances = append(instances, instance)
+	}
+
+	for i, tlv := range tlvs {
+		code := lwm2m.writeInstanceResources(instances[i], tlv.Contents, true)
+		if code != CoapCodeChanged {
+			lwm2m.Connection.SendResponse(message, code, []CoapOption{}, []byte{})
+			return errors.New("リソースの登録に失敗しました")
+		}
+	}
+	lwm2m.Connection.SendResponse(message, CoapCodeChanged, []CoapOption{}, []byte{})
+	return nil
+}
+
+// processWriteInstance : インスタンスに対するWriteを処理する
+// 例 : WRITE /1/0
+// replaceがtrue(PUT)の場合はReplaceとし、指定されなかったリソースを削除する
+// falseの場合(POST)はPartial Updateとし、指定されたリソースのみ更新する
+// 全てのリソースを確認してから書き込む
+func (lwm2m *Lwm2m) processWriteInstance(objectID, instanceID uint16, replace bool, message *CoapMessage) error {
+	log.Printf("WRITE /%d/%d", objectID, instanceID)
+	instance := lwm2m.findInstance(objectID, instanceID)
+	if instance == nil {
+		lwm2m.Connection.SendResponse(message, CoapCodeNotFound, []CoapOption{}, []byte{})
+		return nil
+	}
+	tlvs, code, err := lwm2m.parseWritePayload(message, []uint16{objectID, instanceID}, false)
+	if err != nil {
+		lwm2m.Connection.SendResponse(message, code, []CoapOption{}, []byte{})
+		return err
+	}
+	// リソースがObject InstanceのTLVに格納されている場合は取り出す
+	if len(tlvs) == 1 && tlvs[0].TypeOfID == lwm2mTLVTypeObjectInstance {
+		if tlvs[0].ID != instanceID || tlvs[0].UnmarshalContents() != nil {
+			lwm2m.Connection.SendResponse(message, CoapCodeBadRequest, []CoapOption{}, []byte{})
+			return errors.New("インスタンスのTLVが不正です")
+		}
+		tlvs = tlvs[0].Contents
+	}
+
+	if code := lwm2m.checkResourceTLVs(objectID, tlvs, true); code != CoapCodeChanged {
+		lwm2m.Connection.SendResponse(message, code, []CoapOption{}, []byte{})
+		return nil
+	}
+	code = lwm2m.writeInstanceResources(instance, tlvs, replace)
+	if code != CoapCodeChanged {
+		lwm2m.Connection.SendResponse(message, code, []CoapOption{}, []byte{})
+		return errors.New("リソースの登録に失敗しました")
+	}
+	lwm2m.Connection.SendResponse(message, CoapCodeChanged, []CoapOption{}, []byte{})
+	return nil
+}
+
+// checkResourceTLVs : インスタンスに書き込むリソースのTLVを確認する
+// writableがtrueの場合(Write)は書き込み可能なリソースのみ許可し、falseの場合(Create)は定義があれば許可する
+// 値の長さが型に合わないTLVは4.00とする
+// 書き込めない場合はレスポンスコードを、書き込める場合はCoapCodeChangedを返す
+func (lwm2m *Lwm2m) checkResourceTLVs(objectID uint16, tlvs []*Lwm2mTLV, writable bool) CoapCode {
+	for _, tlv := range tlvs {
+		if tlv.TypeOfID != lwm2mTLVTypeResouce && tlv.TypeOfID != lwm2mTLVTypeMultipleResouce {
+			return CoapCodeBadRequest
+		}
+		resourceDefinition := lwm2m.definitions.findResourceDefinitionByIDs(objectID, tlv.ID)
+		if resourceDefinition == nil {
+			return CoapCodeNotFound
+		}
+		if writable && !resourceDefinition.Writable {
+			return CoapCodeNotAllowed
+		}
+		if _, _, code := decodeResourceTLV(resourceDefinition, tlv); code != CoapCodeChanged {
+			return code
+		}
+	}
+	return CoapCodeChanged
+}
+
+// writeInstanceResources : インスタンスにリソースのTLVを書き込む
+// replaceがtrueの場合、指定されなかった書き込み可能なリソースを削除する
+// ただし必須(Mandatory)のリソースはインスタンスに必要なため削除しない
+// 削除するリソースがあり、ハンドラがLwm2mResourceDeleteHandlerを実装していない場合は、書き込む前に4.05とする
+func (lwm2m *Lwm2m) writeInstanceResources(instance *Lwm2mInstance, tlvs []*Lwm2mTLV, replace bool) CoapCode {
+	written := make(map[uint16]bool)
+	for _, tlv := range tlvs {
+		written[tlv.ID] = true
+	}
+	removed := []*Lwm2mResource{}
+	if replace {
+		var code CoapCode
+		removed, code = lwm2m.unwrittenResources(instance, written)
+		if code != CoapCodeContent {
+			return CoapCodeNotAllowed
+		}
+	}
+	deleteHandler, deletable := lwm2m.handler.(Lwm2mResourceDeleteHandler)
+	if len(removed) > 0 && !deletable {
+		log.Printf("WRITE /%d/%d Replaceで指定されなかったリソースを削除できません", instance.objectID, instance.ID)
+		return CoapCodeNotAllowed
+	}
+
+	for _, tlv := range tlvs {
+		resource := &Lwm2mResource{
+			ID:         tlv.ID,
+			objectID:   instance.objectID,
+			instanceID: instance.ID,
+			Definition: lwm2m.definitions.findResourceDefinitionByIDs(instance.objectID, tlv.ID)}
+		code := writeResourceTLV(lwm2m.handler, resource, tlv)
+		if code != CoapCodeChanged {
+			return code
+		}
+	}
+	for _, resource := range removed {
+		if code := deleteHandler.DeleteResource(resource); code != CoapCodeDeleted {
+			return code
+		}
+	}
+	return CoapCodeChanged
+}
+
+// unwrittenResources : WriteのReplaceで指定されなかった、削除するリソースを取得する
+// 書き込み可能で、必須(Mandatory)でないリソースを対象とする
+// 通常CoapCodeContentを返す
+func (lwm2m *Lwm2m) unwrittenResources(instance *Lwm2mInstance, written map[uint16]bool) ([]*Lwm2mResource, CoapCode) {
+	resourceIDs, code := lwm2m.handler.ListResourceIDs(instance)
+	if code != CoapCodeContent {
+		return nil, code
+	}
+	resources := []*Lwm2mResource{}
+	for _, resourceID := range resourceIDs {
+		resourceDefinition := lwm2m.definitions.findResourceDefinitionByIDs(instance.objectID, resourceID)
+		if written[resourceID] || resourceDefinition == nil || !resourceDefinition.Writable || resourceDefinition.Mandatory {
+			continue
+		}
+		resources = append(resources, &Lwm2mResource{
+			ID:         resourceID,
+			objectID:   instance.objectID,
+			instanceID: instance.ID,
+			Definition: resourceDefinition})
+	}
+	return resources, CoapCodeContent
+}
+
 // processWriteResource : リソースに対するWriteを処理する
 // 例 : WRITE /1/0/1
 // 親インスタンスが存在しない場合、リソース定義が存在しない場合はエラー
 // 対象リソースが存在しない場合は作成する
+// 複数インスタンスのリソースはMultiple ResourceのTLVで全Resource Instanceを置き換える
 func (lwm2m *Lwm2m) processWriteResource(objectID uint16, instanceID uint16, resourceID uint16, message *CoapMessage) error {
 	log.Printf("WRITE /%d/%d/%d", objectID, instanceID, resourceID)
 	instance := lwm2m.findInstance(objectID, instanceID)
@@ -366,10 +1008,16 @@ func (lwm2m *Lwm2m) processWriteResource(objectID uint16, instanceID uint16, res
 		return nil
 	}
 
-	tlv := &Lwm2mTLV{}
-	tlv.Unmarshal(message.Payload)
-	value := convertTLVValueToString(tlv.Value, resource.Definition.Type)
-	code := lwm2m.handler.WriteResource(resource, value)
+	tlvs, code, err := lwm2m.parseWritePayload(message, []uint16{objectID, instanceID}, false)
+	if err != nil {
+		lwm2m.Connection.SendResponse(message, code, []CoapOption{}, []byte{})
+		return err
+	}
+	if len(tlvs) != 1 || tlvs[0].ID != resourceID {
+		lwm2m.Connection.SendResponse(message, CoapCodeBadRequest, []CoapOption{}, []byte{})
+		return errors.New("対象のリソースのデータではありません")
+	}
+	code = writeResourceTLV(lwm2m.handler, resource, tlvs[0])
 	if code != CoapCodeChanged {
 		lwm2m.Connection.SendResponse(message, code, []CoapOption{}, []byte{})
 		return errors.New("リソースの登録に失敗しました")
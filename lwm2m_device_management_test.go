@@ -0,0 +1,586 @@
+package inventoryd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lwm2mTestObserveFiles : Observeのテストに使用するDeviceオブジェクトのファイル
+var lwm2mTestObserveFiles = map[string]string{
+	"3/0/0": "inventoryd",
+	"3/0/9": "80",
+}
+
+// observeTestRequest : Observe Optionとトークンを指定したGETを生成する
+func observeTestRequest(path string, token []byte, observe byte) *CoapMessage {
+	request := lwm2mTestRequest(CoapCodeGet, path,
+		[]CoapOption{CoapOption{coapOptionNoObserve, coapUintOptionValue((uint32)(observe))}}, []byte{})
+	request.Token = token
+	request.TokenLength = (byte)(len(token))
+	return request
+}
+
+// waitObservedTokens : Observe中のオブジェクト / インスタンス / リソースの数がcountになるまで待ち、トークンを返す
+// Resetによる解除は受信処理で行われるため、完了を待つ
+func waitObservedTokens(t *testing.T, lwm2m *Lwm2m, count int) [][]byte {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		tokens := [][]byte{}
+		lwm2m.observeMutex.Lock()
+		for _, observe := range lwm2m.observedObject {
+			tokens = append(tokens, observe.request.Token)
+		}
+		for _, observe := range lwm2m.observedInstance {
+			tokens = append(tokens, observe.request.Token)
+		}
+		for _, observe := range lwm2m.observedResource {
+			tokens = append(tokens, observe.request.Token)
+		}
+		lwm2m.observeMutex.Unlock()
+		if len(tokens) == count {
+			return tokens
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Observeの数が不正です %d", len(tokens))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestLwm2mObserveCancel : Observe=1のGETでトークンが一致するObserveのみ解除し、
+// Observe Optionの無いReadのレスポンスを返すことを確認する
+// RFC7641 3.6 Cancellation参照
+func TestLwm2mObserveCancel(t *testing.T) {
+	lwm2m, peer := newLwm2mTestClient(t, lwm2mTestObserveFiles)
+	tokenA, tokenB := []byte{0x0a}, []byte{0x0b}
+	for _, request := range []*CoapMessage{
+		observeTestRequest("/3/0/9", tokenA, coapObserveRegister),
+		observeTestRequest("/3/0", tokenB, coapObserveRegister),
+	} {
+		response := peer.request(request)
+		if response.Code != CoapCodeContent || response.findOption(coapOptionNoObserve) == nil {
+			t.Fatalf("Observeのレスポンスが不正です %s", response.Code)
+		}
+	}
+	waitObservedTokens(t, lwm2m, 2)
+
+	response := peer.request(observeTestRequest("/3/0/9", tokenA, coapObserveDeregister))
+	if response.Code != CoapCodeContent || string(response.Payload) == "" {
+		t.Fatalf("Observe=1のレスポンスが不正です %s", response.Code)
+	}
+	if response.findOption(coapOptionNoObserve) != nil {
+		t.Fatal("Observe=1のレスポンスにObserve Optionが付加されています")
+	}
+	if tokens := waitObservedTokens(t, lwm2m, 1); !bytes.Equal(tokens[0], tokenB) {
+		t.Fatalf("解除されたObserveが不正です %x", tokens[0])
+	}
+
+	// 登録されていないトークンのObserve=1は通常のReadとして処理する
+	if response := peer.request(observeTestRequest("/3/0/9", []byte{0x0c}, coapObserveDeregister)); response.Code != CoapCodeContent {
+		t.Fatalf("未登録のトークンのObserve=1のレスポンスが不正です %s", response.Code)
+	}
+	waitObservedTokens(t, lwm2m, 1)
+}
+
+// TestLwm2mObserveReregister : 同じトークンのObserve=0は既存のObserveを置き換えることを確認する
+// RFC7641 4.1 Request参照
+func TestLwm2mObserveReregister(t *testing.T) {
+	lwm2m, peer := newLwm2mTestClient(t, lwm2mTestObserveFiles)
+	token := []byte{0x0a}
+	peer.request(observeTestRequest("/3/0/9", token, coapObserveRegister))
+	peer.request(observeTestRequest("/3/0/9", token, coapObserveRegister))
+	waitObservedTokens(t, lwm2m, 1)
+
+	// 同じトークンで別のパスを登録し直した場合も置き換える
+	peer.request(observeTestRequest("/3/0", token, coapObserveRegister))
+	waitObservedTokens(t, lwm2m, 1)
+	lwm2m.observeMutex.Lock()
+	replaced := len(lwm2m.observedInstance) == 1 && len(lwm2m.observedResource) == 0
+	lwm2m.observeMutex.Unlock()
+	if !replaced {
+		t.Fatal("同じトークンのObserveが置き換えられていません")
+	}
+}
+
+// TestLwm2mObserveReset : NotifyにResetが返された場合、そのNotifyのObserveのみ解除することを確認する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 8.2.6 Information Reporting Interface参照
+func TestLwm2mObserveReset(t *testing.T) {
+	lwm2m, peer := newLwm2mTestClient(t, lwm2mTestObserveFiles)
+	lwm2m.registered = true
+	peer.request(observeTestRequest("/3/0/9", []byte{0x0a}, coapObserveRegister))
+	peer.request(observeTestRequest("/3/0/0", []byte{0x0b}, coapObserveRegister))
+
+	handler := lwm2m.handler.(*HandlerFile)
+	writeLwm2mTestFiles(t, handler.ResourceDirPath, map[string]string{"3/0/9": "81"})
+	lwm2m.Observe()
+	notify := peer.read()
+	if notify.Type != CoapTypeNonConfirmable || !bytes.Equal(notify.Token, []byte{0x0a}) {
+		t.Fatalf("Notifyが不正です type=%d token=%x", notify.Type, notify.Token)
+	}
+
+	// 関係の無いメッセージIDのResetでは解除しない
+	peer.write(&CoapMessage{Version: 1, Type: CoapTypeReset, Code: CoapCodeEmpty, MessageID: notify.MessageID + 1, Options: []CoapOption{}})
+	peer.write(&CoapMessage{Version: 1, Type: CoapTypeReset, Code: CoapCodeEmpty, MessageID: notify.MessageID, Options: []CoapOption{}})
+	if tokens := waitObservedTokens(t, lwm2m, 1); !bytes.Equal(tokens[0], []byte{0x0b}) {
+		t.Fatalf("解除されたObserveが不正です %x", tokens[0])
+	}
+
+	// 解除したObserveのNotifyは送らない
+	writeLwm2mTestFiles(t, handler.ResourceDirPath, map[string]string{"3/0/9": "82"})
+	lwm2m.Observe()
+	peer.expectSilence(50 * time.Millisecond)
+}
+
+// newLwm2mTestConfirmableObserve : /3/0/9のNotifyをCONで送信するLwm2mで/3/0/9をObserveし、Observeを返す
+func newLwm2mTestConfirmableObserve(t *testing.T) (*Lwm2m, *coapTestPeer, *Lwm2mObservedResource) {
+	lwm2m, peer := newLwm2mTestClient(t, lwm2mTestObserveFiles)
+	lwm2m.registered = true
+	lwm2m.confirmablePaths = []string{"/3/0/9"}
+	peer.request(observeTestRequest("/3/0/9", []byte{0x0a}, coapObserveRegister))
+	lwm2m.observeMutex.Lock()
+	defer lwm2m.observeMutex.Unlock()
+	if len(lwm2m.observedResource) != 1 || !lwm2m.observedResource[0].confirmable {
+		t.Fatal("CONのNotifyを送信するObserveが登録されていません")
+	}
+	return lwm2m, peer, lwm2m.observedResource[0]
+}
+
+// notifyTestValue : /3/0/9の値を変更してObserveの確認を行う
+func notifyTestValue(t *testing.T, lwm2m *Lwm2m, value string) {
+	t.Helper()
+	writeLwm2mTestFiles(t, lwm2m.handler.(*HandlerFile).ResourceDirPath, map[string]string{"3/0/9": value})
+	lwm2m.Observe()
+}
+
+// waitNotifyPending : Observeのpendingがpendingになるまで待つ
+func waitNotifyPending(t *testing.T, lwm2m *Lwm2m, observe *Lwm2mObservedResource, pending bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		lwm2m.observeMutex.Lock()
+		current := observe.pending
+		lwm2m.observeMutex.Unlock()
+		if current == pending {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pendingが%tになりません", pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestLwm2mConfirmableNotify : CONのNotifyのACKを待っている間は次のNotifyを送らず、
+// ACKを受信したら次のNotifyを送ることを確認する
+// RFC7641 4.5 Transmission参照
+func TestLwm2mConfirmableNotify(t *testing.T) {
+	setCoapTestTransmissionParams(t, time.Second)
+	lwm2m, peer, observe := newLwm2mTestConfirmableObserve(t)
+
+	notifyTestValue(t, lwm2m, "81")
+	notify := peer.read()
+	if notify.Type != CoapTypeConfirmable || string(notify.Payload) == "" {
+		t.Fatalf("CONのNotifyが送信されません type=%d", notify.Type)
+	}
+	waitNotifyPending(t, lwm2m, observe, true)
+	notifyTestValue(t, lwm2m, "82")
+	peer.expectSilence(50 * time.Millisecond)
+
+	peer.write(&CoapMessage{Version: 1, Type: CoapTypeAcknowledgement, Code: CoapCodeEmpty, MessageID: notify.MessageID, Options: []CoapOption{}})
+	waitNotifyPending(t, lwm2m, observe, false)
+	lwm2m.Observe()
+	if next := peer.read(); next.Type != CoapTypeConfirmable || next.MessageID == notify.MessageID {
+		t.Fatalf("ACKの受信後に次のNotifyが送信されません type=%d", next.Type)
+	}
+	waitObservedTokens(t, lwm2m, 1)
+}
+
+// TestLwm2mConfirmableNotifyFailure : CONのNotifyの再送を諦めた場合にpendingを戻し、Observeを解除することを確認する
+func TestLwm2mConfirmableNotifyFailure(t *testing.T) {
+	setCoapTestTransmissionParams(t, 10*time.Millisecond)
+	lwm2m, peer, observe := newLwm2mTestConfirmableObserve(t)
+
+	notifyTestValue(t, lwm2m, "81")
+	notify := peer.read()
+	for i := 0; i < coapMaxRetransmit; i++ {
+		if retransmitted := peer.read(); retransmitted.MessageID != notify.MessageID {
+			t.Fatalf("%d回目の再送が不正です", i+1)
+		}
+	}
+	waitNotifyPending(t, lwm2m, observe, false)
+	waitObservedTokens(t, lwm2m, 0)
+}
+
+// TestLwm2mConfirmableNotifyClose : ACKを待っている間に再送を止めた場合(接続を閉じた場合)も、
+// 再送を諦めたものとしてpendingを戻し、Observeを解除することを確認する
+func TestLwm2mConfirmableNotifyClose(t *testing.T) {
+	setCoapTestTransmissionParams(t, time.Second)
+	lwm2m, peer, observe := newLwm2mTestConfirmableObserve(t)
+
+	notifyTestValue(t, lwm2m, "81")
+	peer.read()
+	waitNotifyPending(t, lwm2m, observe, true)
+	lwm2m.Connection.stopAllRetransmissions()
+	waitNotifyPending(t, lwm2m, observe, false)
+	waitObservedTokens(t, lwm2m, 0)
+}
+
+// lwm2mTestSingleValueHandler : Lwm2mResourceInstanceHandler / Lwm2mResourceDeleteHandlerを実装しないハンドラ
+// Lwm2mHandlerのメソッドのみをHandlerFileに委譲する
+type lwm2mTestSingleValueHandler struct {
+	Lwm2mHandler
+}
+
+// readMultipleResourceTestValues : /2/0/2をTLVで読み出し、各Resource InstanceのIDと値を返す
+// 例 : [0=1 1=5]
+func readMultipleResourceTestValues(t *testing.T, peer *coapTestPeer) string {
+	t.Helper()
+	response := peer.request(lwm2mTestRequest(CoapCodeGet, "/2/0/2", []CoapOption{}, []byte{}))
+	if response.Code != CoapCodeContent {
+		t.Fatalf("/2/0/2 のReadに失敗しました %s", response.Code)
+	}
+	tlvs, err := parseLwm2mTLVs(response.Payload)
+	if err != nil || len(tlvs) != 1 || tlvs[0].TypeOfID != lwm2mTLVTypeMultipleResouce || tlvs[0].UnmarshalContents() != nil {
+		t.Fatalf("Multiple ResourceのTLVではありません %x", response.Payload)
+	}
+	values := []string{}
+	for _, content := range tlvs[0].Contents {
+		value, err := convertTLVValueToString(content.Value, lwm2mResourceTypeInteger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, fmt.Sprintf("%d=%s", content.ID, value))
+	}
+	return fmt.Sprint(values)
+}
+
+// writeMultipleResourceTestValues : /2/0/2にResource Instanceの値をTLVで書き込む
+func writeMultipleResourceTestValues(peer *coapTestPeer, values map[uint16]string) CoapCode {
+	contents := []*Lwm2mTLV{}
+	for id, value := range values {
+		tlvValue := convertStringToTLVValue(value, lwm2mResourceTypeInteger)
+		contents = append(contents, &Lwm2mTLV{TypeOfID: lwm2mTLVTypeResouceInstance, ID: id, Length: (uint32)(len(tlvValue)), Value: tlvValue})
+	}
+	options := []CoapOption{contentFormatOption(coapContentFormatLwm2mTLV)}
+	payload := newMultipleResourceTLV(2, contents).Marshal()
+	return peer.request(lwm2mTestRequest(CoapCodePut, "/2/0/2", options, payload)).Code
+}
+
+// TestLwm2mMultipleResource : 複数インスタンスのリソースをMultiple ResourceのTLVで読み書きすることを確認する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 6.4.3 TLV参照
+func TestLwm2mMultipleResource(t *testing.T) {
+	_, peer := newLwm2mTestClient(t, map[string]string{"2/0/0": "3", "2/0/2/0": "1", "2/0/2/1": "5"})
+	if values := readMultipleResourceTestValues(t, peer); values != "[0=1 1=5]" {
+		t.Fatalf("Resource Instanceの値が不正です %s", values)
+	}
+	if code := writeMultipleResourceTestValues(peer, map[uint16]string{2: "7"}); code != CoapCodeChanged {
+		t.Fatalf("/2/0/2 のWriteに失敗しました %s", code)
+	}
+	if values := readMultipleResourceTestValues(t, peer); values != "[2=7]" {
+		t.Fatalf("Write後のResource Instanceの値が不正です %s", values)
+	}
+}
+
+// TestLwm2mMultipleResourceWithoutInstanceHandler : ハンドラがLwm2mResourceInstanceHandlerを実装していなければ、
+// 複数インスタンスのリソースをResource Instance 0のみとしてReadResource / WriteResourceで読み書きすることを確認する
+func TestLwm2mMultipleResourceWithoutInstanceHandler(t *testing.T) {
+	lwm2m, peer := newLwm2mTestClient(t, map[string]string{"2/0/0": "3", "2/0/2": "1"})
+	lwm2m.handler = lwm2mTestSingleValueHandler{lwm2m.handler}
+	if values := readMultipleResourceTestValues(t, peer); values != "[0=1]" {
+		t.Fatalf("Resource Instance 0の値が不正です %s", values)
+	}
+	if code := writeMultipleResourceTestValues(peer, map[uint16]string{0: "2"}); code != CoapCodeChanged {
+		t.Fatalf("Resource Instance 0のWriteに失敗しました %s", code)
+	}
+	if values := readMultipleResourceTestValues(t, peer); values != "[0=2]" {
+		t.Fatalf("Write後のResource Instance 0の値が不正です %s", values)
+	}
+	if code := writeMultipleResourceTestValues(peer, map[uint16]string{1: "5"}); code != CoapCodeNotAllowed {
+		t.Fatalf("Resource Instance 0以外のWriteの結果が不正です %s", code)
+	}
+}
+
+// lwm2mTestWriteFiles : Writeのテストに使用するServerオブジェクトのファイル
+// 1/0/1(Lifetime)は必須、1/0/2 / 1/0/3(Default Minimum / Maximum Period)は任意の書き込み可能なリソース
+var lwm2mTestWriteFiles = map[string]string{
+	"1/0/1": "60",
+	"1/0/2": "5",
+	"1/0/3": "300",
+}
+
+// integerResourceTestTLVs : 整数のリソースのTLVを、リソースIDと値の対応から生成する
+func integerResourceTestTLVs(values map[uint16]string) []byte {
+	tlvs := []*Lwm2mTLV{}
+	for id, value := range values {
+		tlvValue := convertStringToTLVValue(value, lwm2mResourceTypeInteger)
+		tlvs = append(tlvs, &Lwm2mTLV{TypeOfID: lwm2mTLVTypeResouce, ID: id, Length: (uint32)(len(tlvValue)), Value: tlvValue})
+	}
+	return marshalLwm2mTLVs(tlvs)
+}
+
+// readServerTestFiles : Serverインスタンス(/1/0)のリソースのファイルを読み出す
+// 例 : [0=123 1=60 3=300]
+func readServerTestFiles(t *testing.T, root string) string {
+	t.Helper()
+	instancePath := filepath.Join(root, "1", "0")
+	files, err := ioutil.ReadDir(instancePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []string{}
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(filepath.Join(instancePath, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, file.Name()+"="+string(buf))
+	}
+	return fmt.Sprint(values)
+}
+
+// TestLwm2mWriteReplace : インスタンスに対するPUTは指定したリソースを書き込み、
+// 指定されなかった書き込み可能で任意のリソースを削除することを確認する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.4.3 Write参照
+func TestLwm2mWriteReplace(t *testing.T) {
+	lwm2m, peer := newLwm2mTestClient(t, lwm2mTestWriteFiles)
+	root := lwm2m.handler.(*HandlerFile).ResourceDirPath
+	options := []CoapOption{contentFormatOption(coapContentFormatLwm2mTLV)}
+	response := peer.request(lwm2mTestRequest(CoapCodePut, "/1/0", options, integerResourceTestTLVs(map[uint16]string{1: "120", 3: "600"})))
+	if response.Code != CoapCodeChanged {
+		t.Fatalf("Replaceに失敗しました %s", response.Code)
+	}
+	// 1/0/0は書き込み不可、1/0/1は必須のため削除しない
+	if files := readServerTestFiles(t, root); files != "[0=123 1=120 3=600]" {
+		t.Fatalf("Replace後のリソースが不正です %s", files)
+	}
+}
+
+// TestLwm2mWritePartialUpdate : インスタンスに対するTLVのPOSTは指定したリソースのみ書き込むことを確認する
+func TestLwm2mWritePartialUpdate(t *testing.T) {
+	lwm2m, peer := newLwm2mTestClient(t, lwm2mTestWriteFiles)
+	root := lwm2m.handler.(*HandlerFile).ResourceDirPath
+	options := []CoapOption{contentFormatOption(coapContentFormatLwm2mTLV)}
+	response := peer.request(lwm2mTestRequest(CoapCodePost, "/1/0", options, integerResourceTestTLVs(map[uint16]string{1: "90"})))
+	if response.Code != CoapCodeChanged {
+		t.Fatalf("Partial Updateに失敗しました %s", response.Code)
+	}
+	if files := readServerTestFiles(t, root); files != "[0=123 1=90 2=5 3=300]" {
+		t.Fatalf("Partial Update後のリソースが不正です %s", files)
+	}
+}
+
+// TestLwm2mWriteReplaceWithoutDeleteHandler : ハンドラがLwm2mResourceDeleteHandlerを実装していなければ、
+// リソースの削除が必要なReplaceは何も書き込まずに4.05とし、削除が不要なReplaceとPartial Updateは書き込むことを確認する
+func TestLwm2mWriteReplaceWithoutDeleteHandler(t *testing.T) {
+	lwm2m, peer := newLwm2mTestClient(t, lwm2mTestWriteFiles)
+	root := lwm2m.handler.(*HandlerFile).ResourceDirPath
+	lwm2m.handler = lwm2mTestSingleValueHandler{lwm2m.handler}
+	options := []CoapOption{contentFormatOption(coapContentFormatLwm2mTLV)}
+	cases := []struct {
+		code     CoapCode
+		values   map[uint16]string
+		expected CoapCode
+		files    string
+	}{
+		{CoapCodePut, map[uint16]string{1: "120"}, CoapCodeNotAllowed, "[0=123 1=60 2=5 3=300]"},
+		{CoapCodePut, map[uint16]string{1: "120", 2: "10", 3: "600"}, CoapCodeChanged, "[0=123 1=120 2=10 3=600]"},
+		{CoapCodePost, map[uint16]string{1: "90"}, CoapCodeChanged, "[0=123 1=90 2=10 3=600]"},
+	}
+	for _, c := range cases {
+		response := peer.request(lwm2mTestRequest(c.code, "/1/0", options, integerResourceTestTLVs(c.values)))
+		if response.Code != c.expected {
+			t.Fatalf("%s %v のレスポンスが不正です %s", c.code, c.values, response.Code)
+		}
+		if files := readServerTestFiles(t, root); files != c.files {
+			t.Fatalf("%s %v 後のリソースが不正です %s", c.code, c.values, files)
+		}
+	}
+}
+
+// TestLwm2mWriteInvalidTLV : 値の長さが型に合わないTLVのWriteは、何も書き込まずに4.00とすることを確認する
+func TestLwm2mWriteInvalidTLV(t *testing.T) {
+	lwm2m, peer := newLwm2mTestClient(t, lwm2mTestWriteFiles)
+	root := lwm2m.handler.(*HandlerFile).ResourceDirPath
+	options := []CoapOption{contentFormatOption(coapContentFormatLwm2mTLV)}
+	valid := integerResourceTestTLVs(map[uint16]string{1: "120"})
+	cases := []struct {
+		code    CoapCode
+		path    string
+		payload []byte
+	}{
+		// 3バイトの整数
+		{CoapCodePut, "/1/0/2", []byte{0xc3, 0x02, 0x00, 0x00, 0x01}},
+		// 値の無い真偽値(1/0/6 Notification Storing When Disabled or Offline)
+		{CoapCodePut, "/1/0/6", []byte{0xc0, 0x06}},
+		// 正しいTLVの後に長さが不正なTLV
+		{CoapCodePut, "/1/0", append(append([]byte{}, valid...), 0xc3, 0x02, 0x00, 0x00, 0x01)},
+		{CoapCodePost, "/1/0", append(append([]byte{}, valid...), 0xc3, 0x03, 0x00, 0x00, 0x01)},
+	}
+	for _, c := range cases {
+		if response := peer.request(lwm2mTestRequest(c.code, c.path, options, c.payload)); response.Code != CoapCodeBadRequest {
+			t.Fatalf("%s %s %x のレスポンスが不正です %s", c.code, c.path, c.payload, response.Code)
+		}
+		if files := readServerTestFiles(t, root); files != "[0=123 1=60 2=5 3=300]" {
+			t.Fatalf("%s %s %x で書き込まれました %s", c.code, c.path, c.payload, files)
+		}
+	}
+}
+
+// TestLwm2mExecuteNotResource : リソース以外へのExecute(Content-Formatの無いインスタンスへのPOST)に4.05を返すことを確認する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.4.5 Execute参照
+func TestLwm2mExecuteNotResource(t *testing.T) {
+	_, peer := newLwm2mTestClient(t, lwm2mTestWriteFiles)
+	if response := peer.request(lwm2mTestRequest(CoapCodePost, "/1/0", []CoapOption{}, []byte{})); response.Code != CoapCodeNotAllowed {
+		t.Fatalf("インスタンスへのExecuteのレスポンスが不正です %s", response.Code)
+	}
+}
+
+// lwm2mTestObjectFiles : オブジェクトのRead / Observeのテストに使用するファイル
+// Access Controlはインスタンスを2つ、Deviceはインスタンスを1つ持つ
+var lwm2mTestObjectFiles = map[string]string{
+	"2/0/0": "3",
+	"2/0/1": "0",
+	"2/0/3": "1",
+	"2/1/0": "4",
+	"2/1/1": "0",
+	"2/1/3": "1",
+	"3/0/0": "inventoryd",
+	"3/0/9": "80",
+}
+
+// objectInstanceTestIDs : オブジェクトのTLVのペイロードを解析し、Object InstanceのTLVのIDを返す
+// Object Instance以外のTLVが含まれる場合はエラーとする
+func objectInstanceTestIDs(t *testing.T, payload []byte) string {
+	t.Helper()
+	tlvs, err := parseLwm2mTLVs(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []uint16{}
+	for _, tlv := range tlvs {
+		if tlv.TypeOfID != lwm2mTLVTypeObjectInstance {
+			t.Fatalf("Object Instance以外のTLVが含まれています %d", tlv.TypeOfID)
+		}
+		if err := tlv.UnmarshalContents(); err != nil || len(tlv.Contents) == 0 {
+			t.Fatalf("インスタンス%dのリソースのTLVが不正です", tlv.ID)
+		}
+		ids = append(ids, tlv.ID)
+	}
+	return fmt.Sprint(ids)
+}
+
+// TestLwm2mReadObject : オブジェクトに対するReadは全インスタンスをObject InstanceのTLVで返し、
+// 存在しないオブジェクト、定義の無いオブジェクトは4.04とすることを確認する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.4.1 Read参照
+func TestLwm2mReadObject(t *testing.T) {
+	files := map[string]string{"9999/0/0": "1"}
+	for path, content := range lwm2mTestObjectFiles {
+		files[path] = content
+	}
+	_, peer := newLwm2mTestClient(t, files)
+	for path, expected := range map[string]string{"/2": "[0 1]", "/3": "[0]"} {
+		response := peer.request(lwm2mTestRequest(CoapCodeGet, path, []CoapOption{}, []byte{}))
+		if response.Code != CoapCodeContent {
+			t.Fatalf("%s のReadに失敗しました %s", path, response.Code)
+		}
+		if ids := objectInstanceTestIDs(t, response.Payload); ids != expected {
+			t.Fatalf("%s のObject Instanceが不正です %s", path, ids)
+		}
+	}
+	for _, path := range []string{"/5", "/9999"} {
+		if response := peer.request(lwm2mTestRequest(CoapCodeGet, path, []CoapOption{}, []byte{})); response.Code != CoapCodeNotFound {
+			t.Fatalf("%s のReadの結果が不正です %s", path, response.Code)
+		}
+		if response := peer.request(observeTestRequest(path, []byte{0x0a}, coapObserveRegister)); response.Code != CoapCodeNotFound {
+			t.Fatalf("%s のObserveの結果が不正です %s", path, response.Code)
+		}
+	}
+	peer.expectSilence(50 * time.Millisecond)
+}
+
+// TestLwm2mObserveObjectInstances : オブジェクトのObserveは、インスタンスが追加された場合と削除された場合に
+// 全インスタンスをNotifyすることを確認する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.5.2 Notify参照
+func TestLwm2mObserveObjectInstances(t *testing.T) {
+	lwm2m, peer := newLwm2mTestClient(t, lwm2mTestObjectFiles)
+	root := lwm2m.handler.(*HandlerFile).ResourceDirPath
+	lwm2m.registered = true
+	response := peer.request(observeTestRequest("/2", []byte{0x0a}, coapObserveRegister))
+	if response.Code != CoapCodeContent {
+		t.Fatalf("/2 のObserveに失敗しました %s", response.Code)
+	}
+	waitObservedTokens(t, lwm2m, 1)
+
+	writeLwm2mTestFiles(t, root, map[string]string{"2/2/0": "5", "2/2/1": "0", "2/2/3": "1"})
+	lwm2m.Observe()
+	if ids := objectInstanceTestIDs(t, peer.read().Payload); ids != "[0 1 2]" {
+		t.Fatalf("インスタンスを追加した際のNotifyが不正です %s", ids)
+	}
+
+	if err := os.RemoveAll(filepath.Join(root, "2", "0")); err != nil {
+		t.Fatal(err)
+	}
+	lwm2m.Observe()
+	if ids := objectInstanceTestIDs(t, peer.read().Payload); ids != "[1 2]" {
+		t.Fatalf("インスタンスを削除した際のNotifyが不正です %s", ids)
+	}
+
+	// インスタンスも値も変わらなければNotifyしない
+	lwm2m.Observe()
+	peer.expectSilence(50 * time.Millisecond)
+}
+
+// TestLwm2mNotifyBlock2 : ブロックサイズを超える値のNotifyは最初のブロックとSize2 Optionを送信し、
+// 残りのブロックはObserve無しのBlock2のGETでNotify時の値から返すことを確認する
+// RFC7959 3.4 Block-Wise Transfer and Observe参照
+func TestLwm2mNotifyBlock2(t *testing.T) {
+	lwm2m, peer := newLwm2mTestClient(t, map[string]string{"3/0/0": strings.Repeat("a", 1000)})
+	lwm2m.registered = true
+	if response := peer.request(observeTestRequest("/3/0/0", []byte{0x0a}, coapObserveRegister)); response.Code != CoapCodeContent {
+		t.Fatalf("/3/0/0 のObserveに失敗しました %s", response.Code)
+	}
+
+	writeLwm2mTestFiles(t, lwm2m.handler.(*HandlerFile).ResourceDirPath, map[string]string{"3/0/0": strings.Repeat("b", 1000)})
+	lwm2m.Observe()
+	notify := peer.read()
+	if !bytes.Equal(notify.Token, []byte{0x0a}) || notify.findOption(coapOptionNoObserve) == nil {
+		t.Fatal("Notifyが送信されません")
+	}
+	block2 := notify.findOption(coapOptionNoBlock2)
+	size2 := notify.findOption(coapOptionNoSize2)
+	if block2 == nil || size2 == nil {
+		t.Fatal("NotifyにBlock2 / Size2 Optionが付加されていません")
+	}
+	block := parseCoapBlock(block2.Value)
+	if block.Num != 0 || !block.More || len(notify.Payload) != block.Size() {
+		t.Fatalf("Notifyのブロックが不正です %+v len=%d", block, len(notify.Payload))
+	}
+
+	// 残りのブロックの要求までに値が変わっても、Notify時の値を返す
+	writeLwm2mTestFiles(t, lwm2m.handler.(*HandlerFile).ResourceDirPath, map[string]string{"3/0/0": strings.Repeat("c", 1000)})
+	payload := append([]byte{}, notify.Payload...)
+	for block.More {
+		block.Num++
+		response := peer.request(lwm2mTestRequest(CoapCodeGet, "/3/0/0",
+			[]CoapOption{CoapOption{coapOptionNoBlock2, coapBlock{Num: block.Num, SZX: block.SZX}.Bytes()}}, []byte{}))
+		if response.Code != CoapCodeContent || response.findOption(coapOptionNoBlock2) == nil {
+			t.Fatalf("%d番目のブロックの取得に失敗しました %s", block.Num, response.Code)
+		}
+		block = parseCoapBlock(response.findOption(coapOptionNoBlock2).Value)
+		payload = append(payload, response.Payload...)
+	}
+	if len(payload) != (int)(parseCoapUintOptionValue(size2.Value)) {
+		t.Fatalf("連結したPayloadの長さがSize2と一致しません %d", len(payload))
+	}
+	tlvs, err := parseLwm2mTLVs(payload)
+	if err != nil || len(tlvs) != 1 || string(tlvs[0].Value) != strings.Repeat("b", 1000) {
+		t.Fatalf("連結したNotifyの値が不正です err=%v", err)
+	}
+}
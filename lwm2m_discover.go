@@ -0,0 +1,119 @@
+package inventoryd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// DiscoverRequest : Discoverを処理する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.4.2 Discover参照
+// レスポンスはリンクフォーマット(RFC6690)で、オブジェクト / インスタンス / リソースのいずれかを対象とする
+// Write-Attributesで設定された属性はそれぞれのリンクに付加する
+func (lwm2m *Lwm2m) DiscoverRequest(message *CoapMessage) error {
+	idCount, objectID, instanceID, resourceID, err := message.extractResourceID()
+	if err != nil {
+		return err
+	}
+
+	var links []string
+	switch idCount {
+	case 1:
+		log.Printf("DISCOVER /%d", objectID)
+		links = lwm2m.discoverObject(objectID)
+	case 2:
+		log.Printf("DISCOVER /%d/%d", objectID, instanceID)
+		links = lwm2m.discoverInstance(objectID, instanceID)
+	case 3:
+		log.Printf("DISCOVER /%d/%d/%d", objectID, instanceID, resourceID)
+		links = lwm2m.discoverResource(objectID, instanceID, resourceID)
+	default:
+		lwm2m.Connection.SendResponse(message, CoapCodeBadRequest, []CoapOption{}, []byte{})
+		return nil
+	}
+
+	if links == nil {
+		lwm2m.Connection.SendResponse(message, CoapCodeNotFound, []CoapOption{}, []byte{})
+		return nil
+	}
+
+	options := []CoapOption{CoapOption{coapOptionNoContentFormat, []byte{coapContentFormatLinkFormat}}}
+	lwm2m.Connection.SendResponse(message, CoapCodeContent, options, []byte(strings.Join(links, ",")))
+	return nil
+}
+
+// discoverResourceLink : リソースのリンクを生成する
+// 複数インスタンスのリソースにはResource Instanceの数(dim)を、リソースに設定されている属性とともに付加する
+// 例 : </3/0/6>;dim=2
+func (lwm2m *Lwm2m) discoverResourceLink(objectID, instanceID, resourceID uint16) string {
+	path := fmt.Sprintf("/%d/%d/%d", objectID, instanceID, resourceID)
+	link := "<" + path + ">"
+	resource := &Lwm2mResource{
+		ID:         resourceID,
+		objectID:   objectID,
+		instanceID: instanceID,
+		Definition: lwm2m.definitions.findResourceDefinitionByIDs(objectID, resourceID)}
+	if resource.Definition != nil && resource.Definition.Multi {
+		resourceInstanceIDs, code := listResourceInstanceIDs(lwm2m.handler, resource)
+		if code == CoapCodeContent {
+			link += fmt.Sprintf(";dim=%d", len(resourceInstanceIDs))
+		}
+	}
+	return link + lwm2m.findAttributes(path).linkParams()
+}
+
+// discoverObject : オブジェクトに対するDiscoverのリンクを生成する
+// 例 : </3>;pmin=10,</3/0>,</3/0/1>,</3/0/2>
+// オブジェクトが存在しない場合はnilを返す
+func (lwm2m *Lwm2m) discoverObject(objectID uint16) []string {
+	object := lwm2m.findObject(objectID)
+	if object == nil {
+		return nil
+	}
+	instanceIDs, code := lwm2m.handler.ListInstanceIDs(object)
+	if code != CoapCodeContent {
+		return nil
+	}
+
+	links := []string{fmt.Sprintf("</%d>", objectID) + lwm2m.findAttributes(fmt.Sprintf("/%d", objectID)).linkParams()}
+	for _, instanceID := range instanceIDs {
+		links = append(links, lwm2m.discoverInstance(objectID, instanceID)...)
+	}
+	return links
+}
+
+// discoverInstance : インスタンスに対するDiscoverのリンクを生成する
+// 例 : </3/0>,</3/0/1>,</3/0/2>
+// インスタンスが存在しない場合はnilを返す
+func (lwm2m *Lwm2m) discoverInstance(objectID, instanceID uint16) []string {
+	instance := lwm2m.findInstance(objectID, instanceID)
+	if instance == nil {
+		return nil
+	}
+	resourceIDs, code := lwm2m.handler.ListResourceIDs(instance)
+	if code != CoapCodeContent {
+		return nil
+	}
+
+	links := []string{fmt.Sprintf("</%d/%d>", objectID, instanceID) +
+		lwm2m.findAttributes(fmt.Sprintf("/%d/%d", objectID, instanceID)).linkParams()}
+	for _, resourceID := range resourceIDs {
+		// 定義の無いリソースは公開しない
+		if lwm2m.definitions.findResourceDefinitionByIDs(objectID, resourceID) == nil {
+			continue
+		}
+		links = append(links, lwm2m.discoverResourceLink(objectID, instanceID, resourceID))
+	}
+	return links
+}
+
+// discoverResource : リソースに対するDiscoverのリンクを生成する
+// 例 : </3/0/1>
+// リソースが存在しない場合はnilを返す
+func (lwm2m *Lwm2m) discoverResource(objectID, instanceID, resourceID uint16) []string {
+	resource := lwm2m.findResource(objectID, instanceID, resourceID)
+	if resource == nil || resource.Definition == nil {
+		return nil
+	}
+	return []string{lwm2m.discoverResourceLink(objectID, instanceID, resourceID)}
+}
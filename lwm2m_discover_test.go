@@ -0,0 +1,105 @@
+package inventoryd
+
+import (
+	"testing"
+)
+
+// lwm2mTestDiscoverFiles : Discoverのテストに使用するDeviceオブジェクトのファイル
+// /3/0/6は複数インスタンスのリソース、/3/0/999は定義の無いリソース
+var lwm2mTestDiscoverFiles = map[string]string{
+	"3/0/0":   "inventoryd",
+	"3/0/6/0": "1",
+	"3/0/6/1": "5",
+	"3/0/9":   "80",
+	"3/0/999": "undefined",
+}
+
+// discoverTestRequest : Acceptがリンクフォーマットのリクエストを生成する
+func discoverTestRequest(path string) *CoapMessage {
+	return lwm2mTestRequest(CoapCodeGet, path,
+		[]CoapOption{CoapOption{coapOptionNoAccept, []byte{coapContentFormatLinkFormat}}}, []byte{})
+}
+
+// TestLwm2mDiscover : オブジェクト / インスタンス / リソースに対するDiscoverのリンクフォーマットを確認する
+// 複数インスタンスのリソースにはdimを付加し、定義の無いリソースは公開しない
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.4.2 Discover参照
+func TestLwm2mDiscover(t *testing.T) {
+	_, peer := newLwm2mTestClient(t, lwm2mTestDiscoverFiles)
+	cases := []struct {
+		path  string
+		links string
+	}{
+		{"/3", "</3>,</3/0>,</3/0/0>,</3/0/6>;dim=2,</3/0/9>"},
+		{"/3/0", "</3/0>,</3/0/0>,</3/0/6>;dim=2,</3/0/9>"},
+		{"/3/0/6", "</3/0/6>;dim=2"},
+		{"/3/0/9", "</3/0/9>"},
+	}
+	for _, c := range cases {
+		response := peer.request(discoverTestRequest(c.path))
+		if response.Code != CoapCodeContent {
+			t.Fatalf("%s のレスポンスコードが不正です %s", c.path, response.Code)
+		}
+		if contentFormat, ok := response.ContentFormat(); !ok || contentFormat != coapContentFormatLinkFormat {
+			t.Fatalf("%s のContent-Formatが不正です %d", c.path, contentFormat)
+		}
+		if string(response.Payload) != c.links {
+			t.Fatalf("%s のリンクが不正です %s", c.path, response.Payload)
+		}
+	}
+}
+
+// TestLwm2mDiscoverAttributes : Write-Attributesで設定した属性が、設定したパスのリンクにのみ付加されることを確認する
+func TestLwm2mDiscoverAttributes(t *testing.T) {
+	_, peer := newLwm2mTestClient(t, lwm2mTestDiscoverFiles)
+	attributes := []struct {
+		path    string
+		queries []string
+	}{
+		{"/3", []string{"pmin=10"}},
+		{"/3/0", []string{"pmax=60"}},
+		{"/3/0/9", []string{"gt=50", "lt=20.5", "st=1"}},
+	}
+	for _, a := range attributes {
+		options := []CoapOption{}
+		for _, query := range a.queries {
+			options = append(options, CoapOption{coapOptionNoURIQuery, []byte(query)})
+		}
+		if response := peer.request(lwm2mTestRequest(CoapCodePut, a.path, options, []byte{})); response.Code != CoapCodeChanged {
+			t.Fatalf("%s のWrite-Attributesに失敗しました %s", a.path, response.Code)
+		}
+	}
+
+	cases := []struct {
+		path  string
+		links string
+	}{
+		{"/3", "</3>;pmin=10,</3/0>;pmax=60,</3/0/0>,</3/0/6>;dim=2,</3/0/9>;gt=50;lt=20.5;st=1"},
+		{"/3/0/9", "</3/0/9>;gt=50;lt=20.5;st=1"},
+		{"/3/0/0", "</3/0/0>"},
+	}
+	for _, c := range cases {
+		if response := peer.request(discoverTestRequest(c.path)); string(response.Payload) != c.links {
+			t.Fatalf("%s のリンクが不正です %s", c.path, response.Payload)
+		}
+	}
+}
+
+// TestLwm2mDiscoverNotFound : 存在しない対象には4.04を、パスの無いDiscoverには4.00を返すことを確認する
+func TestLwm2mDiscoverNotFound(t *testing.T) {
+	_, peer := newLwm2mTestClient(t, lwm2mTestDiscoverFiles)
+	cases := []struct {
+		path string
+		code CoapCode
+	}{
+		{"/5", CoapCodeNotFound},
+		{"/3/1", CoapCodeNotFound},
+		{"/3/0/1", CoapCodeNotFound},
+		{"/3/0/999", CoapCodeNotFound},
+		{"", CoapCodeBadRequest},
+	}
+	for _, c := range cases {
+		if response := peer.request(discoverTestRequest(c.path)); response.Code != c.code || len(response.Payload) != 0 {
+			t.Fatalf("%s のレスポンスが不正です %s", c.path, response.Code)
+		}
+	}
+}
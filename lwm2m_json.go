@@ -0,0 +1,289 @@
+package inventoryd
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Lwm2mJSON : データ形式JSON
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 6.4.4 JSON参照
+// 各エントリのパスはbn(Base Name)とn(Name)を連結したもの
+type Lwm2mJSON struct {
+	BaseName string            `json:"bn,omitempty"`
+	Entries  []*Lwm2mJSONEntry `json:"e"`
+}
+
+// Lwm2mJSONEntry : データ形式JSONのリソース(またはResource Instance)のエントリ
+// 値はリソースの型に応じていずれかひとつを使用する
+// v : Integer / Float / Time、sv : String / Opaque(base64)、bv : Boolean、ov : Objlnk
+type Lwm2mJSONEntry struct {
+	Name            string       `json:"n,omitempty"`
+	Value           *json.Number `json:"v,omitempty"`
+	StringValue     *string      `json:"sv,omitempty"`
+	BooleanValue    *bool        `json:"bv,omitempty"`
+	ObjectLinkValue *string      `json:"ov,omitempty"`
+}
+
+// marshalLwm2mJSON : TLVデータをJSON形式に変換する
+// basePathはTLVの親のパス(例 : /3/0/)で、各エントリの名前はbasePathからの相対パスとする
+// 値の型はオブジェクト定義のリソースの型に従う
+func marshalLwm2mJSON(basePath string, objectDefinition *Lwm2mObjectDefinition, tlvs []*Lwm2mTLV) ([]byte, error) {
+	doc := &Lwm2mJSON{
+		BaseName: basePath,
+		Entries:  make([]*Lwm2mJSONEntry, 0)}
+	walkLwm2mTLVs("", objectDefinition, tlvs, func(name string, buf []byte, resourceType byte) {
+		doc.Entries = append(doc.Entries, newLwm2mJSONEntry(name, buf, resourceType))
+	})
+	return json.Marshal(doc)
+}
+
+// walkLwm2mTLVs : TLVデータのリソース(またはResource Instance)ごとに、パスと値と型を渡してfnを呼び出す
+// パスはprefixにIDを連結したもので、Object Instance / Multiple ResourceのTLVは格納されているTLVを展開する
+func walkLwm2mTLVs(prefix string, objectDefinition *Lwm2mObjectDefinition, tlvs []*Lwm2mTLV, fn func(name string, buf []byte, resourceType byte)) {
+	for _, tlv := range tlvs {
+		name := prefix + strconv.Itoa((int)(tlv.ID))
+		switch tlv.TypeOfID {
+		case lwm2mTLVTypeObjectInstance:
+			walkLwm2mTLVs(name+"/", objectDefinition, tlv.Contents, fn)
+		case lwm2mTLVTypeMultipleResouce:
+			resourceType := lwm2mJSONResourceType(objectDefinition, tlv.ID)
+			for _, content := range tlv.Contents {
+				fn(name+"/"+strconv.Itoa((int)(content.ID)), content.Value, resourceType)
+			}
+		default:
+			fn(name, tlv.Value, lwm2mJSONResourceType(objectDefinition, tlv.ID))
+		}
+	}
+}
+
+// lwm2mValueEntry : パスと値を持つエントリ(JSON / SenMLのレコード)
+type lwm2mValueEntry interface {
+	valueString(resourceType byte) (string, error)
+}
+
+// lwm2mPathEntry : エントリと、その絶対パス(Base Nameを連結したもの)
+type lwm2mPathEntry struct {
+	path  string
+	entry lwm2mValueEntry
+}
+
+// parseLwm2mJSON : JSON形式のペイロードをTLVデータに変換する
+// TLVの組み立てはbuildLwm2mTLVs参照
+func parseLwm2mJSON(raw []byte, objectDefinition *Lwm2mObjectDefinition, baseIDs []uint16, withInstance bool) ([]*Lwm2mTLV, error) {
+	doc := &Lwm2mJSON{}
+	if err := json.Unmarshal(raw, doc); err != nil {
+		return nil, err
+	}
+	entries := make([]lwm2mPathEntry, 0)
+	for _, entry := range doc.Entries {
+		entries = append(entries, lwm2mPathEntry{path: doc.BaseName + entry.Name, entry: entry})
+	}
+	return buildLwm2mTLVs(entries, objectDefinition, baseIDs, withInstance)
+}
+
+// buildLwm2mTLVs : エントリのパスと値からTLVデータを組み立てる
+// 各エントリのパスはbaseIDsで始まっていなければならず、残りのパスからTLVを組み立てる
+// withInstanceがtrueの場合、残りのパスはインスタンス/リソース[/Resource Instance]とし、Object InstanceのTLVを返す
+// falseの場合、残りのパスはリソース[/Resource Instance]とし、リソース / Multiple ResourceのTLVを返す
+func buildLwm2mTLVs(entries []lwm2mPathEntry, objectDefinition *Lwm2mObjectDefinition, baseIDs []uint16, withInstance bool) ([]*Lwm2mTLV, error) {
+	tlvs := make([]*Lwm2mTLV, 0)
+	for _, pathEntry := range entries {
+		entry := pathEntry.entry
+		ids, err := parseLwm2mPath(pathEntry.path)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) <= len(baseIDs) || !lwm2mPathOverlaps(ids, baseIDs) {
+			return nil, errors.New("対象外のパスが含まれています")
+		}
+		ids = ids[len(baseIDs):]
+
+		target := &tlvs
+		if withInstance {
+			instance := findLwm2mTLV(tlvs, lwm2mTLVTypeObjectInstance, ids[0])
+			if instance == nil {
+				instance = &Lwm2mTLV{TypeOfID: lwm2mTLVTypeObjectInstance, ID: ids[0]}
+				tlvs = append(tlvs, instance)
+			}
+			target = &instance.Contents
+			ids = ids[1:]
+		}
+		if len(ids) == 0 || len(ids) > 2 {
+			return nil, errors.New("リソースのパスではありません")
+		}
+
+		resourceType := lwm2mJSONResourceType(objectDefinition, ids[0])
+		value, err := entry.valueString(resourceType)
+		if err != nil {
+			return nil, err
+		}
+		resourceTLVValue := convertStringToTLVValue(value, resourceType)
+		if len(ids) == 1 {
+			*target = append(*target, &Lwm2mTLV{
+				TypeOfID: lwm2mTLVTypeResouce,
+				ID:       ids[0],
+				Length:   (uint32)(len(resourceTLVValue)),
+				Value:    resourceTLVValue})
+			continue
+		}
+		multipleResource := findLwm2mTLV(*target, lwm2mTLVTypeMultipleResouce, ids[0])
+		if multipleResource == nil {
+			multipleResource = &Lwm2mTLV{TypeOfID: lwm2mTLVTypeMultipleResouce, ID: ids[0]}
+			*target = append(*target, multipleResource)
+		}
+		multipleResource.Contents = append(multipleResource.Contents, &Lwm2mTLV{
+			TypeOfID: lwm2mTLVTypeResouceInstance,
+			ID:       ids[1],
+			Length:   (uint32)(len(resourceTLVValue)),
+			Value:    resourceTLVValue})
+	}
+
+	for _, tlv := range tlvs {
+		if tlv.TypeOfID != lwm2mTLVTypeResouce {
+			tlv.MarshalContents()
+		}
+	}
+	return tlvs, nil
+}
+
+// parseLwm2mPath : パスの文字列(例 : /3/0/6/1)をIDに変換する
+func parseLwm2mPath(path string) ([]uint16, error) {
+	ids := make([]uint16, 0)
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		id, err := strconv.ParseUint(segment, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, (uint16)(id))
+	}
+	return ids, nil
+}
+
+// findLwm2mTLV : 指定した種類とIDのTLVを検索する
+func findLwm2mTLV(tlvs []*Lwm2mTLV, typeOfID byte, id uint16) *Lwm2mTLV {
+	for _, tlv := range tlvs {
+		if tlv.TypeOfID == typeOfID && tlv.ID == id {
+			return tlv
+		}
+	}
+	return nil
+}
+
+// lwm2mJSONResourceType : リソースの型を取得する
+// 定義の無いリソースは文字列として扱う(書き込み時は定義が無いためエラーとなる)
+func lwm2mJSONResourceType(objectDefinition *Lwm2mObjectDefinition, resourceID uint16) byte {
+	if objectDefinition == nil {
+		return lwm2mResourceTypeString
+	}
+	resourceDefinition := objectDefinition.findResourceByID(resourceID)
+	if resourceDefinition == nil {
+		return lwm2mResourceTypeString
+	}
+	return resourceDefinition.Type
+}
+
+// newLwm2mJSONEntry : TLVの値からエントリを生成する
+func newLwm2mJSONEntry(name string, buf []byte, resourceType byte) *Lwm2mJSONEntry {
+	entry := &Lwm2mJSONEntry{Name: name}
+	switch resourceType {
+	case lwm2mResourceTypeInteger, lwm2mResourceTypeTime, lwm2mResourceTypeFloat:
+		value := lwm2mTLVValueNumber(buf, resourceType)
+		entry.Value = &value
+	case lwm2mResourceTypeBoolean:
+		value := len(buf) > 0 && buf[0] == 1
+		entry.BooleanValue = &value
+	case lwm2mResourceTypeOpaque:
+		value := base64.StdEncoding.EncodeToString(buf)
+		entry.StringValue = &value
+	case lwm2mResourceTypeObjlnk:
+		// 読み出した値から生成したTLVのため、長さは型に合っている
+		value, _ := convertTLVValueToString(buf, resourceType)
+		entry.ObjectLinkValue = &value
+	default: // string/Noneはそのまま
+		value := string(buf)
+		entry.StringValue = &value
+	}
+	return entry
+}
+
+// lwm2mTLVValueNumber : 数値型(Integer / Float / Time)のTLVの値を数値の文字列に変換する
+// 値の長さはOMA-TS-LightweightM2M-V1_0_2-20180209-A 6.4.3 TLV参照
+func lwm2mTLVValueNumber(buf []byte, resourceType byte) json.Number {
+	if resourceType == lwm2mResourceTypeFloat {
+		switch len(buf) {
+		case 4:
+			return json.Number(strconv.FormatFloat((float64)(math.Float32frombits(binary.BigEndian.Uint32(buf))), 'g', -1, 32))
+		case 8:
+			return json.Number(strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(buf)), 'g', -1, 64))
+		}
+		return json.Number("0")
+	}
+	var num int64
+	switch len(buf) {
+	case 1:
+		num = (int64)((int8)(buf[0]))
+	case 2:
+		num = (int64)((int16)(binary.BigEndian.Uint16(buf)))
+	case 4:
+		num = (int64)((int32)(binary.BigEndian.Uint32(buf)))
+	case 8:
+		num = (int64)(binary.BigEndian.Uint64(buf))
+	}
+	return json.Number(strconv.FormatInt(num, 10))
+}
+
+// lwm2mNumberValueString : 数値の値をリソースの型に応じた文字列に変換する
+// Integer / Timeで小数の値が指定された場合は整数に切り捨てる
+func lwm2mNumberValueString(value *json.Number, resourceType byte) (string, error) {
+	if value == nil {
+		return "", errors.New("数値の値がありません")
+	}
+	if resourceType == lwm2mResourceTypeFloat {
+		if _, err := value.Float64(); err != nil {
+			return "", err
+		}
+		return value.String(), nil
+	}
+	if _, err := strconv.ParseInt(value.String(), 10, 64); err == nil {
+		return value.String(), nil
+	}
+	num, err := value.Float64()
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt((int64)(num), 10), nil
+}
+
+// lwm2mObjectLinkValueString : オブジェクトリンクの値("オブジェクトID:インスタンスID")を確認する
+func lwm2mObjectLinkValueString(value *string) (string, error) {
+	if value == nil || strings.Count(*value, ":") != 1 {
+		return "", errors.New("オブジェクトリンクの値がありません")
+	}
+	return *value, nil
+}
+
+// valueString : エントリの値をリソースの型に応じた文字列に変換する
+// 文字列の形式はハンドラに渡す値と同じ(Opaqueはbase64、Objlnkは"オブジェクトID:インスタンスID")
+func (entry *Lwm2mJSONEntry) valueString(resourceType byte) (string, error) {
+	switch resourceType {
+	case lwm2mResourceTypeInteger, lwm2mResourceTypeTime, lwm2mResourceTypeFloat:
+		return lwm2mNumberValueString(entry.Value, resourceType)
+	case lwm2mResourceTypeBoolean:
+		if entry.BooleanValue == nil {
+			return "", errors.New("真偽値の値がありません")
+		}
+		return strconv.FormatBool(*entry.BooleanValue), nil
+	case lwm2mResourceTypeObjlnk:
+		return lwm2mObjectLinkValueString(entry.ObjectLinkValue)
+	default: // string/Opaque/None
+		if entry.StringValue == nil {
+			return "", errors.New("文字列の値がありません")
+		}
+		return *entry.StringValue, nil
+	}
+}
@@ -0,0 +1,178 @@
+package inventoryd
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// lwm2mTestDeviceJSON : senMLTestDeviceJSONと同じ内容(/3/0のRead)のJSON
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 6.4.4 JSON参照
+const lwm2mTestDeviceJSON = `{"bn":"/3/0/","e":[{"n":"0","sv":"Open Mobile Alliance"},` +
+	`{"n":"1","sv":"Lightweight M2M Client"},{"n":"2","sv":"345000123"},{"n":"3","sv":"1.0"},` +
+	`{"n":"6/0","v":1},{"n":"6/1","v":5},{"n":"7/0","v":3800},{"n":"7/1","v":5000},` +
+	`{"n":"8/0","v":125},{"n":"8/1","v":900},{"n":"9","v":100},{"n":"10","v":15},` +
+	`{"n":"11/0","v":0},{"n":"13","v":1367491215},{"n":"14","sv":"+02:00"},{"n":"16","sv":"U"}]}`
+
+// lwm2mTestJSONValueDefinition : 各型のリソースを持つオブジェクトの定義
+var lwm2mTestJSONValueDefinition = &Lwm2mObjectDefinition{
+	ID: 1000,
+	Resources: []*Lwm2mResourceDefinition{
+		&Lwm2mResourceDefinition{ID: 0, Type: lwm2mResourceTypeInteger},
+		&Lwm2mResourceDefinition{ID: 1, Type: lwm2mResourceTypeFloat},
+		&Lwm2mResourceDefinition{ID: 2, Type: lwm2mResourceTypeBoolean},
+		&Lwm2mResourceDefinition{ID: 3, Type: lwm2mResourceTypeOpaque},
+		&Lwm2mResourceDefinition{ID: 4, Type: lwm2mResourceTypeObjlnk},
+		&Lwm2mResourceDefinition{ID: 5, Type: lwm2mResourceTypeTime},
+		&Lwm2mResourceDefinition{ID: 6, Type: lwm2mResourceTypeString}}}
+
+// assertLwm2mJSONEqual : 2つのJSONが同じエントリを表すかを確認する
+func assertLwm2mJSONEqual(t *testing.T, expected, actual []byte) {
+	t.Helper()
+	expectedDoc := &Lwm2mJSON{}
+	actualDoc := &Lwm2mJSON{}
+	if err := json.Unmarshal(expected, expectedDoc); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(actual, actualDoc); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expectedDoc, actualDoc) {
+		t.Fatalf("JSONのエントリが一致しません\nexpected=%s\nactual=%s", expected, actual)
+	}
+}
+
+// lwm2mJSONTestRoundTrip : JSONをTLVのバイト列に変換し、解析したTLVからJSONに戻す
+// Object Instance / Multiple Resourceは書き込み時と同様に格納されているTLVを取り出す
+func lwm2mJSONTestRoundTrip(t *testing.T, payload string, objectDefinition *Lwm2mObjectDefinition, basePath string, baseIDs []uint16, withInstance bool) []byte {
+	t.Helper()
+	tlvs, err := parseLwm2mJSON([]byte(payload), objectDefinition, baseIDs, withInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlvs, err = parseLwm2mTLVs(marshalLwm2mTLVs(tlvs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshal func(tlvs []*Lwm2mTLV)
+	unmarshal = func(tlvs []*Lwm2mTLV) {
+		for _, tlv := range tlvs {
+			if tlv.TypeOfID == lwm2mTLVTypeObjectInstance || tlv.TypeOfID == lwm2mTLVTypeMultipleResouce {
+				if err := tlv.UnmarshalContents(); err != nil {
+					t.Fatal(err)
+				}
+				unmarshal(tlv.Contents)
+			}
+		}
+	}
+	unmarshal(tlvs)
+	raw, err := marshalLwm2mJSON(basePath, objectDefinition, tlvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// TestLwm2mJSONDeviceExample : /3/0のJSONをTLVに変換し、元のJSONに戻せること、
+// SenML JSONから変換したTLVと一致することを確認する
+func TestLwm2mJSONDeviceExample(t *testing.T) {
+	actual := lwm2mJSONTestRoundTrip(t, lwm2mTestDeviceJSON, senMLTestDeviceDefinition, "/3/0/", []uint16{3, 0}, false)
+	assertLwm2mJSONEqual(t, []byte(lwm2mTestDeviceJSON), actual)
+
+	tlvs, err := parseLwm2mJSON([]byte(lwm2mTestDeviceJSON), senMLTestDeviceDefinition, []uint16{3, 0}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	senMLTLVs, err := parseLwm2mSenMLJSON([]byte(senMLTestDeviceJSON), senMLTestDeviceDefinition, []uint16{3, 0}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(marshalLwm2mTLVs(tlvs), marshalLwm2mTLVs(senMLTLVs)) {
+		t.Fatal("JSONとSenML JSONから変換したTLVが一致しません")
+	}
+}
+
+// TestLwm2mJSONObject : オブジェクトに対するJSONでは、パスのインスタンスIDごとにObject InstanceのTLVを生成することを確認する
+func TestLwm2mJSONObject(t *testing.T) {
+	payload := `{"bn":"/3/","e":[{"n":"0/0","sv":"inventoryd"},{"n":"0/6/0","v":1},{"n":"0/6/1","v":5},{"n":"1/9","v":80}]}`
+	tlvs, err := parseLwm2mJSON([]byte(payload), senMLTestDeviceDefinition, []uint16{3}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tlvs) != 2 || tlvs[0].TypeOfID != lwm2mTLVTypeObjectInstance || tlvs[0].ID != 0 || tlvs[1].ID != 1 {
+		t.Fatalf("Object InstanceのTLVが不正です %d件", len(tlvs))
+	}
+	if len(tlvs[0].Contents) != 2 || tlvs[0].Contents[1].TypeOfID != lwm2mTLVTypeMultipleResouce {
+		t.Fatal("インスタンス0のリソースのTLVが不正です")
+	}
+
+	actual := lwm2mJSONTestRoundTrip(t, payload, senMLTestDeviceDefinition, "/3/", []uint16{3}, true)
+	assertLwm2mJSONEqual(t, []byte(payload), actual)
+}
+
+// TestLwm2mJSONValues : 各型の値がTLVの値に変換され、JSONに戻せることを確認する
+// Integer / Floatはv、Booleanはbv、Opaqueはbase64のsv、Objlnkはovとする
+func TestLwm2mJSONValues(t *testing.T) {
+	payload := `{"bn":"/1000/0/","e":[{"n":"0","v":-129},{"n":"1","v":-1.5},{"n":"2","bv":true},` +
+		`{"n":"3","sv":"AQID"},{"n":"4","ov":"3:1"},{"n":"5","v":1367491215},{"n":"6","sv":"text"}]}`
+	tlvs, err := parseLwm2mJSON([]byte(payload), lwm2mTestJSONValueDefinition, []uint16{1000, 0}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{
+		{0xff, 0x7f},
+		{0xbf, 0xf8, 0, 0, 0, 0, 0, 0},
+		{0x01},
+		{0x01, 0x02, 0x03},
+		{0x00, 0x03, 0x00, 0x01},
+		{0x51, 0x82, 0x42, 0x8f},
+		[]byte("text"),
+	}
+	if len(tlvs) != len(expected) {
+		t.Fatalf("TLVの数が不正です %d", len(tlvs))
+	}
+	for i, tlv := range tlvs {
+		if !bytes.Equal(tlv.Value, expected[i]) {
+			t.Fatalf("/1000/0/%d のTLVの値が不正です %x", tlv.ID, tlv.Value)
+		}
+	}
+
+	actual := lwm2mJSONTestRoundTrip(t, payload, lwm2mTestJSONValueDefinition, "/1000/0/", []uint16{1000, 0}, false)
+	assertLwm2mJSONEqual(t, []byte(payload), actual)
+
+	// Integerの小数は切り捨てる
+	tlvs, err = parseLwm2mJSON([]byte(`{"bn":"/1000/0/","e":[{"n":"0","v":2.9}]}`), lwm2mTestJSONValueDefinition, []uint16{1000, 0}, false)
+	if err != nil || !bytes.Equal(tlvs[0].Value, []byte{0x02}) {
+		t.Fatalf("小数のIntegerの変換結果が不正です err=%v", err)
+	}
+}
+
+// TestLwm2mJSONInvalid : 対象外のパス、リソースでないパス、型に合わない値のJSONがエラーになることを確認する
+func TestLwm2mJSONInvalid(t *testing.T) {
+	cases := []struct {
+		name         string
+		payload      string
+		baseIDs      []uint16
+		withInstance bool
+	}{
+		{"JSONでない", `{"bn":"/1000/0/","e":[`, []uint16{1000, 0}, false},
+		{"別のオブジェクトのパス", `{"bn":"/1001/0/","e":[{"n":"0","v":1}]}`, []uint16{1000, 0}, false},
+		{"別のインスタンスのパス", `{"bn":"/1000/","e":[{"n":"1/0","v":1}]}`, []uint16{1000, 0}, false},
+		{"対象と同じパス", `{"bn":"/1000/0","e":[{"v":1}]}`, []uint16{1000, 0}, false},
+		{"Resource Instanceより下のパス", `{"bn":"/1000/0/","e":[{"n":"0/0/0","v":1}]}`, []uint16{1000, 0}, false},
+		{"インスタンスのみのパス", `{"bn":"/1000/","e":[{"n":"0","v":1}]}`, []uint16{1000}, true},
+		{"整数でないパス", `{"bn":"/1000/0/","e":[{"n":"a","v":1}]}`, []uint16{1000, 0}, false},
+		{"範囲外のID", `{"bn":"/1000/0/","e":[{"n":"65536","v":1}]}`, []uint16{1000, 0}, false},
+		{"Integerにsv", `{"bn":"/1000/0/","e":[{"n":"0","sv":"1"}]}`, []uint16{1000, 0}, false},
+		{"Integerに数値でないv", `{"bn":"/1000/0/","e":[{"n":"0","v":"a"}]}`, []uint16{1000, 0}, false},
+		{"Booleanにv", `{"bn":"/1000/0/","e":[{"n":"2","v":1}]}`, []uint16{1000, 0}, false},
+		{"Objlnkに:の無いov", `{"bn":"/1000/0/","e":[{"n":"4","ov":"3"}]}`, []uint16{1000, 0}, false},
+		{"Stringに値が無い", `{"bn":"/1000/0/","e":[{"n":"6"}]}`, []uint16{1000, 0}, false},
+	}
+	for _, c := range cases {
+		if _, err := parseLwm2mJSON([]byte(c.payload), lwm2mTestJSONValueDefinition, c.baseIDs, c.withInstance); err == nil {
+			t.Fatalf("%s のJSONがエラーになりません", c.name)
+		}
+	}
+}
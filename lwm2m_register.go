@@ -1,6 +1,7 @@
 package inventoryd
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"errors"
@@ -19,53 +20,139 @@ const (
 
 // Register : Register Operation
 // OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.3.1 Register参照
+// 接続(DTLSのハンドシェイクを含む)もRegisterの期限内に行う
 func (lwm2m *Lwm2m) Register() error {
 	log.Print("Registering...")
-	err := lwm2m.connect()
+	ctx, cancel := context.WithTimeout(context.Background(), lwm2mRegisterTimeout)
+	defer cancel()
+	err := lwm2m.connect(ctx)
 	if err != nil {
 		return err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), lwm2mRegisterTimeout)
-	defer cancel()
-	registerCh := make(chan int)
-	lwm2m.Connection.SendRequest(CoapCodePost, lwm2m.buildRegisterOptions(lwm2m.getLifetime()), lwm2m.registerLinkFormat(), registerCh)
-	select {
-	case <-ctx.Done():
-		// タイムアウトした場合
+	// 以前のRegisterでのObserveは破棄する
+	lwm2m.clearObservations()
+
+	result, err := lwm2m.Connection.SendRequest(ctx, CoapCodePost, lwm2m.buildRegisterOptions(lwm2m.getLifetime()), lwm2m.registerLinkFormat())
+	if err != nil {
+		lwm2m.close()
+		if err == context.DeadlineExceeded {
+			return errors.New("Register処理がタイムアウトしました")
+		}
+		return err
+	}
+	if result.Code != CoapCodeCreated {
 		lwm2m.close()
-		return errors.New("Register処理がタイムアウトしました")
-	case <-registerCh:
-		// Registerが正常に終了した場合
-		lwm2m.registered = true
-		log.Printf("Register finished. Location is %s\n", lwm2m.Location)
+		return errors.New("Register処理が失敗しました(" + result.Code.String() + ")")
 	}
+	// Registerが正常に終了した場合
+	lwm2m.RegisterDone(result.Message)
+	lwm2m.registered = true
+	log.Printf("Register finished. Location is %s\n", lwm2m.Location)
 	return nil
 }
 
-// connect : DTLS + Coap接続する
-func (lwm2m *Lwm2m) connect() error {
-	identity := lwm2m.getIdentity()
-	psk := lwm2m.getSecretKey()
-	uri := lwm2m.getDMServerURI()
-	host := strings.Replace(uri, "coaps://", "", 1)
-
+// connect : サーバーURIのスキームに応じたTransportで接続する(lwm2m_transport.go参照)
+// DTLSの場合はセッションの再開を試みる
+// ctxが終了した場合は接続を中止する
+func (lwm2m *Lwm2m) connect(ctx context.Context) error {
 	// 接続が残っていたら閉じる
 	if lwm2m.Connection != nil {
 		lwm2m.close()
 	}
 
-	coap := &Coap{}
-	conn, err := DtlsDial(host, identity, psk)
+	transport, host, err := lwm2m.serverTransport()
 	if err != nil {
+		return err
+	}
+
+	// Identity(PSKモード)または公開鍵(RPKモード) / 証明書(Certificateモード)が同じ場合のみセッションを再開する
+	params := lwm2m.transportParams()
+	if _, isDtls := transport.(*dtlsTransport); isDtls {
+		params.DtlsSession = lwm2m.resumableSession(host, params.Identity)
+	}
+	conn, err := transport.Dial(ctx, host, params)
+	if err != nil && params.DtlsSession != nil {
+		// セッションの再開に失敗した場合はフルハンドシェイクでやり直す
 		log.Print(err)
-		return errors.New("DTLSの接続に失敗しました")
+		lwm2m.dtlsSession = nil
+		params.DtlsSession = nil
+		conn, err = transport.Dial(ctx, host, params)
+	}
+	if err != nil {
+		log.Print(err)
+		return errors.New("サーバーへの接続に失敗しました")
+	}
+	if dtls, ok := conn.(*Dtls); ok {
+		if dtls.Handshake.Resumed {
+			log.Print("DTLS session resumed")
+		}
+		lwm2m.storeSession(host, params.Identity, dtls.Session())
+	}
+
+	coap := &Coap{}
+	if transport.Stream() {
+		coap.InitializeTCP(conn, lwm2m.ReceiveMessage)
+	} else {
+		coap.Initialize(conn, lwm2m.ReceiveMessage)
 	}
-	coap.Initialize(conn, lwm2m.ReceiveMessage)
 	lwm2m.Connection = coap
 	return nil
 }
 
+// serverTransport : Device ManagementサーバーのTransportと接続先を取得する
+// Security ModeとURIのスキームが一致しない場合(NoSecでcoaps://、NoSec以外でcoap://)は、
+// スキームを書き換えずにエラーとする
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A E.1 LwM2M Object: LwM2M Security参照
+func (lwm2m *Lwm2m) serverTransport() (Transport, string, error) {
+	uri := lwm2m.getDMServerURI()
+	if err := checkSecureURI(lwm2m.getSecurityMode(), uri); err != nil {
+		return nil, "", err
+	}
+	return findTransport(uri)
+}
+
+// transportParams : 接続に使用するSecurity Objectのパラメータを取得する
+func (lwm2m *Lwm2m) transportParams() *TransportParams {
+	return &TransportParams{
+		SecurityMode:    lwm2m.getSecurityMode(),
+		Identity:        lwm2m.getIdentity(),
+		SecretKey:       lwm2m.getSecretKey(),
+		ServerPublicKey: lwm2m.getServerPublicKey()}
+}
+
+// resumableSession : 再開可能なDTLSセッションを取得する
+// メモリ上に無ければ保存先から読み出す
+// 接続先やIdentityが異なる場合は再開しない
+func (lwm2m *Lwm2m) resumableSession(host string, identity []byte) *DtlsSession {
+	if lwm2m.dtlsSession == nil && lwm2m.dtlsSessionPath != "" {
+		session, err := LoadDtlsSession(lwm2m.dtlsSessionPath)
+		if err == nil {
+			lwm2m.dtlsSession = session
+		}
+	}
+	session := lwm2m.dtlsSession
+	if session == nil || session.Host != host || !bytes.Equal(session.Identity, identity) {
+		return nil
+	}
+	return session
+}
+
+// storeSession : 次回接続時の再開用にDTLSセッションを保持する
+func (lwm2m *Lwm2m) storeSession(host string, identity []byte, session *DtlsSession) {
+	if session == nil {
+		return
+	}
+	session.Host = host
+	session.Identity = identity
+	lwm2m.dtlsSession = session
+	if lwm2m.dtlsSessionPath != "" {
+		if err := session.Save(lwm2m.dtlsSessionPath); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
 // close : 接続を閉じる
 func (lwm2m *Lwm2m) close() {
 	lwm2m.Connection.Close()
@@ -76,6 +163,37 @@ func (lwm2m *Lwm2m) close() {
 // Update : Update Operation
 // OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.3.2 Update参照
 func (lwm2m *Lwm2m) Update() error {
+	return lwm2m.update([]byte{})
+}
+
+// UpdateObjects : オブジェクトとインスタンスのリストを含むUpdate Operation
+// インスタンスが追加 / 削除された場合に送信する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.3.2 Update参照
+func (lwm2m *Lwm2m) UpdateObjects() error {
+	return lwm2m.update(lwm2m.registerLinkFormat())
+}
+
+// requestObjectsUpdate : オブジェクトとインスタンスのリストを含むUpdateを要求する
+// Updateのレスポンスは受信処理で処理されるため、受信処理からはUpdate動作(StartUpdate)に要求する
+func (lwm2m *Lwm2m) requestObjectsUpdate() {
+	select {
+	case lwm2m.objectsChangedCh <- true:
+	default:
+		// 既に要求されている
+	}
+}
+
+// update : Updateを送信する
+// payloadが空でない場合は、オブジェクトとインスタンスのリストとして送信する
+func (lwm2m *Lwm2m) update(payload []byte) error {
+	// 受信エラー(サーバーからの切断等)で受信が止まっていたら接続し直す
+	if lwm2m.Connection != nil {
+		if err := lwm2m.Connection.Err(); err != nil {
+			log.Print(err)
+			lwm2m.close()
+		}
+	}
+
 	// Register状態でなければRegisterする
 	if lwm2m.Connection == nil {
 		err := lwm2m.Register()
@@ -88,17 +206,26 @@ func (lwm2m *Lwm2m) Update() error {
 	log.Print("Updating...")
 	ctx, cancel := context.WithTimeout(context.Background(), lwm2mUpdateTimeout)
 	defer cancel()
-	updateCh := make(chan int)
-	lwm2m.Connection.SendRequest(CoapCodePost, lwm2m.buildUpdateOptions(), []byte{}, updateCh)
-	select {
-	case <-ctx.Done():
-		// タイムアウトした場合
+	options := lwm2m.buildUpdateOptions()
+	if len(payload) > 0 {
+		options = append(options, CoapOption{coapOptionNoContentFormat, []byte{coapContentFormatLinkFormat}})
+	}
+	result, err := lwm2m.Connection.SendRequest(ctx, CoapCodePost, options, payload)
+	if err != nil {
 		lwm2m.close()
-		return errors.New("Update処理がタイムアウトしました")
-	case <-updateCh:
-		// Updateが正常に終了した場合
-		log.Print("Update finished")
+		if err == context.DeadlineExceeded {
+			return errors.New("Update処理がタイムアウトしました")
+		}
+		return err
 	}
+	if result.Code != CoapCodeChanged {
+		// 登録が無効になっている場合があるため、次回Registerし直す
+		lwm2m.close()
+		return errors.New("Update処理が失敗しました(" + result.Code.String() + ")")
+	}
+	// Updateが正常に終了した場合
+	lwm2m.UpdateDone(result.Message)
+	log.Print("Update finished")
 
 	return nil
 }
@@ -130,12 +257,21 @@ func (lwm2m *Lwm2m) buildRegisterOptions(lifetime int) []CoapOption {
 		CoapOption{coapOptionNoContentFormat, []byte{coapContentFormatLinkFormat}},
 		CoapOption{coapOptionNoURIQuery, []byte("lwm2m=" + lwm2mVersion)},
 		CoapOption{coapOptionNoURIQuery, []byte("ep=" + lwm2m.endpointClientName)},
-		CoapOption{coapOptionNoURIQuery, []byte("b=" + lwm2mBindingMode)},
+		CoapOption{coapOptionNoURIQuery, []byte("b=" + lwm2m.bindingMode())},
 		CoapOption{coapOptionNoURIQuery, []byte("lt=" + strconv.Itoa(lifetime))}}
 
 	return ret
 }
 
+// bindingMode : サーバーURIのTransportに応じたBinding Modeを取得する
+func (lwm2m *Lwm2m) bindingMode() string {
+	transport, _, err := lwm2m.serverTransport()
+	if err != nil {
+		return lwm2mBindingMode
+	}
+	return transport.BindingMode()
+}
+
 // registerLinkFormat : Registerに使用するリンクフォーマットを生成する
 // LinkFormatの説明 : RFC6690
 // rt(Resource Type) : oma.lwm2m
@@ -214,6 +350,39 @@ func (lwm2m *Lwm2m) getSecretKey() []byte {
 	return secretKey
 }
 
+// getServerPublicKey : サーバーの公開鍵(RPKモード)または証明書(Certificateモード)を取得する
+func (lwm2m *Lwm2m) getServerPublicKey() []byte {
+	resource := lwm2m.findResource(lwm2mObjectIDSecurity, lwm2m.dmSecurityInstanceID, lwm2mResourceIDSecurityServerKey)
+
+	serverKeyStr, code := lwm2m.handler.ReadResource(resource)
+	if code != CoapCodeContent {
+		return []byte{}
+	}
+
+	serverKey, err := base64.StdEncoding.DecodeString(serverKeyStr)
+	if err != nil {
+		return []byte{}
+	}
+
+	return serverKey
+}
+
+// getSecurityMode : Security Modeを取得する
+// 取得できない場合はPSKモードとする
+func (lwm2m *Lwm2m) getSecurityMode() int {
+	resource := lwm2m.findResource(lwm2mObjectIDSecurity, lwm2m.dmSecurityInstanceID, lwm2mResourceIDSecurityMode)
+	modeStr, code := lwm2m.handler.ReadResource(resource)
+	if code != CoapCodeContent {
+		return Lwm2mSecurityModePSK
+	}
+
+	mode, err := strconv.Atoi(strings.TrimSpace(modeStr))
+	if err != nil {
+		return Lwm2mSecurityModePSK
+	}
+	return mode
+}
+
 // getLifetime : lifetimeを取得する
 // 取得できない場合は60とする
 func (lwm2m *Lwm2m) getLifetime() int {
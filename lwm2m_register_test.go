@@ -0,0 +1,57 @@
+package inventoryd
+
+import (
+	"bytes"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// TestLwm2mResumableSession : 保存したDTLSセッションを読み出し、接続先とIdentityが一致する場合のみ再開に使うことを確認する
+func TestLwm2mResumableSession(t *testing.T) {
+	sessionPath := filepath.Join(t.TempDir(), "session.json")
+	session := &DtlsSession{ID: bytes.Repeat([]byte{0x5A}, 32), MasterSecret: bytes.Repeat([]byte{0x01}, 48)}
+	(&Lwm2m{dtlsSessionPath: sessionPath}).storeSession("localhost:5684", []byte("identity"), session)
+
+	// 再起動後はファイルから読み出す
+	lwm2m := &Lwm2m{dtlsSessionPath: sessionPath}
+	resumable := lwm2m.resumableSession("localhost:5684", []byte("identity"))
+	if resumable == nil || !bytes.Equal(resumable.ID, session.ID) || !bytes.Equal(resumable.MasterSecret, session.MasterSecret) {
+		t.Fatal("保存したセッションを再開に使用できません")
+	}
+	if lwm2m.resumableSession("example.com:5684", []byte("identity")) != nil {
+		t.Fatal("接続先が異なるセッションを再開に使用しています")
+	}
+	if lwm2m.resumableSession("localhost:5684", []byte("other")) != nil {
+		t.Fatal("Identityが異なるセッションを再開に使用しています")
+	}
+}
+
+// TestLwm2mServerTransportSecurityMode : NoSecモードでURIがcoaps://の場合、
+// セキュリティ無しに書き換えて接続せずエラーとすることを確認する
+func TestLwm2mServerTransportSecurityMode(t *testing.T) {
+	cases := []struct {
+		uri   string
+		valid bool
+	}{
+		{"coap://localhost:5683", true},
+		{"coap+tcp://localhost:5683", true},
+		{"coaps://localhost:5684", false},
+		{"coaps+tcp://localhost:5684", false},
+	}
+	for _, c := range cases {
+		lwm2m, _ := newLwm2mTestClient(t, map[string]string{
+			"0/0/0": c.uri,
+			"0/0/2": strconv.Itoa(Lwm2mSecurityModeNoSec)})
+		transport, _, err := lwm2m.serverTransport()
+		if (err == nil) != c.valid {
+			t.Fatalf("uri=%s の結果が不正です err=%v", c.uri, err)
+		}
+		if !c.valid && transport != nil {
+			t.Fatalf("uri=%s でTransportが選択されました", c.uri)
+		}
+		if err := lwm2m.CheckSecurityParams(); (err == nil) != c.valid {
+			t.Fatalf("uri=%s のCheckSecurityParamsの結果が不正です err=%v", c.uri, err)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // 規定のオブジェクトID
@@ -19,13 +20,24 @@ const (
 const (
 	lwm2mResourceIDSecurityURI           uint16 = 0
 	lwm2mResourceIDSecurityBootstrap     uint16 = 1
+	lwm2mResourceIDSecurityMode          uint16 = 2
 	lwm2mResourceIDSecurityIdentity      uint16 = 3
+	lwm2mResourceIDSecurityServerKey     uint16 = 4
 	lwm2mResourceIDSecuritySecretKey     uint16 = 5
 	lwm2mResourceIDSecurityShortServerID uint16 = 10
 	lwm2mResourceIDServerShortServerID   uint16 = 0
 	lwm2mResourceIDServerLifetime        uint16 = 1
 )
 
+// Security Mode
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A E.1 LwM2M Object: LwM2M Security参照
+const (
+	Lwm2mSecurityModePSK         int = 0
+	Lwm2mSecurityModeRPK         int = 1
+	Lwm2mSecurityModeCertificate int = 2
+	Lwm2mSecurityModeNoSec       int = 3
+)
+
 // Lwm2mObject : Lwm2mのオブジェクト
 type Lwm2mObject struct {
 	ID         uint16
@@ -46,26 +58,56 @@ type Lwm2mResource struct {
 	Definition *Lwm2mResourceDefinition
 }
 
+// Lwm2mObservedObject : Lwm2mのObserve中のオブジェクト
+// ObserveはNotifyの際にObserve時と同じTokenを使用する必要がある
+// instancesはインスタンスの追加 / 削除の検出と、各リソースの値の変化の確認に使用する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 8.2.6 Information Reporting Interface参照
+type Lwm2mObservedObject struct {
+	request       *CoapMessage // Observeを登録したリクエスト(NotifyはこのTokenで送信する)
+	messageID     uint16
+	observeCount  uint32
+	object        *Lwm2mObject
+	instances     []*Lwm2mObservedInstance
+	attributes    lwm2mAttributes
+	lastNotified  time.Time
+	contentFormat uint16 // NotifyのContent-Format(Observe時のAcceptに従う)
+	confirmable   bool   // NotifyをCONで送信するか
+	pending       bool   // CONのNotifyのACKを待っているか
+}
+
 // Lwm2mObservedInstance : Lwm2mのObserve中のインスタンス
 // ObserveはNotifyの際にObserve時と同じTokenを使用する必要がある
 // OMA-TS-LightweightM2M-V1_0_2-20180209-A 8.2.6 Information Reporting Interface参照
+// attributesはNotifyの条件(pmin / pmax)で、オブジェクト / インスタンスの属性を継承したもの
 type Lwm2mObservedInstance struct {
-	token        []byte
-	messageID    uint16
-	observeCount uint32
-	instance     *Lwm2mInstance
-	resources    []*Lwm2mObservedResource
+	request       *CoapMessage // Observeを登録したリクエスト(NotifyはこのTokenで送信する)
+	messageID     uint16
+	observeCount  uint32
+	instance      *Lwm2mInstance
+	resources     []*Lwm2mObservedResource
+	attributes    lwm2mAttributes
+	lastNotified  time.Time
+	contentFormat uint16 // NotifyのContent-Format(Observe時のAcceptに従う)
+	confirmable   bool   // NotifyをCONで送信するか
+	pending       bool   // CONのNotifyのACKを待っているか
 }
 
 // Lwm2mObservedResource : Lwm2mのObserve中のリソース
 // ObserveはNotifyの際にObserve時と同じTokenを使用する必要がある
 // OMA-TS-LightweightM2M-V1_0_2-20180209-A 8.2.6 Information Reporting Interface参照
+// attributesはNotifyの条件で、オブジェクト / インスタンス / リソースの属性を継承したもの
+// lastValueは前回Notifyした値
 type Lwm2mObservedResource struct {
-	token        []byte
-	messageID    uint16
-	observeCount uint32
-	resource     *Lwm2mResource
-	lastValue    string
+	request       *CoapMessage // Observeを登録したリクエスト(NotifyはこのTokenで送信する)
+	messageID     uint16
+	observeCount  uint32
+	resource      *Lwm2mResource
+	lastValue     string
+	attributes    lwm2mAttributes
+	lastNotified  time.Time
+	contentFormat uint16 // NotifyのContent-Format(Observe時のAcceptに従う)
+	confirmable   bool   // NotifyをCONで送信するか
+	pending       bool   // CONのNotifyのACKを待っているか
 }
 
 // Lwm2mDataTypes
@@ -0,0 +1,317 @@
+package inventoryd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// SenML CBORのラベル
+// RFC8428 6. CBOR Representation (application/senml+cbor)、
+// OMA-TS-LightweightM2M_Core-V1_1-20180612-C 7.4.5 SenML CBOR参照(vloはLwM2Mの拡張で文字列のラベル)
+const (
+	senMLCborLabelBaseName        int64 = -2
+	senMLCborLabelBaseTime        int64 = -3
+	senMLCborLabelName            int64 = 0
+	senMLCborLabelValue           int64 = 2
+	senMLCborLabelStringValue     int64 = 3
+	senMLCborLabelBooleanValue    int64 = 4
+	senMLCborLabelTime            int64 = 6
+	senMLCborLabelDataValue       int64 = 8
+	senMLCborLabelObjectLinkValue       = "vlo"
+)
+
+// Lwm2mSenMLRecord : データ形式SenMLのレコード
+// RFC8428 4. SenML Structure and Semantics、
+// OMA-TS-LightweightM2M_Core-V1_1-20180612-C 7.4.4 SenML JSON参照
+// 各レコードのパスはbn(Base Name)とn(Name)を連結したもので、bnは以降のレコードにも適用される
+// 値はリソースの型に応じていずれかひとつを使用する
+// v : Integer / Float / Time、vs : String、vb : Boolean、vd : Opaque(base64url)、vlo : Objlnk
+// bt / tは時刻で、書き込み時は使用しない
+type Lwm2mSenMLRecord struct {
+	BaseName        string       `json:"bn,omitempty"`
+	BaseTime        *json.Number `json:"bt,omitempty"`
+	Name            string       `json:"n,omitempty"`
+	Time            *json.Number `json:"t,omitempty"`
+	Value           *json.Number `json:"v,omitempty"`
+	StringValue     *string      `json:"vs,omitempty"`
+	BooleanValue    *bool        `json:"vb,omitempty"`
+	DataValue       *string      `json:"vd,omitempty"`
+	ObjectLinkValue *string      `json:"vlo,omitempty"`
+}
+
+// newLwm2mSenMLRecords : TLVデータをSenMLのレコードに変換する
+// basePathはTLVの親のパス(例 : /3/0/)で、最初のレコードのbnとし、各レコードの名前はbasePathからの相対パスとする
+func newLwm2mSenMLRecords(basePath string, objectDefinition *Lwm2mObjectDefinition, tlvs []*Lwm2mTLV) []*Lwm2mSenMLRecord {
+	records := make([]*Lwm2mSenMLRecord, 0)
+	walkLwm2mTLVs("", objectDefinition, tlvs, func(name string, buf []byte, resourceType byte) {
+		records = append(records, newLwm2mSenMLRecord(name, buf, resourceType))
+	})
+	if len(records) > 0 {
+		records[0].BaseName = basePath
+	}
+	return records
+}
+
+// newLwm2mSenMLRecord : TLVの値からレコードを生成する
+func newLwm2mSenMLRecord(name string, buf []byte, resourceType byte) *Lwm2mSenMLRecord {
+	record := &Lwm2mSenMLRecord{Name: name}
+	switch resourceType {
+	case lwm2mResourceTypeInteger, lwm2mResourceTypeTime, lwm2mResourceTypeFloat:
+		value := lwm2mTLVValueNumber(buf, resourceType)
+		record.Value = &value
+	case lwm2mResourceTypeBoolean:
+		value := len(buf) > 0 && buf[0] == 1
+		record.BooleanValue = &value
+	case lwm2mResourceTypeOpaque:
+		value := base64.RawURLEncoding.EncodeToString(buf)
+		record.DataValue = &value
+	case lwm2mResourceTypeObjlnk:
+		// 読み出した値から生成したTLVのため、長さは型に合っている
+		value, _ := convertTLVValueToString(buf, resourceType)
+		record.ObjectLinkValue = &value
+	default: // string/Noneはそのまま
+		value := string(buf)
+		record.StringValue = &value
+	}
+	return record
+}
+
+// valueString : レコードの値をリソースの型に応じた文字列に変換する
+// 文字列の形式はハンドラに渡す値と同じ(Opaqueはbase64、Objlnkは"オブジェクトID:インスタンスID")
+func (record *Lwm2mSenMLRecord) valueString(resourceType byte) (string, error) {
+	switch resourceType {
+	case lwm2mResourceTypeInteger, lwm2mResourceTypeTime, lwm2mResourceTypeFloat:
+		return lwm2mNumberValueString(record.Value, resourceType)
+	case lwm2mResourceTypeBoolean:
+		if record.BooleanValue == nil {
+			return "", errors.New("真偽値の値がありません")
+		}
+		return strconv.FormatBool(*record.BooleanValue), nil
+	case lwm2mResourceTypeOpaque:
+		if record.DataValue == nil {
+			return "", errors.New("バイナリの値がありません")
+		}
+		buf, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*record.DataValue, "="))
+		if err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(buf), nil
+	case lwm2mResourceTypeObjlnk:
+		return lwm2mObjectLinkValueString(record.ObjectLinkValue)
+	default: // string/None
+		if record.StringValue == nil {
+			return "", errors.New("文字列の値がありません")
+		}
+		return *record.StringValue, nil
+	}
+}
+
+// parseLwm2mSenMLRecords : SenMLのレコードをTLVデータに変換する
+// bnは以降のレコードに適用する
+// TLVの組み立てはbuildLwm2mTLVs参照
+func parseLwm2mSenMLRecords(records []*Lwm2mSenMLRecord, objectDefinition *Lwm2mObjectDefinition, baseIDs []uint16, withInstance bool) ([]*Lwm2mTLV, error) {
+	entries := make([]lwm2mPathEntry, 0)
+	baseName := ""
+	for _, record := range records {
+		if record.BaseName != "" {
+			baseName = record.BaseName
+		}
+		entries = append(entries, lwm2mPathEntry{path: baseName + record.Name, entry: record})
+	}
+	return buildLwm2mTLVs(entries, objectDefinition, baseIDs, withInstance)
+}
+
+// marshalLwm2mSenMLJSON : TLVデータをSenML JSON形式に変換する
+// OMA-TS-LightweightM2M_Core-V1_1-20180612-C 7.4.4 SenML JSON参照
+func marshalLwm2mSenMLJSON(basePath string, objectDefinition *Lwm2mObjectDefinition, tlvs []*Lwm2mTLV) ([]byte, error) {
+	return json.Marshal(newLwm2mSenMLRecords(basePath, objectDefinition, tlvs))
+}
+
+// parseLwm2mSenMLJSON : SenML JSON形式のペイロードをTLVデータに変換する
+func parseLwm2mSenMLJSON(raw []byte, objectDefinition *Lwm2mObjectDefinition, baseIDs []uint16, withInstance bool) ([]*Lwm2mTLV, error) {
+	records := make([]*Lwm2mSenMLRecord, 0)
+	if err := json.Unmarshal(raw, &records); err != nil {
+		return nil, err
+	}
+	return parseLwm2mSenMLRecords(records, objectDefinition, baseIDs, withInstance)
+}
+
+// marshalLwm2mSenMLCBOR : TLVデータをSenML CBOR形式に変換する
+// OMA-TS-LightweightM2M_Core-V1_1-20180612-C 7.4.5 SenML CBOR参照
+func marshalLwm2mSenMLCBOR(basePath string, objectDefinition *Lwm2mObjectDefinition, tlvs []*Lwm2mTLV) ([]byte, error) {
+	records := newLwm2mSenMLRecords(basePath, objectDefinition, tlvs)
+	buf := appendCborHead([]byte{}, cborMajorTypeArray, (uint64)(len(records)))
+	for _, record := range records {
+		var err error
+		buf, err = record.appendCbor(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// parseLwm2mSenMLCBOR : SenML CBOR形式のペイロードをTLVデータに変換する
+func parseLwm2mSenMLCBOR(raw []byte, objectDefinition *Lwm2mObjectDefinition, baseIDs []uint16, withInstance bool) ([]*Lwm2mTLV, error) {
+	doc, err := decodeCbor(raw)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := doc.([]interface{})
+	if !ok {
+		return nil, errors.New("SenMLのレコードの配列ではありません")
+	}
+	records := make([]*Lwm2mSenMLRecord, 0)
+	for _, item := range items {
+		fields, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New("SenMLのレコードではありません")
+		}
+		record, err := newLwm2mSenMLRecordFromCbor(fields)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return parseLwm2mSenMLRecords(records, objectDefinition, baseIDs, withInstance)
+}
+
+// appendCbor : レコードをCBORのマップとして追加する
+func (record *Lwm2mSenMLRecord) appendCbor(buf []byte) ([]byte, error) {
+	count := 0
+	for _, exist := range []bool{record.BaseName != "", record.BaseTime != nil, record.Name != "", record.Time != nil,
+		record.Value != nil, record.StringValue != nil, record.BooleanValue != nil,
+		record.DataValue != nil, record.ObjectLinkValue != nil} {
+		if exist {
+			count++
+		}
+	}
+	buf = appendCborHead(buf, cborMajorTypeMap, (uint64)(count))
+
+	var err error
+	if record.BaseName != "" {
+		buf = appendCborInt(buf, senMLCborLabelBaseName)
+		buf = appendCborText(buf, record.BaseName)
+	}
+	if record.BaseTime != nil {
+		buf = appendCborInt(buf, senMLCborLabelBaseTime)
+		if buf, err = appendSenMLCborNumber(buf, *record.BaseTime); err != nil {
+			return nil, err
+		}
+	}
+	if record.Name != "" {
+		buf = appendCborInt(buf, senMLCborLabelName)
+		buf = appendCborText(buf, record.Name)
+	}
+	if record.Time != nil {
+		buf = appendCborInt(buf, senMLCborLabelTime)
+		if buf, err = appendSenMLCborNumber(buf, *record.Time); err != nil {
+			return nil, err
+		}
+	}
+	if record.Value != nil {
+		buf = appendCborInt(buf, senMLCborLabelValue)
+		if buf, err = appendSenMLCborNumber(buf, *record.Value); err != nil {
+			return nil, err
+		}
+	}
+	if record.StringValue != nil {
+		buf = appendCborInt(buf, senMLCborLabelStringValue)
+		buf = appendCborText(buf, *record.StringValue)
+	}
+	if record.BooleanValue != nil {
+		buf = appendCborInt(buf, senMLCborLabelBooleanValue)
+		buf = appendCborBool(buf, *record.BooleanValue)
+	}
+	if record.DataValue != nil {
+		// CBORではvdはbase64urlではなくバイト列とする
+		data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*record.DataValue, "="))
+		if err != nil {
+			return nil, err
+		}
+		buf = appendCborInt(buf, senMLCborLabelDataValue)
+		buf = appendCborBytes(buf, data)
+	}
+	if record.ObjectLinkValue != nil {
+		buf = appendCborText(buf, senMLCborLabelObjectLinkValue)
+		buf = appendCborText(buf, *record.ObjectLinkValue)
+	}
+	return buf, nil
+}
+
+// appendSenMLCborNumber : 数値を整数または浮動小数点数として追加する
+func appendSenMLCborNumber(buf []byte, value json.Number) ([]byte, error) {
+	if num, err := strconv.ParseInt(value.String(), 10, 64); err == nil {
+		return appendCborInt(buf, num), nil
+	}
+	num, err := value.Float64()
+	if err != nil {
+		return nil, err
+	}
+	return appendCborFloat(buf, num), nil
+}
+
+// newLwm2mSenMLRecordFromCbor : CBORのマップからレコードを生成する
+// 対応していないラベルは無視する
+func newLwm2mSenMLRecordFromCbor(fields map[interface{}]interface{}) (*Lwm2mSenMLRecord, error) {
+	record := &Lwm2mSenMLRecord{}
+	for key, value := range fields {
+		var ok bool
+		switch key {
+		case senMLCborLabelBaseName:
+			record.BaseName, ok = value.(string)
+		case senMLCborLabelBaseTime:
+			record.BaseTime, ok = senMLCborNumber(value)
+		case senMLCborLabelName:
+			record.Name, ok = value.(string)
+		case senMLCborLabelTime:
+			record.Time, ok = senMLCborNumber(value)
+		case senMLCborLabelValue:
+			record.Value, ok = senMLCborNumber(value)
+		case senMLCborLabelStringValue:
+			var stringValue string
+			stringValue, ok = value.(string)
+			record.StringValue = &stringValue
+		case senMLCborLabelBooleanValue:
+			var booleanValue bool
+			booleanValue, ok = value.(bool)
+			record.BooleanValue = &booleanValue
+		case senMLCborLabelDataValue:
+			var data []byte
+			data, ok = value.([]byte)
+			dataValue := base64.RawURLEncoding.EncodeToString(data)
+			record.DataValue = &dataValue
+		case senMLCborLabelObjectLinkValue:
+			var objectLinkValue string
+			objectLinkValue, ok = value.(string)
+			record.ObjectLinkValue = &objectLinkValue
+		default:
+			ok = true
+		}
+		if !ok {
+			return nil, errors.New("SenMLのレコードの値の型が不正です")
+		}
+	}
+	return record, nil
+}
+
+// senMLCborNumber : CBORの整数または浮動小数点数を数値に変換する
+func senMLCborNumber(value interface{}) (*json.Number, bool) {
+	var num json.Number
+	switch value := value.(type) {
+	case int64:
+		num = json.Number(strconv.FormatInt(value, 10))
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, false
+		}
+		num = json.Number(strconv.FormatFloat(value, 'g', -1, 64))
+	default:
+		return nil, false
+	}
+	return &num, true
+}
@@ -0,0 +1,313 @@
+package inventoryd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// senMLTestDeviceDefinition : 仕様の例で使用するDeviceオブジェクト(/3)の定義(例に含まれるリソースのみ)
+var senMLTestDeviceDefinition = &Lwm2mObjectDefinition{
+	ID: 3,
+	Resources: []*Lwm2mResourceDefinition{
+		&Lwm2mResourceDefinition{ID: 0, Type: lwm2mResourceTypeString},
+		&Lwm2mResourceDefinition{ID: 1, Type: lwm2mResourceTypeString},
+		&Lwm2mResourceDefinition{ID: 2, Type: lwm2mResourceTypeString},
+		&Lwm2mResourceDefinition{ID: 3, Type: lwm2mResourceTypeString},
+		&Lwm2mResourceDefinition{ID: 6, Multi: true, Type: lwm2mResourceTypeInteger},
+		&Lwm2mResourceDefinition{ID: 7, Multi: true, Type: lwm2mResourceTypeInteger},
+		&Lwm2mResourceDefinition{ID: 8, Multi: true, Type: lwm2mResourceTypeInteger},
+		&Lwm2mResourceDefinition{ID: 9, Type: lwm2mResourceTypeInteger},
+		&Lwm2mResourceDefinition{ID: 10, Type: lwm2mResourceTypeInteger},
+		&Lwm2mResourceDefinition{ID: 11, Multi: true, Type: lwm2mResourceTypeInteger},
+		&Lwm2mResourceDefinition{ID: 13, Type: lwm2mResourceTypeTime},
+		&Lwm2mResourceDefinition{ID: 14, Type: lwm2mResourceTypeString},
+		&Lwm2mResourceDefinition{ID: 16, Type: lwm2mResourceTypeString}}}
+
+// senMLTestDeviceJSON : OMA-TS-LightweightM2M_Core-V1_1-20180612-C 7.4.4 SenML JSONの例(/3/0のRead)
+const senMLTestDeviceJSON = `[{"bn":"/3/0/","n":"0","vs":"Open Mobile Alliance"},` +
+	`{"n":"1","vs":"Lightweight M2M Client"},{"n":"2","vs":"345000123"},{"n":"3","vs":"1.0"},` +
+	`{"n":"6/0","v":1},{"n":"6/1","v":5},{"n":"7/0","v":3800},{"n":"7/1","v":5000},` +
+	`{"n":"8/0","v":125},{"n":"8/1","v":900},{"n":"9","v":100},{"n":"10","v":15},` +
+	`{"n":"11/0","v":0},{"n":"13","v":1367491215},{"n":"14","vs":"+02:00"},{"n":"16","vs":"U"}]`
+
+// senMLTestDeviceCBOR : OMA-TS-LightweightM2M_Core-V1_1-20180612-C 7.4.5 SenML CBORの例(7.4.4と同じ内容)
+const senMLTestDeviceCBOR = "90a321652f332f302f00613003744f70656e204d6f62696c6520416c6c69616e6365a200613103764c69676874776569" +
+	"676874204d324d20436c69656e74a20061320369333435303030313233a20061330363312e30a20063362f300201a200" +
+	"63362f310205a20063372f3002190ed8a20063372f3102191388a20063382f3002187da20063382f3102190384a20061" +
+	"39021864a200623130020fa2006431312f300200a200623133021a5182428fa20062313403662b30323a3030a2006231" +
+	"36036155"
+
+// senMLTestRFC8428JSON : RFC8428 5.1.2 Multiple Datapointsの例
+// bu / bver / uは対応していないラベルのため無視される
+const senMLTestRFC8428JSON = `[{"bn":"urn:dev:ow:10e2073a01080063:","bt":1.276020076001e+09,"bu":"A","bver":5,` +
+	`"n":"voltage","u":"V","v":120.1},{"n":"current","t":-5,"v":1.2},{"n":"current","t":-4,"v":1.3},` +
+	`{"n":"current","t":-3,"v":1.4},{"n":"current","t":-2,"v":1.5},{"n":"current","t":-1,"v":1.6},` +
+	`{"n":"current","v":1.7}]`
+
+// senMLTestRFC8428CBOR : RFC8428 6. CBOR Representationの例(5.1.2と同じ内容)
+const senMLTestRFC8428CBOR = "87a721781c75726e3a6465763a6f773a313065323037336130313038303036333a22fb41d303a15b0010622361412005" +
+	"0067766f6c7461676501615602fb405e066666666666a3006763757272656e74062402fb3ff3333333333333a3006763" +
+	"757272656e74062302fb3ff4cccccccccccda3006763757272656e74062202fb3ff6666666666666a300676375727265" +
+	"6e74062102fb3ff8000000000000a3006763757272656e74062002fb3ff999999999999aa2006763757272656e7402fb" +
+	"3ffb333333333333"
+
+// senMLTestRecordsFromCBOR : SenML CBORをレコードに変換する
+func senMLTestRecordsFromCBOR(raw []byte) ([]*Lwm2mSenMLRecord, error) {
+	doc, err := decodeCbor(raw)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := doc.([]interface{})
+	if !ok {
+		return nil, nil
+	}
+	records := make([]*Lwm2mSenMLRecord, 0)
+	for _, item := range items {
+		fields, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, nil
+		}
+		record, err := newLwm2mSenMLRecordFromCbor(fields)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// senMLTestRecordsToCBOR : レコードをSenML CBORに変換する
+func senMLTestRecordsToCBOR(records []*Lwm2mSenMLRecord) ([]byte, error) {
+	buf := appendCborHead([]byte{}, cborMajorTypeArray, (uint64)(len(records)))
+	for _, record := range records {
+		var err error
+		if buf, err = record.appendCbor(buf); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// assertSenMLJSONEqual : 2つのSenML JSONが同じレコードを表すかを確認する
+func assertSenMLJSONEqual(t *testing.T, expected, actual []byte) {
+	t.Helper()
+	expectedRecords := make([]*Lwm2mSenMLRecord, 0)
+	actualRecords := make([]*Lwm2mSenMLRecord, 0)
+	if err := json.Unmarshal(expected, &expectedRecords); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(actual, &actualRecords); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expectedRecords, actualRecords) {
+		t.Fatalf("SenMLのレコードが一致しません\nexpected=%s\nactual=%s", expected, actual)
+	}
+}
+
+// TestSenMLDeviceExample : 仕様のSenML JSON / CBORの例をTLVに変換し、元の形式に戻せることを確認する
+func TestSenMLDeviceExample(t *testing.T) {
+	cborExample, _ := hex.DecodeString(senMLTestDeviceCBOR)
+
+	// JSON -> TLV -> JSON
+	tlvs, err := parseLwm2mSenMLJSON([]byte(senMLTestDeviceJSON), senMLTestDeviceDefinition, []uint16{3, 0}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// TLVのバイト列を経由する(Multiple Resourceは書き込み時と同様にResource Instanceを取り出す)
+	tlvs, err = parseLwm2mTLVs(marshalLwm2mTLVs(tlvs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tlv := range tlvs {
+		if tlv.TypeOfID == lwm2mTLVTypeMultipleResouce {
+			if err := tlv.UnmarshalContents(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	actual, err := marshalLwm2mSenMLJSON("/3/0/", senMLTestDeviceDefinition, tlvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSenMLJSONEqual(t, []byte(senMLTestDeviceJSON), actual)
+
+	// JSONの例から変換したTLVをCBORにするとCBORの例と一致する
+	actual, err = marshalLwm2mSenMLCBOR("/3/0/", senMLTestDeviceDefinition, tlvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, cborExample) {
+		t.Fatalf("SenML CBORが一致しません\nexpected=%x\nactual=%x", cborExample, actual)
+	}
+
+	// CBOR -> TLV -> CBOR
+	cborTLVs, err := parseLwm2mSenMLCBOR(cborExample, senMLTestDeviceDefinition, []uint16{3, 0}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(marshalLwm2mTLVs(cborTLVs), marshalLwm2mTLVs(tlvs)) {
+		t.Fatal("SenML CBORとSenML JSONから変換したTLVが一致しません")
+	}
+	actual, err = marshalLwm2mSenMLCBOR("/3/0/", senMLTestDeviceDefinition, cborTLVs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, cborExample) {
+		t.Fatalf("SenML CBORが一致しません\nexpected=%x\nactual=%x", cborExample, actual)
+	}
+}
+
+// TestSenMLRFC8428Example : RFC8428のJSON / CBORの例が同じレコードとして解析され、再変換しても変わらないことを確認する
+func TestSenMLRFC8428Example(t *testing.T) {
+	jsonRecords := make([]*Lwm2mSenMLRecord, 0)
+	if err := json.Unmarshal([]byte(senMLTestRFC8428JSON), &jsonRecords); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := hex.DecodeString(senMLTestRFC8428CBOR)
+	cborRecords, err := senMLTestRecordsFromCBOR(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(jsonRecords, cborRecords) {
+		t.Fatal("SenML JSONとSenML CBORの例のレコードが一致しません")
+	}
+
+	raw, err = senMLTestRecordsToCBOR(cborRecords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTripRecords, err := senMLTestRecordsFromCBOR(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cborRecords, roundTripRecords) {
+		t.Fatal("SenML CBORに再変換したレコードが一致しません")
+	}
+	if *roundTripRecords[0].BaseTime != "1.276020076001e+09" || *roundTripRecords[1].Time != "-5" {
+		t.Fatalf("時刻が一致しません bt=%s t=%s", *roundTripRecords[0].BaseTime, *roundTripRecords[1].Time)
+	}
+}
+
+// senMLTestValueDefinition : Opaque / Objlnkのリソースを持つオブジェクトの定義
+var senMLTestValueDefinition = &Lwm2mObjectDefinition{
+	ID: 1000,
+	Resources: []*Lwm2mResourceDefinition{
+		&Lwm2mResourceDefinition{ID: 0, Type: lwm2mResourceTypeOpaque},
+		&Lwm2mResourceDefinition{ID: 1, Type: lwm2mResourceTypeObjlnk}}}
+
+// TestSenMLDataValue : vdがJSONではbase64url、CBORではバイト列として変換されることを確認する
+func TestSenMLDataValue(t *testing.T) {
+	// base64urlの-と_を含む値(標準のbase64では+と/)
+	data := []byte{0xFB, 0xFF, 0xBF}
+	for _, value := range []string{"-_-_", "-_-_="} {
+		payload := `[{"bn":"/1000/0/","n":"0","vd":"` + value + `"}]`
+		tlvs, err := parseLwm2mSenMLJSON([]byte(payload), senMLTestValueDefinition, []uint16{1000, 0}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tlvs) != 1 || !bytes.Equal(tlvs[0].Value, data) {
+			t.Fatalf("vd=%s のTLVの値が一致しません", value)
+		}
+	}
+
+	tlvs := []*Lwm2mTLV{&Lwm2mTLV{TypeOfID: lwm2mTLVTypeResouce, ID: 0, Length: (uint32)(len(data)), Value: data}}
+	raw, err := marshalLwm2mSenMLJSON("/1000/0/", senMLTestValueDefinition, tlvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSenMLJSONEqual(t, []byte(`[{"bn":"/1000/0/","n":"0","vd":"-_-_"}]`), raw)
+
+	raw, err = marshalLwm2mSenMLCBOR("/1000/0/", senMLTestValueDefinition, tlvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ラベル8(vd)に続いて3byteのバイト列
+	if !bytes.Contains(raw, []byte{0x08, 0x43, 0xFB, 0xFF, 0xBF}) {
+		t.Fatalf("vdがバイト列になっていません %x", raw)
+	}
+	parsed, err := parseLwm2mSenMLCBOR(raw, senMLTestValueDefinition, []uint16{1000, 0}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 1 || !bytes.Equal(parsed[0].Value, data) {
+		t.Fatal("SenML CBORのvdのTLVの値が一致しません")
+	}
+
+	// CBORでvdにバイト列以外を指定した場合はエラー
+	invalid, _ := hex.DecodeString("81a200613008633f2f3f")
+	if _, err := parseLwm2mSenMLCBOR(invalid, senMLTestValueDefinition, []uint16{1000, 0}, false); err == nil {
+		t.Fatal("文字列のvdがエラーになりません")
+	}
+}
+
+// TestSenMLObjectLinkValue : vloがCBORでは文字列のラベルとして変換されることを確認する
+func TestSenMLObjectLinkValue(t *testing.T) {
+	payload := `[{"bn":"/1000/0/","n":"1","vlo":"3:0"}]`
+	tlvs, err := parseLwm2mSenMLJSON([]byte(payload), senMLTestValueDefinition, []uint16{1000, 0}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tlvs) != 1 || !bytes.Equal(tlvs[0].Value, []byte{0x00, 0x03, 0x00, 0x00}) {
+		t.Fatalf("vloのTLVの値が一致しません %x", tlvs[0].Value)
+	}
+
+	raw, err := marshalLwm2mSenMLCBOR("/1000/0/", senMLTestValueDefinition, tlvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 文字列"vlo"のラベルに続いて文字列"3:0"
+	if !bytes.Contains(raw, []byte("\x63vlo\x633:0")) {
+		t.Fatalf("vloが文字列のラベルになっていません %x", raw)
+	}
+	parsed, err := parseLwm2mSenMLCBOR(raw, senMLTestValueDefinition, []uint16{1000, 0}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err = marshalLwm2mSenMLJSON("/1000/0/", senMLTestValueDefinition, parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSenMLJSONEqual(t, []byte(payload), raw)
+}
+
+// FuzzDecodeCbor : 任意のデータの解析でpanicしないこと、
+// SenMLのレコードとして解析できたものはCBORに変換し直しても同じレコードになることを確認する
+// 数値は最初の変換で正規化される(整数値の浮動小数点数は整数になる)ため、2回目以降の変換で比較する
+func FuzzDecodeCbor(f *testing.F) {
+	for _, example := range []string{senMLTestDeviceCBOR, senMLTestRFC8428CBOR} {
+		raw, _ := hex.DecodeString(example)
+		f.Add(raw)
+	}
+	f.Add([]byte{0x81, 0xA2, 0x00, 0x61, 0x30, 0x08, 0x43, 0xFB, 0xFF, 0xBF})
+	f.Add([]byte{0x81, 0xA1, 0x63, 'v', 'l', 'o', 0x63, '3', ':', '0'})
+	f.Add([]byte{0x81, 0xA1, 0x02, 0xF9, 0x3C, 0x00})
+	f.Add([]byte{0xC1, 0x9F, 0xFF})
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		records, err := senMLTestRecordsFromCBOR(raw)
+		if err != nil || records == nil {
+			return
+		}
+		encoded, err := senMLTestRecordsToCBOR(records)
+		if err != nil {
+			return
+		}
+		normalized, err := senMLTestRecordsFromCBOR(encoded)
+		if err != nil {
+			t.Fatalf("変換し直したCBORを解析できません %s", err)
+		}
+		encoded, err = senMLTestRecordsToCBOR(normalized)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := senMLTestRecordsFromCBOR(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(normalized, actual) {
+			t.Fatalf("変換し直したレコードが一致しません %x", encoded)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package inventoryd
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+)
+
+// CoAP over TCP / TLSのデフォルトポート
+// RFC8323 8.1 coap+tcp URI Scheme / 8.2 coaps+tcp URI Scheme参照
+// TCPのBinding(T)はLwm2m 1.1で規定されている
+// OMA-TS-LightweightM2M_Core-V1_1-20180710-A 6.2.1.1 Behaviour with Current Transport Binding and Mode参照
+const (
+	lwm2mDefaultCoapPort  string = "5683"
+	lwm2mDefaultCoapsPort string = "5684"
+	lwm2mBindingModeTCP   string = "T"
+	lwm2mTLSMinVersion    uint16 = tls.VersionTLS12
+)
+
+// tcpTransport : セキュリティ無しのTCP(coap+tcp://)
+type tcpTransport struct{}
+
+// Dial : TCPで接続する
+func (transport *tcpTransport) Dial(ctx context.Context, host string, params *TransportParams) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, "tcp", hostWithDefaultPort(host, lwm2mDefaultCoapPort))
+}
+
+// Stream : CoAP over TCP
+func (transport *tcpTransport) Stream() bool {
+	return true
+}
+
+// BindingMode : TCP Binding
+func (transport *tcpTransport) BindingMode() string {
+	return lwm2mBindingModeTCP
+}
+
+// tlsTransport : TLS(coaps+tcp://)
+// Security ModeがCertificateであればクライアント証明書を使用する
+type tlsTransport struct{}
+
+// Dial : TLSで接続する
+func (transport *tlsTransport) Dial(ctx context.Context, host string, params *TransportParams) (net.Conn, error) {
+	host = hostWithDefaultPort(host, lwm2mDefaultCoapsPort)
+	config, err := tlsConfig(host, params)
+	if err != nil {
+		return nil, err
+	}
+	return (&tls.Dialer{Config: config}).DialContext(ctx, "tcp", host)
+}
+
+// Stream : CoAP over TLS
+func (transport *tlsTransport) Stream() bool {
+	return true
+}
+
+// BindingMode : TCP Binding
+func (transport *tlsTransport) BindingMode() string {
+	return lwm2mBindingModeTCP
+}
+
+// tlsConfig : TLSの設定を生成する
+// Server Public Key(/0/x/4)にサーバー証明書があれば、それを信頼する証明書とする
+// 無ければシステムの証明書でサーバーを検証する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 7.1.9 X.509 Certificates参照
+func tlsConfig(host string, params *TransportParams) (*tls.Config, error) {
+	serverName, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{ServerName: serverName, MinVersion: lwm2mTLSMinVersion}
+
+	if len(params.ServerPublicKey) > 0 {
+		certificate, err := x509.ParseCertificate(params.ServerPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		config.RootCAs.AddCert(certificate)
+	}
+
+	if params.SecurityMode == Lwm2mSecurityModeCertificate {
+		privateKey, err := parseTLSPrivateKey(params.SecretKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{
+			tls.Certificate{Certificate: [][]byte{params.Identity}, PrivateKey: privateKey}}
+	}
+	return config, nil
+}
+
+// parseTLSPrivateKey : PKCS#8、SEC1、PKCS#1(DER)の順に秘密鍵の解析を試みる
+func parseTLSPrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("秘密鍵を解析できませんでした")
+}
+
+// hostWithDefaultPort : ポートが指定されていなければデフォルトのポートを付加する
+func hostWithDefaultPort(host string, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+}
@@ -0,0 +1,82 @@
+package inventoryd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lwm2mTestDefaultFiles : Initializeに必要なSecurity / Serverオブジェクトのファイル
+var lwm2mTestDefaultFiles = map[string]string{
+	"0/0/1":  "false",
+	"0/0/10": "123",
+	"1/0/0":  "123",
+}
+
+// writeLwm2mTestFiles : ResourceDirPathからのパス(例 : 3/0/0)とファイルの内容の対応からリソースのファイルを生成する
+func writeLwm2mTestFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for path, content := range files {
+		filePath := filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filePath, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newLwm2mTestClient : 一時ディレクトリのHandlerFileと、net.Pipeで接続したCoapを使用するLwm2mを生成する
+// filesはSecurity / Serverオブジェクト以外のリソースのファイル
+func newLwm2mTestClient(t *testing.T, files map[string]string) (*Lwm2m, *coapTestPeer) {
+	t.Helper()
+	definitions, err := LoadLwm2mDefinitions("models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	writeLwm2mTestFiles(t, root, lwm2mTestDefaultFiles)
+	writeLwm2mTestFiles(t, root, files)
+	lwm2m := &Lwm2m{}
+	if err := lwm2m.Initialize("inventoryd-test", definitions, &HandlerFile{ResourceDirPath: root}); err != nil {
+		t.Fatal(err)
+	}
+	coap, peer := newCoapTestPeer(t, lwm2m.ReceiveMessage)
+	lwm2m.Connection = coap
+	return lwm2m, peer
+}
+
+// lwm2mTestRequest : パス(例 : /3/0/0)に対するCONのリクエストを生成する
+func lwm2mTestRequest(code CoapCode, path string, options []CoapOption, payload []byte) *CoapMessage {
+	uriOptions := []CoapOption{}
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		if segment != "" {
+			uriOptions = append(uriOptions, CoapOption{coapOptionNoURIPath, []byte(segment)})
+		}
+	}
+	return &CoapMessage{
+		Version:     1,
+		Type:        CoapTypeConfirmable,
+		Code:        code,
+		TokenLength: 2,
+		Token:       []byte{0x4c, 0x4d},
+		Options:     append(uriOptions, options...),
+		Payload:     payload}
+}
+
+// request : リクエストを送信し、レスポンスを返す
+// メッセージIDは送信ごとに変える(同じメッセージIDは重複として扱われるため)
+func (peer *coapTestPeer) request(message *CoapMessage) *CoapMessage {
+	peer.t.Helper()
+	peer.messageID++
+	message.MessageID = peer.messageID
+	peer.write(message)
+	response := peer.read()
+	if response.MessageID != message.MessageID {
+		peer.t.Fatalf("レスポンスのメッセージIDが不正です %d", response.MessageID)
+	}
+	return response
+}
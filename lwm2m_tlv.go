@@ -3,6 +3,7 @@ package inventoryd
 import (
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"math"
 	"strconv"
 	"strings"
@@ -41,7 +42,7 @@ func (tlv *Lwm2mTLV) Marshal() []byte {
 	} else if tlv.Length <= 0xFF {
 		ret[0] += 1 << 3
 		ret = append(ret, (byte)(tlv.Length))
-	} else if tlv.Length >= 0xFFFF {
+	} else if tlv.Length <= 0xFFFF {
 		ret[0] += 2 << 3
 		ret = append(ret, (byte)(tlv.Length>>8), (byte)(tlv.Length&0x0000FF))
 	} else {
@@ -109,6 +110,125 @@ func (tlv *Lwm2mTLV) Unmarshal(raw []byte) int {
 	return parsedIndex
 }
 
+// UnmarshalContents : Object Instance / Multiple ResourceのTLVの値から、格納されているTLVを取得する
+// 取得したTLVはContentsに格納する
+func (tlv *Lwm2mTLV) UnmarshalContents() error {
+	contents, err := parseLwm2mTLVs(tlv.Value)
+	if err != nil {
+		return err
+	}
+	tlv.Contents = contents
+	return nil
+}
+
+// parseLwm2mTLVs : バイト配列から連続するTLVデータを全て取得する
+// 途中で解析できないデータがあればエラーとする
+func parseLwm2mTLVs(raw []byte) ([]*Lwm2mTLV, error) {
+	tlvs := make([]*Lwm2mTLV, 0)
+	parsedIndex := 0
+	for parsedIndex < len(raw) {
+		tlv := &Lwm2mTLV{}
+		tlvLength := tlv.Unmarshal(raw[parsedIndex:])
+		if tlvLength == -1 {
+			return nil, errors.New("TLVの解析に失敗しました")
+		}
+		tlvs = append(tlvs, tlv)
+		parsedIndex += tlvLength
+	}
+	return tlvs, nil
+}
+
+// MarshalContents : Contentsに格納されているTLVから、Object Instance / Multiple ResourceのTLVの値を生成する
+// Contentsに含まれるObject Instance / Multiple ResourceのTLVの値も生成する
+func (tlv *Lwm2mTLV) MarshalContents() {
+	value := make([]byte, 0)
+	for _, content := range tlv.Contents {
+		if content.TypeOfID == lwm2mTLVTypeObjectInstance || content.TypeOfID == lwm2mTLVTypeMultipleResouce {
+			content.MarshalContents()
+		}
+		value = append(value, content.Marshal()...)
+	}
+	tlv.Length = (uint32)(len(value))
+	tlv.Value = value
+}
+
+// newObjectInstanceTLV : インスタンスのTLVを生成する
+// 各リソースのTLVをObject InstanceのTLVの値として格納する
+func newObjectInstanceTLV(instanceID uint16, contents []*Lwm2mTLV) *Lwm2mTLV {
+	tlv := &Lwm2mTLV{
+		TypeOfID: lwm2mTLVTypeObjectInstance,
+		ID:       instanceID,
+		Contents: contents}
+	tlv.MarshalContents()
+	return tlv
+}
+
+// newMultipleResourceTLV : 複数インスタンスのリソースのTLVを生成する
+// 各Resource InstanceのTLVをMultiple ResourceのTLVの値として格納する
+func newMultipleResourceTLV(resourceID uint16, contents []*Lwm2mTLV) *Lwm2mTLV {
+	tlv := &Lwm2mTLV{
+		TypeOfID: lwm2mTLVTypeMultipleResouce,
+		ID:       resourceID,
+		Contents: contents}
+	tlv.MarshalContents()
+	return tlv
+}
+
+// marshalLwm2mTLVs : 連続するTLVデータをバイト配列に変換する
+func marshalLwm2mTLVs(tlvs []*Lwm2mTLV) []byte {
+	ret := make([]byte, 0)
+	for _, tlv := range tlvs {
+		ret = append(ret, tlv.Marshal()...)
+	}
+	return ret
+}
+
+// writeResourceTLV : TLVの値をリソースに書き込む
+// 複数インスタンスのリソースは、Multiple ResourceのTLVに格納された各Resource Instanceで置き換える
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 5.4.3 Write参照
+func writeResourceTLV(handler Lwm2mHandler, resource *Lwm2mResource, tlv *Lwm2mTLV) CoapCode {
+	value, values, code := decodeResourceTLV(resource.Definition, tlv)
+	if code != CoapCodeChanged {
+		return code
+	}
+	if !resource.Definition.Multi {
+		return handler.WriteResource(resource, value)
+	}
+	return writeResourceInstances(handler, resource, values)
+}
+
+// decodeResourceTLV : リソースのTLVをハンドラに渡す値に変換する
+// 単一のリソースはvalueに、複数インスタンスのリソースはvalues(Resource InstanceのIDと値の対応)に格納する
+// TLVの形式や値の長さが不正な場合はCoapCodeBadRequestを、変換できた場合はCoapCodeChangedを返す
+func decodeResourceTLV(definition *Lwm2mResourceDefinition, tlv *Lwm2mTLV) (string, map[uint16]string, CoapCode) {
+	if !definition.Multi {
+		value, err := convertTLVValueToString(tlv.Value, definition.Type)
+		if err != nil {
+			return "", nil, CoapCodeBadRequest
+		}
+		return value, nil, CoapCodeChanged
+	}
+
+	if tlv.TypeOfID != lwm2mTLVTypeMultipleResouce {
+		return "", nil, CoapCodeBadRequest
+	}
+	if err := tlv.UnmarshalContents(); err != nil {
+		return "", nil, CoapCodeBadRequest
+	}
+	values := make(map[uint16]string)
+	for _, content := range tlv.Contents {
+		if content.TypeOfID != lwm2mTLVTypeResouceInstance {
+			return "", nil, CoapCodeBadRequest
+		}
+		value, err := convertTLVValueToString(content.Value, definition.Type)
+		if err != nil {
+			return "", nil, CoapCodeBadRequest
+		}
+		values[content.ID] = value
+	}
+	return "", values, CoapCodeChanged
+}
+
 // TotalLength : TLVデータの長さを取得する
 func (tlv *Lwm2mTLV) TotalLength() int {
 	ret := 1
@@ -121,7 +241,7 @@ func (tlv *Lwm2mTLV) TotalLength() int {
 		// 加算バイト無し
 	} else if tlv.Length <= 0xFF {
 		ret++
-	} else if tlv.Length >= 0xFFFF {
+	} else if tlv.Length <= 0xFFFF {
 		ret += 2
 	} else {
 		ret += 3
@@ -130,7 +250,10 @@ func (tlv *Lwm2mTLV) TotalLength() int {
 	return ret
 }
 
-func convertTLVValueToString(buf []byte, resourceType byte) string {
+// convertTLVValueToString : TLVの値をリソースの型に応じた文字列に変換する
+// 値の長さが型に合わない場合はエラーとする
+// 値の長さはOMA-TS-LightweightM2M-V1_0_2-20180209-A Appendix C Data Types参照
+func convertTLVValueToString(buf []byte, resourceType byte) (string, error) {
 	var ret string
 	switch resourceType {
 	case lwm2mResourceTypeInteger, lwm2mResourceTypeTime:
@@ -146,6 +269,8 @@ func convertTLVValueToString(buf []byte, resourceType byte) string {
 		} else if length == 8 {
 			num := (int64)(binary.BigEndian.Uint64(buf[0:8]))
 			ret = strconv.FormatInt((int64)(num), 10)
+		} else {
+			return "", errors.New("整数のTLVの長さが不正です")
 		}
 	case lwm2mResourceTypeFloat:
 		length := len(buf)
@@ -157,8 +282,13 @@ func convertTLVValueToString(buf []byte, resourceType byte) string {
 			bits := binary.BigEndian.Uint64(buf)
 			num := math.Float64frombits(bits)
 			ret = strconv.FormatFloat(num, 'g', 6, 64)
+		} else {
+			return "", errors.New("浮動小数点数のTLVの長さが不正です")
 		}
 	case lwm2mResourceTypeBoolean:
+		if len(buf) != 1 || buf[0] > 1 {
+			return "", errors.New("真偽値のTLVが不正です")
+		}
 		if buf[0] == 1 {
 			ret = "true"
 		} else {
@@ -167,13 +297,16 @@ func convertTLVValueToString(buf []byte, resourceType byte) string {
 	case lwm2mResourceTypeOpaque:
 		ret = base64.StdEncoding.EncodeToString(buf)
 	case lwm2mResourceTypeObjlnk:
+		if len(buf) != 4 {
+			return "", errors.New("ObjlnkのTLVの長さが不正です")
+		}
 		objLinkNum := (int16)(binary.BigEndian.Uint16(buf[0:2]))
 		instanceLinkNum := (int16)(binary.BigEndian.Uint16(buf[2:4]))
 		ret = strconv.Itoa((int)(objLinkNum)) + ":" + strconv.Itoa((int)(instanceLinkNum))
 	default: // string/Noneはそのままでよい
 		ret = string(buf)
 	}
-	return ret
+	return ret, nil
 }
 
 func convertStringToTLVValue(str string, resourceType byte) []byte {
@@ -0,0 +1,90 @@
+package inventoryd
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestLwm2mTLVLengthBoundaries : Type of Length / IdentifierのLengthの境界値で生成と解析が一致することを確認する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A 6.4.3 TLV参照
+// Lengthが7以下はTypeに格納し、それ以外は8 / 16 / 24bitのLengthフィールドを使用する
+func TestLwm2mTLVLengthBoundaries(t *testing.T) {
+	cases := []struct {
+		length      uint32
+		lengthType  byte // Typeのbit4-3
+		lengthBytes int  // Lengthフィールドのバイト長
+	}{
+		{0, 0, 0},
+		{7, 0, 0},
+		{8, 1, 1},
+		{0xFF, 1, 1},
+		{0x100, 2, 2},
+		{0xFFFF, 2, 2},
+		{0x10000, 3, 3},
+		{0xFFFFFF, 3, 3},
+	}
+	for _, id := range []uint16{0xFF, 0x100} {
+		idBytes := 1
+		if id > 0xFF {
+			idBytes = 2
+		}
+		for _, c := range cases {
+			tlv := &Lwm2mTLV{
+				TypeOfID: lwm2mTLVTypeResouce,
+				ID:       id,
+				Length:   c.length,
+				Value:    bytes.Repeat([]byte{0x5A}, (int)(c.length))}
+			raw := tlv.Marshal()
+			if (raw[0]>>3)&0x03 != c.lengthType {
+				t.Fatalf("id=%d length=%d のType of Lengthが不正です %02x", id, c.length, raw[0])
+			}
+			if len(raw) != 1+idBytes+c.lengthBytes+(int)(c.length) {
+				t.Fatalf("id=%d length=%d のTLVの長さが不正です %d", id, c.length, len(raw))
+			}
+			if tlv.TotalLength() != len(raw) {
+				t.Fatalf("id=%d length=%d のTotalLengthが一致しません %d", id, c.length, tlv.TotalLength())
+			}
+
+			parsed := &Lwm2mTLV{}
+			if parsedLength := parsed.Unmarshal(raw); parsedLength != len(raw) {
+				t.Fatalf("id=%d length=%d を解析できません %d", id, c.length, parsedLength)
+			}
+			if parsed.TypeOfID != tlv.TypeOfID || parsed.ID != id || parsed.Length != c.length || !bytes.Equal(parsed.Value, tlv.Value) {
+				t.Fatalf("id=%d length=%d の解析結果が一致しません", id, c.length)
+			}
+			if parsed.Unmarshal(raw[:len(raw)-1]) != -1 {
+				t.Fatalf("id=%d length=%d の不足したTLVがエラーになりません", id, c.length)
+			}
+		}
+	}
+}
+
+// TestLwm2mTLVValueLength : 値の長さが型に合わないTLVを文字列に変換するとエラーになることを確認する
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A Appendix C Data Types参照
+func TestLwm2mTLVValueLength(t *testing.T) {
+	cases := []struct {
+		resourceType byte
+		value        []byte
+		expected     string
+		valid        bool
+	}{
+		{lwm2mResourceTypeInteger, []byte{0x01, 0x00}, "256", true},
+		{lwm2mResourceTypeInteger, []byte{}, "", false},
+		{lwm2mResourceTypeInteger, []byte{0x00, 0x00, 0x01}, "", false},
+		{lwm2mResourceTypeTime, []byte{0x00, 0x00, 0x00, 0x00, 0x00}, "", false},
+		{lwm2mResourceTypeFloat, []byte{0x3f, 0xc0, 0x00, 0x00}, "1.5", true},
+		{lwm2mResourceTypeFloat, []byte{0x3f, 0xc0}, "", false},
+		{lwm2mResourceTypeBoolean, []byte{0x01}, "true", true},
+		{lwm2mResourceTypeBoolean, []byte{}, "", false},
+		{lwm2mResourceTypeBoolean, []byte{0x02}, "", false},
+		{lwm2mResourceTypeObjlnk, []byte{0x00, 0x03, 0x00, 0x01}, "3:1", true},
+		{lwm2mResourceTypeObjlnk, []byte{0x00, 0x03}, "", false},
+		{lwm2mResourceTypeString, []byte{}, "", true},
+	}
+	for _, c := range cases {
+		value, err := convertTLVValueToString(c.value, c.resourceType)
+		if (err == nil) != c.valid || value != c.expected {
+			t.Fatalf("type=%d value=%x の変換結果が不正です %q err=%v", c.resourceType, c.value, value, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package inventoryd
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Transport : Lwm2mクライアントがサーバーに接続する通信路
+// サーバーURIのスキームごとにRegisterTransportで登録し、RegisterとBootstrapで使用する
+// 標準ではcoap / coaps / coap+tcp / coaps+tcpを登録している
+type Transport interface {
+	// Dial : サーバーに接続する
+	// hostはサーバーURIからスキームを除いたもの
+	// ctxが終了した場合は接続(ハンドシェイクを含む)を中止する
+	Dial(ctx context.Context, host string, params *TransportParams) (net.Conn, error)
+
+	// Stream : CoAP over TCPのメッセージ形式(RFC8323)を使用するか
+	// falseの場合は1回のReadで1つのメッセージを受信できなければならない
+	Stream() bool
+
+	// BindingMode : Registerで通知するBinding Mode(U / T / S等)
+	BindingMode() string
+}
+
+// TransportParams : 接続に使用するSecurity Objectのパラメータ
+// OMA-TS-LightweightM2M-V1_0_2-20180209-A E.1 LwM2M Object: LwM2M Security参照
+type TransportParams struct {
+	SecurityMode    int          // Lwm2mSecurityModeXXX
+	Identity        []byte       // Public Key or Identity(/0/x/3)
+	SecretKey       []byte       // Secret Key(/0/x/5)
+	ServerPublicKey []byte       // Server Public Key(/0/x/4)
+	DtlsSession     *DtlsSession // 再開するDTLSセッション(無ければnil)
+}
+
+// transports : URIスキームごとに登録されたTransport
+var transports = map[string]Transport{
+	"coap":      &udpTransport{},
+	"coaps":     &dtlsTransport{},
+	"coap+tcp":  &tcpTransport{},
+	"coaps+tcp": &tlsTransport{}}
+var transportsMutex sync.Mutex
+
+// RegisterTransport : URIスキームに対するTransportを登録する
+// 既に登録されているスキームの場合は置き換える
+func RegisterTransport(scheme string, transport Transport) {
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+	transports[scheme] = transport
+}
+
+// findTransport : サーバーURIに対するTransportと接続先を取得する
+// スキームが無い場合はcoapとみなす
+func findTransport(uri string) (Transport, string, error) {
+	scheme, host := "coap", uri
+	if index := strings.Index(uri, "://"); index >= 0 {
+		scheme, host = uri[:index], uri[(index+3):]
+	}
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+	transport, exist := transports[scheme]
+	if !exist {
+		return nil, "", errors.New("未対応のURIスキームです: " + scheme)
+	}
+	return transport, host, nil
+}
+
+// checkSecureURI : Security ModeとURIのスキームのセキュリティの有無が一致するかを確認する
+// PSK / RPK / CertificateモードでURIがcoap:// / coap+tcp://の場合、暗号化せずに接続することになるためエラーとする
+// NoSecモードでURIがcoaps:// / coaps+tcp://の場合、セキュリティ無しに書き換えて接続せずエラーとする
+// RegisterTransportで登録したスキームは、Transportがセキュリティを扱うものとして確認しない
+func checkSecureURI(mode int, uri string) error {
+	scheme := "coap"
+	if index := strings.Index(uri, "://"); index >= 0 {
+		scheme = uri[:index]
+	}
+	if mode == Lwm2mSecurityModeNoSec {
+		if scheme == "coaps" || scheme == "coaps+tcp" {
+			return fmt.Errorf("NoSecモードではセキュリティ有りのURIに接続できません: %s", uri)
+		}
+		return nil
+	}
+	if scheme == "coap" || scheme == "coap+tcp" {
+		return fmt.Errorf("Security Mode(%d)ではセキュリティ無しのURIに接続できません: %s", mode, uri)
+	}
+	return nil
+}
+
+// udpTransport : セキュリティ無しのUDP(coap://)
+type udpTransport struct{}
+
+// Dial : UDPで接続する
+func (transport *udpTransport) Dial(ctx context.Context, host string, params *TransportParams) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, "udp", hostWithDefaultPort(host, lwm2mDefaultCoapPort))
+}
+
+// Stream : UDPはデータグラム
+func (transport *udpTransport) Stream() bool {
+	return false
+}
+
+// BindingMode : UDP Binding
+func (transport *udpTransport) BindingMode() string {
+	return lwm2mBindingMode
+}
+
+// dtlsTransport : DTLS(coaps://)
+// Security ModeによりPSKモード、RPKモード、Certificateモードを切り替える
+// Certificateモードでは/0/x/3をクライアントの証明書、/0/x/4をサーバーの証明書とする(TLSの場合と同じ)
+type dtlsTransport struct{}
+
+// Dial : DTLSで接続する
+func (transport *dtlsTransport) Dial(ctx context.Context, host string, params *TransportParams) (net.Conn, error) {
+	host = hostWithDefaultPort(host, lwm2mDefaultCoapsPort)
+	switch params.SecurityMode {
+	case Lwm2mSecurityModePSK:
+		return DtlsDial(ctx, host, params.Identity, params.SecretKey, params.DtlsSession)
+	case Lwm2mSecurityModeRPK:
+		privateKey, err := DtlsParsePrivateKey(params.SecretKey)
+		if err != nil {
+			return nil, err
+		}
+		serverPublicKey, err := DtlsParsePublicKey(params.ServerPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return DtlsDialRawPublicKey(ctx, host, privateKey, serverPublicKey, params.DtlsSession)
+	case Lwm2mSecurityModeCertificate:
+		privateKey, err := DtlsParsePrivateKey(params.SecretKey)
+		if err != nil {
+			return nil, err
+		}
+		var serverCertificate *x509.Certificate
+		if len(params.ServerPublicKey) > 0 {
+			serverCertificate, err = x509.ParseCertificate(params.ServerPublicKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return DtlsDialCertificate(ctx, host, privateKey, params.Identity, serverCertificate, params.DtlsSession)
+	}
+	return nil, errors.New("未対応のセキュリティモードです")
+}
+
+// Stream : DTLSはデータグラム
+func (transport *dtlsTransport) Stream() bool {
+	return false
+}
+
+// BindingMode : UDP Binding
+func (transport *dtlsTransport) BindingMode() string {
+	return lwm2mBindingMode
+}
@@ -0,0 +1,108 @@
+package inventoryd
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// lwm2mTestTransport : RegisterTransportで登録するテスト用のTransport
+type lwm2mTestTransport struct{}
+
+// Dial : 接続しない
+func (transport *lwm2mTestTransport) Dial(ctx context.Context, host string, params *TransportParams) (net.Conn, error) {
+	return nil, nil
+}
+
+// Stream : データグラムとして扱う
+func (transport *lwm2mTestTransport) Stream() bool {
+	return false
+}
+
+// BindingMode : SMS Binding
+func (transport *lwm2mTestTransport) BindingMode() string {
+	return "S"
+}
+
+// TestFindTransport : URIスキームに対して標準のTransportと接続先が選択されることを確認する
+func TestFindTransport(t *testing.T) {
+	cases := []struct {
+		uri         string
+		host        string
+		stream      bool
+		bindingMode string
+	}{
+		{"coap://localhost:5683", "localhost:5683", false, lwm2mBindingMode},
+		{"coaps://localhost:5684", "localhost:5684", false, lwm2mBindingMode},
+		{"coap+tcp://localhost:5683", "localhost:5683", true, lwm2mBindingModeTCP},
+		{"coaps+tcp://localhost:5684", "localhost:5684", true, lwm2mBindingModeTCP},
+		{"localhost:5683", "localhost:5683", false, lwm2mBindingMode},
+	}
+	for _, c := range cases {
+		transport, host, err := findTransport(c.uri)
+		if err != nil {
+			t.Fatalf("uri=%s のTransportが見つかりません %v", c.uri, err)
+		}
+		if host != c.host || transport.Stream() != c.stream || transport.BindingMode() != c.bindingMode {
+			t.Fatalf("uri=%s のTransportが不正です host=%s stream=%t binding=%s", c.uri, host, transport.Stream(), transport.BindingMode())
+		}
+	}
+
+	if _, _, err := findTransport("sms://+819012345678"); err == nil {
+		t.Fatal("未登録のスキームがエラーになりません")
+	}
+}
+
+// TestRegisterTransport : RegisterTransportで追加したスキームと、置き換えたスキームが使用されることを確認する
+func TestRegisterTransport(t *testing.T) {
+	transportsMutex.Lock()
+	saved := transports["coap"]
+	transportsMutex.Unlock()
+	defer func() {
+		transportsMutex.Lock()
+		delete(transports, "sms")
+		transports["coap"] = saved
+		transportsMutex.Unlock()
+	}()
+
+	custom := &lwm2mTestTransport{}
+	RegisterTransport("sms", custom)
+	transport, host, err := findTransport("sms://+819012345678")
+	if err != nil || transport != custom || host != "+819012345678" {
+		t.Fatalf("追加したTransportが選択されません host=%s err=%v", host, err)
+	}
+
+	RegisterTransport("coap", custom)
+	if transport, _, _ := findTransport("coap://localhost:5683"); transport != custom {
+		t.Fatal("置き換えたTransportが選択されません")
+	}
+}
+
+// TestCheckSecureURI : NoSec以外のSecurity Modeでセキュリティ無しのURIが、
+// NoSecでセキュリティ有りのURIがエラーになることを確認する
+func TestCheckSecureURI(t *testing.T) {
+	cases := []struct {
+		mode  int
+		uri   string
+		valid bool
+	}{
+		{Lwm2mSecurityModeNoSec, "coap://localhost:5683", true},
+		{Lwm2mSecurityModeNoSec, "coap+tcp://localhost:5683", true},
+		{Lwm2mSecurityModeNoSec, "localhost:5683", true},
+		{Lwm2mSecurityModeNoSec, "coaps://localhost:5684", false},
+		{Lwm2mSecurityModeNoSec, "coaps+tcp://localhost:5684", false},
+		{Lwm2mSecurityModePSK, "coaps://localhost:5684", true},
+		{Lwm2mSecurityModePSK, "coaps+tcp://localhost:5684", true},
+		{Lwm2mSecurityModePSK, "coap://localhost:5683", false},
+		{Lwm2mSecurityModePSK, "localhost:5683", false},
+		{Lwm2mSecurityModeRPK, "coap://localhost:5683", false},
+		{Lwm2mSecurityModeCertificate, "coap+tcp://localhost:5683", false},
+		{Lwm2mSecurityModeCertificate, "coaps+tcp://localhost:5684", true},
+	}
+	for _, c := range cases {
+		err := checkSecureURI(c.mode, c.uri)
+		if (err == nil) != c.valid {
+			t.Fatalf("mode=%d uri=%s の結果が不正です err=%v", c.mode, c.uri, err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package inventoryd
+
+import (
+	"log"
+	"time"
+)
+
+// Lwm2mResourceWatcher : リソースの変更を監視できるハンドラが実装するインターフェース(任意)
+// Lwm2mHandlerがこのインターフェースを実装している場合、変更があったリソースのObserveは即座にNotifyし、
+// 定期的な確認(ObserveInterval)は監視できないリソースを含むObserveとpmaxの確認のみとする
+type Lwm2mResourceWatcher interface {
+
+	// 変更を検出したらパスのID(オブジェクトID, インスタンスID, リソースIDの1-3個)をchangedに送信する
+	// changedに空きが無い場合も変更を破棄してはならない(監視できるリソースは定期的に確認しないため)
+	// インスタンスの追加 / 削除はオブジェクトのパスとして送信する
+	// 監視を開始したら戻り、stopChを受信したら監視を止める
+	WatchResources(changed chan<- []uint16, stopCh chan bool) error
+
+	// 変更を監視できるリソースか
+	IsWatchable(resource *Lwm2mResource) bool
+}
+
+// lwm2mWatchBufferSize : 変更の通知のバッファ
+const lwm2mWatchBufferSize = 64
+
+// startWatching : ハンドラがLwm2mResourceWatcherを実装していればリソースの監視を開始する
+// 監視できない場合はnilを返す
+func (lwm2m *Lwm2m) startWatching(stopCh chan bool) <-chan []uint16 {
+	watcher, ok := lwm2m.handler.(Lwm2mResourceWatcher)
+	if !ok {
+		return nil
+	}
+	changedCh := make(chan []uint16, lwm2mWatchBufferSize)
+	if err := watcher.WatchResources(changedCh, stopCh); err != nil {
+		log.Printf("リソースの監視を開始できませんでした。定期的な確認のみ行います %s", err)
+		return nil
+	}
+	lwm2m.watcher = watcher
+	return changedCh
+}
+
+// NotifyChanged : 変更があったパスを含むObserve、およびそのパスの中のObserveのNotifyを実行する
+// Notifyの条件(pmin / gt / lt / st)は定期的な確認と同様に判定する
+func (lwm2m *Lwm2m) NotifyChanged(path []uint16) {
+	if lwm2m.Connection == nil || !lwm2m.registered {
+		return
+	}
+	lwm2m.observeMutex.Lock()
+	defer lwm2m.observeMutex.Unlock()
+	for _, observe := range lwm2m.observedObject {
+		if lwm2mPathOverlaps(path, []uint16{observe.object.ID}) {
+			lwm2m.NotifyObject(observe)
+		}
+	}
+	for _, observe := range lwm2m.observedInstance {
+		if lwm2mPathOverlaps(path, []uint16{observe.instance.objectID, observe.instance.ID}) {
+			lwm2m.NotifyInstance(observe)
+		}
+	}
+	for _, observe := range lwm2m.observedResource {
+		resource := observe.resource
+		if lwm2mPathOverlaps(path, []uint16{resource.objectID, resource.instanceID, resource.ID}) {
+			lwm2m.NotifyResource(observe)
+		}
+	}
+}
+
+// lwm2mPathOverlaps : 2つのパスのどちらかがもう一方を含むかを判定する
+func lwm2mPathOverlaps(a, b []uint16) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// requiresPolling : 定期的な確認が必要かを判定する
+// 監視していない場合、監視できないリソースを含む場合、pmaxが経過した場合は確認が必要
+// pminがある場合は、pmin経過前の変更をpmin経過後にNotifyするため確認が必要
+func (lwm2m *Lwm2m) requiresPolling(attributes lwm2mAttributes, lastNotified time.Time, resources []*Lwm2mObservedResource) bool {
+	if lwm2m.watcher == nil || attributes.exceedsMaximumPeriod(lastNotified, time.Now()) {
+		return true
+	}
+	if attributes.pmin != nil && *attributes.pmin > 0 {
+		return true
+	}
+	for _, resourceObserve := range resources {
+		if !lwm2m.watcher.IsWatchable(resourceObserve.resource) {
+			return true
+		}
+	}
+	return false
+}